@@ -0,0 +1,124 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package cli
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	KeyDomain = "domain"
+)
+
+func CreateAdoptCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "adopt",
+		Usage: "generates the custom resources that adopt the existing domains of a host, including data disk and network references",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     KeyConfig,
+				Aliases:  []string{"c"},
+				Usage:    "Name of the SSH config entry",
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name:     KeyDomain,
+				Aliases:  []string{"d"},
+				Usage:    "Name of a domain to adopt, all domains not managed by the operator if not set",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     KeyLabel,
+				Aliases:  []string{"l"},
+				Usage:    "Label for the custom resources",
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     KeyImageURL,
+				Aliases:  []string{"i"},
+				Usage:    "Location of the qcow2 file used to recreate the domains, defaults to the base image of the boot disk",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     KeyTarget,
+				Usage:    "Label used to select the associated config map(s)",
+				Required: true,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			domains := ctx.StringSlice(KeyDomain)
+			opt := &onprem.AdoptionResourceOptions{
+				Labels:       labelsFromList(ctx.StringSlice(KeyLabel)),
+				TargetLabels: labelsFromList(ctx.StringSlice(KeyTarget)),
+				ImageURL:     ctx.String(KeyImageURL),
+			}
+			// find SSH path
+			sshPath, err := onprem.GetSSHConfigPath()
+			if err != nil {
+				return err
+			}
+			// load config
+			sshConfig, err := onprem.LoadSSHConfig(sshPath)(ctx.String(KeyConfig))
+			if err != nil {
+				return err
+			}
+			client, err := onprem.CreateLivirtClient(sshConfig)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			// describe the domains
+			inspections, err := onprem.InspectDomains(client)()
+			if err != nil {
+				return err
+			}
+			var items []any
+			for _, inspection := range inspections {
+				if inspection.Metadata != nil || (len(domains) > 0 && !slices.Contains(domains, inspection.Name)) {
+					continue
+				}
+				// the resources of a domain with problems are generated, so the problems can be fixed before applying them
+				if len(inspection.Problems) > 0 {
+					log.Printf("Domain [%s] cannot be adopted as is: [%s]", inspection.Name, strings.Join(inspection.Problems, ", "))
+				}
+				res, err := onprem.CreateAdoptionResources(inspection, opt)
+				if err != nil {
+					log.Printf("Skipping domain [%s], cause: [%v]", inspection.Name, err)
+					continue
+				}
+				items = append(items, res.VSI)
+				for _, disk := range res.DataDiskRefs {
+					items = append(items, disk)
+				}
+				for _, network := range res.NetworkRefs {
+					items = append(items, network)
+				}
+			}
+			// stream the result as a list that can be applied at once
+			return json.NewEncoder(os.Stdout).Encode(map[string]any{
+				"apiVersion": "v1",
+				"kind":       "List",
+				"items":      items,
+			})
+		},
+	}
+}
@@ -33,6 +33,7 @@ func CreateApp(version, compiled, commit string) *c.App {
 		Commands: []*c.Command{
 			StartServerCommand(version, compiled, commit),
 			DownloadCommand(version, compiled, commit),
+			LogsCommand(),
 		},
 	}
 }
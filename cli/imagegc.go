@@ -0,0 +1,96 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	KeyRetention = "retention"
+	KeyDryRun    = "dry-run"
+	KeyPin       = "pin"
+)
+
+func CreateImageGCCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "image-gc",
+		Usage: "deletes base images that are no longer used from a storage pool on the host",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     KeyConfig,
+				Aliases:  []string{"c"},
+				Usage:    "Name of the SSH config entry",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:        KeyStoragePool,
+				Aliases:     []string{"p"},
+				Usage:       "Name of the storage pool",
+				Value:       DefaultStoragePool,
+				DefaultText: DefaultStoragePool,
+				Required:    false,
+			},
+			&cli.DurationFlag{
+				Name:     KeyRetention,
+				Aliases:  []string{"r"},
+				Usage:    "Only delete images that have not been used for this period",
+				Required: true,
+			},
+			&cli.BoolFlag{
+				Name:     KeyDryRun,
+				Usage:    "Report the images that would be deleted without deleting them",
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     KeyPin,
+				Usage:    "Name of an image to keep",
+				Required: false,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			// find SSH path
+			sshPath, err := onprem.GetSSHConfigPath()
+			if err != nil {
+				return err
+			}
+			// load config
+			sshConfig, err := onprem.LoadSSHConfig(sshPath)(ctx.String(KeyConfig))
+			if err != nil {
+				return err
+			}
+			client, err := onprem.CreateLivirtClient(sshConfig)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			// collect
+			report, err := onprem.CollectBaseImages(client)(ctx.String(KeyStoragePool), &onprem.ImageGCConfig{
+				Retention: ctx.Duration(KeyRetention),
+				DryRun:    ctx.Bool(KeyDryRun),
+				Pinned:    ctx.StringSlice(KeyPin),
+			})
+			if err != nil {
+				return err
+			}
+			// serialize the report
+			return json.NewEncoder(os.Stdout).Encode(report)
+		},
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/uuid"
+	S "github.com/ibm-hyper-protect/k8s-operator-hpcr/server/onprem"
+	c "github.com/urfave/cli/v2"
+)
+
+const (
+	serverFlagName    = "server"
+	namespaceFlagName = "namespace"
+	followFlagName    = "follow"
+	kubectlFlagName   = "kubectl"
+
+	// plural of the OnPrem VSI resource
+	onPremResource = "onprem-hpcrs"
+)
+
+// resolveOnPremUID returns the UID of an OnPrem VSI resource, names are resolved via kubectl
+func resolveOnPremUID(ctx context.Context, kubectl, namespace, nameOrUID string) (string, error) {
+	if _, err := uuid.Parse(nameOrUID); err == nil {
+		return nameOrUID, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, kubectl, "get", onPremResource, nameOrUID, "--namespace", namespace, "--output", "jsonpath={.metadata.uid}")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("unable to resolve the UID of [%s/%s], cause: [%v] %s", namespace, nameOrUID, err, strings.TrimSpace(stderr.String()))
+	}
+	uid := strings.TrimSpace(stdout.String())
+	if len(uid) == 0 {
+		return "", fmt.Errorf("resource [%s/%s] has no UID", namespace, nameOrUID)
+	}
+	return uid, nil
+}
+
+// readServerSentEvents decodes a stream of server sent events and invokes the handler for each event
+func readServerSentEvents(r io.Reader, handle func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case len(line) == 0:
+			// dispatch
+			if len(data) > 0 {
+				if err := handle(event, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// comment
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimPrefix(strings.TrimPrefix(line, "event:"), " ")
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+// LogsCommand streams the console log of an OnPrem VSI from the controller
+func LogsCommand() *c.Command {
+	return &c.Command{
+		Name:        "logs",
+		Usage:       "Streams the console log of an OnPrem VSI",
+		ArgsUsage:   "<name or UID of the VSI resource>",
+		Description: "Streams the console log of an OnPrem VSI from the controller, e.g. after 'kubectl port-forward service/k8s-operator-hpcr 8080'",
+		Flags: []c.Flag{
+			&c.StringFlag{
+				Name:    serverFlagName,
+				Aliases: []string{"s"},
+				Value:   "http://localhost:8080",
+				Usage:   "URL of the controller",
+			},
+			&c.StringFlag{
+				Name:    namespaceFlagName,
+				Aliases: []string{"n"},
+				Value:   "default",
+				Usage:   "Namespace of the VSI resource",
+			},
+			&c.BoolFlag{
+				Name:    followFlagName,
+				Aliases: []string{"f"},
+				Usage:   "Keep streaming new content of the log",
+			},
+			&c.StringFlag{
+				Name:  kubectlFlagName,
+				Value: "kubectl",
+				Usage: "Path to kubectl, used to resolve the name of the VSI resource",
+			},
+		},
+		Action: func(ctx *c.Context) error {
+			if ctx.NArg() != 1 {
+				return fmt.Errorf("expected the name or UID of the VSI resource")
+			}
+			uid, err := resolveOnPremUID(ctx.Context, ctx.String(kubectlFlagName), ctx.String(namespaceFlagName), ctx.Args().First())
+			if err != nil {
+				return err
+			}
+			logsURL := fmt.Sprintf("%s/onprem/logs/%s?follow=%t", strings.TrimRight(ctx.String(serverFlagName), "/"), url.PathEscape(uid), ctx.Bool(followFlagName))
+			req, err := http.NewRequestWithContext(ctx.Context, http.MethodGet, logsURL, nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Accept", "text/event-stream")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("unable to stream the logs of [%s], status: [%s], cause: [%s]", uid, resp.Status, strings.TrimSpace(string(body)))
+			}
+			return readServerSentEvents(resp.Body, func(event, data string) error {
+				var evt S.LogEvent
+				if err := json.Unmarshal([]byte(data), &evt); err != nil {
+					return err
+				}
+				switch event {
+				case S.LogEventLog:
+					_, err := os.Stdout.WriteString(evt.Text)
+					return err
+				case S.LogEventRestart:
+					_, err := fmt.Fprintln(os.Stderr, "--- the console log has been restarted ---")
+					return err
+				case S.LogEventError:
+					return errors.New(evt.Error)
+				}
+				return nil
+			})
+		},
+	}
+}
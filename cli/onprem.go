@@ -51,7 +51,7 @@ func CreateOnPremCommand() *cli.Command {
 			&cli.StringFlag{
 				Name:     KeyImageURL,
 				Aliases:  []string{"i"},
-				Usage:    "Download URL of the qcow2 file",
+				Usage:    "Location of the qcow2 file (http(s)://, oci://, file:// or volume://)",
 				Required: true,
 			},
 			&cli.StringFlag{
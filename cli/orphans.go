@@ -0,0 +1,116 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	KeyResources   = "resources"
+	KeyGracePeriod = "grace-period"
+)
+
+// readResources reads the list of resources from a file or from stdin
+func readResources(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func CreateOrphansCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "orphans",
+		Usage: "lists the domains and volumes on the host that belong to VSI resources that do not exist any more",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     KeyConfig,
+				Aliases:  []string{"c"},
+				Usage:    "Name of the SSH config entry",
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:        KeyStoragePool,
+				Aliases:     []string{"p"},
+				Usage:       "Name of the storage pool",
+				Value:       DefaultStoragePool,
+				DefaultText: DefaultStoragePool,
+				Required:    false,
+			},
+			&cli.PathFlag{
+				Name:      KeyResources,
+				Aliases:   []string{"r"},
+				Usage:     "Path to the output of 'kubectl get onprem-hpcrs -A -o json' of all clusters using the host, '-' reads from stdin",
+				TakesFile: true,
+				Required:  true,
+			},
+			&cli.DurationFlag{
+				Name:     KeyGracePeriod,
+				Aliases:  []string{"g"},
+				Usage:    "Delete orphans that have been known for this period, orphans are only listed if not set",
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     KeyDryRun,
+				Usage:    "Report the orphans that would be deleted without deleting them",
+				Required: false,
+			},
+		},
+		Action: func(ctx *cli.Context) error {
+			// the existing resources
+			data, err := readResources(ctx.Path(KeyResources))
+			if err != nil {
+				return err
+			}
+			live, err := onprem.GetResourceUIDsFromList(data)
+			if err != nil {
+				return err
+			}
+			// find SSH path
+			sshPath, err := onprem.GetSSHConfigPath()
+			if err != nil {
+				return err
+			}
+			// load config
+			sshConfig, err := onprem.LoadSSHConfig(sshPath)(ctx.String(KeyConfig))
+			if err != nil {
+				return err
+			}
+			client, err := onprem.CreateLivirtClient(sshConfig)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			// sweep
+			report, err := onprem.SweepOrphans(client)(ctx.String(KeyStoragePool), &onprem.OrphanSweepConfig{
+				Enabled:     true,
+				Live:        live,
+				GracePeriod: ctx.Duration(KeyGracePeriod),
+				DryRun:      ctx.Bool(KeyDryRun),
+			})
+			if err != nil {
+				return err
+			}
+			// serialize the report
+			return json.NewEncoder(os.Stdout).Encode(report)
+		},
+	}
+}
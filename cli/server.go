@@ -19,7 +19,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server"
+	SC "github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
 	c "github.com/urfave/cli/v2"
 )
 
@@ -48,6 +50,14 @@ func StartServerCommand(version, compiled, commit string) *c.Command {
 
 			log.Printf("Starting server [%s] built on [%v] on port [%d] ...", version, compiledAt, port)
 
+			// pin host keys in a secret, so they survive restarts of the controller
+			kube, err := SC.GetInClusterKubeClient()
+			if err == nil {
+				onprem.SetHostKeyStore(SC.CreateSecretHostKeyStore(kube, SC.GetInClusterNamespace(), SC.HostKeySecretName))
+			} else {
+				log.Printf("Host keys pinned on first use are kept in memory, cause: [%v]", err)
+			}
+
 			svr := server.CreateServer(version, compiled)
 
 			return svr(port)
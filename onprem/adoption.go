@@ -0,0 +1,627 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/kdomanski/iso9660"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// AnnotationDomainName names the domain of a VSI, an existing domain of that name is adopted rather than recreated
+	AnnotationDomainName = "hpse.ibm.com/domain-name"
+	// LabelAdoptedDomain selects the data disk and network references generated for an adopted domain
+	LabelAdoptedDomain = "hpse.ibm.com/adopted-domain"
+
+	// ConditionAdoptionFailed is the condition type reported if an existing domain cannot be adopted
+	ConditionAdoptionFailed = "AdoptionFailed"
+
+	// maximum size of a cloud-init disk that is inspected
+	maxCloudInitSize = 16 * 1024 * 1024
+	// maximum length of the name of a resource and of the value of a label
+	maxResourceNameLength = 63
+)
+
+var (
+	// characters that must not appear in the name of a resource
+	reInvalidResourceName = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// InstanceVolume identifies a volume of an instance
+type InstanceVolume struct {
+	Pool string `xml:"pool,attr"`
+	Name string `xml:",chardata"`
+}
+
+// InstanceAdoption records the volumes of an adopted domain, they do not follow the naming of the operator
+type InstanceAdoption struct {
+	BootDisk  *InstanceVolume `xml:"bootDisk,omitempty"`
+	CloudInit *InstanceVolume `xml:"cloudInit,omitempty"`
+	Console   *InstanceVolume `xml:"console,omitempty"`
+}
+
+// DomainInspection describes an existing domain in terms of the resources of the operator
+type DomainInspection struct {
+	// name of the domain
+	Name string
+	// true if the domain is running or paused
+	Active bool
+	// metadata of the operator, nil if the domain is not managed by the operator
+	Metadata *InstanceMetadata
+	// volume attached as the boot disk
+	BootDisk *InstanceVolume
+	// volume the boot disk has been created from, nil for a full copy
+	BaseImage *InstanceVolume
+	// volume attached as the cloud-init disk
+	CloudInit *InstanceVolume
+	// content of the user-data file of the cloud-init disk
+	UserData string
+	// volume receiving the console log
+	Console *InstanceVolume
+	// attached data disks
+	DataDisks []*AttachedDataDisk
+	// target devices of the data disks
+	DataDiskDevs []InstanceDataDisk
+	// networks of the interfaces in the order of the interfaces
+	Networks []string
+	// reasons why the domain cannot be adopted as is
+	Problems []string
+}
+
+// AdoptionError is returned if an existing domain does not match its resource
+type AdoptionError struct {
+	Name     string
+	Problems []string
+}
+
+func (err *AdoptionError) Error() string {
+	return fmt.Sprintf("%s: domain [%s] cannot be adopted, %s", ConditionAdoptionFailed, err.Name, strings.Join(err.Problems, ", "))
+}
+
+// ConditionType returns the type of the condition that reports the error
+func (err *AdoptionError) ConditionType() string {
+	return ConditionAdoptionFailed
+}
+
+// AdoptionResourceOptions controls the generation of the resources for an existing domain
+type AdoptionResourceOptions struct {
+	// labels of the generated resources
+	Labels map[string]string
+	// references to the configs (for SSH)
+	TargetLabels map[string]string
+	// URL of the image used when the domain is recreated, defaults to the volume the boot disk has been created from
+	ImageURL string
+}
+
+// AdoptionResources are the resources that bring an existing domain under the control of the operator
+type AdoptionResources struct {
+	VSI          *OnPremCustomResource
+	DataDiskRefs []*DataDiskRefCustomResource
+	NetworkRefs  []*NetworkRefCustomResource
+}
+
+// GetInstanceDomainName returns the name of the domain of a VSI, the UID of the resource unless it names a domain
+func GetInstanceDomainName(res *OnPremCustomResource) string {
+	if name := res.Annotations[AnnotationDomainName]; len(name) > 0 {
+		return name
+	}
+	return string(res.UID)
+}
+
+// GetAdoptionResourceName derives a valid resource name from the name of a domain
+func GetAdoptionResourceName(domainName string) string {
+	name := strings.Trim(reInvalidResourceName.ReplaceAllString(strings.ToLower(domainName), "-"), "-")
+	if len(name) > maxResourceNameLength {
+		name = strings.TrimRight(name[:maxResourceNameLength], "-")
+	}
+	if len(name) == 0 {
+		return "domain"
+	}
+	return name
+}
+
+// getLoggingVolume returns the pool and the name of the volume that receives the console log of an instance
+func getLoggingVolume(opt *InstanceOptions, metadata *InstanceMetadata) (string, string) {
+	if metadata != nil && metadata.Adopted != nil && metadata.Adopted.Console != nil {
+		return metadata.Adopted.Console.Pool, metadata.Adopted.Console.Name
+	}
+	return opt.StoragePool, GetLoggingVolumeName(opt.Name)
+}
+
+// GetInstanceLoggingVolume returns the pool and the name of the volume that receives the console log of a domain
+func GetInstanceLoggingVolume(opt *InstanceOptions, domainXML *libvirtxml.Domain) (string, string) {
+	metadata, _ := findInstanceMetadata(domainXML)
+	return getLoggingVolume(opt, metadata)
+}
+
+// LookupInstanceLoggingVolume returns the pool and the name of the volume that receives the console log of an instance
+func LookupInstanceLoggingVolume(client *LivirtClient) func(opt *InstanceOptions) (string, string) {
+	getMetadata := getInstanceMetadataByName(client.LibVirt)
+	return func(opt *InstanceOptions) (string, string) {
+		return getLoggingVolume(opt, getMetadata(opt.Name))
+	}
+}
+
+// normalizeISOFileName maps the name of a file on an ISO image to its original name, plain ISO 9660 names are upper
+// case, carry a version and use underscores instead of dashes
+func normalizeISOFileName(name string) string {
+	name = strings.ToLower(name)
+	if idx := strings.LastIndex(name, ";"); idx >= 0 {
+		name = name[:idx]
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(name, "."), "_", "-")
+}
+
+// readCloudInitUserData extracts the user-data file from a cloud-init disk
+func readCloudInitUserData(data []byte) (string, error) {
+	img, err := iso9660.OpenImage(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	root, err := img.RootDir()
+	if err != nil {
+		return "", err
+	}
+	children, err := root.GetChildren()
+	if err != nil {
+		return "", err
+	}
+	for _, child := range children {
+		if child.IsDir() || normalizeISOFileName(child.Name()) != userDataFilename {
+			continue
+		}
+		userData, err := io.ReadAll(child.Reader())
+		if err != nil {
+			return "", err
+		}
+		return string(userData), nil
+	}
+	return "", fmt.Errorf("the cloud-init disk does not contain a [%s] file", userDataFilename)
+}
+
+// getConsoleLogFile returns the file that receives the output of the console or of the first serial port
+func getConsoleLogFile(devices *libvirtxml.DomainDeviceList) string {
+	for _, console := range devices.Consoles {
+		if console.Log != nil && len(console.Log.File) > 0 {
+			return console.Log.File
+		}
+	}
+	for _, serial := range devices.Serials {
+		if serial.Log != nil && len(serial.Log.File) > 0 {
+			return serial.Log.File
+		}
+	}
+	return ""
+}
+
+// inspectDomainXML maps the devices of a domain to volumes and networks. The lookup resolves the path of a disk to a
+// volume and fails for files outside of a storage pool.
+func inspectDomainXML(domainXML *libvirtxml.Domain, lookup func(path string) (*InstanceVolume, bool)) *DomainInspection {
+	result := &DomainInspection{Name: domainXML.Name}
+	result.Metadata, _ = findInstanceMetadata(domainXML)
+	problem := func(format string, args ...any) {
+		result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+	}
+	if domainXML.Devices == nil {
+		problem("the domain does not have any devices")
+		return result
+	}
+	for _, disk := range domainXML.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+		dev := disk.Target.Dev
+		path := getDiskSourcePath(&disk)
+		switch {
+		case disk.Device == "cdrom" && len(path) == 0:
+			// empty drive
+			continue
+		case disk.Device == "cdrom" || (disk.Device == "disk" && dev == cloudInitDiskDev):
+			if result.CloudInit != nil {
+				problem("disk [%s] is a second cloud-init disk", dev)
+				continue
+			}
+			vol, ok := lookup(path)
+			if !ok {
+				problem("cloud-init disk [%s] is not a volume of a storage pool", path)
+				continue
+			}
+			result.CloudInit = vol
+		case disk.Device == "disk" && dev == bootDiskDev:
+			vol, ok := lookup(path)
+			if !ok {
+				problem("boot disk [%s] is not a volume of a storage pool", path)
+				continue
+			}
+			result.BootDisk = vol
+		case isDataDisk(&disk):
+			vol, ok := lookup(path)
+			if !ok {
+				problem("data disk [%s] is not a volume of a storage pool", path)
+				continue
+			}
+			dataDisk := &AttachedDataDisk{Name: vol.Name, StoragePool: vol.Pool, Mode: getDataDiskMode(&disk)}
+			if disk.Driver != nil {
+				dataDisk.Cache, dataDisk.IO = disk.Driver.Cache, disk.Driver.IO
+			}
+			result.DataDisks = append(result.DataDisks, dataDisk)
+			result.DataDiskDevs = append(result.DataDiskDevs, InstanceDataDisk{Dev: dev, Pool: vol.Pool, Name: vol.Name})
+		default:
+			problem("disk [%s] of type [%s] is not supported", dev, disk.Device)
+		}
+	}
+	if result.BootDisk == nil {
+		problem("the domain does not have a boot disk attached as [%s]", bootDiskDev)
+	}
+	if result.CloudInit == nil {
+		problem("the domain does not have a cloud-init disk attached as [%s] or as cdrom", cloudInitDiskDev)
+	}
+	// the boot progress is read from the console log
+	if path := getConsoleLogFile(domainXML.Devices); len(path) == 0 {
+		problem("the console output is not logged to a file")
+	} else if vol, ok := lookup(path); ok {
+		result.Console = vol
+	} else {
+		problem("console log [%s] is not a volume of a storage pool", path)
+	}
+	for _, iface := range domainXML.Devices.Interfaces {
+		if iface.Source == nil || iface.Source.Network == nil {
+			var mac string
+			if iface.MAC != nil {
+				mac = iface.MAC.Address
+			}
+			problem("interface [%s] is not connected to a libvirt network", mac)
+			continue
+		}
+		result.Networks = append(result.Networks, iface.Source.Network.Network)
+	}
+	return result
+}
+
+// validateAdoption compares an unmanaged domain with the options of the resource that adopts it
+func validateAdoption(inspection *DomainInspection, opt *InstanceOptions) []string {
+	problems := slices.Clone(inspection.Problems)
+	if inspection.CloudInit != nil && strings.TrimSpace(inspection.UserData) != strings.TrimSpace(opt.UserData) {
+		problems = append(problems, "the user-data of the cloud-init disk differs from the contract")
+	}
+	if actual, expected := sortNetwoks(inspection.Networks), sortNetwoks(GetNetworks(opt)); !slices.Equal(actual, expected) {
+		problems = append(problems, fmt.Sprintf("the domain is connected to the networks %v, the resource selects %v", actual, expected))
+	}
+	if len(opt.Addresses) > 0 {
+		problems = append(problems, "static addresses are only supported for domains created by the operator")
+	}
+	// data disks that are not selected would be detached
+	for _, disk := range inspection.DataDisks {
+		selected := findAttachedDataDisk(opt.DataDisks, disk.StoragePool, disk.Name)
+		switch {
+		case selected == nil:
+			problems = append(problems, fmt.Sprintf("data disk [%s] of pool [%s] is not selected by the resource", disk.Name, disk.StoragePool))
+		case BoxDataDiskMode(selected.Mode) != disk.Mode || selected.Cache != disk.Cache || selected.IO != disk.IO:
+			problems = append(problems, fmt.Sprintf("data disk [%s] of pool [%s] is attached with a different mode or tuning", disk.Name, disk.StoragePool))
+		}
+	}
+	return problems
+}
+
+// downloadCloudInit reads the content of a cloud-init disk
+func downloadCloudInit(conn *libvirt.Libvirt) func(vol *InstanceVolume) ([]byte, error) {
+	return func(vol *InstanceVolume) ([]byte, error) {
+		pool, err := conn.StoragePoolLookupByName(vol.Pool)
+		if err != nil {
+			return nil, err
+		}
+		existing, err := conn.StorageVolLookupByName(pool, vol.Name)
+		if err != nil {
+			return nil, err
+		}
+		_, capacity, _, err := conn.StorageVolGetInfo(existing)
+		if err != nil {
+			return nil, err
+		}
+		if capacity > maxCloudInitSize {
+			return nil, fmt.Errorf("the cloud-init disk [%s] exceeds the maximum size of [%d] bytes", vol.Name, maxCloudInitSize)
+		}
+		var buffer bytes.Buffer
+		err = conn.StorageVolDownload(existing, &buffer, 0, capacity, 0)
+		if err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+}
+
+// inspectDomain describes an existing domain including the content of its cloud-init disk
+func inspectDomain(conn *libvirt.Libvirt) func(domain libvirt.Domain) (*DomainInspection, error) {
+	storageVolByNameXMLDesc := getStorageVolByNameXMLDesc(conn)
+	download := downloadCloudInit(conn)
+
+	lookup := func(path string) (*InstanceVolume, bool) {
+		vol, err := conn.StorageVolLookupByPath(path)
+		if err != nil {
+			return nil, false
+		}
+		return &InstanceVolume{Pool: vol.Pool, Name: vol.Name}, true
+	}
+
+	return func(domain libvirt.Domain) (*DomainInspection, error) {
+		domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return nil, err
+		}
+		domainXML, err := parseDomainXML(domainStrg)
+		if err != nil {
+			return nil, err
+		}
+		result := inspectDomainXML(domainXML, lookup)
+		active, err := conn.DomainIsActive(domain)
+		if err != nil {
+			return nil, err
+		}
+		result.Active = active != 0
+		// the base image of an overlay
+		if result.BootDisk != nil {
+			pool, err := conn.StoragePoolLookupByName(result.BootDisk.Pool)
+			if err != nil {
+				return nil, err
+			}
+			volXML, err := storageVolByNameXMLDesc(pool, result.BootDisk.Name)
+			if err != nil {
+				return nil, err
+			}
+			if volXML.BackingStore != nil && len(volXML.BackingStore.Path) > 0 {
+				result.BaseImage, _ = lookup(volXML.BackingStore.Path)
+			}
+		}
+		// the contract of an unmanaged domain
+		if result.CloudInit != nil && result.Metadata == nil {
+			data, err := download(result.CloudInit)
+			if err == nil {
+				result.UserData, err = readCloudInitUserData(data)
+			}
+			if err != nil {
+				result.Problems = append(result.Problems, fmt.Sprintf("unable to read the cloud-init disk [%s], cause: [%v]", result.CloudInit.Name, err))
+			}
+		}
+		return result, nil
+	}
+}
+
+// InspectDomains describes all domains of the host
+func InspectDomains(client *LivirtClient) func() ([]*DomainInspection, error) {
+	conn := client.LibVirt
+	inspect := inspectDomain(conn)
+
+	return func() ([]*DomainInspection, error) {
+		domains, _, err := conn.ConnectListAllDomains(NeedResults, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result []*DomainInspection
+		for _, domain := range domains {
+			inspection, err := inspect(domain)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, inspection)
+		}
+		return result, nil
+	}
+}
+
+// AdoptInstanceSync (synchronously) adopts an existing domain that has not been created by the operator. The domain
+// definition and its disks are validated against the options and the domain is annotated with the metadata of the
+// operator, so it is not recreated. Nothing happens if the domain does not exist or if it is managed already.
+func AdoptInstanceSync(client *LivirtClient) func(opt *InstanceOptions) error {
+	conn := client.LibVirt
+	inspect := inspectDomain(conn)
+	setMetadata := setInstanceMetadata(conn)
+
+	return func(opt *InstanceOptions) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("AdoptInstanceSync(%s)", opt.Name))()
+		name := opt.Name
+		domain, err := conn.DomainLookupByName(name)
+		if err != nil {
+			log.Printf("Domain [%s] does not exist, it will be created", name)
+			return nil
+		}
+		domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return err
+		}
+		domainXML, err := parseDomainXML(domainStrg)
+		if err != nil {
+			return err
+		}
+		// a domain must not change its owner
+		if metadata, ok := findInstanceMetadata(domainXML); ok {
+			if owner := metadata.Owner; len(owner) > 0 && owner != opt.Owner {
+				return &AdoptionError{Name: name, Problems: []string{fmt.Sprintf("the domain is managed by the resource [%s]", owner)}}
+			}
+			return nil
+		}
+		inspection, err := inspect(domain)
+		if err != nil {
+			return err
+		}
+		if problems := validateAdoption(inspection, opt); len(problems) > 0 {
+			return &AdoptionError{Name: name, Problems: problems}
+		}
+		// from now on the domain is valid for the resource
+		metadata := &InstanceMetadata{
+			Hash:      CreateInstanceHash(opt),
+			Owner:     opt.Owner,
+			Cluster:   opt.Cluster,
+			DataDisks: inspection.DataDiskDevs,
+			Adopted: &InstanceAdoption{
+				BootDisk:  inspection.BootDisk,
+				CloudInit: inspection.CloudInit,
+				Console:   inspection.Console,
+			},
+		}
+		running := opt.PowerState != PowerStateStopped
+		if !running {
+			metadata.PowerState = PowerStateStopped
+		}
+		log.Printf("Adopting domain [%s] for resource [%s] ...", name, opt.Owner)
+		err = setMetadata(domain, metadata)
+		if err != nil {
+			return err
+		}
+		err = conn.DomainSetAutostart(domain, boolToInt32(running))
+		if err != nil {
+			return err
+		}
+		// a stopped domain would otherwise be handled by the restart policy
+		if running && !inspection.Active {
+			log.Printf("Starting adopted domain [%s] ...", name)
+			return conn.DomainCreate(domain)
+		}
+		return nil
+	}
+}
+
+// deleteAdoptedVolumes deletes the volumes an adopted domain has been created with, failures are logged only
+func deleteAdoptedVolumes(conn *libvirt.Libvirt) func(adoption *InstanceAdoption) {
+	delDisk := deleteStorageVol(conn)
+
+	return func(adoption *InstanceAdoption) {
+		if adoption == nil {
+			return
+		}
+		for _, vol := range []*InstanceVolume{adoption.BootDisk, adoption.CloudInit, adoption.Console} {
+			if vol == nil {
+				continue
+			}
+			pool, err := conn.StoragePoolLookupByName(vol.Pool)
+			if err != nil {
+				log.Printf("Unable to locate storage pool [%s], cause: [%v]", vol.Pool, err)
+				continue
+			}
+			_, err = delDisk(pool, vol.Name)
+			if err != nil {
+				log.Printf("Unable to delete disk [%s], cause: [%v]", vol.Name, err)
+			}
+		}
+	}
+}
+
+// copyLabels returns the labels extended by a further label
+func copyLabels(labels map[string]string, key, value string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[key] = value
+	return result
+}
+
+// CreateAdoptionResources creates the VSI, data disk references and network references that adopt an existing domain
+func CreateAdoptionResources(inspection *DomainInspection, opt *AdoptionResourceOptions) (*AdoptionResources, error) {
+	if inspection.BootDisk == nil || inspection.CloudInit == nil {
+		return nil, fmt.Errorf("domain [%s] lacks a boot disk or a cloud-init disk", inspection.Name)
+	}
+	imageURL := opt.ImageURL
+	if len(imageURL) == 0 {
+		if inspection.BaseImage == nil {
+			return nil, fmt.Errorf("the boot disk of domain [%s] has not been created from a base image in a storage pool, an image URL is required", inspection.Name)
+		}
+		imageURL = fmt.Sprintf("volume://%s/%s", inspection.BaseImage.Pool, inspection.BaseImage.Name)
+	}
+	name := GetAdoptionResourceName(inspection.Name)
+	labels := copyLabels(opt.Labels, LabelAdoptedDomain, name)
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{LabelAdoptedDomain: name}}
+	targetSelector := &metav1.LabelSelector{MatchLabels: opt.TargetLabels}
+
+	vsi := &OnPremCustomResource{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       KindVSI,
+			APIVersion: APIVersion,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      opt.Labels,
+			Annotations: map[string]string{AnnotationDomainName: inspection.Name},
+		},
+		Spec: OnPremCustomResourceSpec{
+			Contract:       inspection.UserData,
+			ImageURL:       imageURL,
+			StoragePool:    inspection.BootDisk.Pool,
+			TargetSelector: targetSelector,
+		},
+	}
+	// keep the current power state
+	if !inspection.Active {
+		vsi.Spec.PowerState = PowerStateStopped
+	}
+	result := &AdoptionResources{VSI: vsi}
+	for i, disk := range inspection.DataDisks {
+		result.DataDiskRefs = append(result.DataDiskRefs, &DataDiskRefCustomResource{
+			TypeMeta: metav1.TypeMeta{
+				Kind:       KindDataDiskRef,
+				APIVersion: APIVersion,
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("%s-%s", name, inspection.DataDiskDevs[i].Dev),
+				Labels: labels,
+			},
+			Spec: DataDiskRefCustomResourceSpec{
+				VolumeName:     disk.Name,
+				StoragePool:    disk.StoragePool,
+				Mode:           disk.Mode,
+				Cache:          disk.Cache,
+				IO:             disk.IO,
+				TargetSelector: targetSelector,
+			},
+		})
+	}
+	if len(result.DataDiskRefs) > 0 {
+		vsi.Spec.DiskSelector = selector
+	}
+	// a domain that is only connected to the default network does not need a reference
+	if !slices.Equal(inspection.Networks, []string{DefaultNetwork}) {
+		for i, network := range inspection.Networks {
+			result.NetworkRefs = append(result.NetworkRefs, &NetworkRefCustomResource{
+				TypeMeta: metav1.TypeMeta{
+					Kind:       KindNetworkRef,
+					APIVersion: APIVersion,
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   fmt.Sprintf("%s-net%d", name, i),
+					Labels: labels,
+				},
+				Spec: NetworkRefCustomResourceSpec{
+					NetworkName:    network,
+					TargetSelector: targetSelector,
+				},
+			})
+		}
+	}
+	if len(result.NetworkRefs) > 0 {
+		vsi.Spec.NetworkSelector = selector
+	}
+	return result, nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	testAdoptionDomain = "Web_Server.prod"
+	testAdoptionUID    = "5f0c6a3e-2d1b-4c8e-9f7a-6b5c4d3e2f1a"
+)
+
+// testAdoptionVolumes resolves the paths below /pool to volumes of the pool "images"
+func testAdoptionVolumes(path string) (*InstanceVolume, bool) {
+	name, ok := strings.CutPrefix(path, "/pool/")
+	if !ok {
+		return nil, false
+	}
+	return &InstanceVolume{Pool: "images", Name: name}, true
+}
+
+func testAdoptionDisk(device, dev, path string) libvirtxml.DomainDisk {
+	return libvirtxml.DomainDisk{
+		Device: device,
+		Target: &libvirtxml.DomainDiskTarget{Dev: dev},
+		Source: &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: path}},
+	}
+}
+
+func testAdoptionDomainXML() *libvirtxml.Domain {
+	data := testAdoptionDisk("disk", "vdc", "/pool/data.qcow2")
+	data.Shareable = &libvirtxml.DomainDiskShareable{}
+	data.Driver = &libvirtxml.DomainDiskDriver{Cache: "none"}
+	return &libvirtxml.Domain{
+		Name: testAdoptionDomain,
+		Devices: &libvirtxml.DomainDeviceList{
+			Disks: []libvirtxml.DomainDisk{
+				testAdoptionDisk("disk", bootDiskDev, "/pool/web.qcow2"),
+				testAdoptionDisk("cdrom", "sda", "/pool/web-cidata.iso"),
+				// empty drive
+				{Device: "cdrom", Target: &libvirtxml.DomainDiskTarget{Dev: "sdb"}},
+				data,
+			},
+			Consoles: []libvirtxml.DomainConsole{{Log: &libvirtxml.DomainChardevLog{File: "/pool/web.log"}}},
+			Interfaces: []libvirtxml.DomainInterface{{
+				Source: &libvirtxml.DomainInterfaceSource{Network: &libvirtxml.DomainInterfaceSourceNetwork{Network: "prod"}},
+			}},
+		},
+	}
+}
+
+func TestGetInstanceDomainName(t *testing.T) {
+	res := &OnPremCustomResource{ObjectMeta: metav1.ObjectMeta{UID: testAdoptionUID}}
+	assert.Equal(t, testAdoptionUID, GetInstanceDomainName(res))
+
+	res.Annotations = map[string]string{AnnotationDomainName: testAdoptionDomain}
+	assert.Equal(t, testAdoptionDomain, GetInstanceDomainName(res))
+}
+
+func TestGetAdoptionResourceName(t *testing.T) {
+	assert.Equal(t, "web-server-prod", GetAdoptionResourceName(testAdoptionDomain))
+	assert.Equal(t, "hpcr1", GetAdoptionResourceName("--hpcr1--"))
+	assert.Equal(t, "domain", GetAdoptionResourceName("__"))
+	assert.Len(t, GetAdoptionResourceName(strings.Repeat("a", 100)), maxResourceNameLength)
+}
+
+func TestReadCloudInitUserData(t *testing.T) {
+	isoData, err := CreateCloudInit([]byte("contract"), createMetaData("web"))
+	require.NoError(t, err)
+
+	userData, err := readCloudInitUserData(isoData)
+	require.NoError(t, err)
+	assert.Equal(t, "contract", userData)
+
+	// plain ISO 9660 names
+	assert.Equal(t, userDataFilename, normalizeISOFileName("USER_DATA.;1"))
+	assert.Equal(t, metaDataFilename, normalizeISOFileName("meta-data"))
+
+	_, err = readCloudInitUserData([]byte("not an iso"))
+	assert.Error(t, err)
+}
+
+func TestInspectDomainXML(t *testing.T) {
+	inspection := inspectDomainXML(testAdoptionDomainXML(), testAdoptionVolumes)
+	assert.Empty(t, inspection.Problems)
+	assert.Nil(t, inspection.Metadata)
+	assert.Equal(t, &InstanceVolume{Pool: "images", Name: "web.qcow2"}, inspection.BootDisk)
+	assert.Equal(t, &InstanceVolume{Pool: "images", Name: "web-cidata.iso"}, inspection.CloudInit)
+	assert.Equal(t, &InstanceVolume{Pool: "images", Name: "web.log"}, inspection.Console)
+	assert.Equal(t, []*AttachedDataDisk{{Name: "data.qcow2", StoragePool: "images", Mode: DataDiskModeShareable, Cache: "none"}}, inspection.DataDisks)
+	assert.Equal(t, []InstanceDataDisk{{Dev: "vdc", Pool: "images", Name: "data.qcow2"}}, inspection.DataDiskDevs)
+	assert.Equal(t, []string{"prod"}, inspection.Networks)
+
+	// files outside of a pool, a bridged interface and a missing console log
+	domainXML := testAdoptionDomainXML()
+	domainXML.Devices.Disks[0] = testAdoptionDisk("disk", bootDiskDev, "/var/lib/web.qcow2")
+	domainXML.Devices.Consoles = nil
+	domainXML.Devices.Interfaces = append(domainXML.Devices.Interfaces, libvirtxml.DomainInterface{
+		MAC:    &libvirtxml.DomainInterfaceMAC{Address: "52:54:00:00:00:01"},
+		Source: &libvirtxml.DomainInterfaceSource{Bridge: &libvirtxml.DomainInterfaceSourceBridge{Bridge: "br0"}},
+	})
+	inspection = inspectDomainXML(domainXML, testAdoptionVolumes)
+	assert.Nil(t, inspection.BootDisk)
+	assert.Len(t, inspection.Problems, 4)
+	assert.Contains(t, inspection.Problems[0], "/var/lib/web.qcow2")
+	assert.Contains(t, inspection.Problems[1], "boot disk")
+	assert.Contains(t, inspection.Problems[2], "console")
+	assert.Contains(t, inspection.Problems[3], "52:54:00:00:00:01")
+}
+
+func TestValidateAdoption(t *testing.T) {
+	inspection := inspectDomainXML(testAdoptionDomainXML(), testAdoptionVolumes)
+	inspection.UserData = "contract\n"
+
+	opt := &InstanceOptions{
+		Name:     testAdoptionDomain,
+		UserData: "contract",
+		Networks: []string{"prod"},
+		DataDisks: []*AttachedDataDisk{
+			{Name: "data.qcow2", StoragePool: "images", Mode: DataDiskModeShareable, Cache: "none"},
+			// attached after the adoption
+			{Name: "more.qcow2", StoragePool: "images"},
+		},
+	}
+	assert.Empty(t, validateAdoption(inspection, opt))
+
+	// a different contract, network and a data disk that would be detached
+	opt.UserData = "other"
+	opt.Networks = nil
+	opt.DataDisks = opt.DataDisks[1:]
+	problems := validateAdoption(inspection, opt)
+	require.Len(t, problems, 3)
+	assert.Contains(t, problems[0], "contract")
+	assert.Contains(t, problems[1], "[prod]")
+	assert.Contains(t, problems[2], "data.qcow2")
+
+	// a different mode
+	opt = &InstanceOptions{
+		UserData:  "contract",
+		Networks:  []string{"prod"},
+		DataDisks: []*AttachedDataDisk{{Name: "data.qcow2", StoragePool: "images", Cache: "none"}},
+	}
+	problems = validateAdoption(inspection, opt)
+	require.Len(t, problems, 1)
+	assert.Contains(t, problems[0], "mode")
+}
+
+func TestAdoptionError(t *testing.T) {
+	var err error = &AdoptionError{Name: testAdoptionDomain, Problems: []string{"a", "b"}}
+	assert.Equal(t, "AdoptionFailed: domain [Web_Server.prod] cannot be adopted, a, b", err.Error())
+
+	var condErr interface{ ConditionType() string }
+	assert.True(t, errors.As(err, &condErr))
+	assert.Equal(t, ConditionAdoptionFailed, condErr.ConditionType())
+}
+
+func TestGetLoggingVolume(t *testing.T) {
+	opt := &InstanceOptions{Name: testAdoptionUID, StoragePool: "default"}
+	pool, name := getLoggingVolume(opt, &InstanceMetadata{})
+	assert.Equal(t, "default", pool)
+	assert.Equal(t, GetLoggingVolumeName(testAdoptionUID), name)
+
+	pool, name = getLoggingVolume(opt, &InstanceMetadata{Adopted: &InstanceAdoption{Console: &InstanceVolume{Pool: "images", Name: "web.log"}}})
+	assert.Equal(t, "images", pool)
+	assert.Equal(t, "web.log", name)
+}
+
+func TestAdoptionMetadata(t *testing.T) {
+	metadataXML, err := XMLMarshall(InstanceMetadata{
+		Hash:    "hash",
+		Owner:   testAdoptionUID,
+		Adopted: &InstanceAdoption{BootDisk: &InstanceVolume{Pool: "images", Name: "web.qcow2"}},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, metadataXML, `<bootDisk pool="images">web.qcow2</bootDisk>`)
+
+	var metadata InstanceMetadata
+	require.NoError(t, xml.Unmarshal([]byte(metadataXML), &metadata))
+	assert.Equal(t, testAdoptionUID, metadata.Owner)
+	assert.Equal(t, "web.qcow2", metadata.Adopted.BootDisk.Name)
+	assert.Nil(t, metadata.Adopted.Console)
+}
+
+func TestCreateAdoptionResources(t *testing.T) {
+	inspection := inspectDomainXML(testAdoptionDomainXML(), testAdoptionVolumes)
+	inspection.UserData = "contract"
+	inspection.BaseImage = &InstanceVolume{Pool: "images", Name: "hpcr.qcow2"}
+
+	opt := &AdoptionResourceOptions{
+		Labels:       map[string]string{"app": "web"},
+		TargetLabels: map[string]string{"host": "kvm1"},
+	}
+	res, err := CreateAdoptionResources(inspection, opt)
+	require.NoError(t, err)
+
+	vsi := res.VSI
+	assert.Equal(t, "web-server-prod", vsi.Name)
+	assert.Equal(t, testAdoptionDomain, vsi.Annotations[AnnotationDomainName])
+	assert.Equal(t, "contract", vsi.Spec.Contract)
+	assert.Equal(t, "volume://images/hpcr.qcow2", vsi.Spec.ImageURL)
+	assert.Equal(t, "images", vsi.Spec.StoragePool)
+	assert.Equal(t, PowerStateStopped, vsi.Spec.PowerState)
+	assert.Equal(t, map[string]string{"host": "kvm1"}, vsi.Spec.TargetSelector.MatchLabels)
+
+	require.Len(t, res.DataDiskRefs, 1)
+	disk := res.DataDiskRefs[0]
+	assert.Equal(t, "web-server-prod-vdc", disk.Name)
+	assert.Equal(t, "data.qcow2", disk.Spec.VolumeName)
+	assert.Equal(t, DataDiskModeShareable, disk.Spec.Mode)
+	assert.Equal(t, "none", disk.Spec.Cache)
+	assert.Equal(t, map[string]string{"app": "web", LabelAdoptedDomain: "web-server-prod"}, disk.Labels)
+	assert.Equal(t, map[string]string{LabelAdoptedDomain: "web-server-prod"}, vsi.Spec.DiskSelector.MatchLabels)
+
+	require.Len(t, res.NetworkRefs, 1)
+	assert.Equal(t, "prod", res.NetworkRefs[0].Spec.NetworkName)
+	assert.Equal(t, vsi.Spec.DiskSelector, vsi.Spec.NetworkSelector)
+
+	// the image URL takes precedence, the default network does not need a reference
+	inspection.Active = true
+	inspection.Networks = []string{DefaultNetwork}
+	opt.ImageURL = "https://example.com/hpcr.qcow2"
+	res, err = CreateAdoptionResources(inspection, opt)
+	require.NoError(t, err)
+	assert.Equal(t, opt.ImageURL, res.VSI.Spec.ImageURL)
+	assert.Empty(t, res.VSI.Spec.PowerState)
+	assert.Empty(t, res.NetworkRefs)
+	assert.Nil(t, res.VSI.Spec.NetworkSelector)
+
+	// a full copy without an image URL
+	inspection.BaseImage = nil
+	opt.ImageURL = ""
+	_, err = CreateAdoptionResources(inspection, opt)
+	assert.Error(t, err)
+}
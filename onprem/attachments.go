@@ -0,0 +1,335 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+)
+
+const (
+	// the volume is attached to at most one VSI, the default
+	DataDiskModeExclusive = "exclusive"
+	// the volume may be attached read-write to several VSIs, the guests must coordinate their writes
+	DataDiskModeShareable = "shareable"
+	// the volume may be attached read-only to several VSIs
+	DataDiskModeReadOnly = "readonly"
+
+	// name of the volume that records the attachments of the volumes of a pool
+	attachmentRegistryVolumeName = "hpcr-attachments.json"
+	// maximum size of the attachment registry
+	maxAttachmentRegistrySize = 256 * 1024
+	// time a claim of a VSI whose domain does not exist yet stays valid, the claim is renewed on every sync
+	claimGracePeriod = 10 * time.Minute
+)
+
+// VolumeOwner identifies a VSI that has a volume attached
+type VolumeOwner struct {
+	// name of the libvirt domain
+	Domain string `json:"domain"`
+	// name of the VSI resource
+	Name string `json:"name"`
+}
+
+// volumeAttachment records the VSIs that have a volume attached and the mode they use
+type volumeAttachment struct {
+	Mode   string        `json:"mode"`
+	Owners []VolumeOwner `json:"owners"`
+	// time of the claim of owners whose domain does not exist yet, keyed by domain
+	Pending map[string]time.Time `json:"pending,omitempty"`
+}
+
+// attachmentRegistry records the attachments of the volumes of a storage pool keyed by volume name
+type attachmentRegistry struct {
+	Volumes map[string]*volumeAttachment `json:"volumes"`
+}
+
+// AttachmentConflictError reports that a volume is attached to other VSIs in an incompatible mode
+type AttachmentConflictError struct {
+	// name of the volume
+	Volume string
+	// name of the storage pool
+	StoragePool string
+	// mode of the existing attachment
+	Mode string
+	// the VSIs that have the volume attached
+	Owners []VolumeOwner
+}
+
+func (err *AttachmentConflictError) Error() string {
+	return fmt.Sprintf("volume [%s] on pool [%s] is attached in mode [%s] to VSIs %v", err.Volume, err.StoragePool, err.Mode, VolumeOwnerNames(err.Owners))
+}
+
+// VolumeOwnerNames returns the names of the VSI resources of the owners
+func VolumeOwnerNames(owners []VolumeOwner) []string {
+	names := make([]string, len(owners))
+	for idx, owner := range owners {
+		names[idx] = owner.Name
+	}
+	return names
+}
+
+// isAttachmentCompatible checks if a volume attached in the existing mode may also be attached in the requested mode
+func isAttachmentCompatible(existing, requested string) bool {
+	return existing == requested && existing != DataDiskModeExclusive
+}
+
+// isPendingClaim tests if the owner of a domain that does not exist claimed the volume within the grace period, i.e.
+// its domain is still being created
+func isPendingClaim(current *volumeAttachment, domain string, now time.Time) bool {
+	claimed, ok := current.Pending[domain]
+	return ok && now.Sub(claimed) < claimGracePeriod
+}
+
+// claimVolume records the owner of a volume. The claim is refused if other VSIs have the volume attached in an
+// incompatible mode. Owners whose domain does not exist are dropped unless their claim is pending, the claim of an
+// owner without domain is recorded as pending. Returns true if the registry changed.
+func claimVolume(registry *attachmentRegistry, pool, volume, mode string, owner VolumeOwner, now time.Time, exists func(domain string) bool) (bool, error) {
+	if registry.Volumes == nil {
+		registry.Volumes = make(map[string]*volumeAttachment)
+	}
+	current, ok := registry.Volumes[volume]
+	if !ok {
+		current = &volumeAttachment{Mode: mode}
+	}
+	// other owners that are still alive or about to be created
+	var others []VolumeOwner
+	pending := make(map[string]time.Time)
+	for _, existing := range current.Owners {
+		if existing.Domain == owner.Domain {
+			continue
+		}
+		if exists(existing.Domain) {
+			others = append(others, existing)
+		} else if isPendingClaim(current, existing.Domain, now) {
+			others = append(others, existing)
+			pending[existing.Domain] = current.Pending[existing.Domain]
+		}
+	}
+	if len(others) > 0 && !isAttachmentCompatible(current.Mode, mode) {
+		return false, &AttachmentConflictError{Volume: volume, StoragePool: pool, Mode: current.Mode, Owners: others}
+	}
+	owners := append(others, owner)
+	sort.Slice(owners, func(i, j int) bool {
+		return owners[i].Domain < owners[j].Domain
+	})
+	if !exists(owner.Domain) {
+		pending[owner.Domain] = now
+	}
+	if len(pending) == 0 {
+		pending = nil
+	}
+	if ok && current.Mode == mode && slices.Equal(current.Owners, owners) && maps.Equal(current.Pending, pending) {
+		return false, nil
+	}
+	registry.Volumes[volume] = &volumeAttachment{Mode: mode, Owners: owners, Pending: pending}
+	return true, nil
+}
+
+// releaseVolumes removes the owner from all volumes that are not kept. Returns true if the registry changed.
+func releaseVolumes(registry *attachmentRegistry, domain string, keep map[string]bool) bool {
+	changed := false
+	for volume, current := range registry.Volumes {
+		if keep[volume] {
+			continue
+		}
+		owners := slices.DeleteFunc(slices.Clone(current.Owners), func(owner VolumeOwner) bool {
+			return owner.Domain == domain
+		})
+		if len(owners) == len(current.Owners) {
+			continue
+		}
+		changed = true
+		if len(owners) == 0 {
+			delete(registry.Volumes, volume)
+		} else {
+			current.Owners = owners
+			delete(current.Pending, domain)
+		}
+	}
+	return changed
+}
+
+// domainExists checks if a domain with the given name is defined
+func domainExists(conn *libvirt.Libvirt) func(name string) bool {
+	return func(name string) bool {
+		_, err := conn.DomainLookupByName(name)
+		return err == nil
+	}
+}
+
+// ClaimDataDisks records the VSI as owner of its data disks in the attachment registries of their pools. Fails with
+// an AttachmentConflictError if one of the disks is attached to another VSI in an incompatible mode, in that case
+// no claim is recorded in any pool.
+func ClaimDataDisks(client *LivirtClient) func(owner VolumeOwner, disks []*AttachedDataDisk) error {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	writeRegistry := writeJSONVolume(conn)
+	exists := domainExists(conn)
+
+	return func(owner VolumeOwner, disks []*AttachedDataDisk) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("ClaimDataDisks(%s)", owner.Domain))()
+
+		// group by pool
+		byPool := make(map[string][]*AttachedDataDisk)
+		var poolNames []string
+		for _, disk := range disks {
+			if _, ok := byPool[disk.StoragePool]; !ok {
+				poolNames = append(poolNames, disk.StoragePool)
+			}
+			byPool[disk.StoragePool] = append(byPool[disk.StoragePool], disk)
+		}
+		// lock the registries in a fixed order, so concurrent claims do not deadlock
+		slices.Sort(poolNames)
+
+		type claim struct {
+			pool     libvirt.StoragePool
+			registry attachmentRegistry
+			changed  bool
+		}
+		// check all pools for conflicts before recording any claim
+		claims := make([]*claim, 0, len(poolNames))
+		now := time.Now()
+		for _, poolName := range poolNames {
+			pool, err := conn.StoragePoolLookupByName(poolName)
+			if err != nil {
+				return err
+			}
+			defer lockRegistry(pool, attachmentRegistryVolumeName)()
+			c := &claim{pool: pool}
+			_, err = readRegistry(pool, attachmentRegistryVolumeName, maxAttachmentRegistrySize, &c.registry)
+			if err != nil {
+				return err
+			}
+			for _, disk := range byPool[poolName] {
+				claimed, err := claimVolume(&c.registry, poolName, disk.Name, BoxDataDiskMode(disk.Mode), owner, now, exists)
+				if err != nil {
+					return err
+				}
+				c.changed = c.changed || claimed
+			}
+			claims = append(claims, c)
+		}
+		for _, c := range claims {
+			if !c.changed {
+				continue
+			}
+			log.Printf("Recording the attachments of VSI [%s] on pool [%s] ...", owner.Name, c.pool.Name)
+			err := writeRegistry(c.pool, attachmentRegistryVolumeName, maxAttachmentRegistrySize, &c.registry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ReleaseDataDisks removes the VSI as owner from all volumes of all pools except from the given data disks
+func ReleaseDataDisks(client *LivirtClient) func(domain string, keep []*AttachedDataDisk) error {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	writeRegistry := writeJSONVolume(conn)
+
+	releasePool := func(pool libvirt.StoragePool, domain string, keep []*AttachedDataDisk) error {
+		defer lockRegistry(pool, attachmentRegistryVolumeName)()
+		var registry attachmentRegistry
+		found, err := readRegistry(pool, attachmentRegistryVolumeName, maxAttachmentRegistrySize, &registry)
+		if err != nil || !found {
+			return err
+		}
+		kept := make(map[string]bool)
+		for _, disk := range keep {
+			if disk.StoragePool == pool.Name {
+				kept[disk.Name] = true
+			}
+		}
+		if !releaseVolumes(&registry, domain, kept) {
+			return nil
+		}
+		log.Printf("Releasing the attachments of domain [%s] on pool [%s] ...", domain, pool.Name)
+		return writeRegistry(pool, attachmentRegistryVolumeName, maxAttachmentRegistrySize, &registry)
+	}
+
+	return func(domain string, keep []*AttachedDataDisk) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("ReleaseDataDisks(%s)", domain))()
+
+		pools, _, err := conn.ConnectListAllStoragePools(NeedResults, libvirt.ConnectListStoragePoolsActive)
+		if err != nil {
+			return err
+		}
+		for _, pool := range pools {
+			err = releasePool(pool, domain, keep)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ReleasePendingDataDisks removes the claims of a VSI whose domain could not be created, the claims of an existing
+// domain are kept
+func ReleasePendingDataDisks(client *LivirtClient) func(domain string) error {
+	exists := domainExists(client.LibVirt)
+	releaseDataDisks := ReleaseDataDisks(client)
+
+	return func(domain string) error {
+		if exists(domain) {
+			return nil
+		}
+		return releaseDataDisks(domain, nil)
+	}
+}
+
+// GetVolumeOwners returns the VSIs that have a volume attached, owners whose domain does not exist are skipped unless
+// their claim is pending
+func GetVolumeOwners(client *LivirtClient) func(storagePool, name string) ([]VolumeOwner, error) {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	exists := domainExists(conn)
+
+	return func(storagePool, name string) ([]VolumeOwner, error) {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return nil, err
+		}
+		var registry attachmentRegistry
+		_, err = readRegistry(pool, attachmentRegistryVolumeName, maxAttachmentRegistrySize, &registry)
+		if err != nil {
+			return nil, err
+		}
+		current, ok := registry.Volumes[name]
+		if !ok {
+			return nil, nil
+		}
+		var result []VolumeOwner
+		now := time.Now()
+		for _, owner := range current.Owners {
+			if exists(owner.Domain) || isPendingClaim(current, owner.Domain, now) {
+				result = append(result, owner)
+			}
+		}
+		return result, nil
+	}
+}
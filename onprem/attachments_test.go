@@ -0,0 +1,137 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimVolume(t *testing.T) {
+	now := time.Now()
+	alive := map[string]bool{"a": true, "b": true}
+	exists := func(domain string) bool {
+		return alive[domain]
+	}
+	first := VolumeOwner{Domain: "a", Name: "first"}
+	second := VolumeOwner{Domain: "b", Name: "second"}
+
+	var registry attachmentRegistry
+
+	// the first claim is recorded, a repeated claim does not change the registry
+	changed, err := claimVolume(&registry, "images", "disk", DataDiskModeExclusive, first, now, exists)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	changed, err = claimVolume(&registry, "images", "disk", DataDiskModeExclusive, first, now, exists)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// a second claimant is refused
+	_, err = claimVolume(&registry, "images", "disk", DataDiskModeExclusive, second, now, exists)
+	var conflict *AttachmentConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, []VolumeOwner{first}, conflict.Owners)
+	assert.Contains(t, err.Error(), "[first]")
+
+	// unless the first owner is gone
+	delete(alive, "a")
+	changed, err = claimVolume(&registry, "images", "disk", DataDiskModeExclusive, second, now, exists)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []VolumeOwner{second}, registry.Volumes["disk"].Owners)
+}
+
+func TestClaimSharedVolume(t *testing.T) {
+	now := time.Now()
+	exists := func(domain string) bool {
+		return true
+	}
+	first := VolumeOwner{Domain: "a", Name: "first"}
+	second := VolumeOwner{Domain: "b", Name: "second"}
+
+	var registry attachmentRegistry
+
+	_, err := claimVolume(&registry, "images", "disk", DataDiskModeShareable, second, now, exists)
+	require.NoError(t, err)
+	_, err = claimVolume(&registry, "images", "disk", DataDiskModeShareable, first, now, exists)
+	require.NoError(t, err)
+	assert.Equal(t, []VolumeOwner{first, second}, registry.Volumes["disk"].Owners)
+
+	// modes must match
+	_, err = claimVolume(&registry, "images", "disk", DataDiskModeReadOnly, VolumeOwner{Domain: "c", Name: "third"}, now, exists)
+	assert.Error(t, err)
+
+	// a single owner may change the mode
+	_, err = claimVolume(&registry, "images", "other", DataDiskModeExclusive, first, now, exists)
+	require.NoError(t, err)
+	_, err = claimVolume(&registry, "images", "other", DataDiskModeReadOnly, first, now, exists)
+	require.NoError(t, err)
+	assert.Equal(t, DataDiskModeReadOnly, registry.Volumes["other"].Mode)
+}
+
+func TestClaimPendingVolume(t *testing.T) {
+	now := time.Now()
+	alive := map[string]bool{"b": true}
+	exists := func(domain string) bool {
+		return alive[domain]
+	}
+	first := VolumeOwner{Domain: "a", Name: "first"}
+	second := VolumeOwner{Domain: "b", Name: "second"}
+
+	var registry attachmentRegistry
+
+	// the domain of the first owner is still being created
+	changed, err := claimVolume(&registry, "images", "disk", DataDiskModeExclusive, first, now, exists)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, now, registry.Volumes["disk"].Pending["a"])
+
+	// a pending claim blocks other VSIs
+	_, err = claimVolume(&registry, "images", "disk", DataDiskModeExclusive, second, now.Add(time.Minute), exists)
+	var conflict *AttachmentConflictError
+	require.ErrorAs(t, err, &conflict)
+	assert.Equal(t, []VolumeOwner{first}, conflict.Owners)
+
+	// until it expires
+	changed, err = claimVolume(&registry, "images", "disk", DataDiskModeExclusive, second, now.Add(claimGracePeriod), exists)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []VolumeOwner{second}, registry.Volumes["disk"].Owners)
+	assert.Empty(t, registry.Volumes["disk"].Pending)
+}
+
+func TestReleaseVolumes(t *testing.T) {
+	first := VolumeOwner{Domain: "a", Name: "first"}
+	second := VolumeOwner{Domain: "b", Name: "second"}
+
+	registry := attachmentRegistry{
+		Volumes: map[string]*volumeAttachment{
+			"shared": {Mode: DataDiskModeShareable, Owners: []VolumeOwner{first, second}},
+			"kept":   {Mode: DataDiskModeExclusive, Owners: []VolumeOwner{first}},
+			"gone":   {Mode: DataDiskModeExclusive, Owners: []VolumeOwner{first}},
+		},
+	}
+
+	assert.True(t, releaseVolumes(&registry, "a", map[string]bool{"kept": true}))
+	assert.Equal(t, []VolumeOwner{second}, registry.Volumes["shared"].Owners)
+	assert.Equal(t, []VolumeOwner{first}, registry.Volumes["kept"].Owners)
+	assert.NotContains(t, registry.Volumes, "gone")
+
+	// nothing left to release
+	assert.False(t, releaseVolumes(&registry, "a", map[string]bool{"kept": true}))
+}
@@ -15,40 +15,43 @@
 package onprem
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
+	"path/filepath"
+	"strings"
 	"time"
 
+	A "github.com/IBM/fp-go/array"
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
 	"libvirt.org/go/libvirtxml"
 )
 
-// checks if the file needs update
-func needsUpdateFromURL(url string, vol *libvirtxml.StorageVolume) bool {
-	// access some typical metadata
-	req, err := http.NewRequest("HEAD", url, nil)
-	if err != nil {
-		return true
-	}
-	if vol.Target.Timestamps != nil && len(vol.Target.Timestamps.Mtime) > 0 {
-		// add modified header
-		req.Header.Set("If-Modified-Since", timeFromEpoch(vol.Target.Timestamps.Mtime).UTC().Format(http.TimeFormat))
-	}
-	// send
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return true
-	}
-	if resp.StatusCode == http.StatusNotModified {
-		return false
+const (
+	// Environment variable names
+	KeyBootDiskMode = "BOOT_DISK_MODE"
+
+	// the boot disk is a full copy of the base image
+	BootDiskModeCopy = "copy"
+	// the boot disk is a qcow2 overlay backed by the base image
+	BootDiskModeOverlay = "overlay"
+)
+
+// GetBootDiskModeFromEnvMap returns the way boot disks are created from the base image
+func GetBootDiskModeFromEnvMap(envMap env.Environment) string {
+	mode, ok := envMap[KeyBootDiskMode]
+	if !ok {
+		return BootDiskModeCopy
 	}
-	// get size
-	volSize, ok := getVolumeSize(vol)
-	// check the size
-	remoteSize := resp.ContentLength
-	if remoteSize > 0 && ok && remoteSize == int64(volSize) {
-		return false
+	switch mode {
+	case BootDiskModeCopy, BootDiskModeOverlay:
+		return mode
 	}
-	return true
+	log.Printf("Ignoring invalid value [%s] for [%s]", mode, KeyBootDiskMode)
+	return BootDiskModeCopy
 }
 
 // CloneBootDisk will clone an existing (boot) disk, so the clone may safely be modified
@@ -120,12 +123,114 @@ func CloneBootDisk(client *LivirtClient) func(storagePool string, existingVolume
 	}
 }
 
-// UploadBootDisk uploads the iso file to the remote storage pool
-func UploadBootDisk(client *LivirtClient) func(storagePool, name, url string) (*libvirtxml.StorageVolume, error) {
+// createOverlayVolumeDef creates the definition of a qcow2 volume that is backed by the given base image
+func createOverlayVolumeDef(name string, base *libvirtxml.StorageVolume, basePath string) libvirtxml.StorageVolume {
+	volumeDef := createDefaultVolume()
+	volumeDef.Name = name
+	// the overlay exposes the full virtual size of the base image
+	volumeDef.Capacity = base.Capacity
+	volumeDef.BackingStore = &libvirtxml.StorageVolumeBackingStore{
+		Path: basePath,
+		Format: &libvirtxml.StorageVolumeTargetFormat{
+			Type: "qcow2",
+		},
+	}
+	return volumeDef
+}
+
+// OverlayBootDisk creates a qcow2 overlay on top of an existing (boot) disk, writes go to the overlay
+// and leave the base image untouched, so the overlay may safely be modified
+func OverlayBootDisk(client *LivirtClient) func(storagePool string, existingVolumeXML *libvirtxml.StorageVolume, newName string) (*libvirtxml.StorageVolume, error) {
+	conn := client.LibVirt
+	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+
+	return func(storagePool string, existingVolumeXML *libvirtxml.StorageVolume, newName string) (*libvirtxml.StorageVolume, error) {
+		// some logging
+		log.Printf("Creating overlay [%s] on pool [%s] for boot disk [%s] ...", newName, storagePool, existingVolumeXML.Name)
+		// access the pool
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return nil, err
+		}
+		// lookup volume by key
+		existingVol, err := conn.StorageVolLookupByKey(existingVolumeXML.Key)
+		if err != nil {
+			return nil, err
+		}
+		existingPath, err := conn.StorageVolGetPath(existingVol)
+		if err != nil {
+			return nil, err
+		}
+		// delete a previous overlay, it may have a different backing file
+		_, err = deleteStorageVol(conn)(pool, newName)
+		if err != nil && !isError(err, libvirt.ErrNoStorageVol) {
+			return nil, err
+		}
+		// Refresh the pool
+		err = refreshPool(conn)(pool)
+		if err != nil {
+			return nil, err
+		}
+
+		volumeDefXML, err := XMLMarshall(createOverlayVolumeDef(newName, existingVolumeXML, existingPath))
+		if err != nil {
+			return nil, err
+		}
+
+		// create the volume
+		overlayVolume, err := conn.StorageVolCreateXML(pool, volumeDefXML, 0)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Overlay [%s] backed by [%s] created on pool [%s].", newName, existingPath, pool.Name)
+
+		// Refresh the pool
+		err = refreshPool(conn)(pool)
+		if err != nil {
+			return nil, err
+		}
+
+		// refresh the description
+		return storageVolXMLDesc(&overlayVolume)
+	}
+}
+
+// versionedImageVolumeName returns the name of the volume that holds a specific version of an image, the name of the
+// image itself if its identity is unknown
+func versionedImageVolumeName(name, identity string) string {
+	if len(identity) == 0 {
+		return name
+	}
+	digest := sha256.Sum256([]byte(identity))
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), hex.EncodeToString(digest[:])[:12], ext)
+}
+
+// UploadBootDisk makes the base image available on the remote storage pool
+func UploadBootDisk(client *LivirtClient) func(storagePool string, src ImageSource) (*libvirtxml.StorageVolume, error) {
 	conn := client.LibVirt
 	// hooks
 	storageVolXMLDesc := getStorageVolByNameXMLDesc(conn)
-	return func(storagePool, name, url string) (*libvirtxml.StorageVolume, error) {
+	readProgress := readUploadProgress(conn)
+	writeProgress := writeUploadProgress(conn)
+	uploadInChunks := uploadVolumeInChunks(client)
+	recordImage := recordBaseImage(conn)
+	getDependents := getVolumeDependents(conn)
+	return func(storagePool string, src ImageSource) (*libvirtxml.StorageVolume, error) {
+		// name of the volume
+		name, err := src.Name()
+		if err != nil {
+			return nil, err
+		}
+		// images that already exist on the host do not need an upload
+		if hostSrc, ok := src.(HostImageSource); ok {
+			log.Printf("Using boot disk [%s] available on pool [%s] ...", name, hostSrc.StoragePool())
+			pool, err := conn.StoragePoolLookupByName(hostSrc.StoragePool())
+			if err != nil {
+				return nil, err
+			}
+			return storageVolXMLDesc(pool, name)
+		}
 		// some logging
 		log.Printf("Make boot disk [%s] available on pool [%s] ...", name, storagePool)
 		// access the pool
@@ -133,59 +238,129 @@ func UploadBootDisk(client *LivirtClient) func(storagePool, name, url string) (*
 		if err != nil {
 			return nil, err
 		}
+		// a version of the image that could not replace the base image of existing overlays
+		identity := src.Identity()
+		versionedName := versionedImageVolumeName(name, identity)
+		if versionedName != name {
+			if _, err := conn.StorageVolLookupByName(pool, versionedName); err == nil {
+				if readProgress(pool, versionedName) == nil {
+					log.Printf("Using version [%s] of boot disk [%s] on pool [%s] ...", versionedName, name, pool.Name)
+					recordImage(pool, versionedName, src.String())
+					return storageVolXMLDesc(pool, versionedName)
+				}
+				name = versionedName
+			}
+		}
+		// check if a previous upload got interrupted
+		progress := readProgress(pool, name)
 		// check if we already know the volume
 		existing, err := storageVolXMLDesc(pool, name)
-		if err == nil {
+		if err == nil && progress == nil {
 			// maybe there is no need for an update
-			if !needsUpdateFromURL(url, existing) {
+			if !src.NeedsUpdate(existing) {
 				log.Println("Skipping upload, image is already available.")
+				recordImage(pool, name, src.String())
 				return existing, nil
 			}
-			// we need to delete the volume
-			_, err := deleteStorageVol(conn)(pool, name)
-			if err != nil {
-				return nil, err
+		}
+		// resume the upload if the image did not change
+		var offset uint64
+		if err == nil && progress != nil {
+			if canResumeUpload(progress, identity) {
+				offset = progress.Offset
+			} else {
+				log.Printf("Image [%s] changed since the upload of [%s] started, restarting the upload ...", src, name)
 			}
 		}
-		// Refresh the pool
-		err = refreshPool(conn)(pool)
-		if err != nil {
-			return nil, err
+		// get the content
+		rdr, size, err := openImageSource(src, offset, identity)
+		if errors.Is(err, ErrImageChanged) {
+			log.Printf("Image [%s] changed since the upload of [%s] started, restarting the upload ...", src, name)
+			offset = 0
+			rdr, size, err = src.Open(offset)
 		}
-		// get some metadata
-		resp, err := http.Get(url) // #nosec G107 - we do want the URL to come from config
 		if err != nil {
 			return nil, err
 		}
-		defer safeClose(resp.Body)
-		size := uint64(resp.ContentLength)
-		// update the volume identifier
-		volumeDef := createDefaultVolume()
-		volumeDef.Name = name
-		volumeDef.Capacity.Unit = "B"
-		volumeDef.Capacity.Value = size
-		volumeDef.Target.Format.Type = "qcow2"
-
-		volumeDefXML, err := XMLMarshall(volumeDef)
-		if err != nil {
-			return nil, err
+		// the image changed since the upload started
+		if offset > 0 && progress.Size != size {
+			log.Printf("Size of [%s] changed from [%d] to [%d] bytes, restarting the upload ...", name, progress.Size, size)
+			safeClose(rdr)
+			offset = 0
+			rdr, size, err = src.Open(offset)
+			if err != nil {
+				return nil, err
+			}
 		}
+		defer safeClose(rdr)
+		var volume libvirt.StorageVol
+		if offset > 0 {
+			log.Printf("Resuming upload of [%s] to pool [%s] at [%d] of [%d bytes] ...", name, pool.Name, offset, size)
+			volume, err = conn.StorageVolLookupByName(pool, name)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// overlays would be corrupted by replacing their backing file
+			if existingVol, err := conn.StorageVolLookupByName(pool, name); err == nil {
+				dependents, err := getDependents(existingVol)
+				if err != nil {
+					return nil, err
+				}
+				if A.IsNonEmpty(dependents) {
+					// upload the new version next to the old one, the garbage collection removes the old one once it
+					// is no longer used
+					if versionedName == name {
+						return nil, fmt.Errorf("unable to replace base image [%s] on pool [%s], it is the backing file of volumes %v", name, pool.Name, dependents)
+					}
+					log.Printf("Base image [%s] on pool [%s] is the backing file of volumes %v, uploading the new version as [%s] ...", name, pool.Name, dependents, versionedName)
+					name = versionedName
+				}
+			}
+			// start from scratch
+			_, err = deleteStorageVol(conn)(pool, name)
+			if err != nil && !isError(err, libvirt.ErrNoStorageVol) {
+				return nil, err
+			}
+			// Refresh the pool
+			err = refreshPool(conn)(pool)
+			if err != nil {
+				return nil, err
+			}
+			// update the volume identifier
+			volumeDef := createDefaultVolume()
+			volumeDef.Name = name
+			volumeDef.Capacity.Unit = "B"
+			volumeDef.Capacity.Value = size
+			volumeDef.Target.Format.Type = "qcow2"
 
-		// create the volume
-		volume, err := conn.StorageVolCreateXML(pool, string(volumeDefXML), 0)
-		if err != nil {
-			return nil, err
+			volumeDefXML, err := XMLMarshall(volumeDef)
+			if err != nil {
+				return nil, err
+			}
+
+			// create the volume
+			volume, err = conn.StorageVolCreateXML(pool, string(volumeDefXML), 0)
+			if err != nil {
+				return nil, err
+			}
+			// mark the volume as incomplete until the upload succeeds
+			err = writeProgress(pool, name, &uploadProgress{Size: size, Source: identity})
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		t0 := time.Now()
-		log.Printf("Starting upload of [%s] to pool [%s], size=[%d bytes]...", url, pool.Name, size)
+		log.Printf("Starting upload of [%s] to pool [%s], size=[%d bytes]...", name, pool.Name, size)
 
-		err = conn.StorageVolUpload(volume, createReaderWithLog(resp.Body, size), 0, size, 0)
+		err = uploadInChunks(pool, volume, rdr, uploadProgress{Size: size, Offset: offset, Source: identity})
 		if err != nil {
 			return nil, err
 		}
 		t1 := time.Now()
-		log.Printf("Upload of [%s] to pool [%s] done in [%f s].", url, pool.Name, t1.Sub(t0).Seconds())
+		log.Printf("Upload of [%s] to pool [%s] done in [%f s].", name, pool.Name, t1.Sub(t0).Seconds())
+		recordImage(pool, name, src.String())
 
 		// Refresh the pool
 		err = refreshPool(conn)(pool)
@@ -32,7 +32,43 @@ func TestBootDiskUpload(t *testing.T) {
 
 	uploader := UploadBootDisk(client)
 
-	vol, err := uploader("libvirt", "hpcr.qcow2", "http://localhost:8080/hpcr.qcow2")
+	src, err := CreateImageSource(&ImageSourceConfig{})("http://localhost:8080/hpcr.qcow2")
+	require.NoError(t, err)
+
+	vol, err := uploader("libvirt", src)
 	require.NoError(t, err)
 	assert.NotNil(t, vol)
 }
+
+func TestCreateOverlayVolumeDef(t *testing.T) {
+	base := createDefaultVolume()
+	base.Name = "hpcr.qcow2"
+	base.Capacity.Value = 10 * 1024 * 1024 * 1024
+
+	overlay := createOverlayVolumeDef("boot-vsi.qcow2", &base, "/var/lib/libvirt/images/hpcr.qcow2")
+	assert.Equal(t, "boot-vsi.qcow2", overlay.Name)
+	assert.Equal(t, "qcow2", overlay.Target.Format.Type)
+	assert.Equal(t, base.Capacity.Value, overlay.Capacity.Value)
+	require.NotNil(t, overlay.BackingStore)
+	assert.Equal(t, "/var/lib/libvirt/images/hpcr.qcow2", overlay.BackingStore.Path)
+	assert.Equal(t, "qcow2", overlay.BackingStore.Format.Type)
+
+	overlayXML, err := XMLMarshall(overlay)
+	require.NoError(t, err)
+	assert.Contains(t, overlayXML, "<backingStore>")
+}
+
+func TestGetBootDiskModeFromEnvMap(t *testing.T) {
+	assert.Equal(t, BootDiskModeCopy, GetBootDiskModeFromEnvMap(map[string]string{}))
+	assert.Equal(t, BootDiskModeOverlay, GetBootDiskModeFromEnvMap(map[string]string{KeyBootDiskMode: BootDiskModeOverlay}))
+	assert.Equal(t, BootDiskModeCopy, GetBootDiskModeFromEnvMap(map[string]string{KeyBootDiskMode: "thin"}))
+}
+
+func TestVersionedImageVolumeName(t *testing.T) {
+	v1 := versionedImageVolumeName("hpcr.qcow2", `"v1"`)
+	assert.Regexp(t, `^hpcr-[0-9a-f]{12}\.qcow2$`, v1)
+	assert.NotEqual(t, v1, versionedImageVolumeName("hpcr.qcow2", `"v2"`))
+	assert.Equal(t, v1, versionedImageVolumeName("hpcr.qcow2", `"v1"`))
+	// without identity there is only a single version
+	assert.Equal(t, "hpcr.qcow2", versionedImageVolumeName("hpcr.qcow2", ""))
+}
@@ -23,16 +23,24 @@ const (
 	vendorDataFilename = "vendor-data"
 	ciDataVolumeName   = "cidata"
 
-	APIVersion      = "hpse.ibm.com/v1"
-	KindVSI         = "HyperProtectContainerRuntimeOnPrem"
-	KindDataDisk    = "HyperProtectContainerRuntimeOnPremDataDisk"
-	KindDataDiskRef = "HyperProtectContainerRuntimeOnPremDataDiskRef"
-	KindNetworkRef  = "HyperProtectContainerRuntimeOnPremNetworkRef"
+	APIVersion           = "hpse.ibm.com/v1"
+	KindVSI              = "HyperProtectContainerRuntimeOnPrem"
+	KindDataDisk         = "HyperProtectContainerRuntimeOnPremDataDisk"
+	KindDataDiskRef      = "HyperProtectContainerRuntimeOnPremDataDiskRef"
+	KindDataDiskSnapshot = "HyperProtectContainerRuntimeOnPremDataDiskSnapshot"
+	KindNetworkRef       = "HyperProtectContainerRuntimeOnPremNetworkRef"
+	KindImage            = "HyperProtectContainerRuntimeOnPremImage"
+	KindNetwork          = "HyperProtectContainerRuntimeOnPremNetwork"
+	KindStoragePool      = "HyperProtectContainerRuntimeOnPremStoragePool"
 
-	ResourceNameDataDisks    = "onprem-datadisks"
-	ResourceNameDataDiskRefs = "onprem-datadiskrefs"
-	ResourceNameNetworkRefs  = "onprem-networkrefs"
-	ResourceNameVSIs         = "onprem-hpcrs"
+	ResourceNameDataDisks         = "onprem-datadisks"
+	ResourceNameDataDiskRefs      = "onprem-datadiskrefs"
+	ResourceNameDataDiskSnapshots = "onprem-datadisksnapshots"
+	ResourceNameNetworkRefs       = "onprem-networkrefs"
+	ResourceNameVSIs              = "onprem-hpcrs"
+	ResourceNameImages            = "onprem-images"
+	ResourceNameNetworks          = "onprem-networks"
+	ResourceNameStoragePools      = "onprem-storagepools"
 
 	NeedResults = int32(1)
 )
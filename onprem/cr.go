@@ -30,6 +30,8 @@ type OnPremCustomResourceSpec struct {
 	Contract string `json:"contract"`
 	// URL to the service that serves the base qcow2 image
 	ImageURL string `json:"imageURL"`
+	// name of a pre-staged image resource, takes precedence over the image URL
+	Image string `json:"image,omitempty"`
 	// name of the storage pool, must exist and must be large enough
 	StoragePool string `json:"storagePool"`
 	// specification of the associated config maps
@@ -38,22 +40,86 @@ type OnPremCustomResourceSpec struct {
 	DiskSelector *metav1.LabelSelector `json:"diskSelector"`
 	// specification of the associated networks
 	NetworkSelector *metav1.LabelSelector `json:"networkSelector"`
+	// static addresses keyed by the network name, take precedence over the addresses of the network refs
+	Addresses map[string]*NetworkAddress `json:"addresses,omitempty"`
+	// what happens when the VSI stops, one of Always, OnFailure, Recreate or Never, defaults to Recreate
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+	// desired state of the VSI, one of Running or Stopped, defaults to Running
+	PowerState string `json:"powerState,omitempty"`
+}
+
+type NetworkAddress struct {
+	// static IPv4 address reserved for the VSI
+	IPv4 string `json:"ipv4,omitempty"`
+	// static IPv6 address reserved for the VSI
+	IPv6 string `json:"ipv6,omitempty"`
 }
 
 type DataDiskCustomResourceSpec struct {
 	// size of the data disk, defaults to 100GiB
 	Size uint64 `json:"size"`
+	// name of a data disk snapshot resource to restore the disk from, shorthand for a snapshot source
+	Snapshot string `json:"snapshot,omitempty"`
+	// content of a new disk
+	Source *DataDiskSource `json:"source,omitempty"`
 	// name of the storage pool, must exist and must be large enough
 	StoragePool string `json:"storagePool"`
+	// attachment mode, one of exclusive, shareable or readonly, defaults to exclusive
+	Mode string `json:"mode,omitempty"`
+	// what happens to the volume when the resource is deleted, one of Delete or Retain, defaults to Delete
+	ReclaimPolicy string `json:"reclaimPolicy,omitempty"`
+	// name of an existing volume to adopt, e.g. one retained by a deleted data disk, defaults to the UID of the resource
+	VolumeName string `json:"volumeName,omitempty"`
+	// format of a new volume, one of qcow2 or raw, defaults to qcow2
+	Format string `json:"format,omitempty"`
+	// preallocation of a new volume, one of off, metadata or full, defaults to the libvirt default
+	Preallocation string `json:"preallocation,omitempty"`
+	// host cache mode of the attached disk, e.g. none or writeback, defaults to the hypervisor default
+	Cache string `json:"cache,omitempty"`
+	// I/O mode of the attached disk, one of native, threads or io_uring, defaults to the hypervisor default
+	IO string `json:"io,omitempty"`
 	// specification of the associated config maps
 	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
 }
 
+// DataDiskSource names exactly one origin of the content of a new data disk
+type DataDiskSource struct {
+	// name of a data disk resource to copy
+	DataDisk string `json:"dataDisk,omitempty"`
+	// name of a data disk reference resource to copy
+	DataDiskRef string `json:"dataDiskRef,omitempty"`
+	// name of a data disk snapshot resource to restore
+	Snapshot string `json:"snapshot,omitempty"`
+	// URL of an image to seed the disk from, supports the same schemes as the image URL of a VSI
+	URL string `json:"url,omitempty"`
+	// format of the image behind the URL, one of qcow2 or raw, detected from the content by default
+	Format string `json:"format,omitempty"`
+	// consistency handling while VSIs write to the copied volume, one of pause or none, defaults to none
+	Consistency string `json:"consistency,omitempty"`
+}
+
 type DataDiskRefCustomResourceSpec struct {
 	// name of the volume, must exist
 	VolumeName string `json:"volumeName"`
 	// name of the storage pool, must exist and must be large enough
 	StoragePool string `json:"storagePool"`
+	// attachment mode, one of exclusive, shareable or readonly, defaults to exclusive
+	Mode string `json:"mode,omitempty"`
+	// host cache mode of the attached disk, e.g. none or writeback, defaults to the hypervisor default
+	Cache string `json:"cache,omitempty"`
+	// I/O mode of the attached disk, one of native, threads or io_uring, defaults to the hypervisor default
+	IO string `json:"io,omitempty"`
+	// specification of the associated config maps
+	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
+}
+
+type DataDiskSnapshotCustomResourceSpec struct {
+	// name of the data disk resource to take the snapshot of
+	DataDisk string `json:"dataDisk"`
+	// name of the storage pool that receives the snapshot, defaults to the pool of the data disk
+	StoragePool string `json:"storagePool,omitempty"`
+	// consistency handling while the owning VSI is running, one of pause or none, defaults to none
+	Consistency string `json:"consistency,omitempty"`
 	// specification of the associated config maps
 	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
 }
@@ -61,10 +127,79 @@ type DataDiskRefCustomResourceSpec struct {
 type NetworkRefCustomResourceSpec struct {
 	// name of the network, must exist
 	NetworkName string `json:"networkName"`
+	// optional static addresses of the VSI on this network
+	NetworkAddress `json:",inline"`
 	// specification of the associated config maps
 	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
 }
 
+type NetworkCustomResourceSpec struct {
+	// name of the libvirt network, defaults to the name of the resource
+	NetworkName string `json:"networkName,omitempty"`
+	// forward mode of the network, one of nat, route, isolated or bridge, defaults to nat
+	Mode string `json:"mode,omitempty"`
+	// name of the bridge device, must exist on the host in bridge mode
+	Bridge string `json:"bridge,omitempty"`
+	// IP ranges of the network, not supported in bridge mode
+	IPs []*NetworkIPRange `json:"ips,omitempty"`
+	// static DNS entries
+	DNS []*NetworkDNSEntry `json:"dns,omitempty"`
+	// start the network when the host boots
+	Autostart bool `json:"autostart,omitempty"`
+	// specification of the associated config maps
+	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
+}
+
+type NetworkIPRange struct {
+	// address of the host on the network in CIDR notation, e.g. 192.168.100.1/24
+	Address string `json:"address"`
+	// first address of the DHCP range, DHCP is disabled if empty
+	DHCPStart string `json:"dhcpStart,omitempty"`
+	// last address of the DHCP range
+	DHCPEnd string `json:"dhcpEnd,omitempty"`
+}
+
+type NetworkDNSEntry struct {
+	// IP address the hostnames resolve to
+	IP string `json:"ip"`
+	// hostnames of the entry
+	Hostnames []string `json:"hostnames"`
+}
+
+type StoragePoolCustomResourceSpec struct {
+	// name of the libvirt storage pool, defaults to the name of the resource
+	PoolName string `json:"poolName,omitempty"`
+	// type of the pool, one of dir, logical or netfs, defaults to dir
+	Type string `json:"type,omitempty"`
+	// target path of the pool, the directory for dir pools or the mount point for netfs pools
+	Path string `json:"path,omitempty"`
+	// name of the volume group of a logical pool, defaults to the pool name
+	VolumeGroup string `json:"volumeGroup,omitempty"`
+	// physical devices of a logical pool, only required if the volume group does not exist, yet
+	Devices []string `json:"devices,omitempty"`
+	// hostname of the file server of a netfs pool
+	Host string `json:"host,omitempty"`
+	// exported directory of a netfs pool
+	Dir string `json:"dir,omitempty"`
+	// format of a netfs pool, defaults to nfs
+	Format string `json:"format,omitempty"`
+	// start the pool when the host boots
+	Autostart bool `json:"autostart,omitempty"`
+	// refuse the deletion while volumes managed by the operator remain in the pool
+	ProtectVolumes bool `json:"protectVolumes,omitempty"`
+	// specification of the associated config maps
+	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
+}
+
+type ImageCustomResourceSpec struct {
+	// URL to the service that serves the base qcow2 image
+	ImageURL string `json:"imageURL"`
+	// name of the storage pool, must exist and must be large enough
+	StoragePool string `json:"storagePool"`
+	// specification of the associated config maps, one per host
+	TargetSelector *metav1.LabelSelector `json:"targetSelector"`
+}
+
 type DataDiskStatus struct {
 	// description of the data disk status
 	Description string `json:"description"`
@@ -86,6 +221,61 @@ type NetworkRefStatus struct {
 	Status int `json:"status"`
 }
 
+type DataDiskSnapshotStatusMetadata struct {
+	// name of the storage pool that holds the snapshot
+	StoragePool string `json:"storagePool,omitempty"`
+	// name of the snapshot volume
+	VolumeName string `json:"volumeName,omitempty"`
+}
+
+type DataDiskSnapshotStatus struct {
+	// description of the snapshot status
+	Description string `json:"description"`
+	// the status flag
+	Status int `json:"status"`
+	// location of the snapshot
+	Metadata DataDiskSnapshotStatusMetadata `json:"metadata,omitempty"`
+}
+
+type NetworkStatus struct {
+	// description of the network status
+	Description string `json:"description"`
+	// the status flag
+	Status int `json:"status"`
+}
+
+type StoragePoolStatus struct {
+	// description of the storage pool status
+	Description string `json:"description"`
+	// the status flag
+	Status int `json:"status"`
+}
+
+type ImageHostStatus struct {
+	// description of the image status on the host
+	Description string `json:"description"`
+	// the status flag
+	Status int `json:"status"`
+	// name of the storage pool that holds the image
+	StoragePool string `json:"storagePool,omitempty"`
+	// name of the volume that holds the image
+	VolumeName string `json:"volumeName,omitempty"`
+}
+
+type ImageStatusMetadata struct {
+	// status per host, indexed by hostname
+	Hosts map[string]*ImageHostStatus `json:"hosts,omitempty"`
+}
+
+type ImageStatus struct {
+	// description of the image status
+	Description string `json:"description"`
+	// the status flag
+	Status int `json:"status"`
+	// per host details
+	Metadata ImageStatusMetadata `json:"metadata,omitempty"`
+}
+
 type OnPremCustomResource struct {
 	metav1.TypeMeta `json:",inline"`
 	// Standard object's metadata.
@@ -147,6 +337,70 @@ type NetworkRefCustomResource struct {
 	Status NetworkRefStatus `json:"status,omitempty"`
 }
 
+type DataDiskSnapshotCustomResource struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard object's metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// Specification of the desired behavior of the pod.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#spec-and-status
+	// +optional
+	Spec DataDiskSnapshotCustomResourceSpec `json:"spec,omitempty" protobuf:"bytes,2,opt,name=spec"`
+
+	// status of this custom resource
+	Status DataDiskSnapshotStatus `json:"status,omitempty"`
+}
+
+type NetworkCustomResource struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard object's metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// Specification of the desired behavior of the pod.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#spec-and-status
+	// +optional
+	Spec NetworkCustomResourceSpec `json:"spec,omitempty" protobuf:"bytes,2,opt,name=spec"`
+
+	// status of this custom resource
+	Status NetworkStatus `json:"status,omitempty"`
+}
+
+type StoragePoolCustomResource struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard object's metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// Specification of the desired behavior of the pod.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#spec-and-status
+	// +optional
+	Spec StoragePoolCustomResourceSpec `json:"spec,omitempty" protobuf:"bytes,2,opt,name=spec"`
+
+	// status of this custom resource
+	Status StoragePoolStatus `json:"status,omitempty"`
+}
+
+type ImageCustomResource struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard object's metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#metadata
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// Specification of the desired behavior of the pod.
+	// More info: https://git.k8s.io/community/contributors/devel/sig-architecture/api-conventions.md#spec-and-status
+	// +optional
+	Spec ImageCustomResourceSpec `json:"spec,omitempty" protobuf:"bytes,2,opt,name=spec"`
+
+	// status of this custom resource
+	Status ImageStatus `json:"status,omitempty"`
+}
+
 type OnPremCustomResourceOptions struct {
 	// name of the instance, will also be the hostname
 	Name string
@@ -37,19 +37,20 @@ func RemoveDataDisk(client *LivirtClient) func(key string) error {
 }
 
 // CreateDataDisk creates a data disk or resizes an existing one if required
-func CreateDataDisk(client *LivirtClient) func(storagePool, name string, size uint64) (*libvirt.StorageVol, error) {
+func CreateDataDisk(client *LivirtClient) func(opt *DataDiskOptions) (*libvirt.StorageVol, error) {
 	conn := client.LibVirt
 
 	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+	volumeDefXML := getDataDiskVolumeDefXML(conn)
 
-	return func(storagePool, name string, size uint64) (*libvirt.StorageVol, error) {
+	return func(opt *DataDiskOptions) (*libvirt.StorageVol, error) {
 		// check if we already know the disk
-		pool, err := conn.StoragePoolLookupByName(storagePool)
+		pool, err := conn.StoragePoolLookupByName(opt.StoragePool)
 		if err != nil {
 			return nil, err
 		}
 		// check if the volume exists
-		existing, err := conn.StorageVolLookupByName(pool, name)
+		existing, err := conn.StorageVolLookupByName(pool, opt.Name)
 		if err == nil {
 			// check some metadata
 			existingXML, err := storageVolXMLDesc(&existing)
@@ -57,68 +58,109 @@ func CreateDataDisk(client *LivirtClient) func(storagePool, name string, size ui
 				return nil, err
 			}
 			// check if the capacity matches
-			if existingXML.Capacity.Value < size {
-				log.Printf("Resizing storage volume [%s] on pool [%s] from [%d] to [%d] ...", existingXML.Name, pool.Name, existingXML.Capacity.Value, size)
+			if existingXML.Capacity.Value < opt.Size {
+				log.Printf("Resizing storage volume [%s] on pool [%s] from [%d] to [%d] ...", existingXML.Name, pool.Name, existingXML.Capacity.Value, opt.Size)
 				// resize
-				err := conn.StorageVolResize(existing, size, 0)
+				err := conn.StorageVolResize(existing, opt.Size, 0)
 				if err != nil {
 					return nil, err
 				}
 				log.Printf("Successfully resized volume [%s] on pool [%s]", existingXML.Name, pool.Name)
-				return &existing, nil
 			}
+			return &existing, nil
 		}
 		// need to create a new volume
-		volumeDef := createDefaultVolume()
-		volumeDef.Name = name
-		volumeDef.Capacity.Value = size
-
-		volumeDefXML, err := XMLMarshall(volumeDef)
+		volumeXML, flags, err := volumeDefXML(pool, opt.Name, opt.Size, &opt.Layout)
 		if err != nil {
 			return nil, err
 		}
 
 		// create the volume
-		log.Printf("Creating new volume [%s] on pool [%s] with size [%d] ...", volumeDef.Name, pool.Name, size)
-		volume, err := conn.StorageVolCreateXML(pool, string(volumeDefXML), 0)
+		log.Printf("Creating new volume [%s] on pool [%s] with size [%d] ...", opt.Name, pool.Name, opt.Size)
+		volume, err := conn.StorageVolCreateXML(pool, volumeXML, flags)
 		if err != nil {
 			return nil, err
 		}
 
-		log.Printf("Successfully created volume [%s] on pool [%s]", volumeDef.Name, pool.Name)
+		log.Printf("Successfully created volume [%s] on pool [%s]", opt.Name, pool.Name)
 
 		return &volume, nil
 	}
 }
 
-// CreateDataDiskXML creates the XML for the data disk
-func CreateDataDiskXML(client *LivirtClient) func(storagePool, name string, index int) (*libvirtxml.DomainDisk, error) {
-	conn := client.LibVirt
-
-	return func(storagePool, name string, index int) (*libvirtxml.DomainDisk, error) {
+// getVolumePath returns the path to the file or the block device of an existing volume
+func getVolumePath(conn *libvirt.Libvirt) func(storagePool, name string) (string, error) {
+	return func(storagePool, name string) (string, error) {
 		// check if we already know the disk
 		pool, err := conn.StoragePoolLookupByName(storagePool)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		// check if the volume exists
 		existing, err := conn.StorageVolLookupByName(pool, name)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-
 		// get the path to the file
-		path, err := conn.StorageVolGetPath(existing)
+		return conn.StorageVolGetPath(existing)
+	}
+}
+
+// setDataDiskMode marks the disk of a domain as shareable or readonly according to the attachment mode
+func setDataDiskMode(disk *libvirtxml.DomainDisk, mode string) *libvirtxml.DomainDisk {
+	switch BoxDataDiskMode(mode) {
+	case DataDiskModeShareable:
+		disk.Shareable = &libvirtxml.DomainDiskShareable{}
+		// the host cache must not hide the writes of the other VSIs
+		disk.Driver.Cache = "none"
+	case DataDiskModeReadOnly:
+		disk.ReadOnly = &libvirtxml.DomainDiskReadOnly{}
+	}
+	return disk
+}
+
+// getDataDiskMode returns the attachment mode of the disk of a domain
+func getDataDiskMode(disk *libvirtxml.DomainDisk) string {
+	switch {
+	case disk.Shareable != nil:
+		return DataDiskModeShareable
+	case disk.ReadOnly != nil:
+		return DataDiskModeReadOnly
+	}
+	return DataDiskModeExclusive
+}
+
+// CreateDataDiskXML creates the XML for the data disk, block volumes are attached as block devices
+func CreateDataDiskXML(client *LivirtClient) func(disk *AttachedDataDisk, dev string) (*libvirtxml.DomainDisk, error) {
+	conn := client.LibVirt
+	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+
+	return func(disk *AttachedDataDisk, dev string) (*libvirtxml.DomainDisk, error) {
+		pool, err := conn.StoragePoolLookupByName(disk.StoragePool)
 		if err != nil {
 			return nil, err
 		}
+		vol, err := conn.StorageVolLookupByName(pool, disk.Name)
+		if err != nil {
+			return nil, err
+		}
+		volType, _, _, err := conn.StorageVolGetInfo(vol)
+		if err != nil {
+			return nil, err
+		}
+		volXML, err := storageVolXMLDesc(&vol)
+		if err != nil {
+			return nil, err
+		}
+		var format string
+		if volXML.Target != nil && volXML.Target.Format != nil {
+			format = volXML.Target.Format.Type
+		}
+		path := volXML.Target.Path
 
-		// define the bus by index
-		dev := fmt.Sprintf("vd%x", index+13) // use offset 13 so it starts with 'd' for `vdd`
-
-		log.Printf("Defining data disk [%s] on path [%s]", dev, path)
+		log.Printf("Defining data disk [%s] on path [%s] in mode [%s]", dev, path, BoxDataDiskMode(disk.Mode))
 
-		return &libvirtxml.DomainDisk{
+		diskXML := setDataDiskSource(&libvirtxml.DomainDisk{
 			Device: "disk",
 			Target: &libvirtxml.DomainDiskTarget{
 				Dev: dev,
@@ -126,15 +168,11 @@ func CreateDataDiskXML(client *LivirtClient) func(storagePool, name string, inde
 			},
 			Driver: &libvirtxml.DomainDiskDriver{
 				Name:  "qemu",
-				Type:  "qcow2",
 				IOMMU: "on",
 			},
-			Source: &libvirtxml.DomainDiskSource{
-				File: &libvirtxml.DomainDiskSourceFile{
-					File: path,
-				},
-			},
-		}, nil
+		}, libvirt.StorageVolType(volType), path, format)
+
+		return setDataDiskTuning(diskXML, disk), nil
 	}
 }
 
@@ -230,8 +268,17 @@ func GetDataDiskRef(client *LivirtClient) func(opt *DataDiskRefOptions) (*libvir
 // CreateDataDiskSync creates a data disk or resizes an existing one if required
 func CreateDataDiskSync(client *LivirtClient) func(opt *DataDiskOptions) (*libvirt.StorageVol, error) {
 	createDataDisk := CreateDataDisk(client)
+	populateDataDisk := PopulateDataDisk(client)
 	return func(opt *DataDiskOptions) (*libvirt.StorageVol, error) {
-		return createDataDisk(opt.StoragePool, opt.Name, opt.Size)
+		// a new disk starts with the content of its source
+		if opt.Source != nil {
+			err := populateDataDisk(opt.StoragePool, opt.Name, opt.Source, &opt.Layout)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// grows a populated disk to the requested size
+		return createDataDisk(opt)
 	}
 }
 
@@ -291,8 +338,11 @@ func DataDiskRefsFromRelated(data map[string]any) ([]*DataDiskRefCustomResource,
 
 func dataDiskCustomResourceToAttachedDataDisk(res *DataDiskCustomResource) *AttachedDataDisk {
 	return &AttachedDataDisk{
-		StoragePool: res.Spec.StoragePool,
-		Name:        string(res.UID),
+		StoragePool: BoxStoragePool(res.Spec.StoragePool),
+		Name:        GetDataDiskVolumeName(res),
+		Mode:        BoxDataDiskMode(res.Spec.Mode),
+		Cache:       res.Spec.Cache,
+		IO:          res.Spec.IO,
 	}
 }
 
@@ -301,8 +351,11 @@ var DataDiskCustomResourcesToAttachedDataDisks = A.Map(dataDiskCustomResourceToA
 
 func dataDiskRefCustomResourceToAttachedDataDisk(res *DataDiskRefCustomResource) *AttachedDataDisk {
 	return &AttachedDataDisk{
-		StoragePool: res.Spec.StoragePool,
+		StoragePool: BoxStoragePool(res.Spec.StoragePool),
 		Name:        res.Spec.VolumeName,
+		Mode:        BoxDataDiskMode(res.Spec.Mode),
+		Cache:       res.Spec.Cache,
+		IO:          res.Spec.IO,
 	}
 }
 
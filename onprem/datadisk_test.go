@@ -75,7 +75,7 @@ func TestCreateDataDisk(t *testing.T) {
 	expSize := uint64(100 * 1024 * 1024 * 1024)
 
 	// create the data disk
-	dataDisk, err := CreateDataDisk(client)(storagePool, "TestCreateDataDisk", expSize)
+	dataDisk, err := CreateDataDisk(client)(&DataDiskOptions{StoragePool: storagePool, Name: "TestCreateDataDisk", Size: expSize})
 	require.NoError(t, err)
 
 	defer func() {
@@ -0,0 +1,262 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+
+	A "github.com/IBM/fp-go/array"
+	libvirt "github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+)
+
+const (
+	DataDiskFormatQCow2 = "qcow2"
+	DataDiskFormatRaw   = "raw"
+)
+
+var (
+	// leading bytes of every qcow2 image
+	qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+)
+
+// DataDiskSourceOptions describes where the content of a new data disk comes from
+type DataDiskSourceOptions struct {
+	// volume to copy the content from
+	Volume *AttachedDataDisk
+	// image to stream the content from
+	Image ImageSource
+	// format of the image, detected from the content if empty
+	Format string
+	// consistency handling while VSIs write to the source volume
+	Consistency string
+}
+
+// GetSeedVolumeName returns the name of the volume that receives the image before it is converted into the data disk
+func GetSeedVolumeName(name string) string {
+	return fmt.Sprintf("%s.seed", name)
+}
+
+// GetDataDiskSource validates the source of a data disk, the snapshot field of the spec is a shorthand
+// for a snapshot source. Returns nil for an empty disk.
+func GetDataDiskSource(spec *DataDiskCustomResourceSpec) (*DataDiskSource, error) {
+	src := spec.Source
+	if len(spec.Snapshot) > 0 {
+		if src != nil {
+			return nil, fmt.Errorf("a data disk must not specify both a snapshot [%s] and a source", spec.Snapshot)
+		}
+		return &DataDiskSource{Snapshot: spec.Snapshot}, nil
+	}
+	if src == nil {
+		return nil, nil
+	}
+	origins := A.Filter(func(s string) bool {
+		return len(s) > 0
+	})([]string{src.DataDisk, src.DataDiskRef, src.Snapshot, src.URL})
+	if len(origins) != 1 {
+		return nil, fmt.Errorf("the source of a data disk must name exactly one of dataDisk, dataDiskRef, snapshot or url, found %v", origins)
+	}
+	switch src.Format {
+	case "", DataDiskFormatQCow2, DataDiskFormatRaw:
+	default:
+		return nil, fmt.Errorf("unsupported format [%s] of the data disk source, expected one of [%s, %s]", src.Format, DataDiskFormatQCow2, DataDiskFormatRaw)
+	}
+	if len(src.Format) > 0 && len(src.URL) == 0 {
+		return nil, fmt.Errorf("the format [%s] of the data disk source requires a url", src.Format)
+	}
+	return src, nil
+}
+
+// detectImageFormat tells qcow2 images from raw images by their leading bytes
+func detectImageFormat(rdr *bufio.Reader) string {
+	magic, err := rdr.Peek(len(qcow2Magic))
+	if err == nil && bytes.Equal(magic, qcow2Magic) {
+		return DataDiskFormatQCow2
+	}
+	return DataDiskFormatRaw
+}
+
+// uploadSeedVolume streams the image into a seed volume, an interrupted upload is resumed
+func uploadSeedVolume(client *LivirtClient) func(pool libvirt.StoragePool, name string, src ImageSource, format string) (*libvirt.StorageVol, error) {
+	conn := client.LibVirt
+	readProgress := readUploadProgress(conn)
+	writeProgress := writeUploadProgress(conn)
+	uploadInChunks := uploadVolumeInChunks(client)
+	delVolume := deleteStorageVol(conn)
+
+	return func(pool libvirt.StoragePool, name string, src ImageSource, format string) (*libvirt.StorageVol, error) {
+		seedName := GetSeedVolumeName(name)
+		progress := readProgress(pool, seedName)
+		identity := src.Identity()
+		existing, err := conn.StorageVolLookupByName(pool, seedName)
+		if err == nil {
+			// a complete seed of an earlier attempt
+			if progress == nil {
+				return &existing, nil
+			}
+			// resume the upload if the image did not change
+			if canResumeUpload(progress, identity) {
+				rdr, size, err := openImageSource(src, progress.Offset, identity)
+				if err == nil {
+					defer safeClose(rdr)
+					if size == progress.Size {
+						log.Printf("Resuming upload of [%s] to pool [%s] at [%d] of [%d bytes] ...", seedName, pool.Name, progress.Offset, size)
+						err = uploadInChunks(pool, existing, rdr, *progress)
+						if err != nil {
+							return nil, err
+						}
+						return &existing, nil
+					}
+				}
+				log.Printf("Unable to resume the upload of [%s], restarting ...", seedName)
+			}
+		}
+		// start from scratch
+		_, err = delVolume(pool, seedName)
+		if err != nil && !isError(err, libvirt.ErrNoStorageVol) {
+			return nil, err
+		}
+		rdr, size, err := src.Open(0)
+		if err != nil {
+			return nil, err
+		}
+		defer safeClose(rdr)
+		buffered := bufio.NewReader(rdr)
+		if len(format) == 0 {
+			format = detectImageFormat(buffered)
+		}
+
+		volumeDef := createDefaultVolume()
+		volumeDef.Name = seedName
+		volumeDef.Capacity.Unit = "B"
+		volumeDef.Capacity.Value = size
+		volumeDef.Target.Format.Type = format
+
+		volumeDefXML, err := XMLMarshall(volumeDef)
+		if err != nil {
+			return nil, err
+		}
+		volume, err := conn.StorageVolCreateXML(pool, volumeDefXML, 0)
+		if err != nil {
+			return nil, err
+		}
+		// mark the volume as incomplete until the upload succeeds
+		err = writeProgress(pool, seedName, &uploadProgress{Size: size, Source: identity})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Starting upload of [%s] in format [%s] to pool [%s], size=[%d bytes]...", src.String(), format, pool.Name, size)
+		err = uploadInChunks(pool, volume, buffered, uploadProgress{Size: size, Source: identity})
+		if err != nil {
+			return nil, err
+		}
+		return &volume, nil
+	}
+}
+
+// PopulateDataDisk creates a new data disk in the given layout with the content of its source. Images are converted
+// into the format of the layout. An existing disk is never overwritten.
+func PopulateDataDisk(client *LivirtClient) func(storagePool, name string, source *DataDiskSourceOptions, layout *DataDiskLayout) error {
+	conn := client.LibVirt
+	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+	copyVol := copyVolume(conn)
+	clone := cloneVolume(conn)
+	uploadSeed := uploadSeedVolume(client)
+	delVolume := deleteStorageVol(conn)
+
+	return func(storagePool, name string, source *DataDiskSourceOptions, layout *DataDiskLayout) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("PopulateDataDisk(%s)", name))()
+
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.StorageVolLookupByName(pool, name); err == nil {
+			log.Printf("Data disk [%s] exists already on pool [%s], not populating it", name, storagePool)
+			return nil
+		}
+		// copy an existing volume
+		if source.Volume != nil {
+			_, err = copyVol(pool, name, source.Volume, source.Consistency, layout)
+			return err
+		}
+		if source.Image == nil {
+			return fmt.Errorf("the source of data disk [%s] names neither a volume nor an image", name)
+		}
+		// images on the host are copied like volumes
+		if hostSrc, ok := source.Image.(HostImageSource); ok {
+			imageName, err := hostSrc.Name()
+			if err != nil {
+				return err
+			}
+			_, err = copyVol(pool, name, &AttachedDataDisk{Name: imageName, StoragePool: hostSrc.StoragePool()}, source.Consistency, layout)
+			return err
+		}
+		// stream the image, then convert it into the data disk
+		seed, err := uploadSeed(pool, name, source.Image, source.Format)
+		if err != nil {
+			return err
+		}
+		err = refreshPool(conn)(pool)
+		if err != nil {
+			return err
+		}
+		seedXML, err := storageVolXMLDesc(seed)
+		if err != nil {
+			return err
+		}
+		_, err = clone(pool, name, seedXML.Capacity.Value, *seed, layout)
+		if err != nil {
+			return err
+		}
+		// the seed is not needed any more
+		if _, err := delVolume(pool, seed.Name); err != nil {
+			log.Printf("Unable to delete the seed [%s], cause: [%v]", seed.Name, err)
+		}
+		return nil
+	}
+}
+
+// GetDataDiskRefVolume locates the volume of the named data disk reference and makes sure it is ready
+func GetDataDiskRefVolume(dataDiskRefs []*DataDiskRefCustomResource, name string) (*AttachedDataDisk, error) {
+	for _, dataDiskRef := range dataDiskRefs {
+		if dataDiskRef.Name == name {
+			return &AttachedDataDisk{
+				Name:        dataDiskRef.Spec.VolumeName,
+				StoragePool: BoxStoragePool(dataDiskRef.Spec.StoragePool),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("data disk reference [%s] does not exist or is not ready", name)
+}
+
+// GetDataDiskSnapshotVolume locates the volume of the named snapshot and makes sure it is ready
+func GetDataDiskSnapshotVolume(snapshots []*DataDiskSnapshotCustomResource, name string) (*AttachedDataDisk, error) {
+	snapshot, err := GetDataDiskSnapshot(snapshots, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshot.Status.Metadata.VolumeName) == 0 {
+		return nil, fmt.Errorf("snapshot [%s] does not report its volume", name)
+	}
+	return &AttachedDataDisk{
+		Name:        snapshot.Status.Metadata.VolumeName,
+		StoragePool: snapshot.Status.Metadata.StoragePool,
+	}, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetDataDiskSource(t *testing.T) {
+	// an empty disk
+	src, err := GetDataDiskSource(&DataDiskCustomResourceSpec{})
+	require.NoError(t, err)
+	assert.Nil(t, src)
+
+	// the snapshot shorthand
+	src, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Snapshot: "snap"})
+	require.NoError(t, err)
+	assert.Equal(t, "snap", src.Snapshot)
+
+	_, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Snapshot: "snap", Source: &DataDiskSource{DataDisk: "disk"}})
+	assert.Error(t, err)
+
+	src, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Source: &DataDiskSource{URL: "https://example.com/disk.img", Format: DataDiskFormatRaw}})
+	require.NoError(t, err)
+	assert.Equal(t, DataDiskFormatRaw, src.Format)
+
+	// exactly one origin
+	_, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Source: &DataDiskSource{}})
+	assert.Error(t, err)
+	_, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Source: &DataDiskSource{DataDisk: "disk", DataDiskRef: "ref"}})
+	assert.Error(t, err)
+
+	// formats apply to URLs only
+	_, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Source: &DataDiskSource{DataDisk: "disk", Format: DataDiskFormatRaw}})
+	assert.Error(t, err)
+	_, err = GetDataDiskSource(&DataDiskCustomResourceSpec{Source: &DataDiskSource{URL: "https://example.com/disk.vmdk", Format: "vmdk"}})
+	assert.Error(t, err)
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	assert.Equal(t, DataDiskFormatQCow2, detectImageFormat(bufio.NewReader(bytes.NewReader([]byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 3}))))
+	assert.Equal(t, DataDiskFormatRaw, detectImageFormat(bufio.NewReader(bytes.NewReader([]byte("raw content")))))
+	assert.Equal(t, DataDiskFormatRaw, detectImageFormat(bufio.NewReader(bytes.NewReader(nil))))
+}
+
+func TestGetDataDiskSourceVolumes(t *testing.T) {
+	snapshots := []*DataDiskSnapshotCustomResource{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "snap"},
+			Status: DataDiskSnapshotStatus{
+				Status:   int(common.Ready),
+				Metadata: DataDiskSnapshotStatusMetadata{StoragePool: "backups", VolumeName: GetSnapshotVolumeName("uid")},
+			},
+		},
+	}
+	vol, err := GetDataDiskSnapshotVolume(snapshots, "snap")
+	require.NoError(t, err)
+	assert.Equal(t, "backups", vol.StoragePool)
+	assert.Equal(t, "snapshot-uid.qcow2", vol.Name)
+
+	refs := []*DataDiskRefCustomResource{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "ref"},
+			Spec:       DataDiskRefCustomResourceSpec{VolumeName: "prod.qcow2", StoragePool: "prod"},
+		},
+	}
+	vol, err = GetDataDiskRefVolume(refs, "ref")
+	require.NoError(t, err)
+	assert.Equal(t, "prod", vol.StoragePool)
+	assert.Equal(t, "prod.qcow2", vol.Name)
+
+	_, err = GetDataDiskRefVolume(refs, "missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,176 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"sort"
+
+	"github.com/digitalocean/go-libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// namespace of the instance metadata
+	InstanceMetadataNamespace = "https://github.com/ibm-hyper-protect/k8s-operator-hpcr"
+	// prefix of the instance metadata namespace
+	instanceMetadataKey = "hpcr"
+
+	// data disks start after the boot disk (vda), the cloud-init disk (vdb) and a spare device (vdc)
+	firstDataDiskIndex = 3
+)
+
+// InstanceDataDisk records the target device a data disk is attached as
+type InstanceDataDisk struct {
+	Dev  string `xml:"dev,attr"`
+	Pool string `xml:"pool,attr"`
+	Name string `xml:",chardata"`
+}
+
+// getDiskDev returns the name of the virtio device at the given index, i.e. vda ... vdz, vdaa ... vdaz, vdba ...
+func getDiskDev(index int) string {
+	var suffix []byte
+	for n := index + 1; n > 0; n = (n - 1) / 26 {
+		suffix = append([]byte{byte('a' + (n-1)%26)}, suffix...)
+	}
+	return "vd" + string(suffix)
+}
+
+// getDataDiskDev returns the target device of the data disk at the given index
+func getDataDiskDev(index int) string {
+	return getDiskDev(index + firstDataDiskIndex)
+}
+
+// nextFreeDataDiskDev returns the first data disk device that is not in use and marks it as used
+func nextFreeDataDiskDev(used map[string]bool) string {
+	index := 0
+	for used[getDataDiskDev(index)] {
+		index++
+	}
+	dev := getDataDiskDev(index)
+	used[dev] = true
+	return dev
+}
+
+// allocateDataDiskDevs assigns a target device to each data disk. Disks keep the device recorded in the mapping
+// as long as it is not in use, all other disks receive the first free device in the order of their names.
+func allocateDataDiskDevs(mapping []InstanceDataDisk, disks []*AttachedDataDisk, used map[string]bool) []InstanceDataDisk {
+	type diskKey struct{ pool, name string }
+	previous := make(map[diskKey]string)
+	for _, entry := range mapping {
+		previous[diskKey{entry.Pool, entry.Name}] = entry.Dev
+	}
+	var result []InstanceDataDisk
+	for _, disk := range disks {
+		result = append(result, InstanceDataDisk{Pool: disk.StoragePool, Name: disk.Name})
+	}
+	// predictable order
+	result = sortInstanceDataDisks(result)
+	// keep the recorded devices
+	for idx := range result {
+		if dev, ok := previous[diskKey{result[idx].Pool, result[idx].Name}]; ok && !used[dev] {
+			result[idx].Dev = dev
+			used[dev] = true
+		}
+	}
+	// allocate the new devices
+	for idx := range result {
+		if len(result[idx].Dev) == 0 {
+			result[idx].Dev = nextFreeDataDiskDev(used)
+		}
+	}
+	return result
+}
+
+// sortInstanceDataDisks sorts the data disks by name and pool
+func sortInstanceDataDisks(disks []InstanceDataDisk) []InstanceDataDisk {
+	sort.Slice(disks, func(i, j int) bool {
+		if disks[i].Name == disks[j].Name {
+			return disks[i].Pool < disks[j].Pool
+		}
+		return disks[i].Name < disks[j].Name
+	})
+	return disks
+}
+
+// parseInstanceMetadata decodes the metadata the operator attached to a domain
+func parseInstanceMetadata(domainXML *libvirtxml.Domain) (*InstanceMetadata, error) {
+	metadata := InstanceMetadata{}
+	if domainXML.Metadata == nil {
+		return &metadata, nil
+	}
+	err := xml.Unmarshal([]byte(domainXML.Metadata.XML), &metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// getInstanceMetadata returns the metadata of an existing domain
+func getInstanceMetadata(conn *libvirt.Libvirt) func(domain libvirt.Domain) (*InstanceMetadata, error) {
+	return func(domain libvirt.Domain) (*InstanceMetadata, error) {
+		domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return nil, err
+		}
+		domainXML, err := parseDomainXML(domainStrg)
+		if err != nil {
+			return nil, err
+		}
+		return parseInstanceMetadata(domainXML)
+	}
+}
+
+// getInstanceMetadataByName returns the metadata of an existing domain or empty metadata if the domain does not exist
+func getInstanceMetadataByName(conn *libvirt.Libvirt) func(name string) *InstanceMetadata {
+	return func(name string) *InstanceMetadata {
+		domain, err := conn.DomainLookupByName(name)
+		if err != nil {
+			return &InstanceMetadata{}
+		}
+		domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return &InstanceMetadata{}
+		}
+		domainXML, err := parseDomainXML(domainStrg)
+		if err != nil {
+			return &InstanceMetadata{}
+		}
+		metadata, err := parseInstanceMetadata(domainXML)
+		if err != nil {
+			return &InstanceMetadata{}
+		}
+		return metadata
+	}
+}
+
+// setInstanceMetadata replaces the metadata of the persistent definition of a domain and of the domain if it is running
+func setInstanceMetadata(conn *libvirt.Libvirt) func(domain libvirt.Domain, metadata *InstanceMetadata) error {
+	return func(domain libvirt.Domain, metadata *InstanceMetadata) error {
+		metadataXML, err := XMLMarshall(metadata)
+		if err != nil {
+			return err
+		}
+		active, err := conn.DomainIsActive(domain)
+		if err != nil {
+			return err
+		}
+		flags := libvirt.DomainAffectConfig
+		if active != 0 {
+			flags |= libvirt.DomainAffectLive
+		}
+		return conn.DomainSetMetadata(domain, int32(libvirt.DomainMetadataElement), libvirt.OptString{metadataXML}, libvirt.OptString{instanceMetadataKey}, libvirt.OptString{InstanceMetadataNamespace}, flags)
+	}
+}
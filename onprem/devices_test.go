@@ -0,0 +1,94 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestGetDataDiskDev(t *testing.T) {
+	assert.Equal(t, "vda", getDiskDev(0))
+	assert.Equal(t, "vdd", getDataDiskDev(0))
+	assert.Equal(t, "vdg", getDataDiskDev(3))
+	assert.Equal(t, "vdz", getDataDiskDev(22))
+	assert.Equal(t, "vdaa", getDataDiskDev(23))
+	assert.Equal(t, "vdaz", getDataDiskDev(48))
+	assert.Equal(t, "vdba", getDataDiskDev(49))
+}
+
+func TestAllocateDataDiskDevs(t *testing.T) {
+	used := func() map[string]bool {
+		return map[string]bool{bootDiskDev: true, cloudInitDiskDev: true}
+	}
+	disks := []*AttachedDataDisk{
+		{Name: "c", StoragePool: "images"},
+		{Name: "a", StoragePool: "images"},
+		{Name: "b", StoragePool: "images"},
+	}
+	// new disks are allocated in the order of their names, independent of the input order
+	mapping := allocateDataDiskDevs(nil, disks, used())
+	assert.Equal(t, []InstanceDataDisk{
+		{Dev: "vdd", Pool: "images", Name: "a"},
+		{Dev: "vde", Pool: "images", Name: "b"},
+		{Dev: "vdf", Pool: "images", Name: "c"},
+	}, mapping)
+
+	// removing a disk and adding a new one keeps the devices of the others
+	disks = []*AttachedDataDisk{
+		{Name: "c", StoragePool: "images"},
+		{Name: "0", StoragePool: "images"},
+		{Name: "b", StoragePool: "images"},
+	}
+	assert.Equal(t, []InstanceDataDisk{
+		{Dev: "vdd", Pool: "images", Name: "0"},
+		{Dev: "vde", Pool: "images", Name: "b"},
+		{Dev: "vdf", Pool: "images", Name: "c"},
+	}, allocateDataDiskDevs(mapping, disks, used()))
+
+	// many disks produce valid names
+	var many []*AttachedDataDisk
+	for i := 0; i < 30; i++ {
+		many = append(many, &AttachedDataDisk{Name: getDataDiskDev(i), StoragePool: "images"})
+	}
+	devs := make(map[string]bool)
+	for _, entry := range allocateDataDiskDevs(nil, many, used()) {
+		assert.Regexp(t, "^vd[a-z]+$", entry.Dev)
+		devs[entry.Dev] = true
+	}
+	assert.Len(t, devs, 30)
+}
+
+func TestInstanceMetadataRoundtrip(t *testing.T) {
+	metadata := &InstanceMetadata{
+		Hash:      "hash",
+		DataDisks: []InstanceDataDisk{{Dev: "vdd", Pool: "images", Name: "6d997109-6b44-40eb-8d88-8bf7fc90bfb5"}},
+	}
+	metadataXML, err := XMLMarshall(metadata)
+	require.NoError(t, err)
+
+	parsed, err := parseInstanceMetadata(&libvirtxml.Domain{Metadata: &libvirtxml.DomainMetadata{XML: metadataXML}})
+	require.NoError(t, err)
+	assert.Equal(t, metadata.Hash, parsed.Hash)
+	assert.Equal(t, metadata.DataDisks, parsed.DataDisks)
+
+	// domains without metadata
+	parsed, err = parseInstanceMetadata(&libvirtxml.Domain{})
+	require.NoError(t, err)
+	assert.Empty(t, parsed.Hash)
+}
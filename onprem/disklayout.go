@@ -0,0 +1,157 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// only metadata of a qcow2 volume is allocated when it is created
+	DataDiskPreallocationMetadata = "metadata"
+	// the volume is allocated completely when it is created
+	DataDiskPreallocationFull = "full"
+	// the volume is sparse
+	DataDiskPreallocationOff = "off"
+)
+
+// DataDiskLayout describes how the volume of a data disk is stored
+type DataDiskLayout struct {
+	// format of a new volume, one of qcow2 or raw, defaults to qcow2. Volumes on block pools are always raw.
+	Format string
+	// preallocation of a new volume on a file based pool, one of off, metadata or full, the libvirt default if empty
+	Preallocation string
+}
+
+// ValidateDataDiskLayout checks the format and the preallocation of a data disk
+func ValidateDataDiskLayout(layout *DataDiskLayout) error {
+	format := BoxDataDiskFormat(layout.Format)
+	if format != DataDiskFormatQCow2 && format != DataDiskFormatRaw {
+		return fmt.Errorf("unsupported data disk format [%s], must be one of [%s, %s]", format, DataDiskFormatQCow2, DataDiskFormatRaw)
+	}
+	switch layout.Preallocation {
+	case "", DataDiskPreallocationOff, DataDiskPreallocationFull:
+	case DataDiskPreallocationMetadata:
+		if format != DataDiskFormatQCow2 {
+			return fmt.Errorf("preallocation [%s] requires the format [%s]", layout.Preallocation, DataDiskFormatQCow2)
+		}
+	default:
+		return fmt.Errorf("unsupported preallocation [%s], must be one of [%s, %s, %s]", layout.Preallocation, DataDiskPreallocationOff, DataDiskPreallocationMetadata, DataDiskPreallocationFull)
+	}
+	return nil
+}
+
+// isBlockStoragePoolType checks if the volumes of a pool of the given type are block devices
+func isBlockStoragePoolType(poolType string) bool {
+	return poolType == StoragePoolTypeLogical || poolType == StoragePoolTypeDisk
+}
+
+// createDataDiskVolumeDef creates the definition of the volume of a data disk on a pool of the given type
+// and returns the flags required to create it
+func createDataDiskVolumeDef(poolType, name string, size uint64, layout *DataDiskLayout) (*libvirtxml.StorageVolume, libvirt.StorageVolCreateFlags) {
+	volumeDef := createDefaultVolume()
+	volumeDef.Name = name
+	volumeDef.Capacity.Value = size
+
+	// the volumes of block pools are raw devices that are allocated completely
+	if isBlockStoragePoolType(poolType) {
+		volumeDef.Target.Format = nil
+		volumeDef.Target.Permissions = nil
+		return &volumeDef, 0
+	}
+	volumeDef.Target.Format.Type = BoxDataDiskFormat(layout.Format)
+
+	var flags libvirt.StorageVolCreateFlags
+	switch layout.Preallocation {
+	case DataDiskPreallocationOff:
+		volumeDef.Allocation = &libvirtxml.StorageVolumeSize{Unit: "bytes", Value: 0}
+	case DataDiskPreallocationFull:
+		volumeDef.Allocation = &libvirtxml.StorageVolumeSize{Unit: "bytes", Value: size}
+	case DataDiskPreallocationMetadata:
+		flags = libvirt.StorageVolCreatePreallocMetadata
+	}
+	return &volumeDef, flags
+}
+
+// getDataDiskVolumeDefXML creates the definition of the volume of a data disk on the given pool
+func getDataDiskVolumeDefXML(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string, size uint64, layout *DataDiskLayout) (string, libvirt.StorageVolCreateFlags, error) {
+	storagePoolXMLDesc := getStoragePoolXMLDesc(conn)
+
+	return func(pool libvirt.StoragePool, name string, size uint64, layout *DataDiskLayout) (string, libvirt.StorageVolCreateFlags, error) {
+		poolXML, err := storagePoolXMLDesc(pool)
+		if err != nil {
+			return "", 0, err
+		}
+		if isBlockStoragePoolType(poolXML.Type) && BoxDataDiskFormat(layout.Format) != DataDiskFormatRaw {
+			log.Printf("Volume [%s] on the %s pool [%s] is a raw block device", name, poolXML.Type, pool.Name)
+		}
+		volumeDef, flags := createDataDiskVolumeDef(poolXML.Type, name, size, layout)
+		volumeDefXML, err := XMLMarshall(volumeDef)
+		if err != nil {
+			return "", 0, err
+		}
+		return volumeDefXML, flags, nil
+	}
+}
+
+// getDiskSourcePath returns the file or the block device of the disk of a domain
+func getDiskSourcePath(disk *libvirtxml.DomainDisk) string {
+	switch {
+	case disk.Source == nil:
+		return ""
+	case disk.Source.File != nil:
+		return disk.Source.File.File
+	case disk.Source.Block != nil:
+		return disk.Source.Block.Dev
+	}
+	return ""
+}
+
+// setDataDiskSource points the disk of a domain to the volume, block volumes are attached as block devices
+func setDataDiskSource(disk *libvirtxml.DomainDisk, volType libvirt.StorageVolType, path, format string) *libvirtxml.DomainDisk {
+	if volType == libvirt.StorageVolBlock {
+		disk.Source = &libvirtxml.DomainDiskSource{Block: &libvirtxml.DomainDiskSourceBlock{Dev: path}}
+	} else {
+		disk.Source = &libvirtxml.DomainDiskSource{File: &libvirtxml.DomainDiskSourceFile{File: path}}
+	}
+	// anything but qcow2 is passed through as is
+	if format == DataDiskFormatQCow2 {
+		disk.Driver.Type = DataDiskFormatQCow2
+	} else {
+		disk.Driver.Type = DataDiskFormatRaw
+	}
+	return disk
+}
+
+// setDataDiskTuning applies the cache and I/O settings and the attachment mode of a data disk
+func setDataDiskTuning(disk *libvirtxml.DomainDisk, dataDisk *AttachedDataDisk) *libvirtxml.DomainDisk {
+	disk.Driver.Cache = dataDisk.Cache
+	disk.Driver.IO = dataDisk.IO
+	return setDataDiskMode(disk, dataDisk.Mode)
+}
+
+// isDataDiskUpToDate checks if the attached disk of a domain has the tuning and the mode of the data disk
+func isDataDiskUpToDate(existing *libvirtxml.DomainDisk, dataDisk *AttachedDataDisk) bool {
+	expected := setDataDiskTuning(&libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{}}, dataDisk)
+	var cache, io string
+	if existing.Driver != nil {
+		cache, io = existing.Driver.Cache, existing.Driver.IO
+	}
+	return getDataDiskMode(existing) == getDataDiskMode(expected) && cache == expected.Driver.Cache && io == expected.Driver.IO
+}
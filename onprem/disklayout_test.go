@@ -0,0 +1,96 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestValidateDataDiskLayout(t *testing.T) {
+	assert.NoError(t, ValidateDataDiskLayout(&DataDiskLayout{}))
+	assert.NoError(t, ValidateDataDiskLayout(&DataDiskLayout{Format: DataDiskFormatRaw, Preallocation: DataDiskPreallocationFull}))
+	assert.NoError(t, ValidateDataDiskLayout(&DataDiskLayout{Preallocation: DataDiskPreallocationMetadata}))
+
+	assert.Error(t, ValidateDataDiskLayout(&DataDiskLayout{Format: "vmdk"}))
+	assert.Error(t, ValidateDataDiskLayout(&DataDiskLayout{Preallocation: "falloc"}))
+	// metadata preallocation is a qcow2 feature
+	assert.Error(t, ValidateDataDiskLayout(&DataDiskLayout{Format: DataDiskFormatRaw, Preallocation: DataDiskPreallocationMetadata}))
+}
+
+func TestCreateDataDiskVolumeDef(t *testing.T) {
+	size := uint64(1024 * 1024)
+
+	def, flags := createDataDiskVolumeDef(StoragePoolTypeDir, "disk", size, &DataDiskLayout{})
+	assert.Equal(t, DataDiskFormatQCow2, def.Target.Format.Type)
+	assert.Nil(t, def.Allocation)
+	assert.Zero(t, flags)
+
+	def, flags = createDataDiskVolumeDef(StoragePoolTypeDir, "disk", size, &DataDiskLayout{Preallocation: DataDiskPreallocationMetadata})
+	assert.Equal(t, libvirt.StorageVolCreatePreallocMetadata, flags)
+	assert.Nil(t, def.Allocation)
+
+	def, _ = createDataDiskVolumeDef(StoragePoolTypeNetFS, "disk", size, &DataDiskLayout{Format: DataDiskFormatRaw, Preallocation: DataDiskPreallocationFull})
+	assert.Equal(t, DataDiskFormatRaw, def.Target.Format.Type)
+	require.NotNil(t, def.Allocation)
+	assert.Equal(t, size, def.Allocation.Value)
+
+	def, _ = createDataDiskVolumeDef(StoragePoolTypeDir, "disk", size, &DataDiskLayout{Preallocation: DataDiskPreallocationOff})
+	require.NotNil(t, def.Allocation)
+	assert.Zero(t, def.Allocation.Value)
+
+	// logical volumes are raw and allocated completely
+	def, flags = createDataDiskVolumeDef(StoragePoolTypeLogical, "disk", size, &DataDiskLayout{Preallocation: DataDiskPreallocationOff})
+	assert.Nil(t, def.Target.Format)
+	assert.Nil(t, def.Allocation)
+	assert.Zero(t, flags)
+	assert.Equal(t, size, def.Capacity.Value)
+}
+
+func TestSetDataDiskSource(t *testing.T) {
+	disk := setDataDiskSource(&libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{}}, libvirt.StorageVolFile, "/var/lib/libvirt/images/disk", DataDiskFormatQCow2)
+	require.NotNil(t, disk.Source.File)
+	assert.Equal(t, DataDiskFormatQCow2, disk.Driver.Type)
+	assert.Equal(t, "/var/lib/libvirt/images/disk", getDiskSourcePath(disk))
+
+	disk = setDataDiskSource(&libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{}}, libvirt.StorageVolBlock, "/dev/vg/disk", "")
+	require.NotNil(t, disk.Source.Block)
+	assert.Nil(t, disk.Source.File)
+	assert.Equal(t, DataDiskFormatRaw, disk.Driver.Type)
+	assert.Equal(t, "/dev/vg/disk", getDiskSourcePath(disk))
+
+	diskXML, err := XMLMarshall(disk)
+	require.NoError(t, err)
+	assert.Contains(t, diskXML, `type="block"`)
+	assert.Contains(t, diskXML, `<source dev="/dev/vg/disk"`)
+}
+
+func TestIsDataDiskUpToDate(t *testing.T) {
+	tuned := &AttachedDataDisk{Name: "db", StoragePool: "lvm", Cache: "none", IO: "native"}
+
+	disk := setDataDiskTuning(&libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{}}, tuned)
+	assert.True(t, isDataDiskUpToDate(disk, tuned))
+	assert.False(t, isDataDiskUpToDate(disk, &AttachedDataDisk{Name: "db", StoragePool: "lvm"}))
+	assert.False(t, isDataDiskUpToDate(&libvirtxml.DomainDisk{}, tuned))
+	assert.True(t, isDataDiskUpToDate(&libvirtxml.DomainDisk{}, &AttachedDataDisk{Name: "db", StoragePool: "lvm"}))
+
+	// shared disks bypass the host cache
+	shared := setDataDiskTuning(&libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{}}, &AttachedDataDisk{Cache: "writeback", Mode: DataDiskModeShareable})
+	assert.Equal(t, "none", shared.Driver.Cache)
+}
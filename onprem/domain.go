@@ -299,11 +299,30 @@ func GetDomains(client *LivirtClient) func() ([]libvirt.Domain, error) {
 	}
 }
 
+// StartDomain defines a domain and starts it, the domain is started again when the host boots
 func StartDomain(client *LivirtClient) func(*libvirtxml.Domain) (*libvirtxml.Domain, error) {
+	createDomain := createDomain(client)
 
-	conn := client.LibVirt
+	return func(domainXML *libvirtxml.Domain) (*libvirtxml.Domain, error) {
+		return createDomain(domainXML, true)
+	}
+}
+
+// DefineDomain defines a domain without starting it
+func DefineDomain(client *LivirtClient) func(*libvirtxml.Domain) (*libvirtxml.Domain, error) {
+	createDomain := createDomain(client)
 
 	return func(domainXML *libvirtxml.Domain) (*libvirtxml.Domain, error) {
+		return createDomain(domainXML, false)
+	}
+}
+
+// createDomain defines a domain and optionally starts it, only started domains are autostarted
+func createDomain(client *LivirtClient) func(*libvirtxml.Domain, bool) (*libvirtxml.Domain, error) {
+
+	conn := client.LibVirt
+
+	return func(domainXML *libvirtxml.Domain, start bool) (*libvirtxml.Domain, error) {
 		// marshal
 		domainString, err := XMLMarshall(domainXML)
 		if err != nil {
@@ -317,17 +336,19 @@ func StartDomain(client *LivirtClient) func(*libvirtxml.Domain) (*libvirtxml.Dom
 		if err != nil {
 			return nil, err
 		}
-		err = conn.DomainSetAutostart(domain, 1)
+		err = conn.DomainSetAutostart(domain, boolToInt32(start))
 		if err != nil {
 			return nil, err
 		}
 		// get some identifier
 		domainId := uuidToString(domain.UUID)
 		// create the beast
-		log.Printf("Creating domain [%s] with ID [%s]...", domain.Name, domainId)
-		err = conn.DomainCreate(domain)
-		if err != nil {
-			return nil, err
+		if start {
+			log.Printf("Creating domain [%s] with ID [%s]...", domain.Name, domainId)
+			err = conn.DomainCreate(domain)
+			if err != nil {
+				return nil, err
+			}
 		}
 		// read back the domain info
 		log.Printf("Reading domain info for [%s] with ID [%s] ...", domain.Name, domainId)
@@ -0,0 +1,62 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+)
+
+const (
+	// KeyLifecycleEvents enables or disables the subscription to the lifecycle events of the domains on a host
+	KeyLifecycleEvents = "LIFECYCLE_EVENTS"
+
+	// AnnotationLifecycleEvent records the last lifecycle event of the domain of a VSI, touching it triggers a reconcile
+	AnnotationLifecycleEvent = "hpse.ibm.com/lifecycle-event"
+)
+
+// names of the lifecycle events that require a reconcile of the owning resource
+var lifecycleEventNames = map[libvirt.DomainEventType]string{
+	libvirt.DomainEventStopped:   "Stopped",
+	libvirt.DomainEventCrashed:   "Crashed",
+	libvirt.DomainEventUndefined: "Undefined",
+}
+
+// GetLifecycleEventsEnabledFromEnvMap tests if the lifecycle events of a host should be watched, defaults to true
+func GetLifecycleEventsEnabledFromEnvMap(envMap env.Environment) bool {
+	if enabled, ok := envMap[KeyLifecycleEvents]; ok {
+		b, err := strconv.ParseBool(enabled)
+		if err == nil {
+			return b
+		}
+		log.Printf("Ignoring invalid value [%s] for [%s]", enabled, KeyLifecycleEvents)
+	}
+	return true
+}
+
+// GetLifecycleEventName returns the name of a lifecycle event that requires a reconcile, i.e. the domain
+// stopped, crashed or got undefined. The second return value is false for all other events.
+func GetLifecycleEventName(ev *libvirt.DomainEventLifecycleMsg) (string, bool) {
+	name, ok := lifecycleEventNames[libvirt.DomainEventType(ev.Event)]
+	return name, ok
+}
+
+// GetLifecycleEventDomainKeys returns the keys that identify the domain of a lifecycle event, i.e. its name and its UUID
+func GetLifecycleEventDomainKeys(ev *libvirt.DomainEventLifecycleMsg) []string {
+	return []string{ev.Dom.Name, uuidToString(ev.Dom.UUID)}
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLifecycleEventName(t *testing.T) {
+	tests := []struct {
+		event libvirt.DomainEventType
+		name  string
+		ok    bool
+	}{
+		{libvirt.DomainEventStopped, "Stopped", true},
+		{libvirt.DomainEventCrashed, "Crashed", true},
+		{libvirt.DomainEventUndefined, "Undefined", true},
+		{libvirt.DomainEventStarted, "", false},
+		{libvirt.DomainEventShutdown, "", false},
+		{libvirt.DomainEventDefined, "", false},
+	}
+	for _, tc := range tests {
+		name, ok := GetLifecycleEventName(&libvirt.DomainEventLifecycleMsg{Event: int32(tc.event)})
+		assert.Equal(t, tc.ok, ok)
+		assert.Equal(t, tc.name, name)
+	}
+}
+
+func TestGetLifecycleEventDomainKeys(t *testing.T) {
+	id := uuid.New()
+	ev := &libvirt.DomainEventLifecycleMsg{
+		Dom: libvirt.Domain{Name: "sample", UUID: libvirt.UUID(id)},
+	}
+	assert.Equal(t, []string{"sample", id.String()}, GetLifecycleEventDomainKeys(ev))
+}
+
+func TestGetLifecycleEventsEnabledFromEnvMap(t *testing.T) {
+	assert.True(t, GetLifecycleEventsEnabledFromEnvMap(env.Environment{}))
+	assert.False(t, GetLifecycleEventsEnabledFromEnvMap(env.Environment{KeyLifecycleEvents: "false"}))
+	assert.True(t, GetLifecycleEventsEnabledFromEnvMap(env.Environment{KeyLifecycleEvents: "invalid"}))
+}
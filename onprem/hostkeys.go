@@ -0,0 +1,348 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1" // #nosec G505 - required by the hashed host format of OpenSSH
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// KeyHostKeyPolicy selects how hosts without known host keys are treated
+	KeyHostKeyPolicy = "HOST_KEY_POLICY"
+
+	// accept any host key if no known hosts are configured
+	HostKeyPolicyInsecure = "insecure"
+	// refuse to connect to hosts whose key is not contained in the known hosts
+	HostKeyPolicyStrict = "strict"
+	// pin the host key on first use and reject changed keys afterwards
+	HostKeyPolicyTOFU = "tofu"
+
+	// ConditionHostKeyChanged is the condition type reported when a host presents a different key
+	ConditionHostKeyChanged = "HostKeyChanged"
+
+	markerCertAuthority = "cert-authority"
+	markerRevoked       = "revoked"
+	hashedHostPrefix    = "|1|"
+)
+
+// HostKeyStore persists the host keys pinned on first use, the keys are stored as known hosts lines
+type HostKeyStore interface {
+	// LoadHostKey returns the pinned known hosts line of the host or an empty string
+	LoadHostKey(host string) (string, error)
+	// StoreHostKey pins the known hosts line of the host
+	StoreHostKey(host, line string) error
+}
+
+// HostKeyChangedError is returned if a host presents a key that differs from the known or pinned one
+type HostKeyChangedError struct {
+	Host     string
+	Expected []string
+	Actual   string
+}
+
+func (err *HostKeyChangedError) Error() string {
+	return fmt.Sprintf("%s: the host key of [%s] changed, expected [%s] but got [%s]. Update the known hosts if the change is legitimate", ConditionHostKeyChanged, err.Host, strings.Join(err.Expected, ", "), err.Actual)
+}
+
+// ConditionType returns the type of the condition that reports the error
+func (err *HostKeyChangedError) ConditionType() string {
+	return ConditionHostKeyChanged
+}
+
+// memoryHostKeyStore keeps the pinned host keys for the lifetime of the process
+type memoryHostKeyStore struct {
+	keys sync.Map
+}
+
+func (store *memoryHostKeyStore) LoadHostKey(host string) (string, error) {
+	if line, ok := store.keys.Load(host); ok {
+		return line.(string), nil
+	}
+	return "", nil
+}
+
+func (store *memoryHostKeyStore) StoreHostKey(host, line string) error {
+	store.keys.Store(host, line)
+	return nil
+}
+
+// the store for pinned host keys, replaced by a persistent store when running in a cluster
+var hostKeyStore HostKeyStore = &memoryHostKeyStore{}
+
+// SetHostKeyStore replaces the store for pinned host keys, must be called before the first connection
+func SetHostKeyStore(store HostKeyStore) {
+	hostKeyStore = store
+}
+
+// knownHost is a parsed line of a known hosts file
+type knownHost struct {
+	marker   string
+	patterns []string
+	key      ssh.PublicKey
+}
+
+// knownHosts is the in memory representation of a known hosts file
+type knownHosts []*knownHost
+
+// parseKnownHosts parses known hosts lines in memory
+func parseKnownHosts(lines []string) (knownHosts, error) {
+	var result knownHosts
+	rest := []byte(strings.Join(lines, "\n"))
+	for {
+		marker, hosts, key, _, next, err := ssh.ParseKnownHosts(rest)
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the known hosts, cause: [%w]", err)
+		}
+		result = append(result, &knownHost{marker: marker, patterns: hosts, key: key})
+		rest = next
+	}
+}
+
+// matchHostPattern matches a host against an OpenSSH pattern with the wildcards * and ?
+func matchHostPattern(pattern, host string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(host); i >= 0; i-- {
+				if matchHostPattern(pattern[1:], host[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(host) == 0 {
+				return false
+			}
+		default:
+			if len(host) == 0 || pattern[0] != host[0] {
+				return false
+			}
+		}
+		pattern, host = pattern[1:], host[1:]
+	}
+	return len(host) == 0
+}
+
+// matchHashedHost matches a host against a hashed entry of the form |1|salt|hash
+func matchHashedHost(pattern, host string) bool {
+	parts := strings.Split(strings.TrimPrefix(pattern, hashedHostPrefix), "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matches tests if the entry applies to the normalized host, negated patterns take precedence
+func (entry *knownHost) matches(host string) bool {
+	matched := false
+	for _, pattern := range entry.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		var ok bool
+		if strings.HasPrefix(pattern, hashedHostPrefix) {
+			ok = matchHashedHost(pattern, host)
+		} else {
+			ok = matchHostPattern(pattern, host)
+		}
+		if ok && negated {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// check verifies the key of a host. The boolean result is false if the host is not contained in the known hosts,
+// in that case the key has neither been accepted nor rejected.
+func (hosts knownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	host := knownhosts.Normalize(hostname)
+	actual := key.Marshal()
+	var authorities []ssh.PublicKey
+	var expected []string
+	for _, entry := range hosts {
+		if !entry.matches(host) {
+			continue
+		}
+		switch entry.marker {
+		case markerRevoked:
+			if bytes.Equal(entry.key.Marshal(), actual) {
+				return true, fmt.Errorf("the host key [%s] of [%s] has been revoked", ssh.FingerprintSHA256(key), host)
+			}
+		case markerCertAuthority:
+			authorities = append(authorities, entry.key)
+		default:
+			if bytes.Equal(entry.key.Marshal(), actual) {
+				return true, nil
+			}
+			expected = append(expected, ssh.FingerprintSHA256(entry.key))
+		}
+	}
+	if _, ok := key.(*ssh.Certificate); ok && len(authorities) > 0 {
+		checker := &ssh.CertChecker{
+			IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+				for _, authority := range authorities {
+					if bytes.Equal(authority.Marshal(), auth.Marshal()) {
+						return true
+					}
+				}
+				return false
+			},
+		}
+		return true, checker.CheckHostKey(hostname, remote, key)
+	}
+	if len(expected) > 0 {
+		return true, &HostKeyChangedError{Host: host, Expected: expected, Actual: ssh.FingerprintSHA256(key)}
+	}
+	return false, nil
+}
+
+// getHostKeyPolicy returns the validated host key policy of a config
+func getHostKeyPolicy(config *SSHConfig) (string, error) {
+	switch config.HostKeyPolicy {
+	case "":
+		return HostKeyPolicyInsecure, nil
+	case HostKeyPolicyInsecure, HostKeyPolicyStrict, HostKeyPolicyTOFU:
+		return config.HostKeyPolicy, nil
+	default:
+		return "", fmt.Errorf("unsupported host key policy [%s] in [%s], expected one of [%s], [%s] or [%s]", config.HostKeyPolicy, KeyHostKeyPolicy, HostKeyPolicyInsecure, HostKeyPolicyStrict, HostKeyPolicyTOFU)
+	}
+}
+
+// getHostKeyPolicyFromStrictHostKeyChecking maps the OpenSSH StrictHostKeyChecking option to a host key policy
+func getHostKeyPolicyFromStrictHostKeyChecking(value string) string {
+	switch strings.ToLower(value) {
+	case "yes":
+		return HostKeyPolicyStrict
+	case "accept-new":
+		return HostKeyPolicyTOFU
+	case "no", "off":
+		return HostKeyPolicyInsecure
+	default:
+		return ""
+	}
+}
+
+// checkPinnedHostKey verifies the key of a host against the pinned one, the first key is pinned
+func checkPinnedHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	host := knownhosts.Normalize(hostname)
+	line, err := hostKeyStore.LoadHostKey(host)
+	if err != nil {
+		return fmt.Errorf("unable to load the pinned host key of [%s], cause: [%w]", host, err)
+	}
+	if len(line) == 0 {
+		// trust on first use
+		err = hostKeyStore.StoreHostKey(host, knownhosts.Line([]string{host}, key))
+		if err != nil {
+			return fmt.Errorf("unable to pin the host key of [%s], cause: [%w]", host, err)
+		}
+		log.Printf("Pinned host key [%s] of [%s] on first use", ssh.FingerprintSHA256(key), host)
+		return nil
+	}
+	pinned, err := parseKnownHosts([]string{line})
+	if err != nil {
+		return err
+	}
+	found, err := pinned.check(hostname, remote, key)
+	if !found {
+		return fmt.Errorf("the pinned host key [%s] does not apply to [%s]", line, host)
+	}
+	return err
+}
+
+// createHostKeyCallback creates the callback that verifies host keys according to the policy
+func createHostKeyCallback(policy string, hosts knownHosts) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		found, err := hosts.check(hostname, remote, key)
+		if found {
+			return err
+		}
+		if policy == HostKeyPolicyTOFU {
+			return checkPinnedHostKey(hostname, remote, key)
+		}
+		return fmt.Errorf("the host [%s] with key [%s] is not contained in the known hosts, refusing to connect", knownhosts.Normalize(hostname), ssh.FingerprintSHA256(key))
+	}
+}
+
+func getHostKeyCallback(config *SSHConfig) (ssh.HostKeyCallback, error) {
+	policy, err := getHostKeyPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseKnownHosts(config.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	switch policy {
+	case HostKeyPolicyStrict:
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("the host key policy [%s] requires [%s] for host [%s]", HostKeyPolicyStrict, KeyKnownHosts, getHost(config))
+		}
+	case HostKeyPolicyInsecure:
+		// if no keys are configured, fallback to ignore everything
+		if len(hosts) == 0 {
+			return ssh.InsecureIgnoreHostKey(), nil // #nosec G106 ignoring host key on purpose
+		}
+	}
+	return createHostKeyCallback(policy, hosts), nil
+}
+
+// resolvePinnedHostKeys returns a copy of the config with the pinned host keys added to the known hosts,
+// so a separate process that does not have access to the store verifies the same keys
+func resolvePinnedHostKeys(config *SSHConfig) *SSHConfig {
+	resolve := func(hop *SSHConfig) *SSHConfig {
+		result := *hop
+		if hop.HostKeyPolicy != HostKeyPolicyTOFU {
+			return &result
+		}
+		line, err := hostKeyStore.LoadHostKey(knownhosts.Normalize(getHost(hop)))
+		if err == nil && len(line) > 0 {
+			result.KnownHosts = append(append([]string{}, hop.KnownHosts...), line)
+			result.HostKeyPolicy = HostKeyPolicyStrict
+		}
+		return &result
+	}
+	result := resolve(config)
+	result.Jumps = make([]*SSHConfig, len(config.Jumps))
+	for i, hop := range config.Jumps {
+		result.Jumps[i] = resolve(hop)
+	}
+	return result
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestKnownHostsCheck(t *testing.T) {
+	key1, _ := createTestKey(t, "")
+	key2, _ := createTestKey(t, "")
+	key3, _ := createTestKey(t, "")
+
+	hosts, err := parseKnownHosts([]string{
+		"# comment",
+		"",
+		knownhosts.Line([]string{"lpar.example.com"}, key1.PublicKey()),
+		knownhosts.Line([]string{"[lpar.example.com]:2222"}, key2.PublicKey()),
+		knownhosts.HashHostname("hashed.example.com") + " " + string(ssh.MarshalAuthorizedKey(key1.PublicKey())),
+		"*.wild.example.com,!bad.wild.example.com " + string(ssh.MarshalAuthorizedKey(key2.PublicKey())),
+		"@revoked * " + string(ssh.MarshalAuthorizedKey(key3.PublicKey())),
+	})
+	require.NoError(t, err)
+	require.Len(t, hosts, 5)
+
+	tests := []struct {
+		host  string
+		key   ssh.Signer
+		found bool
+		ok    bool
+	}{
+		{"lpar.example.com:22", key1, true, true},
+		{"lpar.example.com:22", key2, true, false},
+		{"lpar.example.com:2222", key2, true, true},
+		{"hashed.example.com:22", key1, true, true},
+		{"a.wild.example.com:22", key2, true, true},
+		{"bad.wild.example.com:22", key2, false, true},
+		{"unknown.example.com:22", key1, false, true},
+		{"unknown.example.com:22", key3, true, false},
+	}
+	for _, tc := range tests {
+		found, err := hosts.check(tc.host, nil, tc.key.PublicKey())
+		assert.Equal(t, tc.found, found, tc.host)
+		assert.Equal(t, tc.ok, err == nil, tc.host)
+	}
+
+	// a changed key is reported as such
+	_, err = hosts.check("lpar.example.com:22", nil, key2.PublicKey())
+	var changed *HostKeyChangedError
+	require.True(t, errors.As(err, &changed))
+	assert.Equal(t, "lpar.example.com", changed.Host)
+	assert.Equal(t, []string{ssh.FingerprintSHA256(key1.PublicKey())}, changed.Expected)
+	assert.Equal(t, ConditionHostKeyChanged, changed.ConditionType())
+}
+
+func TestKnownHostsCertAuthority(t *testing.T) {
+	ca, _ := createTestKey(t, "")
+	hostKey, _ := createTestKey(t, "")
+
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"lpar.example.com"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	hosts, err := parseKnownHosts([]string{"@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))})
+	require.NoError(t, err)
+
+	found, err := hosts.check("lpar.example.com:22", nil, cert)
+	assert.True(t, found)
+	assert.NoError(t, err)
+
+	found, err = hosts.check("other.example.com:22", nil, cert)
+	assert.True(t, found)
+	assert.Error(t, err)
+}
+
+func TestHostKeyPolicies(t *testing.T) {
+	key, _ := createTestKey(t, "")
+
+	cb, err := getHostKeyCallback(&SSHConfig{Hostname: "lpar"})
+	require.NoError(t, err)
+	assert.NoError(t, cb("lpar:22", nil, key.PublicKey()))
+
+	_, err = getHostKeyCallback(&SSHConfig{Hostname: "lpar", HostKeyPolicy: HostKeyPolicyStrict})
+	assert.ErrorContains(t, err, KeyKnownHosts)
+
+	cb, err = getHostKeyCallback(&SSHConfig{
+		Hostname:      "lpar",
+		HostKeyPolicy: HostKeyPolicyStrict,
+		KnownHosts:    []string{knownhosts.Line([]string{"other"}, key.PublicKey())},
+	})
+	require.NoError(t, err)
+	assert.Error(t, cb("lpar:22", nil, key.PublicKey()))
+	assert.NoError(t, cb("other:22", nil, key.PublicKey()))
+
+	_, err = getHostKeyCallback(&SSHConfig{Hostname: "lpar", HostKeyPolicy: "invalid"})
+	assert.Error(t, err)
+}
+
+func TestHostKeyTrustOnFirstUse(t *testing.T) {
+	store := &memoryHostKeyStore{}
+	defer SetHostKeyStore(hostKeyStore)
+	SetHostKeyStore(store)
+
+	key1, _ := createTestKey(t, "")
+	key2, _ := createTestKey(t, "")
+
+	config := &SSHConfig{Hostname: "lpar", Port: 2222, HostKeyPolicy: HostKeyPolicyTOFU}
+	cb, err := getHostKeyCallback(config)
+	require.NoError(t, err)
+
+	// the first key is pinned
+	require.NoError(t, cb("lpar:2222", nil, key1.PublicKey()))
+	line, err := store.LoadHostKey("[lpar]:2222")
+	require.NoError(t, err)
+	assert.Equal(t, knownhosts.Line([]string{"[lpar]:2222"}, key1.PublicKey()), line)
+
+	assert.NoError(t, cb("lpar:2222", nil, key1.PublicKey()))
+
+	var changed *HostKeyChangedError
+	assert.True(t, errors.As(cb("lpar:2222", nil, key2.PublicKey()), &changed))
+
+	// a separate process verifies the pinned key strictly
+	resolved := resolvePinnedHostKeys(config)
+	assert.Equal(t, HostKeyPolicyStrict, resolved.HostKeyPolicy)
+	assert.Equal(t, []string{line}, resolved.KnownHosts)
+	assert.Equal(t, HostKeyPolicyTOFU, config.HostKeyPolicy)
+	assert.Empty(t, config.KnownHosts)
+}
+
+func TestGetHostKeyPolicyFromStrictHostKeyChecking(t *testing.T) {
+	assert.Equal(t, HostKeyPolicyStrict, getHostKeyPolicyFromStrictHostKeyChecking("yes"))
+	assert.Equal(t, HostKeyPolicyTOFU, getHostKeyPolicyFromStrictHostKeyChecking("accept-new"))
+	assert.Equal(t, HostKeyPolicyInsecure, getHostKeyPolicyFromStrictHostKeyChecking("no"))
+	assert.Equal(t, "", getHostKeyPolicyFromStrictHostKeyChecking("ask"))
+}
@@ -0,0 +1,200 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+
+	"github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// target device of the boot disk
+	bootDiskDev = "vda"
+	// target device of the cloud-init disk
+	cloudInitDiskDev = "vdb"
+
+	// attachments change the running domain and its persistent definition
+	deviceModifyFlags = uint32(libvirt.DomainDeviceModifyLive | libvirt.DomainDeviceModifyConfig)
+)
+
+// dataDiskAttachment is a data disk that needs to be attached as the given device
+type dataDiskAttachment struct {
+	Disk *AttachedDataDisk
+	Path string
+	Dev  string
+}
+
+// isDataDisk checks if a disk of a domain is a data disk, i.e. neither the boot disk nor the cloud-init disk
+func isDataDisk(disk *libvirtxml.DomainDisk) bool {
+	if disk.Device != "disk" || disk.Target == nil || len(getDiskSourcePath(disk)) == 0 {
+		return false
+	}
+	return disk.Target.Dev != bootDiskDev && disk.Target.Dev != cloudInitDiskDev
+}
+
+// getDomainDataDisks returns the data disks of a domain keyed by the path of their file or block device
+func getDomainDataDisks(domainXML *libvirtxml.Domain) map[string]libvirtxml.DomainDisk {
+	result := make(map[string]libvirtxml.DomainDisk)
+	if domainXML.Devices == nil {
+		return result
+	}
+	for _, disk := range domainXML.Devices.Disks {
+		if isDataDisk(&disk) {
+			result[getDiskSourcePath(&disk)] = disk
+		}
+	}
+	return result
+}
+
+// getUsedDevs returns the target devices used by the disks of a domain
+func getUsedDevs(domainXML *libvirtxml.Domain) map[string]bool {
+	result := make(map[string]bool)
+	if domainXML.Devices == nil {
+		return result
+	}
+	for _, disk := range domainXML.Devices.Disks {
+		if disk.Target != nil {
+			result[disk.Target.Dev] = true
+		}
+	}
+	return result
+}
+
+// planDataDiskAttachments compares the data disks of a domain with the desired disks keyed by the path of their volume.
+// Returns the disks to detach, the disks to attach and the resulting mapping of the data disks to their devices.
+func planDataDiskAttachments(domainXML *libvirtxml.Domain, mapping []InstanceDataDisk, desired map[string]*AttachedDataDisk) ([]libvirtxml.DomainDisk, []*dataDiskAttachment, []InstanceDataDisk) {
+	existing := getDomainDataDisks(domainXML)
+	used := getUsedDevs(domainXML)
+	// detach the disks that are not desired any more and the ones that change their mode or tuning
+	var detach []libvirtxml.DomainDisk
+	for path, disk := range existing {
+		if desiredDisk, ok := desired[path]; !ok || !isDataDiskUpToDate(&disk, desiredDisk) {
+			detach = append(detach, disk)
+			delete(used, disk.Target.Dev)
+			delete(existing, path)
+		}
+	}
+	sort.Slice(detach, func(i, j int) bool {
+		return detach[i].Target.Dev < detach[j].Target.Dev
+	})
+	// attached disks keep their device, the missing ones get a device
+	var result []InstanceDataDisk
+	var missing []*AttachedDataDisk
+	paths := make(map[*AttachedDataDisk]string)
+	for path, disk := range desired {
+		if existingDisk, ok := existing[path]; ok {
+			result = append(result, InstanceDataDisk{Dev: existingDisk.Target.Dev, Pool: disk.StoragePool, Name: disk.Name})
+		} else {
+			missing = append(missing, disk)
+			paths[disk] = path
+		}
+	}
+	allocated := allocateDataDiskDevs(mapping, missing, used)
+	var attach []*dataDiskAttachment
+	for _, entry := range allocated {
+		disk := findAttachedDataDisk(missing, entry.Pool, entry.Name)
+		attach = append(attach, &dataDiskAttachment{Disk: disk, Path: paths[disk], Dev: entry.Dev})
+	}
+	return detach, attach, sortInstanceDataDisks(append(result, allocated...))
+}
+
+// findAttachedDataDisk locates a data disk by pool and name
+func findAttachedDataDisk(disks []*AttachedDataDisk, pool, name string) *AttachedDataDisk {
+	for _, disk := range disks {
+		if disk.StoragePool == pool && disk.Name == name {
+			return disk
+		}
+	}
+	return nil
+}
+
+// SyncDataDiskAttachments attaches and detaches data disks on a running domain, so that exactly the given disks are attached.
+// The changes are persisted in the domain definition. Returns the updated domain.
+func SyncDataDiskAttachments(client *LivirtClient) func(domainXML *libvirtxml.Domain, disks []*AttachedDataDisk) (*libvirtxml.Domain, error) {
+	conn := client.LibVirt
+	volumePath := getVolumePath(conn)
+	createDataDiskXML := CreateDataDiskXML(client)
+	setMetadata := setInstanceMetadata(conn)
+
+	return func(domainXML *libvirtxml.Domain, disks []*AttachedDataDisk) (*libvirtxml.Domain, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("SyncDataDiskAttachments(%s)", domainXML.Name))()
+		// resolve the files of the desired disks
+		desired := make(map[string]*AttachedDataDisk)
+		for _, disk := range disks {
+			path, err := volumePath(disk.StoragePool, disk.Name)
+			if err != nil {
+				return nil, err
+			}
+			desired[path] = disk
+		}
+		metadata, err := parseInstanceMetadata(domainXML)
+		if err != nil {
+			return nil, err
+		}
+		detach, attach, mapping := planDataDiskAttachments(domainXML, metadata.DataDisks, desired)
+		if len(detach) == 0 && len(attach) == 0 && slices.Equal(mapping, metadata.DataDisks) {
+			return domainXML, nil
+		}
+		domain, err := conn.DomainLookupByName(domainXML.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, disk := range detach {
+			diskXML, err := XMLMarshall(disk)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Detaching data disk [%s] on path [%s] from domain [%s] ...", disk.Target.Dev, getDiskSourcePath(&disk), domainXML.Name)
+			err = conn.DomainDetachDeviceFlags(domain, diskXML, deviceModifyFlags)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, attachment := range attach {
+			disk, err := createDataDiskXML(attachment.Disk, attachment.Dev)
+			if err != nil {
+				return nil, err
+			}
+			diskXML, err := XMLMarshall(disk)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Attaching data disk [%s] on path [%s] to domain [%s] ...", disk.Target.Dev, attachment.Path, domainXML.Name)
+			err = conn.DomainAttachDeviceFlags(domain, diskXML, deviceModifyFlags)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// remember the devices, so they survive a recreate
+		metadata.DataDisks = mapping
+		err = setMetadata(domain, metadata)
+		if err != nil {
+			return nil, err
+		}
+		// refresh the description
+		domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return nil, err
+		}
+		return parseDomainXML(domainStrg)
+	}
+}
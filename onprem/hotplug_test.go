@@ -0,0 +1,150 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+)
+
+const testHotplugDomainXML = `<domain type="kvm">
+  <name>vsi</name>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/boot-vsi.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/cidata-vsi.iso"/>
+      <target dev="vdb" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/first"/>
+      <target dev="vdd" bus="virtio"/>
+    </disk>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/second"/>
+      <target dev="vde" bus="virtio"/>
+    </disk>
+  </devices>
+</domain>`
+
+func TestPlanDataDiskAttachments(t *testing.T) {
+	domainXML, err := parseDomainXML(testHotplugDomainXML)
+	require.NoError(t, err)
+
+	first := &AttachedDataDisk{Name: "first", StoragePool: "images"}
+	second := &AttachedDataDisk{Name: "second", StoragePool: "images"}
+	third := &AttachedDataDisk{Name: "third", StoragePool: "images"}
+
+	// nothing to do
+	detach, attach, mapping := planDataDiskAttachments(domainXML, nil, map[string]*AttachedDataDisk{
+		"/var/lib/libvirt/images/first":  first,
+		"/var/lib/libvirt/images/second": second,
+	})
+	assert.Empty(t, detach)
+	assert.Empty(t, attach)
+	assert.Equal(t, []InstanceDataDisk{
+		{Dev: "vdd", Pool: "images", Name: "first"},
+		{Dev: "vde", Pool: "images", Name: "second"},
+	}, mapping)
+
+	// replace the second disk by a third one, it reuses the free device
+	detach, attach, mapping = planDataDiskAttachments(domainXML, mapping, map[string]*AttachedDataDisk{
+		"/var/lib/libvirt/images/first": first,
+		"/var/lib/libvirt/images/third": third,
+	})
+	require.Len(t, detach, 1)
+	assert.Equal(t, "vde", detach[0].Target.Dev)
+	require.Len(t, attach, 1)
+	assert.Equal(t, third, attach[0].Disk)
+	assert.Equal(t, "/var/lib/libvirt/images/third", attach[0].Path)
+	assert.Equal(t, "vde", attach[0].Dev)
+	assert.Equal(t, []InstanceDataDisk{
+		{Dev: "vdd", Pool: "images", Name: "first"},
+		{Dev: "vde", Pool: "images", Name: "third"},
+	}, mapping)
+
+	// the boot and cloud-init disks are never detached
+	detach, attach, mapping = planDataDiskAttachments(domainXML, mapping, map[string]*AttachedDataDisk{})
+	assert.Len(t, detach, 2)
+	assert.Empty(t, attach)
+	assert.Empty(t, mapping)
+}
+
+func TestPlanDataDiskModeChange(t *testing.T) {
+	domainXML, err := parseDomainXML(testHotplugDomainXML)
+	require.NoError(t, err)
+
+	first := &AttachedDataDisk{Name: "first", StoragePool: "images"}
+	second := &AttachedDataDisk{Name: "second", StoragePool: "images", Mode: DataDiskModeReadOnly}
+	mapping := []InstanceDataDisk{
+		{Dev: "vdd", Pool: "images", Name: "first"},
+		{Dev: "vde", Pool: "images", Name: "second"},
+	}
+
+	// the disk is re-attached on its device
+	detach, attach, result := planDataDiskAttachments(domainXML, mapping, map[string]*AttachedDataDisk{
+		"/var/lib/libvirt/images/first":  first,
+		"/var/lib/libvirt/images/second": second,
+	})
+	require.Len(t, detach, 1)
+	assert.Equal(t, "vde", detach[0].Target.Dev)
+	require.Len(t, attach, 1)
+	assert.Equal(t, second, attach[0].Disk)
+	assert.Equal(t, "vde", attach[0].Dev)
+	assert.Equal(t, mapping, result)
+}
+
+func TestSetDataDiskMode(t *testing.T) {
+	for _, mode := range []string{"", DataDiskModeExclusive, DataDiskModeShareable, DataDiskModeReadOnly} {
+		disk := setDataDiskMode(&libvirtxml.DomainDisk{Driver: &libvirtxml.DomainDiskDriver{}}, mode)
+		assert.Equal(t, BoxDataDiskMode(mode), getDataDiskMode(disk))
+	}
+}
+
+func TestGetDomainBlockDataDisks(t *testing.T) {
+	domainXML, err := parseDomainXML(`<domain type="kvm">
+  <name>vsi</name>
+  <devices>
+    <disk type="file" device="disk">
+      <source file="/var/lib/libvirt/images/boot-vsi.qcow2"/>
+      <target dev="vda" bus="virtio"/>
+    </disk>
+    <disk type="block" device="disk">
+      <driver name="qemu" type="raw" cache="none" io="native"/>
+      <source dev="/dev/vg/db"/>
+      <target dev="vdd" bus="virtio"/>
+    </disk>
+  </devices>
+</domain>`)
+	require.NoError(t, err)
+
+	disks := getDomainDataDisks(domainXML)
+	require.Contains(t, disks, "/dev/vg/db")
+
+	// the tuning is part of the attachment
+	db := &AttachedDataDisk{Name: "db", StoragePool: "lvm", Cache: "none", IO: "native"}
+	detach, attach, _ := planDataDiskAttachments(domainXML, nil, map[string]*AttachedDataDisk{"/dev/vg/db": db})
+	assert.Empty(t, detach)
+	assert.Empty(t, attach)
+
+	detach, attach, _ = planDataDiskAttachments(domainXML, nil, map[string]*AttachedDataDisk{"/dev/vg/db": {Name: "db", StoragePool: "lvm", Cache: "writeback"}})
+	assert.Len(t, detach, 1)
+	assert.Len(t, attach, 1)
+}
@@ -0,0 +1,359 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// severities of HPL messages
+	HPLSeverityInfo    = "info"
+	HPLSeverityWarning = "warning"
+	HPLSeverityError   = "error"
+
+	// boot stages in the order they are reached
+	BootStageBootloader           = "bootloader"
+	BootStageRootDisk             = "rootDisk"
+	BootStageContractDecryption   = "contractDecryption"
+	BootStageAttestation          = "attestation"
+	BootStageBootloaderEnd        = "bootloaderEnd"
+	BootStageNetworkCheck         = "networkCheck"
+	BootStageLoggingConfiguration = "loggingConfiguration"
+	BootStageStarted              = "started"
+
+	// reasons of a failed start
+	BootFailureContractDecryption   = "ContractDecryptionFailed"
+	BootFailureAttestation          = "AttestationFailed"
+	BootFailureImagePull            = "ImagePullFailed"
+	BootFailureLoggingConfiguration = "LoggingConfigurationFailed"
+	BootFailureNetworkCheck         = "NetworkCheckFailed"
+	BootFailureServices             = "ServicesFailed"
+	BootFailureUnknown              = "Unknown"
+)
+
+// HPLMessage describes a message code of the HPCR console log
+type HPLMessage struct {
+	// the message code, e.g. HPL10001I
+	Code string `json:"code"`
+	// the component that issues the message
+	Component string `json:"component"`
+	// one of info, warning or error
+	Severity string `json:"severity"`
+	// what the message means
+	Meaning string `json:"meaning"`
+}
+
+// BootFailure is the classified reason of a failed start of a VSI
+type BootFailure struct {
+	// the classified reason, e.g. ContractDecryptionFailed
+	Reason string `json:"reason"`
+	// the code of the message that caused the classification
+	Code string `json:"code,omitempty"`
+	// the component that reported the failure
+	Component string `json:"component,omitempty"`
+	// the log line that reported the failure
+	Message string `json:"message"`
+	// hint how to resolve the failure
+	Remediation string `json:"remediation"`
+}
+
+func (f *BootFailure) String() string {
+	return fmt.Sprintf("%s: %s. %s", f.Reason, f.Message, f.Remediation)
+}
+
+// BootReport summarizes the console log of a VSI
+type BootReport struct {
+	// the boot stages that have been reached, in boot order
+	Stages []string `json:"stages"`
+	// the messages of the log that are known to the catalog
+	Messages []*HPLMessage `json:"messages,omitempty"`
+	// the reason of a failed start, nil if no error has been reported
+	Failure *BootFailure `json:"failure,omitempty"`
+}
+
+// bootStage detects that a stage has been reached by a line of the console log
+type bootStage struct {
+	name    string
+	pattern *regexp.Regexp
+	// optional expression that indicates that the stage has completed
+	done *regexp.Regexp
+}
+
+// bootFailureClass maps failures to a reason and a remediation
+type bootFailureClass struct {
+	reason      string
+	remediation string
+	// codes of the error messages that belong to the class
+	codes []string
+	// components whose errors belong to the class
+	components []string
+	// the text of error messages that belong to the class
+	pattern *regexp.Regexp
+	// the stage that is reached but not left when the class fails
+	stage string
+}
+
+var (
+	// expression to match an HPL message, captures the code, the component number, the severity and the text
+	reHPLMessage = regexp.MustCompile(`(HPL(\d{2})\d*([IWE])):?\s*(.*)$`)
+
+	// components by the first two digits of the message number
+	hplComponents = map[string]string{
+		"01": "logging",
+		"10": "service-monitor",
+		"11": "bootloader",
+		"12": "container",
+		"14": "network",
+	}
+
+	// catalog of the known message codes
+	hplCatalog = map[string]*HPLMessage{
+		// logging
+		"HPL01001E": {Code: "HPL01001E", Component: "logging", Severity: HPLSeverityError, Meaning: "The contract does not configure a logging endpoint"},
+		"HPL01002E": {Code: "HPL01002E", Component: "logging", Severity: HPLSeverityError, Meaning: "The logging probe could not be sent to the logging endpoint"},
+		"HPL01003E": {Code: "HPL01003E", Component: "logging", Severity: HPLSeverityError, Meaning: "The logging section of the contract is invalid"},
+		"HPL01004E": {Code: "HPL01004E", Component: "logging", Severity: HPLSeverityError, Meaning: "The TLS connection to the logging endpoint could not be established"},
+		"HPL01010I": {Code: "HPL01010I", Component: "logging", Severity: HPLSeverityInfo, Meaning: "Logging has been set up as configured in the contract"},
+		// service monitor
+		"HPL10000E": {Code: "HPL10000E", Component: "service-monitor", Severity: HPLSeverityError, Meaning: "One or more services failed, the VSI shuts down"},
+		"HPL10001I": {Code: "HPL10001I", Component: "service-monitor", Severity: HPLSeverityInfo, Meaning: "All services started, the VSI is up"},
+		// bootloader
+		"HPL11001E": {Code: "HPL11001E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The contract could not be read from the user data of the VSI"},
+		"HPL11002E": {Code: "HPL11002E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The contract is malformed or misses a mandatory section"},
+		"HPL11003E": {Code: "HPL11003E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The signature of the contract could not be verified"},
+		"HPL11004E": {Code: "HPL11004E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The contract has expired"},
+		"HPL11005E": {Code: "HPL11005E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "A section of the contract could not be decrypted with the key of the image"},
+		"HPL11006E": {Code: "HPL11006E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The attestation record could not be created"},
+		"HPL11007E": {Code: "HPL11007E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The attestation record could not be encrypted with the attestation public key of the contract"},
+		"HPL11008E": {Code: "HPL11008E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The measurement of the boot image does not match the expected value"},
+		"HPL11099I": {Code: "HPL11099I", Component: "bootloader", Severity: HPLSeverityInfo, Meaning: "The bootloader has decrypted the contract, attested and set up the root disk"},
+		"HPL11999E": {Code: "HPL11999E", Component: "bootloader", Severity: HPLSeverityError, Meaning: "The bootloader failed unexpectedly"},
+		// container runtime
+		"HPL12001E": {Code: "HPL12001E", Component: "container", Severity: HPLSeverityError, Meaning: "The registry rejected the credentials of the auths section of the contract"},
+		"HPL12002E": {Code: "HPL12002E", Component: "container", Severity: HPLSeverityError, Meaning: "An image of the workload could not be pulled from its registry"},
+		"HPL12003E": {Code: "HPL12003E", Component: "container", Severity: HPLSeverityError, Meaning: "The digest of a pulled image does not match the reference in the contract"},
+		"HPL12004E": {Code: "HPL12004E", Component: "container", Severity: HPLSeverityError, Meaning: "The signature of a pulled image could not be verified"},
+		// network
+		"HPL14000I": {Code: "HPL14000I", Component: "network", Severity: HPLSeverityInfo, Meaning: "The network connectivity check succeeded"},
+		"HPL14001E": {Code: "HPL14001E", Component: "network", Severity: HPLSeverityError, Meaning: "A hostname could not be resolved"},
+		"HPL14002E": {Code: "HPL14002E", Component: "network", Severity: HPLSeverityError, Meaning: "An endpoint required by the contract is not reachable"},
+		"HPL14003E": {Code: "HPL14003E", Component: "network", Severity: HPLSeverityError, Meaning: "No network interface received an address"},
+	}
+
+	// boot stages in boot order
+	bootStages = []*bootStage{
+		{name: BootStageBootloader, pattern: regexp.MustCompile(`# HPL11 build`)},
+		{name: BootStageRootDisk, pattern: regexp.MustCompile(`# (create new root partition|encrypt root partition|create root filesystem|write OS to root disk)`)},
+		{name: BootStageContractDecryption, pattern: regexp.MustCompile(`# decrypt user-data`)},
+		{name: BootStageAttestation, pattern: regexp.MustCompile(`# run attestation`)},
+		{name: BootStageBootloaderEnd, pattern: regexp.MustCompile(`HPL11099I`)},
+		{name: BootStageNetworkCheck, pattern: regexp.MustCompile(`HPL14\d+[IWE]|hpcr-dnslookup`), done: regexp.MustCompile(`HPL14000I`)},
+		{name: BootStageLoggingConfiguration, pattern: regexp.MustCompile(`HPL01\d+[IWE]|hpcr-logging`), done: regexp.MustCompile(`HPL01010I`)},
+		{name: BootStageStarted, pattern: reStartedSuccessfully},
+	}
+
+	// failure classes, a class that lists the code of a message wins over a class of its component, which wins over
+	// the first class that matches its text
+	bootFailureClasses = []*bootFailureClass{
+		{
+			reason:      BootFailureContractDecryption,
+			remediation: "Encrypt the workload and env sections of the contract with the encryption certificate of the HPCR image version the VSI boots, and check the signature of the contract",
+			codes:       []string{"HPL11001E", "HPL11002E", "HPL11003E", "HPL11004E", "HPL11005E"},
+			pattern:     regexp.MustCompile(`(?i)(decrypt|user-data|contract)`),
+			stage:       BootStageContractDecryption,
+		},
+		{
+			reason:      BootFailureAttestation,
+			remediation: "Verify that the VSI boots an unmodified HPCR image and that the attestation public key in the contract is valid",
+			codes:       []string{"HPL11006E", "HPL11007E", "HPL11008E"},
+			pattern:     regexp.MustCompile(`(?i)attest`),
+			stage:       BootStageAttestation,
+		},
+		{
+			reason:      BootFailureImagePull,
+			remediation: "Check the image references and digests of the workload, the registry credentials in the auths section of the contract and that the registry is reachable from the VSI",
+			codes:       []string{"HPL12001E", "HPL12002E", "HPL12003E", "HPL12004E"},
+			pattern:     regexp.MustCompile(`(?i)(pull|registry|manifest unknown|unauthorized)`),
+		},
+		{
+			reason:      BootFailureLoggingConfiguration,
+			remediation: "Check the hostname, the port and the ingestion key of the logging section of the contract and that the logging endpoint is reachable from the VSI",
+			codes:       []string{"HPL01001E", "HPL01002E", "HPL01003E", "HPL01004E"},
+			components:  []string{"01"},
+			pattern:     regexp.MustCompile(`(?i)logging`),
+			stage:       BootStageLoggingConfiguration,
+		},
+		{
+			reason:      BootFailureNetworkCheck,
+			remediation: "Check the networks of the VSI, the DHCP or static addresses, the DNS servers and the default route",
+			codes:       []string{"HPL14001E", "HPL14002E", "HPL14003E"},
+			components:  []string{"14"},
+			pattern:     regexp.MustCompile(`(?i)(network|dns)`),
+			stage:       BootStageNetworkCheck,
+		},
+	}
+
+	// the failure of services in general, reported in addition to the specific failure
+	bootFailureServices = &bootFailureClass{
+		reason:      BootFailureServices,
+		remediation: "Check the preceding messages of the console log for the service that failed",
+		components:  []string{"10"},
+	}
+)
+
+// GetHPLMessage returns the catalog entry of a message code or nil if the code is not known
+func GetHPLMessage(code string) *HPLMessage {
+	return hplCatalog[code]
+}
+
+// matches checks if an error message belongs to the failure class
+func (cls *bootFailureClass) matches(component, text string) bool {
+	return cls.matchesComponent(component) || cls.matchesText(text)
+}
+
+// matchesCode checks if the error message with the code belongs to the failure class
+func (cls *bootFailureClass) matchesCode(code string) bool {
+	return slices.Contains(cls.codes, code)
+}
+
+// matchesComponent checks if an error message of the component belongs to the failure class
+func (cls *bootFailureClass) matchesComponent(component string) bool {
+	return slices.Contains(cls.components, component)
+}
+
+// matchesText checks if the text of an error message belongs to the failure class
+func (cls *bootFailureClass) matchesText(text string) bool {
+	return cls.pattern != nil && cls.pattern.MatchString(text)
+}
+
+// findBootFailureClass returns the failure class of an error message. The code of a message is most reliable, then
+// its component, e.g. a logging error may mention the contract. The text is only matched for unknown codes.
+func findBootFailureClass(code, component, text string) *bootFailureClass {
+	for _, cls := range bootFailureClasses {
+		if cls.matchesCode(code) {
+			return cls
+		}
+	}
+	for _, cls := range bootFailureClasses {
+		if cls.matchesComponent(component) {
+			return cls
+		}
+	}
+	// the meaning of a known code does not depend on its text
+	if _, ok := hplCatalog[code]; ok {
+		return nil
+	}
+	for _, cls := range bootFailureClasses {
+		if cls.matchesText(text) {
+			return cls
+		}
+	}
+	return nil
+}
+
+// createBootFailure creates the failure of the given class for an error message
+func createBootFailure(cls *bootFailureClass, code, component, line string) *BootFailure {
+	return &BootFailure{
+		Reason:      cls.reason,
+		Code:        code,
+		Component:   hplComponents[component],
+		Message:     line,
+		Remediation: cls.remediation,
+	}
+}
+
+// classifyBootFailure determines the reason of a failed start from the error messages and the stage that
+// has been entered but not completed, if any
+func classifyBootFailure(errors [][]string, pending string) *BootFailure {
+	if len(errors) == 0 {
+		return nil
+	}
+	// specific errors win over the summary of the service monitor
+	for _, match := range errors {
+		code, component, text := match[1], match[2], match[4]
+		if cls := findBootFailureClass(code, component, text); cls != nil {
+			return createBootFailure(cls, code, component, match[0])
+		}
+	}
+	// the pending stage hints at the failing step
+	first := errors[0]
+	if pending != "" {
+		for _, cls := range bootFailureClasses {
+			if cls.stage == pending {
+				return createBootFailure(cls, first[1], first[2], first[0])
+			}
+		}
+	}
+	for _, match := range errors {
+		if bootFailureServices.matches(match[2], match[4]) {
+			return createBootFailure(bootFailureServices, match[1], match[2], match[0])
+		}
+	}
+	return &BootFailure{
+		Reason:      BootFailureUnknown,
+		Code:        first[1],
+		Component:   hplComponents[first[2]],
+		Message:     first[0],
+		Remediation: "Check the console log of the VSI",
+	}
+}
+
+// ParseBootLog parses the lines of the console log into the stages reached, the known messages and the reason of a failure
+func ParseBootLog(lines []string) *BootReport {
+	report := &BootReport{Stages: []string{}}
+	reached := make(map[string]bool)
+	completed := make(map[string]bool)
+	known := make(map[string]bool)
+	var errors [][]string
+	for _, line := range lines {
+		for _, stage := range bootStages {
+			if !reached[stage.name] && stage.pattern.MatchString(line) {
+				reached[stage.name] = true
+			}
+			if stage.done != nil && stage.done.MatchString(line) {
+				completed[stage.name] = true
+			}
+		}
+		match := reHPLMessage.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if msg, ok := hplCatalog[match[1]]; ok && !known[msg.Code] {
+			known[msg.Code] = true
+			report.Messages = append(report.Messages, msg)
+		}
+		if match[3] == "E" {
+			match[0] = strings.TrimSpace(line)
+			errors = append(errors, match)
+		}
+	}
+	// report the stages in boot order, a stage is completed once a later stage has been reached
+	var pending string
+	for _, stage := range bootStages {
+		if reached[stage.name] {
+			report.Stages = append(report.Stages, stage.name)
+			pending = stage.name
+			if completed[stage.name] {
+				pending = ""
+			}
+		}
+	}
+	report.Failure = classifyBootFailure(errors, pending)
+	return report
+}
@@ -0,0 +1,167 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"strings"
+	"testing"
+
+	A "github.com/IBM/fp-go/array"
+	F "github.com/IBM/fp-go/function"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func toLogLines(data string) []string {
+	return F.Pipe1(
+		strings.Split(data, "\n"),
+		A.Map(strings.TrimSpace),
+	)
+}
+
+func TestParseSuccessfulBootLog(t *testing.T) {
+	report := ParseBootLog(toLogLines(successLog))
+
+	assert.Nil(t, report.Failure)
+	assert.Contains(t, report.Stages, BootStageBootloaderEnd)
+	assert.Equal(t, BootStageStarted, report.Stages[len(report.Stages)-1])
+	assert.Contains(t, report.Messages, GetHPLMessage("HPL10001I"))
+}
+
+func TestParseFailedBootLog(t *testing.T) {
+	report := ParseBootLog(toLogLines(failureLog))
+
+	assert.NotContains(t, report.Stages, BootStageStarted)
+	assert.Contains(t, report.Stages, BootStageLoggingConfiguration)
+	assert.NotNil(t, report.Failure)
+	assert.Equal(t, BootFailureServices, report.Failure.Reason)
+	assert.Equal(t, "HPL10000E", report.Failure.Code)
+	assert.Equal(t, "service-monitor", report.Failure.Component)
+}
+
+func TestClassifyBootFailure(t *testing.T) {
+	tests := []struct {
+		lines  []string
+		reason string
+	}{
+		{
+			lines: []string{
+				"# HPL11 build:23.1.0 enabler:22.11.6",
+				"# decrypt user-data...",
+				"HPL11005E: unable to decrypt the workload section",
+			},
+			reason: BootFailureContractDecryption,
+		},
+		{
+			lines: []string{
+				"# decrypt user-data...",
+				"# run attestation...",
+				"HPL11999E: unexpected failure",
+			},
+			reason: BootFailureAttestation,
+		},
+		{
+			lines: []string{
+				"# HPL11099I: bootloader end",
+				"hpcr-container[700]: HPL12002E: failed to pull image from registry",
+				"hpcr-catch-failure[698]: HPL10000E: One or more service failed",
+			},
+			reason: BootFailureImagePull,
+		},
+		{
+			lines: []string{
+				"hpcr-dnslookup[485]: HPL14000I: Network connectivity check completed successfully.",
+				"hpcr-logging[497]: Configuring logging ...",
+				"hpcr-logging[498]: HPL01002E: Sending logging probe failed",
+			},
+			reason: BootFailureLoggingConfiguration,
+		},
+		{
+			lines: []string{
+				"# HPL11099I: bootloader end",
+				"hpcr-dnslookup[485]: HPL14001E: Unable to resolve the hostname",
+			},
+			reason: BootFailureNetworkCheck,
+		},
+		{
+			// the component wins over the text
+			lines: []string{
+				"hpcr-logging[498]: HPL01003E: Invalid logging configuration in the contract",
+			},
+			reason: BootFailureLoggingConfiguration,
+		},
+		{
+			lines: []string{
+				"hpcr-dnslookup[485]: HPL14002E: No route to the registry configured in the contract",
+			},
+			reason: BootFailureNetworkCheck,
+		},
+		{
+			// the code wins over the text
+			lines: []string{
+				"hpcr-container[700]: HPL12001E: unauthorized, check the credentials of the contract",
+			},
+			reason: BootFailureImagePull,
+		},
+		{
+			// the text of a known code is not matched
+			lines: []string{
+				"# HPL11099I: bootloader end",
+				"HPL11999E: unable to pull the attestation key",
+			},
+			reason: BootFailureUnknown,
+		},
+		{
+			// the text of an unknown code is matched
+			lines: []string{
+				"# HPL11099I: bootloader end",
+				"HPL11042E: unable to decrypt the env section",
+			},
+			reason: BootFailureContractDecryption,
+		},
+		{
+			lines: []string{
+				"# HPL11099I: bootloader end",
+				"HPL16003E: some other error",
+			},
+			reason: BootFailureUnknown,
+		},
+	}
+
+	for _, tc := range tests {
+		report := ParseBootLog(tc.lines)
+		assert.NotNil(t, report.Failure)
+		assert.Equal(t, tc.reason, report.Failure.Reason, strings.Join(tc.lines, "\n"))
+		assert.NotEmpty(t, report.Failure.Remediation)
+	}
+}
+
+func TestParseBootLogWithoutErrors(t *testing.T) {
+	report := ParseBootLog([]string{"# decrypt user-data..."})
+
+	assert.Nil(t, report.Failure)
+	assert.Equal(t, []string{BootStageContractDecryption}, report.Stages)
+}
+
+func TestBootFailureClassCodes(t *testing.T) {
+	for _, cls := range bootFailureClasses {
+		for _, code := range cls.codes {
+			msg := GetHPLMessage(code)
+			require.NotNil(t, msg, code)
+			assert.Equal(t, HPLSeverityError, msg.Severity, code)
+			assert.Equal(t, hplComponents[code[3:5]], msg.Component, code)
+		}
+	}
+}
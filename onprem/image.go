@@ -0,0 +1,109 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+var (
+	// full identifier of the image config entry
+	KeyImageConfig = fmt.Sprintf("%s.%s", KindImage, APIVersion)
+)
+
+type ImageOptions struct {
+	// name of the image resource, owns the pin of the staged image
+	Name string
+	// source of the HPCR qcow2
+	ImageSource ImageSource
+	// name of the libvirt storage pool, the pool must exist
+	StoragePool string
+}
+
+// StageImageSync (synchronously) uploads the base image to the host and pins it, so it survives the garbage collection
+func StageImageSync(client *LivirtClient) func(opt *ImageOptions) (*libvirtxml.StorageVolume, error) {
+	uploadBootDisk := UploadBootDisk(client)
+	pinBaseImages := PinBaseImages(client)
+
+	return func(opt *ImageOptions) (*libvirtxml.StorageVolume, error) {
+		vol, err := uploadBootDisk(opt.StoragePool, opt.ImageSource)
+		if err != nil {
+			return nil, err
+		}
+		err = pinBaseImages(GetImageStoragePool(opt.StoragePool, opt.ImageSource), opt.Name, []string{vol.Name})
+		if err != nil {
+			return nil, err
+		}
+		return vol, nil
+	}
+}
+
+// DeleteImageSync releases the pin of the staged image, the image itself is left to the garbage collection
+func DeleteImageSync(client *LivirtClient) func(opt *ImageOptions) error {
+	pinBaseImages := PinBaseImages(client)
+
+	return func(opt *ImageOptions) error {
+		return pinBaseImages(GetImageStoragePool(opt.StoragePool, opt.ImageSource), opt.Name, nil)
+	}
+}
+
+// ImagesFromRelated decodes the set of referenced images from the related data structure
+func ImagesFromRelated(data map[string]any) ([]*ImageCustomResource, error) {
+	var result []*ImageCustomResource
+	if related, ok := data["related"].(map[string]any); ok {
+		// all images
+		if images, ok := related[KeyImageConfig].(map[string]any); ok {
+			// decode each image
+			for _, image := range images {
+				// transcode to the expected format
+				img, err := common.Transcode[*ImageCustomResource](image)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, img)
+			}
+		}
+	}
+	// ok
+	return result, nil
+}
+
+// GetStagedImage locates the named image and returns its status on the host
+func GetStagedImage(images []*ImageCustomResource, name, hostname string) (*ImageCustomResource, *ImageHostStatus, error) {
+	for _, image := range images {
+		if image.Name != name {
+			continue
+		}
+		hostStatus, ok := image.Status.Metadata.Hosts[hostname]
+		if !ok {
+			return image, nil, fmt.Errorf("image [%s] does not target host [%s]", name, hostname)
+		}
+		if common.Status(hostStatus.Status) != common.Ready {
+			log.Printf("Image [%s] is not ready on host [%s], cause: [%s]", name, hostname, hostStatus.Description)
+			return image, nil, fmt.Errorf("image [%s] is not ready on host [%s]", name, hostname)
+		}
+		return image, hostStatus, nil
+	}
+	return nil, nil, fmt.Errorf("image [%s] does not exist", name)
+}
+
+// CreateStagedImageSource returns the source of an image that has been staged on the host
+func CreateStagedImageSource(status *ImageHostStatus) ImageSource {
+	return &volumeImageSource{pool: status.StoragePool, name: status.VolumeName}
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImagesFromRelated(t *testing.T) {
+	data := map[string]any{
+		"related": map[string]any{
+			KeyImageConfig: map[string]any{
+				"default/hpcr": map[string]any{
+					"metadata": map[string]any{"name": "hpcr"},
+					"spec":     map[string]any{"imageURL": "https://images.example.com/hpcr.qcow2"},
+					"status": map[string]any{
+						"status": 1,
+						"metadata": map[string]any{
+							"hosts": map[string]any{
+								"lpar1": map[string]any{"status": 1, "storagePool": "images", "volumeName": "hpcr.qcow2"},
+								"lpar2": map[string]any{"status": 2, "description": "failed"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	images, err := ImagesFromRelated(data)
+	require.NoError(t, err)
+	require.Len(t, images, 1)
+
+	image, hostStatus, err := GetStagedImage(images, "hpcr", "lpar1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://images.example.com/hpcr.qcow2", image.Spec.ImageURL)
+
+	src := CreateStagedImageSource(hostStatus)
+	assert.Equal(t, "volume://images/hpcr.qcow2", src.String())
+	assert.Equal(t, "images", GetImageStoragePool(DefaultStoragePool, src))
+
+	// not ready
+	_, _, err = GetStagedImage(images, "hpcr", "lpar2")
+	assert.Error(t, err)
+	// not targeted
+	_, _, err = GetStagedImage(images, "hpcr", "lpar3")
+	assert.Error(t, err)
+	// unknown
+	_, _, err = GetStagedImage(images, "other", "lpar1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,426 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	A "github.com/IBM/fp-go/array"
+	libvirt "github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+)
+
+const (
+	// Environment variable names
+	KeyImageGCRetention = "IMAGE_GC_RETENTION"
+	KeyImageGCInterval  = "IMAGE_GC_INTERVAL"
+	KeyImageGCDryRun    = "IMAGE_GC_DRY_RUN"
+
+	// AnnotationPinnedImages lists the names of base images that must never be collected
+	AnnotationPinnedImages = "hpse.ibm.com/pinned-images"
+
+	DefaultImageGCInterval = 24 * time.Hour
+
+	// name of the volume that tracks the base images uploaded to a pool
+	imageIndexVolumeName = "hpcr-images.json"
+	// size reserved for the image index
+	maxImageIndexSize = uint64(64 * 1024)
+)
+
+// BaseImage describes a base image that has been uploaded by the operator
+type BaseImage struct {
+	// name of the volume
+	Name string `json:"name"`
+	// location the image has been uploaded from
+	Source string `json:"source,omitempty"`
+	// last time an instance has been provisioned from the image
+	LastUsed time.Time `json:"lastUsed"`
+	// identifiers of the resources that pin the image
+	PinnedBy []string `json:"pinnedBy,omitempty"`
+}
+
+// imageIndex is persisted per storage pool and tracks the managed base images
+type imageIndex struct {
+	// last time the garbage collection ran
+	LastCollected time.Time `json:"lastCollected,omitempty"`
+	// images by name
+	Images map[string]*BaseImage `json:"images"`
+}
+
+// ImageGCConfig controls the garbage collection of base images
+type ImageGCConfig struct {
+	// images unused for longer than this period may be deleted, zero disables the periodic collection
+	Retention time.Duration
+	// minimum time between two periodic collections
+	Interval time.Duration
+	// only report, do not delete
+	DryRun bool
+	// names of additional images to keep
+	Pinned []string
+}
+
+// ImageGCResult is the verdict for a single base image
+type ImageGCResult struct {
+	// name of the volume
+	Name string `json:"name"`
+	// true if the image is (or would be in dry-run mode) deleted
+	Delete bool `json:"delete"`
+	// human readable explanation
+	Reason string `json:"reason"`
+}
+
+// ImageGCReport summarizes a garbage collection pass
+type ImageGCReport struct {
+	StoragePool string           `json:"storagePool"`
+	DryRun      bool             `json:"dryRun"`
+	Images      []*ImageGCResult `json:"images"`
+}
+
+func readImageIndex(conn *libvirt.Libvirt) func(pool libvirt.StoragePool) (*imageIndex, error) {
+	readVolume := readJSONVolume(conn)
+	return func(pool libvirt.StoragePool) (*imageIndex, error) {
+		idx := imageIndex{}
+		_, err := readVolume(pool, imageIndexVolumeName, maxImageIndexSize, &idx)
+		if err != nil {
+			return nil, err
+		}
+		if idx.Images == nil {
+			idx.Images = make(map[string]*BaseImage)
+		}
+		return &idx, nil
+	}
+}
+
+func writeImageIndex(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, idx *imageIndex) error {
+	writeVolume := writeJSONVolume(conn)
+	return func(pool libvirt.StoragePool, idx *imageIndex) error {
+		return writeVolume(pool, imageIndexVolumeName, maxImageIndexSize, idx)
+	}
+}
+
+// recordBaseImage marks a base image as managed and used right now
+func recordBaseImage(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name, source string) {
+	readIndex := readImageIndex(conn)
+	writeIndex := writeImageIndex(conn)
+	return func(pool libvirt.StoragePool, name, source string) {
+		defer lockRegistry(pool, imageIndexVolumeName)()
+		idx, err := readIndex(pool)
+		if err != nil {
+			log.Printf("Unable to read the image index of pool [%s], cause: [%v]", pool.Name, err)
+			return
+		}
+		image, ok := idx.Images[name]
+		if !ok {
+			image = &BaseImage{Name: name}
+			idx.Images[name] = image
+		}
+		image.Source = source
+		image.LastUsed = time.Now().UTC()
+		if err := writeIndex(pool, idx); err != nil {
+			log.Printf("Unable to update the image index of pool [%s], cause: [%v]", pool.Name, err)
+		}
+	}
+}
+
+// PinBaseImages replaces the set of images pinned by an owner, an empty list removes all pins of the owner
+func PinBaseImages(client *LivirtClient) func(storagePool, owner string, names []string) error {
+	conn := client.LibVirt
+	readIndex := readImageIndex(conn)
+	writeIndex := writeImageIndex(conn)
+	return func(storagePool, owner string, names []string) error {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return err
+		}
+		defer lockRegistry(pool, imageIndexVolumeName)()
+		idx, err := readIndex(pool)
+		if err != nil {
+			return err
+		}
+		pinned := toSet(names)
+		changed := false
+		for name, image := range idx.Images {
+			if pinned[name] == slices.Contains(image.PinnedBy, owner) {
+				continue
+			}
+			changed = true
+			if pinned[name] {
+				image.PinnedBy = append(image.PinnedBy, owner)
+			} else {
+				image.PinnedBy = A.Filter(func(o string) bool { return o != owner })(image.PinnedBy)
+			}
+		}
+		if !changed {
+			return nil
+		}
+		log.Printf("Updating pins of [%s] on pool [%s] to %v ...", owner, pool.Name, names)
+		return writeIndex(pool, idx)
+	}
+}
+
+func toSet(names []string) map[string]bool {
+	result := make(map[string]bool)
+	for _, name := range names {
+		result[name] = true
+	}
+	return result
+}
+
+// referencedBaseImages returns the names of the volumes in the pool that other volumes or domains depend on,
+// together with a description of the dependent
+func referencedBaseImages(conn *libvirt.Libvirt) func(pool libvirt.StoragePool) (map[string]string, error) {
+	getDependents := getBackingFileDependents(conn)
+	return func(pool libvirt.StoragePool) (map[string]string, error) {
+		result := make(map[string]string)
+		// map from path to volume name
+		volumes, _, err := conn.StoragePoolListAllVolumes(pool, NeedResults, 0)
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]string)
+		for _, vol := range volumes {
+			path, err := conn.StorageVolGetPath(vol)
+			if err == nil {
+				names[path] = vol.Name
+			}
+		}
+		// volumes (e.g. boot disk overlays) that use a volume of this pool as their backing file
+		dependents, err := getDependents()
+		if err != nil {
+			return nil, err
+		}
+		for path, name := range names {
+			if deps := dependents[path]; A.IsNonEmpty(deps) {
+				result[name] = fmt.Sprintf("backing file of volumes %v", deps)
+			}
+		}
+		// volumes referenced by domains
+		domains, _, err := conn.ConnectListAllDomains(NeedResults, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range domains {
+			domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+			if err != nil {
+				return nil, err
+			}
+			domainXML, err := parseDomainXML(domainStrg)
+			if err != nil {
+				return nil, err
+			}
+			// the base image recorded by the operator
+			if domainXML.Metadata != nil {
+				metadata := InstanceMetadata{}
+				if xml.Unmarshal([]byte(domainXML.Metadata.XML), &metadata) == nil && metadata.BaseImage != nil && metadata.BaseImage.Pool == pool.Name {
+					result[metadata.BaseImage.Name] = fmt.Sprintf("base image of domain [%s]", domain.Name)
+				}
+			}
+			// disks attached directly
+			if domainXML.Devices == nil {
+				continue
+			}
+			for _, disk := range domainXML.Devices.Disks {
+				if disk.Source == nil {
+					continue
+				}
+				if disk.Source.File != nil {
+					if name, ok := names[disk.Source.File.File]; ok {
+						result[name] = fmt.Sprintf("disk of domain [%s]", domain.Name)
+					}
+				}
+				if disk.Source.Volume != nil && disk.Source.Volume.Pool == pool.Name {
+					result[disk.Source.Volume.Volume] = fmt.Sprintf("disk of domain [%s]", domain.Name)
+				}
+			}
+		}
+		return result, nil
+	}
+}
+
+// planImageCollection decides which of the managed images may be deleted
+func planImageCollection(images []*BaseImage, existing map[string]bool, uploading map[string]bool, referenced map[string]string, pinned map[string]bool, now time.Time, retention time.Duration) []*ImageGCResult {
+	var result []*ImageGCResult
+	for _, image := range images {
+		verdict := &ImageGCResult{Name: image.Name}
+		switch {
+		case !existing[image.Name]:
+			verdict.Reason = "volume does not exist"
+		case uploading[image.Name]:
+			verdict.Reason = "upload incomplete"
+		case pinned[image.Name]:
+			verdict.Reason = "pinned"
+		case A.IsNonEmpty(image.PinnedBy):
+			verdict.Reason = fmt.Sprintf("pinned by %v", image.PinnedBy)
+		case referenced[image.Name] != "":
+			verdict.Reason = fmt.Sprintf("referenced as %s", referenced[image.Name])
+		case now.Sub(image.LastUsed) < retention:
+			verdict.Reason = fmt.Sprintf("last used at [%s], within the retention period", image.LastUsed.Format(time.RFC3339))
+		default:
+			verdict.Delete = true
+			verdict.Reason = fmt.Sprintf("unused since [%s]", image.LastUsed.Format(time.RFC3339))
+		}
+		result = append(result, verdict)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// CollectBaseImages deletes managed base images that are neither referenced nor pinned and that have not been used within the retention period
+func CollectBaseImages(client *LivirtClient) func(storagePool string, cfg *ImageGCConfig) (*ImageGCReport, error) {
+	conn := client.LibVirt
+	readIndex := readImageIndex(conn)
+	writeIndex := writeImageIndex(conn)
+	getReferences := referencedBaseImages(conn)
+	delVol := deleteStorageVol(conn)
+	readProgress := readUploadProgress(conn)
+	delProgress := deleteUploadProgress(conn)
+
+	return func(storagePool string, cfg *ImageGCConfig) (*ImageGCReport, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("CollectBaseImages(%s)", storagePool))()
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return nil, err
+		}
+		err = refreshPool(conn)(pool)
+		if err != nil {
+			return nil, err
+		}
+		// pins and uses recorded while the collection runs must not be lost
+		defer lockRegistry(pool, imageIndexVolumeName)()
+		idx, err := readIndex(pool)
+		if err != nil {
+			return nil, err
+		}
+		referenced, err := getReferences(pool)
+		if err != nil {
+			return nil, err
+		}
+		// images with an incomplete upload are kept, the upload resumes on the next sync
+		existing := make(map[string]bool)
+		uploading := make(map[string]bool)
+		for name := range idx.Images {
+			if _, err := conn.StorageVolLookupByName(pool, name); err == nil {
+				existing[name] = true
+				uploading[name] = readProgress(pool, name) != nil
+			}
+		}
+		var images []*BaseImage
+		for _, image := range idx.Images {
+			images = append(images, image)
+		}
+		report := &ImageGCReport{
+			StoragePool: storagePool,
+			DryRun:      cfg.DryRun,
+			Images:      planImageCollection(images, existing, uploading, referenced, toSet(cfg.Pinned), time.Now().UTC(), cfg.Retention),
+		}
+		for _, verdict := range report.Images {
+			log.Printf("Base image [%s] on pool [%s]: delete=[%t], dryRun=[%t], reason: [%s]", verdict.Name, storagePool, verdict.Delete, cfg.DryRun, verdict.Reason)
+			if cfg.DryRun {
+				continue
+			}
+			if verdict.Delete {
+				if _, err := delVol(pool, verdict.Name); err != nil {
+					return report, err
+				}
+				delProgress(pool, verdict.Name)
+				delete(idx.Images, verdict.Name)
+			} else if !existing[verdict.Name] {
+				delete(idx.Images, verdict.Name)
+			}
+		}
+		idx.LastCollected = time.Now().UTC()
+		if err := writeIndex(pool, idx); err != nil {
+			return report, err
+		}
+		return report, refreshPool(conn)(pool)
+	}
+}
+
+// CollectBaseImagesIfDue runs the garbage collection if it is enabled and if the last run is older than the interval
+func CollectBaseImagesIfDue(client *LivirtClient) func(storagePool string, cfg *ImageGCConfig) (*ImageGCReport, error) {
+	conn := client.LibVirt
+	readIndex := readImageIndex(conn)
+	collect := CollectBaseImages(client)
+
+	return func(storagePool string, cfg *ImageGCConfig) (*ImageGCReport, error) {
+		if cfg.Retention <= 0 {
+			return nil, nil
+		}
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := readIndex(pool)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(idx.LastCollected) < cfg.Interval {
+			return nil, nil
+		}
+		return collect(storagePool, cfg)
+	}
+}
+
+// GetPinnedImagesFromAnnotations parses the comma separated list of pinned images
+func GetPinnedImagesFromAnnotations(annotations map[string]string) []string {
+	var result []string
+	for _, name := range strings.Split(annotations[AnnotationPinnedImages], ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// GetImageGCConfigFromEnvMap deserializes the garbage collection config from a set of (env) parameters
+func GetImageGCConfigFromEnvMap(envMap env.Environment) *ImageGCConfig {
+	result := &ImageGCConfig{Interval: DefaultImageGCInterval}
+	if retention, ok := envMap[KeyImageGCRetention]; ok {
+		d, err := time.ParseDuration(retention)
+		if err == nil && d > 0 {
+			result.Retention = d
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", retention, KeyImageGCRetention)
+		}
+	}
+	if interval, ok := envMap[KeyImageGCInterval]; ok {
+		d, err := time.ParseDuration(interval)
+		if err == nil && d > 0 {
+			result.Interval = d
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", interval, KeyImageGCInterval)
+		}
+	}
+	if dryRun, ok := envMap[KeyImageGCDryRun]; ok {
+		b, err := strconv.ParseBool(dryRun)
+		if err == nil {
+			result.DryRun = b
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", dryRun, KeyImageGCDryRun)
+		}
+	}
+	return result
+}
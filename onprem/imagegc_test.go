@@ -0,0 +1,119 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanImageCollection(t *testing.T) {
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-60 * 24 * time.Hour)
+	recent := now.Add(-24 * time.Hour)
+
+	images := []*BaseImage{
+		{Name: "old.qcow2", LastUsed: old},
+		{Name: "recent.qcow2", LastUsed: recent},
+		{Name: "used.qcow2", LastUsed: old},
+		{Name: "pinned.qcow2", LastUsed: old, PinnedBy: []string{"uid"}},
+		{Name: "flag.qcow2", LastUsed: old},
+		{Name: "gone.qcow2", LastUsed: old},
+		{Name: "partial.qcow2", LastUsed: old},
+	}
+	existing := toSet([]string{"old.qcow2", "recent.qcow2", "used.qcow2", "pinned.qcow2", "flag.qcow2", "partial.qcow2"})
+	uploading := toSet([]string{"partial.qcow2"})
+	referenced := map[string]string{"used.qcow2": "base image of domain [vsi]"}
+
+	plan := planImageCollection(images, existing, uploading, referenced, toSet([]string{"flag.qcow2"}), now, 30*24*time.Hour)
+	require.Len(t, plan, 7)
+
+	verdicts := make(map[string]bool)
+	for _, verdict := range plan {
+		verdicts[verdict.Name] = verdict.Delete
+	}
+	assert.Equal(t, map[string]bool{
+		"flag.qcow2":    false,
+		"gone.qcow2":    false,
+		"old.qcow2":     true,
+		"partial.qcow2": false,
+		"pinned.qcow2":  false,
+		"recent.qcow2":  false,
+		"used.qcow2":    false,
+	}, verdicts)
+	// the report is sorted
+	assert.Equal(t, "flag.qcow2", plan[0].Name)
+}
+
+func TestGetPinnedImagesFromAnnotations(t *testing.T) {
+	assert.Equal(t, []string{"a.qcow2", "b.qcow2"}, GetPinnedImagesFromAnnotations(map[string]string{
+		AnnotationPinnedImages: " a.qcow2, ,b.qcow2",
+	}))
+	assert.Empty(t, GetPinnedImagesFromAnnotations(nil))
+}
+
+func TestGetImageGCConfigFromEnvMap(t *testing.T) {
+	config := GetImageGCConfigFromEnvMap(map[string]string{
+		KeyImageGCRetention: "720h",
+		KeyImageGCDryRun:    "true",
+	})
+	assert.Equal(t, 720*time.Hour, config.Retention)
+	assert.Equal(t, DefaultImageGCInterval, config.Interval)
+	assert.True(t, config.DryRun)
+
+	config = GetImageGCConfigFromEnvMap(map[string]string{})
+	assert.Equal(t, time.Duration(0), config.Retention)
+}
+
+func TestInstanceMetadataBaseImage(t *testing.T) {
+	metadataXML, err := XMLMarshall(InstanceMetadata{
+		Hash:      "abc",
+		BaseImage: &InstanceBaseImage{Pool: "images", Name: "hpcr.qcow2"},
+	})
+	require.NoError(t, err)
+
+	var metadata InstanceMetadata
+	require.NoError(t, xml.Unmarshal([]byte(metadataXML), &metadata))
+	assert.Equal(t, "abc", metadata.Hash)
+	assert.Equal(t, &InstanceBaseImage{Pool: "images", Name: "hpcr.qcow2"}, metadata.BaseImage)
+}
+
+func TestLockRegistry(t *testing.T) {
+	pool := libvirt.StoragePool{Name: "images", UUID: libvirt.UUID{1}}
+	other := libvirt.StoragePool{Name: "images", UUID: libvirt.UUID{2}}
+
+	unlock := lockRegistry(pool, imageIndexVolumeName)
+	// other registries and pools of the same name on other hosts are not affected
+	lockRegistry(pool, "hpcr-other.json")()
+	lockRegistry(other, imageIndexVolumeName)()
+
+	locked := make(chan bool)
+	go func() {
+		defer lockRegistry(pool, imageIndexVolumeName)()
+		locked <- true
+	}()
+	select {
+	case <-locked:
+		assert.Fail(t, "the registry has been locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	assert.True(t, <-locked)
+}
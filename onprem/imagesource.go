@@ -0,0 +1,699 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// Environment variable names
+	KeyImageCACert   = "IMAGE_CA_CERT"
+	KeyImageHeaders  = "IMAGE_HEADERS"
+	KeyImageUser     = "IMAGE_USER"
+	KeyImagePassword = "IMAGE_PASSWORD"
+
+	schemeHTTP   = "http"
+	schemeHTTPS  = "https"
+	schemeOCI    = "oci"
+	schemeFile   = "file"
+	schemeVolume = "volume"
+
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	annotationTitle         = "org.opencontainers.image.title"
+	defaultOCITag           = "latest"
+)
+
+// ImageSourceConfig captures the settings required to access the HPCR base image
+type ImageSourceConfig struct {
+	// PEM encoded certificates of the CAs that sign the server certificate
+	CACert string `json:"caCert,omitempty" yaml:"caCert,omitempty"`
+	// additional headers sent with each request, e.g. for authorization
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// user name for registry authentication
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	// password or token for registry authentication
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+}
+
+// ImageSource abstracts the location the HPCR base image is read from
+type ImageSource interface {
+	// String returns the location of the image
+	String() string
+	// Name returns the name of the volume that holds the image on the host
+	Name() (string, error)
+	// NeedsUpdate checks if an existing volume differs from the image
+	NeedsUpdate(vol *libvirtxml.StorageVolume) bool
+	// Open returns the content of the image starting at the given offset and the total size of the image in bytes
+	Open(offset uint64) (io.ReadCloser, uint64, error)
+	// Identity returns a value that changes with the content of the image, e.g. its digest, ETag or modification
+	// time, empty if unknown
+	Identity() string
+}
+
+// ErrImageChanged reports that an image changed since the upload of its content started
+var ErrImageChanged = errors.New("the image changed since the upload started")
+
+// ResumableImageSource is implemented by image sources that verify the identity of the image when a download resumes
+type ResumableImageSource interface {
+	ImageSource
+	// OpenIfUnchanged is like Open, but fails with ErrImageChanged if the image does not have the given identity
+	OpenIfUnchanged(offset uint64, identity string) (io.ReadCloser, uint64, error)
+}
+
+// openImageSource opens the content of an image at the offset. A resumed download fails with ErrImageChanged if the
+// image does not have the identity recorded when the upload started, if the source can verify it.
+func openImageSource(src ImageSource, offset uint64, identity string) (io.ReadCloser, uint64, error) {
+	if resumable, ok := src.(ResumableImageSource); ok && offset > 0 {
+		return resumable.OpenIfUnchanged(offset, identity)
+	}
+	return src.Open(offset)
+}
+
+// HostImageSource is implemented by image sources that reference a volume that already exists on the host
+type HostImageSource interface {
+	ImageSource
+	// StoragePool returns the name of the pool that holds the volume
+	StoragePool() string
+}
+
+type httpImageSource struct {
+	url     string
+	client  *http.Client
+	headers map[string]string
+}
+
+type fileImageSource struct {
+	path string
+}
+
+type volumeImageSource struct {
+	pool string
+	name string
+}
+
+type ociLayer struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string     `json:"mediaType"`
+	Layers    []ociLayer `json:"layers"`
+}
+
+type ociImageSource struct {
+	registry   string
+	repository string
+	reference  string
+	config     *ImageSourceConfig
+	client     *http.Client
+	// bearer token obtained from the registry, if any
+	token string
+	// the resolved layer, nil until the manifest has been fetched
+	layer *ociLayer
+}
+
+// checks if the volume matches the given size and modification time
+func needsUpdateFromSizeAndTime(vol *libvirtxml.StorageVolume, size int64, lastModified string) bool {
+	if len(lastModified) > 0 && vol.Target.Timestamps != nil && len(vol.Target.Timestamps.Mtime) > 0 {
+		remoteTime, err := http.ParseTime(lastModified)
+		if err == nil && !remoteTime.After(timeFromEpoch(vol.Target.Timestamps.Mtime)) {
+			return false
+		}
+	}
+	// get size
+	volSize, ok := getVolumeSize(vol)
+	// check the size
+	if size > 0 && ok && size == int64(volSize) {
+		return false
+	}
+	return true
+}
+
+func (src *httpImageSource) newRequest(method string) (*http.Request, error) {
+	req, err := http.NewRequest(method, src.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range src.headers {
+		req.Header.Set(key, value)
+	}
+	return req, nil
+}
+
+func (src *httpImageSource) String() string {
+	return src.url
+}
+
+func (src *httpImageSource) Name() (string, error) {
+	u, err := url.Parse(src.url)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(u.Path), nil
+}
+
+func (src *httpImageSource) NeedsUpdate(vol *libvirtxml.StorageVolume) bool {
+	// access some typical metadata
+	req, err := src.newRequest(http.MethodHead)
+	if err != nil {
+		return true
+	}
+	if vol.Target.Timestamps != nil && len(vol.Target.Timestamps.Mtime) > 0 {
+		// add modified header
+		req.Header.Set("If-Modified-Since", timeFromEpoch(vol.Target.Timestamps.Mtime).UTC().Format(http.TimeFormat))
+	}
+	// send
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return true
+	}
+	defer safeClose(resp.Body)
+	if resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	return needsUpdateFromSizeAndTime(vol, resp.ContentLength, "")
+}
+
+func (src *httpImageSource) Identity() string {
+	req, err := src.newRequest(http.MethodHead)
+	if err != nil {
+		return ""
+	}
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer safeClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	if etag := resp.Header.Get("ETag"); len(etag) > 0 {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+func (src *httpImageSource) Open(offset uint64) (io.ReadCloser, uint64, error) {
+	req, err := src.newRequest(http.MethodGet)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return openRangeResponse(src.url, resp, offset)
+}
+
+func (src *httpImageSource) OpenIfUnchanged(offset uint64, identity string) (io.ReadCloser, uint64, error) {
+	// If-Range only accepts strong validators
+	if len(identity) == 0 || strings.HasPrefix(identity, "W/") {
+		return nil, 0, ErrImageChanged
+	}
+	req, err := src.newRequest(http.MethodGet)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", identity)
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the server sends the full content if the image changed, or if it does not support ranges
+	if resp.StatusCode == http.StatusOK {
+		safeClose(resp.Body)
+		return nil, 0, ErrImageChanged
+	}
+	return openRangeResponse(src.url, resp, offset)
+}
+
+// parseContentRange extracts the total size from a header of the form "bytes start-end/total"
+func parseContentRange(header string) (uint64, error) {
+	_, total, ok := strings.Cut(header, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid content range [%s]", header)
+	}
+	return strconv.ParseUint(total, 10, 64)
+}
+
+// openRangeResponse validates the response to a (range) request and positions the content at the offset
+func openRangeResponse(location string, resp *http.Response, offset uint64) (io.ReadCloser, uint64, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			safeClose(resp.Body)
+			return nil, 0, err
+		}
+		return resp.Body, total, nil
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			safeClose(resp.Body)
+			return nil, 0, fmt.Errorf("unable to determine the size of [%s]", location)
+		}
+		// the server ignored the range, so skip the content up to the offset
+		if offset > 0 {
+			log.Printf("Server does not support range requests for [%s], skipping [%d bytes] ...", location, offset)
+			if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+				safeClose(resp.Body)
+				return nil, 0, err
+			}
+		}
+		return resp.Body, uint64(resp.ContentLength), nil
+	}
+	safeClose(resp.Body)
+	return nil, 0, fmt.Errorf("unable to download [%s], status: [%s]", location, resp.Status)
+}
+
+func (src *fileImageSource) String() string {
+	return fmt.Sprintf("%s://%s", schemeFile, src.path)
+}
+
+func (src *fileImageSource) Name() (string, error) {
+	return filepath.Base(src.path), nil
+}
+
+func (src *fileImageSource) NeedsUpdate(vol *libvirtxml.StorageVolume) bool {
+	info, err := os.Stat(src.path)
+	if err != nil {
+		return true
+	}
+	return needsUpdateFromSizeAndTime(vol, info.Size(), info.ModTime().UTC().Format(http.TimeFormat))
+}
+
+func (src *fileImageSource) Identity() string {
+	info, err := os.Stat(src.path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+}
+
+func (src *fileImageSource) OpenIfUnchanged(offset uint64, identity string) (io.ReadCloser, uint64, error) {
+	rdr, size, err := src.Open(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	// compare the identity of the opened file, it may have been replaced in the meantime
+	info, err := rdr.(*os.File).Stat()
+	if err != nil {
+		safeClose(rdr)
+		return nil, 0, err
+	}
+	if fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano()) != identity {
+		safeClose(rdr)
+		return nil, 0, ErrImageChanged
+	}
+	return rdr, size, nil
+}
+
+func (src *fileImageSource) Open(offset uint64) (io.ReadCloser, uint64, error) {
+	file, err := os.Open(src.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		safeClose(file)
+		return nil, 0, err
+	}
+	_, err = file.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		safeClose(file)
+		return nil, 0, err
+	}
+	return file, uint64(info.Size()), nil
+}
+
+func (src *volumeImageSource) String() string {
+	return fmt.Sprintf("%s://%s/%s", schemeVolume, src.pool, src.name)
+}
+
+func (src *volumeImageSource) Name() (string, error) {
+	return src.name, nil
+}
+
+func (src *volumeImageSource) NeedsUpdate(vol *libvirtxml.StorageVolume) bool {
+	// the volume is managed outside of the operator
+	return false
+}
+
+func (src *volumeImageSource) Identity() string {
+	// the volume is never uploaded
+	return ""
+}
+
+func (src *volumeImageSource) Open(offset uint64) (io.ReadCloser, uint64, error) {
+	return nil, 0, fmt.Errorf("image [%s] on pool [%s] cannot be uploaded, it must exist on the host", src.name, src.pool)
+}
+
+func (src *volumeImageSource) StoragePool() string {
+	return src.pool
+}
+
+// parseAuthChallenge decodes the parameters of a WWW-Authenticate header
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := make(map[string]string)
+	for len(rest) > 0 {
+		key, value, ok := strings.Cut(strings.TrimLeft(rest, ", "), "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(value, "\"") {
+			value, rest, _ = strings.Cut(value[1:], "\"")
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return strings.ToLower(scheme), params
+}
+
+// parseOCIReference splits a reference of the form registry/repository[:tag|@digest]
+func parseOCIReference(ref string) (string, string, string, error) {
+	registry, repo, ok := strings.Cut(ref, "/")
+	if !ok || len(registry) == 0 || len(repo) == 0 {
+		return "", "", "", fmt.Errorf("invalid OCI reference [%s], expected registry/repository[:tag|@digest]", ref)
+	}
+	if repository, digest, ok := strings.Cut(repo, "@"); ok {
+		return registry, repository, digest, nil
+	}
+	if idx := strings.LastIndex(repo, ":"); idx > strings.LastIndex(repo, "/") {
+		return registry, repo[:idx], repo[idx+1:], nil
+	}
+	return registry, repo, defaultOCITag, nil
+}
+
+func (src *ociImageSource) String() string {
+	return fmt.Sprintf("%s://%s/%s:%s", schemeOCI, src.registry, src.repository, src.reference)
+}
+
+// authorize fetches a token for the bearer challenge or falls back to basic authentication
+func (src *ociImageSource) authorize(challenge string) error {
+	scheme, params := parseAuthChallenge(challenge)
+	if scheme == "basic" {
+		if len(src.config.User) == 0 {
+			return fmt.Errorf("registry [%s] requires credentials", src.registry)
+		}
+		return nil
+	}
+	if scheme != "bearer" || len(params["realm"]) == 0 {
+		return fmt.Errorf("unsupported authentication challenge [%s] from registry [%s]", challenge, src.registry)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", src.repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if len(src.config.User) > 0 {
+		req.SetBasicAuth(src.config.User, src.config.Password)
+	}
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer safeClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to obtain a token for registry [%s], status: [%s]", src.registry, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	src.token = token.Token
+	if len(src.token) == 0 {
+		src.token = token.AccessToken
+	}
+	return nil
+}
+
+// do sends a request to the registry and handles authentication challenges
+func (src *ociImageSource) do(method, urlPath string, headers map[string]string, accept ...string) (*http.Response, error) {
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", schemeHTTPS, src.registry, urlPath), nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range src.config.Headers {
+			req.Header.Set(key, value)
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if len(src.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+src.token)
+		} else if len(src.config.User) > 0 {
+			req.SetBasicAuth(src.config.User, src.config.Password)
+		}
+		return src.client.Do(req)
+	}
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || len(src.token) > 0 {
+		return resp, err
+	}
+	// try to authenticate
+	safeClose(resp.Body)
+	if err := src.authorize(resp.Header.Get("WWW-Authenticate")); err != nil {
+		return nil, err
+	}
+	return send()
+}
+
+// resolve fetches the manifest and locates the layer that carries the qcow2 image
+func (src *ociImageSource) resolve() (*ociLayer, error) {
+	if src.layer != nil {
+		return src.layer, nil
+	}
+	resp, err := src.do(http.MethodGet, fmt.Sprintf("/v2/%s/manifests/%s", src.repository, src.reference), nil, mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return nil, err
+	}
+	defer safeClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to fetch the manifest for [%s], status: [%s]", src, resp.Status)
+	}
+	var manifest ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	// prefer the layer that identifies itself as qcow2
+	for idx, layer := range manifest.Layers {
+		if strings.Contains(layer.MediaType, "qcow2") || strings.HasSuffix(layer.Annotations[annotationTitle], ".qcow2") {
+			src.layer = &manifest.Layers[idx]
+			return src.layer, nil
+		}
+	}
+	if len(manifest.Layers) != 1 {
+		return nil, fmt.Errorf("unable to identify the qcow2 layer in [%s], found [%d] layers", src, len(manifest.Layers))
+	}
+	src.layer = &manifest.Layers[0]
+	return src.layer, nil
+}
+
+func (src *ociImageSource) Name() (string, error) {
+	layer, err := src.resolve()
+	if err != nil {
+		return "", err
+	}
+	// the digest identifies the content, so different versions never share a volume
+	_, digest, _ := strings.Cut(layer.Digest, ":")
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return fmt.Sprintf("%s-%s.qcow2", path.Base(src.repository), digest), nil
+}
+
+func (src *ociImageSource) NeedsUpdate(vol *libvirtxml.StorageVolume) bool {
+	layer, err := src.resolve()
+	if err != nil {
+		log.Printf("Unable to resolve [%s], cause: [%v]", src, err)
+		return true
+	}
+	return needsUpdateFromSizeAndTime(vol, layer.Size, "")
+}
+
+func (src *ociImageSource) Identity() string {
+	layer, err := src.resolve()
+	if err != nil {
+		return ""
+	}
+	return layer.Digest
+}
+
+func (src *ociImageSource) OpenIfUnchanged(offset uint64, identity string) (io.ReadCloser, uint64, error) {
+	return src.openLayer(offset, identity)
+}
+
+func (src *ociImageSource) Open(offset uint64) (io.ReadCloser, uint64, error) {
+	return src.openLayer(offset, "")
+}
+
+// openLayer opens the blob of the image layer, a non-empty digest must match the digest of the layer
+func (src *ociImageSource) openLayer(offset uint64, digest string) (io.ReadCloser, uint64, error) {
+	layer, err := src.resolve()
+	if err != nil {
+		return nil, 0, err
+	}
+	// blobs are addressed by their digest, so the content of a resolved layer never changes
+	if len(digest) > 0 && layer.Digest != digest {
+		return nil, 0, ErrImageChanged
+	}
+	log.Printf("Pulling layer [%s] of [%s] from offset [%d] ...", layer.Digest, src, offset)
+	var headers map[string]string
+	if offset > 0 {
+		headers = map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset)}
+	}
+	resp, err := src.do(http.MethodGet, fmt.Sprintf("/v2/%s/blobs/%s", src.repository, layer.Digest), headers)
+	if err != nil {
+		return nil, 0, err
+	}
+	return openRangeResponse(src.String(), resp, offset)
+}
+
+// createHTTPClient returns an HTTP client that trusts the configured CAs in addition to the system CAs
+func createHTTPClient(config *ImageSourceConfig) (*http.Client, error) {
+	if len(config.CACert) == 0 {
+		return http.DefaultClient, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+		return nil, fmt.Errorf("unable to parse the CA certificate from [%s]", KeyImageCACert)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// CreateImageSource constructs the image source for an image URL. Supported schemes are
+// http(s)://, oci://registry/repository:tag, file:///path and volume://pool/name
+func CreateImageSource(config *ImageSourceConfig) func(imageURL string) (ImageSource, error) {
+	return func(imageURL string) (ImageSource, error) {
+		u, err := url.Parse(imageURL)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case schemeHTTP, schemeHTTPS:
+			client, err := createHTTPClient(config)
+			if err != nil {
+				return nil, err
+			}
+			return &httpImageSource{url: imageURL, client: client, headers: config.Headers}, nil
+		case schemeOCI:
+			client, err := createHTTPClient(config)
+			if err != nil {
+				return nil, err
+			}
+			registry, repository, reference, err := parseOCIReference(strings.TrimPrefix(imageURL, schemeOCI+"://"))
+			if err != nil {
+				return nil, err
+			}
+			return &ociImageSource{registry: registry, repository: repository, reference: reference, config: config, client: client}, nil
+		case schemeFile:
+			return &fileImageSource{path: filepath.Clean(u.Path)}, nil
+		case schemeVolume:
+			name := strings.TrimPrefix(u.Path, "/")
+			if len(u.Host) == 0 || len(name) == 0 {
+				return nil, fmt.Errorf("invalid volume reference [%s], expected volume://pool/name", imageURL)
+			}
+			return &volumeImageSource{pool: u.Host, name: name}, nil
+		}
+		return nil, fmt.Errorf("unsupported scheme [%s] in image URL [%s]", u.Scheme, imageURL)
+	}
+}
+
+// GetImageSource returns the configured image source or derives it from the image URL
+func GetImageSource(opt *InstanceOptions) (ImageSource, error) {
+	if opt.ImageSource != nil {
+		return opt.ImageSource, nil
+	}
+	return CreateImageSource(&ImageSourceConfig{})(opt.ImageURL)
+}
+
+// GetImageSourceConfigFromEnvMap deserializes the image source config from a set of (env) parameters
+func GetImageSourceConfigFromEnvMap(envMap env.Environment) *ImageSourceConfig {
+	result := &ImageSourceConfig{
+		CACert:   envMap[KeyImageCACert],
+		User:     envMap[KeyImageUser],
+		Password: envMap[KeyImagePassword],
+	}
+	// headers are encoded as one "name: value" pair per line
+	if headers, ok := envMap[KeyImageHeaders]; ok {
+		result.Headers = make(map[string]string)
+		for _, line := range strings.Split(headers, "\n") {
+			key, value, ok := strings.Cut(line, ":")
+			if ok && len(strings.TrimSpace(key)) > 0 {
+				result.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	return result
+}
+
+// GetImageStoragePool returns the name of the pool that holds the base image on the host
+func GetImageStoragePool(storagePool string, src ImageSource) string {
+	if hostSrc, ok := src.(HostImageSource); ok {
+		return hostSrc.StoragePool()
+	}
+	return storagePool
+}
@@ -0,0 +1,184 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestParseOCIReference(t *testing.T) {
+	registry, repo, ref, err := parseOCIReference("registry.example.com/hpcr/image:23.1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "registry.example.com", registry)
+	assert.Equal(t, "hpcr/image", repo)
+	assert.Equal(t, "23.1.0", ref)
+
+	registry, repo, ref, err = parseOCIReference("localhost:5000/hpcr")
+	require.NoError(t, err)
+	assert.Equal(t, "localhost:5000", registry)
+	assert.Equal(t, "hpcr", repo)
+	assert.Equal(t, defaultOCITag, ref)
+
+	_, repo, ref, err = parseOCIReference("localhost:5000/hpcr@sha256:abcdef")
+	require.NoError(t, err)
+	assert.Equal(t, "hpcr", repo)
+	assert.Equal(t, "sha256:abcdef", ref)
+
+	_, _, _, err = parseOCIReference("hpcr")
+	assert.Error(t, err)
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:hpcr:pull,push"`)
+	assert.Equal(t, "bearer", scheme)
+	assert.Equal(t, "https://auth.example.com/token", params["realm"])
+	assert.Equal(t, "registry.example.com", params["service"])
+	assert.Equal(t, "repository:hpcr:pull,push", params["scope"])
+}
+
+func TestCreateImageSource(t *testing.T) {
+	create := CreateImageSource(&ImageSourceConfig{})
+
+	src, err := create("http://localhost:8080/hpcr.qcow2")
+	require.NoError(t, err)
+	name, err := src.Name()
+	require.NoError(t, err)
+	assert.Equal(t, "hpcr.qcow2", name)
+
+	src, err = create("volume://images/hpcr-23.1.0.qcow2")
+	require.NoError(t, err)
+	hostSrc, ok := src.(HostImageSource)
+	require.True(t, ok)
+	assert.Equal(t, "images", hostSrc.StoragePool())
+	name, err = hostSrc.Name()
+	require.NoError(t, err)
+	assert.Equal(t, "hpcr-23.1.0.qcow2", name)
+
+	_, err = create("volume://images")
+	assert.Error(t, err)
+
+	_, err = create("ftp://localhost/hpcr.qcow2")
+	assert.Error(t, err)
+}
+
+func TestFileImageSource(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "hpcr.qcow2")
+	require.NoError(t, os.WriteFile(imagePath, []byte("qcow2"), 0600))
+
+	src, err := CreateImageSource(&ImageSourceConfig{})("file://" + imagePath)
+	require.NoError(t, err)
+
+	rdr, size, err := src.Open(0)
+	require.NoError(t, err)
+	defer rdr.Close()
+	assert.Equal(t, uint64(5), size)
+
+	vol := createDefaultVolume()
+	vol.Capacity.Value = 5
+	assert.False(t, src.NeedsUpdate(&vol))
+
+	vol.Capacity.Value = 6
+	assert.True(t, src.NeedsUpdate(&vol))
+}
+
+func TestHTTPImageSourceHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("qcow2"))
+	}))
+	defer server.Close()
+
+	config := GetImageSourceConfigFromEnvMap(map[string]string{
+		KeyImageHeaders: "Authorization: Bearer secret\nX-Empty:",
+	})
+	assert.Len(t, config.Headers, 2)
+
+	src, err := CreateImageSource(config)(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+
+	rdr, size, err := src.Open(0)
+	require.NoError(t, err)
+	defer rdr.Close()
+	assert.Equal(t, uint64(5), size)
+
+	// without the header the download must fail
+	src, err = CreateImageSource(&ImageSourceConfig{})(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+	_, _, err = src.Open(0)
+	assert.Error(t, err)
+}
+
+func TestOCIImageSource(t *testing.T) {
+	manifest := ociManifest{
+		MediaType: mediaTypeOCIManifest,
+		Layers: []ociLayer{
+			{MediaType: "application/vnd.oci.image.config.v1+json", Digest: "sha256:0000", Size: 2},
+			{MediaType: "application/octet-stream", Digest: "sha256:0123456789abcdef", Size: 5, Annotations: map[string]string{annotationTitle: "hpcr.qcow2"}},
+		},
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			_ = json.NewEncoder(w).Encode(map[string]string{"token": "abc"})
+		case r.Header.Get("Authorization") != "Bearer abc":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://`+r.Host+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/hpcr/image/manifests/1.0":
+			_ = json.NewEncoder(w).Encode(manifest)
+		case r.URL.Path == "/v2/hpcr/image/blobs/sha256:0123456789abcdef":
+			_, _ = w.Write([]byte("qcow2"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	config := &ImageSourceConfig{CACert: string(caCert)}
+
+	src, err := CreateImageSource(config)("oci://" + strings.TrimPrefix(server.URL, "https://") + "/hpcr/image:1.0")
+	require.NoError(t, err)
+
+	name, err := src.Name()
+	require.NoError(t, err)
+	assert.Equal(t, "image-0123456789ab.qcow2", name)
+
+	rdr, size, err := src.Open(0)
+	require.NoError(t, err)
+	defer rdr.Close()
+	assert.Equal(t, uint64(5), size)
+
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	assert.Equal(t, "qcow2", string(data))
+
+	vol := libvirtxml.StorageVolume{Target: &libvirtxml.StorageVolumeTarget{}, Capacity: &libvirtxml.StorageVolumeSize{Unit: "bytes", Value: 5}}
+	assert.False(t, src.NeedsUpdate(&vol))
+}
@@ -19,7 +19,6 @@ import (
 	"encoding/xml"
 	"fmt"
 	"log"
-	"path"
 	"sort"
 
 	"crypto/sha256"
@@ -34,6 +33,25 @@ import (
 type InstanceMetadata struct {
 	XMLName xml.Name `xml:"https://github.com/ibm-hyper-protect/k8s-operator-hpcr instance"`
 	Hash    string   `xml:"hash"`
+	// UID of the resource the domain belongs to
+	Owner string `xml:"owner,omitempty"`
+	// identifier of the cluster of the resource, the orphan sweep of a cluster only deletes its own domains
+	Cluster   string             `xml:"cluster,omitempty"`
+	BaseImage *InstanceBaseImage `xml:"baseImage,omitempty"`
+	// target devices of the data disks, kept stable across recreates
+	DataDisks []InstanceDataDisk `xml:"dataDisks>disk,omitempty"`
+	// restarts of the instance with the current definition
+	Restarts *InstanceRestarts `xml:"restarts,omitempty"`
+	// set if the domain has been stopped on purpose
+	PowerState string `xml:"powerState,omitempty"`
+	// volumes of a domain that has been adopted rather than created
+	Adopted *InstanceAdoption `xml:"adopted,omitempty"`
+}
+
+// InstanceBaseImage identifies the base image the boot disk of an instance has been created from
+type InstanceBaseImage struct {
+	Pool string `xml:"pool,attr"`
+	Name string `xml:",chardata"`
 }
 
 type AttachedDataDisk struct {
@@ -41,21 +59,41 @@ type AttachedDataDisk struct {
 	Name string
 	// name of the libvirt storage pool, the pool must exist
 	StoragePool string
+	// attachment mode, one of exclusive, shareable or readonly
+	Mode string
+	// host cache mode, the hypervisor default if empty
+	Cache string
+	// I/O mode, the hypervisor default if empty
+	IO string
 }
 
 type InstanceOptions struct {
 	// name of the instance, will also be the hostname
 	Name string
+	// UID of the resource, not part of the hash
+	Owner string
+	// identifier of the cluster of the resource, not part of the hash
+	Cluster string
 	// the userdata field
 	UserData string
 	// URL to the HPCR qcow2
 	ImageURL string
+	// source of the HPCR qcow2, derived from the ImageURL if not set
+	ImageSource ImageSource
 	// name of the libvirt storage pool, the pool must exist
 	StoragePool string
+	// how the boot disk is created from the base image, defaults to a full copy
+	BootDiskMode string
+	// what happens when the domain stops, one of Always, OnFailure, Recreate or Never
+	RestartPolicy string
+	// desired state of the domain, one of Running or Stopped
+	PowerState string
 	// attached data disks
 	DataDisks []*AttachedDataDisk
 	// attached networks
 	Networks []string
+	// static addresses keyed by the network name
+	Addresses map[string]*NetworkAddress
 }
 
 type DataDiskOptions struct {
@@ -65,6 +103,12 @@ type DataDiskOptions struct {
 	StoragePool string
 	// size of the disk
 	Size uint64
+	// content of a new disk, nil for an empty disk
+	Source *DataDiskSourceOptions
+	// format and preallocation of a new disk
+	Layout DataDiskLayout
+	// what happens to the volume when the resource is deleted
+	ReclaimPolicy string
 }
 
 type DataDiskRefOptions struct {
@@ -77,6 +121,8 @@ type DataDiskRefOptions struct {
 type NetworkRefOptions struct {
 	// name of the network
 	Name string
+	// optional static addresses on the network
+	Address *NetworkAddress
 }
 
 // GetNetwork returns the network attached to the instane
@@ -99,6 +145,18 @@ func GetLoggingVolumeName(name string) string {
 	return fmt.Sprintf("console-%s.log", name)
 }
 
+// sort the networks by name, so the hash is predictable
+func sortNetwoks(networks []string) []string {
+	if !A.IsNonEmpty(networks) {
+		return networks
+	}
+	var sorted []string
+	sorted = append(sorted, networks...)
+	sort.Strings(sorted)
+	// returns the sorted list
+	return sorted
+}
+
 // sort the data disks by name, so the hash is predictable
 func sortDataDisks(disks []*AttachedDataDisk) []*AttachedDataDisk {
 	if !A.IsNonEmpty(disks) {
@@ -114,34 +172,47 @@ func sortDataDisks(disks []*AttachedDataDisk) []*AttachedDataDisk {
 	return sorted
 }
 
-// sort the networks by name, so the hash is predictable
-func sortNetwoks(networks []string) []string {
-	if !A.IsNonEmpty(networks) {
-		return networks
-	}
-	var sorted []string
-	sorted = append(sorted, networks...)
-	sort.Strings(sorted)
-	// returns the sorted list
-	return sorted
-}
-
 // createInstanceHash computes a hash value for the instance options
 func CreateInstanceHash(opt *InstanceOptions) string {
+	// data disks are not part of the hash, they are attached to the running domain
+	return createInstanceHash(opt, false)
+}
+
+// createLegacyInstanceHash computes the hash value of domains created before data disks could be attached to running
+// domains, it includes the data disks
+func createLegacyInstanceHash(opt *InstanceOptions) string {
+	return createInstanceHash(opt, true)
+}
+
+// matchesInstanceHash tests if the metadata of a domain carry the current or the legacy hash of the instance options
+func matchesInstanceHash(metadata *InstanceMetadata, opt *InstanceOptions) bool {
+	return metadata.Hash == CreateInstanceHash(opt) || metadata.Hash == createLegacyInstanceHash(opt)
+}
+
+func createInstanceHash(opt *InstanceOptions, withDataDisks bool) string {
 	h := sha256.New()
 	h.Write([]byte(opt.Name))
 	h.Write([]byte(opt.ImageURL))
 	h.Write([]byte(opt.StoragePool))
 	h.Write([]byte(opt.UserData))
-	// add the data disks to the mix
-	for _, disk := range sortDataDisks(opt.DataDisks) {
-		h.Write([]byte(disk.Name))
-		h.Write([]byte(disk.StoragePool))
+	if withDataDisks {
+		for _, disk := range sortDataDisks(opt.DataDisks) {
+			h.Write([]byte(disk.Name))
+			h.Write([]byte(disk.StoragePool))
+		}
 	}
 	// add the networks
 	for _, network := range sortNetwoks(opt.Networks) {
 		h.Write([]byte(network))
 	}
+	// add the static addresses
+	for _, network := range sortAddressNetworks(opt.Addresses) {
+		if address := opt.Addresses[network]; address != nil {
+			h.Write([]byte(network))
+			h.Write([]byte(address.IPv4))
+			h.Write([]byte(address.IPv6))
+		}
+	}
 	bs := h.Sum(nil)
 
 	return hex.EncodeToString(bs)
@@ -155,6 +226,7 @@ func createMetaData(name string) []byte {
 func IsInstanceValid(client *LivirtClient) func(opt *InstanceOptions) (*libvirtxml.Domain, bool) {
 	// connection
 	conn := client.LibVirt
+	setMetadata := setInstanceMetadata(conn)
 
 	return func(opt *InstanceOptions) (*libvirtxml.Domain, bool) {
 		// instance name
@@ -190,22 +262,34 @@ func IsInstanceValid(client *LivirtClient) func(opt *InstanceOptions) (*libvirtx
 			log.Printf("Domain [%s] does not have metadata", name)
 		}
 		// check the metadata
-		metadata := InstanceMetadata{}
-		err = xml.Unmarshal([]byte(existingXML.Metadata.XML), &metadata)
+		metadata, err := parseInstanceMetadata(existingXML)
 		if err != nil {
 			log.Printf("Unable to parse metadata XML for domain [%s], cause: [%v]", name, err)
 			return existingXML, false
 		}
 		// test the hash
 		newHash := CreateInstanceHash(opt)
-		if metadata.Hash == newHash {
-			// nothing to do
-			log.Printf("Domain [%s] is already up to date, hashes match.", name)
+		if metadata.Hash != newHash && metadata.Hash != createLegacyInstanceHash(opt) {
+			// needs update
+			log.Printf("Domain [%s] needs an update, hashes differ!", name)
+			return existingXML, false
+		}
+		// domains created by an older version hashed their data disks or do not record their cluster, keep them and
+		// record the current values
+		if metadata.Hash != newHash || (len(metadata.Cluster) == 0 && len(opt.Cluster) > 0) {
+			log.Printf("Domain [%s] carries legacy metadata, updating it.", name)
+			metadata.Hash = newHash
+			if len(metadata.Cluster) == 0 {
+				metadata.Cluster = opt.Cluster
+			}
+			if err := setMetadata(existing, metadata); err != nil {
+				log.Printf("Unable to update the metadata of domain [%s], cause: [%v]", name, err)
+			}
 			return existingXML, true
 		}
-		// needs update
-		log.Printf("Domain [%s] needs an update, hashes differ!", name)
-		return existingXML, false
+		// nothing to do
+		log.Printf("Domain [%s] is already up to date, hashes match.", name)
+		return existingXML, true
 	}
 }
 
@@ -214,16 +298,23 @@ func CreateInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (*libvi
 	// some shortcuts
 	uploadBootDisk := UploadBootDisk(client)
 	cloneBootDisk := CloneBootDisk(client)
+	overlayBootDisk := OverlayBootDisk(client)
 	uploadCloudInit := UploadCloudInit(client)
 
 	createBootDisk := CreateBootDiskXML(client)
 	createCloudInit := CreateCloudInitDisk(client)
 	startDomain := StartDomain(client)
+	defineDomain := DefineDomain(client)
 	deleteDomain := DeleteDomainByName(client)
 
 	createLoggingVolume := CreateLoggingVolume(client)
 	isInstanceValid := IsInstanceValid(client)
 	createDataDiskXML := CreateDataDiskXML(client)
+	syncDhcpHostReservations := SyncDhcpHostReservations(client)
+	syncDataDiskAttachments := SyncDataDiskAttachments(client)
+	getInstanceMetadata := getInstanceMetadataByName(client.LibVirt)
+	restartInstance := RestartInstanceSync(client)
+	deleteAdopted := deleteAdoptedVolumes(client.LibVirt)
 
 	return func(opt *InstanceOptions) (*libvirtxml.Domain, error) {
 		// log this config
@@ -235,37 +326,82 @@ func CreateInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (*libvi
 		logName := GetLoggingVolumeName(name)
 		// compute some identifier of the input
 		metadata := InstanceMetadata{
-			Hash: CreateInstanceHash(opt),
+			Hash:    CreateInstanceHash(opt),
+			Owner:   opt.Owner,
+			Cluster: opt.Cluster,
 		}
-		metadataXML, err := XMLMarshall(metadata)
-		if err != nil {
-			return nil, err
+		if opt.PowerState == PowerStateStopped {
+			metadata.PowerState = PowerStateStopped
 		}
 		// check for domain
 		existingDomain, valid := isInstanceValid(opt)
 		if valid {
-			return existingDomain, nil
+			// changes of the data disks do not require a new domain
+			return syncDataDiskAttachments(existingDomain, opt.DataDisks)
 		}
+		// a stopped domain is restarted according to its policy, without touching its storage
+		restartedDomain, restarts, err := restartInstance(opt)
+		if err != nil || restartedDomain != nil {
+			return restartedDomain, err
+		}
+		metadata.Restarts = restarts
 		// cidata
 		cidataIso, err := CreateCloudInit([]byte(opt.UserData), createMetaData(name))
 		if err != nil {
 			return nil, err
 		}
+		// locate the base image
+		imageSource, err := GetImageSource(opt)
+		if err != nil {
+			return nil, err
+		}
+		// reserve the static addresses, so the domain receives them with its first lease
+		reservations, err := GetDhcpHostReservations(opt)
+		if err != nil {
+			return nil, err
+		}
+		err = syncDhcpHostReservations(name, reservations)
+		if err != nil {
+			return nil, err
+		}
+		// data disks keep the devices of the previous domain
+		previous := getInstanceMetadata(name)
+		metadata.DataDisks = allocateDataDiskDevs(previous.DataDisks, opt.DataDisks, map[string]bool{
+			bootDiskDev:      true,
+			cloudInitDiskDev: true,
+		})
+		// make sure to upload the image, the previous domain keeps running if this fails
+		log.Println("Uploading boot disk ...")
+		bootVolume, err := uploadBootDisk(opt.StoragePool, imageSource)
+		if err != nil {
+			return nil, err
+		}
 		// delete a previous domain
 		log.Println("Deleting domain ...")
 		err = deleteDomain(name)
 		if err != nil {
 			return nil, err
 		}
-		// make sure to upload the image
-		log.Println("Uploading boot disk ...")
-		bootVolume, err := uploadBootDisk(opt.StoragePool, path.Base(opt.ImageURL), opt.ImageURL)
+		// the volumes of an adopted domain are replaced by volumes of the operator
+		deleteAdopted(previous.Adopted)
+		// remember the base image, so it is not garbage collected while in use
+		metadata.BaseImage = &InstanceBaseImage{
+			Pool: GetImageStoragePool(opt.StoragePool, imageSource),
+			Name: bootVolume.Name,
+		}
+		metadataXML, err := XMLMarshall(metadata)
 		if err != nil {
 			return nil, err
 		}
 		// make sure to clone the image
-		log.Println("Cloning boot disk ...")
-		clonedBootVolume, err := cloneBootDisk(opt.StoragePool, bootVolume, bootName)
+		var clonedBootVolume *libvirtxml.StorageVolume
+		if opt.BootDiskMode == BootDiskModeOverlay {
+			log.Println("Creating boot disk overlay ...")
+			clonedBootVolume, err = overlayBootDisk(opt.StoragePool, bootVolume, bootName)
+		} else {
+			log.Println("Cloning boot disk ...")
+			clonedBootVolume, err = cloneBootDisk(opt.StoragePool, bootVolume, bootName)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -299,8 +435,8 @@ func CreateInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (*libvi
 		domainXML.Metadata.XML = metadataXML
 		domainXML.Devices.Disks = append(domainXML.Devices.Disks, *bootXML, *cidataXML) // order of disks is important
 		// add data disks
-		for idx, dataDisk := range opt.DataDisks {
-			diskXML, err := createDataDiskXML(dataDisk.StoragePool, dataDisk.Name, idx)
+		for _, dataDisk := range metadata.DataDisks {
+			diskXML, err := createDataDiskXML(findAttachedDataDisk(opt.DataDisks, dataDisk.Pool, dataDisk.Name), dataDisk.Dev)
 			if err != nil {
 				return nil, err
 			}
@@ -320,7 +456,7 @@ func CreateInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (*libvi
 			domainXML.Devices.Interfaces = networks
 		} else {
 			// mac address based on the UUID
-			macAddress := CreateMacAddressFromMaybeUUID(name)
+			macAddress := GetInterfaceMacAddress(opt, DefaultNetwork)
 			// construct a network
 			domainXML.Devices.Interfaces = []libvirtxml.DomainInterface{{
 				Model: &libvirtxml.DomainInterfaceModel{
@@ -346,6 +482,10 @@ func CreateInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (*libvi
 			// explicitly set the domain UUID
 			domainXML.UUID = uid.String()
 		}
+		// a stopped instance is only defined
+		if opt.PowerState == PowerStateStopped {
+			return defineDomain(domainXML)
+		}
 		// start the domain
 		return startDomain(domainXML)
 	}
@@ -357,6 +497,9 @@ func DeleteInstanceSync(client *LivirtClient) func(storagePool, name string) err
 	conn := client.LibVirt
 	deleteDomain := DeleteDomainByName(client)
 	delDisk := deleteStorageVol(conn)
+	deleteDhcpHostReservations := DeleteDhcpHostReservations(client)
+	getInstanceMetadata := getInstanceMetadataByName(conn)
+	deleteAdopted := deleteAdoptedVolumes(conn)
 
 	// delete the disks, but failure will only be logged
 	delDisks := func(storagePool, name string) {
@@ -386,10 +529,17 @@ func DeleteInstanceSync(client *LivirtClient) func(storagePool, name string) err
 	}
 
 	return func(storagePool, name string) error {
+		// the volumes of an adopted domain do not follow the naming of the operator
+		adoption := getInstanceMetadata(name).Adopted
 		// delete the domain
 		err := deleteDomain(name)
 		// delete the disks
 		delDisks(storagePool, name)
+		deleteAdopted(adoption)
+		// release the static addresses, failure will only be logged
+		if errRes := deleteDhcpHostReservations(name); errRes != nil {
+			log.Printf("Unable to release the static addresses of [%s], cause: [%v]", name, errRes)
+		}
 		// done
 		return err
 	}
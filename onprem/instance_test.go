@@ -104,3 +104,23 @@ func TestCreateHash(t *testing.T) {
 
 	assert.Equal(t, hash1, hash2)
 }
+
+func TestMatchesLegacyInstanceHash(t *testing.T) {
+	opt := InstanceOptions{
+		Name:        "vsi",
+		UserData:    "user_data",
+		ImageURL:    "http://example.com",
+		StoragePool: "default",
+		DataDisks: []*AttachedDataDisk{
+			{Name: "data.qcow2", StoragePool: "default"},
+		},
+	}
+	legacy := &InstanceMetadata{Hash: createLegacyInstanceHash(&opt)}
+
+	assert.NotEqual(t, CreateInstanceHash(&opt), legacy.Hash)
+	assert.True(t, matchesInstanceHash(legacy, &opt))
+	assert.True(t, matchesInstanceHash(&InstanceMetadata{Hash: CreateInstanceHash(&opt)}, &opt))
+
+	opt.UserData = "changed"
+	assert.False(t, matchesInstanceHash(legacy, &opt))
+}
@@ -24,9 +24,14 @@ import (
 
 type LivirtClient struct {
 	io.Closer
-	LibVirt   *libvirt.Libvirt
-	Hash      string
+	LibVirt *libvirt.Libvirt
+	Hash    string
+	// the host that identifies the connection, e.g. for staged images
+	Hostname string
+	// the SSH config, nil if the client does not connect via SSH
 	SSHConfig *SSHConfig
+	// controls the transfer of images to the host
+	UploadConfig *UploadConfig
 }
 
 func (client *LivirtClient) Close() error {
@@ -38,29 +43,43 @@ func (client *LivirtClient) Close() error {
 
 // CreateLivirtClient creates a libvirt connection based on an SSH config
 func CreateLivirtClient(sshConfig *SSHConfig) (*LivirtClient, error) {
+	return CreateLivirtClientFromTransport(&TransportConfig{
+		Transport: TransportSSH,
+		Hostname:  sshConfig.Hostname,
+		SSH:       sshConfig,
+	})
+}
+
+// CreateLivirtClientFromTransport creates a libvirt connection based on a transport config
+func CreateLivirtClientFromTransport(config *TransportConfig) (*LivirtClient, error) {
 
-	dialer := CreateSSHDialer(sshConfig)
+	dialer, hash := createTransportDialer(config)
 
 	// construct the client
 	l := libvirt.NewWithDialer(dialer)
-	// TODO do we need to be able to pass a sub identifier of the libvirt instance
-	err := l.ConnectToURI(libvirt.ConnectURI(""))
+	err := l.ConnectToURI(libvirt.ConnectURI(config.URI))
 	if err != nil {
 		return nil, err
 	}
 
-	// build the hash
-	hash := getHost(sshConfig)
-
 	return &LivirtClient{
 		LibVirt:   l,
 		Hash:      hash,
-		SSHConfig: sshConfig,
+		Hostname:  config.Hostname,
+		SSHConfig: config.SSH,
 	}, nil
 }
 
 // CreateLivirtClientFromEnvMap constructs the libvirt client from an env map
 func CreateLivirtClientFromEnvMap(envMap env.Environment) (*LivirtClient, error) {
-	// just dispatch
-	return CreateLivirtClient(GetSSHConfigFromEnvMap(envMap))
+	transport, err := GetTransportConfigFromEnvMap(envMap)
+	if err != nil {
+		return nil, err
+	}
+	client, err := CreateLivirtClientFromTransport(transport)
+	if err != nil {
+		return nil, err
+	}
+	client.UploadConfig = GetUploadConfigFromEnvMap(envMap)
+	return client, nil
 }
@@ -27,7 +27,6 @@ import (
 	"os/exec"
 
 	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
-	"golang.org/x/crypto/ssh"
 	"libvirt.org/go/libvirtxml"
 )
 
@@ -141,6 +140,62 @@ func GetLoggingVolume(client *LivirtClient) func(storagePool, name string) (stri
 	}
 }
 
+// LogChunk is the content of the console log that has been appended since a given offset
+type LogChunk struct {
+	// offset of the data in the log
+	Offset uint64
+	// the new content, may end with an incomplete line
+	Data []byte
+	// offset to continue reading from
+	Next uint64
+	// the log has been truncated, e.g. because the VSI was restarted, so reading started from the beginning
+	Restarted bool
+}
+
+// getLogReadRange computes the range of the log to read, starting over if the log is shorter than the offset
+func getLogReadRange(offset, size uint64) (uint64, uint64, bool) {
+	size = min(size, maxLoggingVolumeSize)
+	if offset > size {
+		return 0, size, true
+	}
+	return offset, size - offset, false
+}
+
+// ReadLoggingVolume reads the console log from the given offset, so only new content is transferred
+func ReadLoggingVolume(client *LivirtClient) func(storagePool, name string, offset uint64) (*LogChunk, error) {
+	conn := client.LibVirt
+
+	return func(storagePool, name string, offset uint64) (*LogChunk, error) {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return nil, err
+		}
+		vol, err := conn.StorageVolLookupByName(pool, name)
+		if err != nil {
+			return nil, err
+		}
+		// the capacity of the raw log file is its current size
+		_, size, _, err := conn.StorageVolGetInfo(vol)
+		if err != nil {
+			return nil, err
+		}
+		start, length, restarted := getLogReadRange(offset, size)
+		chunk := &LogChunk{Offset: start, Next: start, Restarted: restarted}
+		if length == 0 {
+			return chunk, nil
+		}
+		var buffer bytes.Buffer
+		err = conn.StorageVolDownload(vol, &buffer, start, length, 0)
+		if err != nil {
+			return nil, err
+		}
+		// a log that has not been opened by the VSI, yet, is padded
+		chunk.Data = bytes.TrimRight(buffer.Bytes(), "\x00")
+		chunk.Next = start + uint64(len(chunk.Data))
+		return chunk, nil
+	}
+}
+
 // PartitionLogs partitions the original logs into success and error logs
 func PartitionLogs(logs []string) ([]string, []string) {
 	var success, failure []string
@@ -186,34 +241,7 @@ func GetLoggingVolumeViaSSH(config *SSHConfig) func(path string) (string, error)
 		defer CM.PanicAfterTimeout(msg, maxDownloadTimeout)()
 		defer CM.EntryExit(msg)()
 
-		origin := getHost(config)
-
-		// detect the username
-		username, err := getUserName(config)
-		if err != nil {
-			return "", err
-		}
-		// host key
-		hostKeyCallback, err := getHostKeyCallback(config)
-		if err != nil {
-			return "", err
-		}
-		// private key
-		signer, err := getPrivateKey(config)
-		if err != nil {
-			log.Printf("Unable to get private key, cause: [%v]", err)
-			return "", err
-		}
-
-		cfg := ssh.ClientConfig{
-			User:            username,
-			HostKeyCallback: hostKeyCallback,
-			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
-			Timeout:         dialTimeout,
-			BannerCallback:  printBanner,
-		}
-
-		sshClient, err := ssh.Dial("tcp", origin, &cfg)
+		sshClient, err := dialSSH(config)
 		if err != nil {
 			log.Printf("Unable to create SSH client, cause: [%v]", err)
 			return "", err
@@ -250,7 +278,7 @@ func getLoggingVolumeViaCommand(ctx context.Context, config *SSHConfig, command
 	defer CM.EntryExit(msg)()
 
 	// marshal the ssh config
-	configBytes, err := json.Marshal(config)
+	configBytes, err := json.Marshal(resolvePinnedHostKeys(config))
 	if err != nil {
 		log.Printf("Unable to marshal SSH config, cause: [%v]", err)
 		return "", err
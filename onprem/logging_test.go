@@ -110,3 +110,26 @@ func TestPartitionFailedStartup(t *testing.T) {
 
 // 	fmt.Println(data)
 // }
+
+func TestGetLogReadRange(t *testing.T) {
+	// new content
+	start, length, restarted := getLogReadRange(100, 150)
+	assert.Equal(t, uint64(100), start)
+	assert.Equal(t, uint64(50), length)
+	assert.False(t, restarted)
+
+	// nothing new
+	_, length, restarted = getLogReadRange(150, 150)
+	assert.Zero(t, length)
+	assert.False(t, restarted)
+
+	// the log has been truncated
+	start, length, restarted = getLogReadRange(150, 20)
+	assert.Zero(t, start)
+	assert.Equal(t, uint64(20), length)
+	assert.True(t, restarted)
+
+	// never read beyond the logging volume
+	_, length, _ = getLogReadRange(0, 2*maxLoggingVolumeSize)
+	assert.Equal(t, maxLoggingVolumeSize, length)
+}
@@ -0,0 +1,515 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	A "github.com/IBM/fp-go/array"
+	libvirt "github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// the network is connected to the outside via NAT
+	NetworkModeNAT = "nat"
+	// the network is connected to the outside via routing
+	NetworkModeRoute = "route"
+	// the network is not connected to the outside
+	NetworkModeIsolated = "isolated"
+	// the network is an existing bridge on the host
+	NetworkModeBridge = "bridge"
+)
+
+var (
+	// full identifier of the network config entry
+	KeyNetworkConfig = fmt.Sprintf("%s.%s", KindNetwork, APIVersion)
+)
+
+// ManagedNetworkMetadata marks a libvirt network as being owned by a network resource
+type ManagedNetworkMetadata struct {
+	XMLName xml.Name `xml:"https://github.com/ibm-hyper-protect/k8s-operator-hpcr network"`
+	Owner   string   `xml:"owner"`
+}
+
+type NetworkOptions struct {
+	// name of the libvirt network
+	Name string
+	// identifier of the owning resource
+	Owner string
+	// forward mode of the network
+	Mode string
+	// name of the bridge device
+	Bridge string
+	// IP ranges of the network
+	IPs []*NetworkIPRange
+	// static DNS entries
+	DNS []*NetworkDNSEntry
+	// start the network when the host boots
+	Autostart bool
+}
+
+// NetworkInUseError reports that domains are still attached to a network
+type NetworkInUseError struct {
+	// name of the network
+	Network string
+	// names of the attached domains
+	Domains []string
+}
+
+func (e *NetworkInUseError) Error() string {
+	return fmt.Sprintf("network [%s] is in use by domains %v", e.Network, e.Domains)
+}
+
+// GetManagedNetworkName returns the name of the libvirt network of a network resource
+func GetManagedNetworkName(res *NetworkCustomResource) string {
+	if len(res.Spec.NetworkName) > 0 {
+		return res.Spec.NetworkName
+	}
+	return res.Name
+}
+
+func createNetworkIPDef(ipRange *NetworkIPRange) (*libvirtxml.NetworkIP, error) {
+	prefix, err := netip.ParsePrefix(ipRange.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address [%s], expected CIDR notation, cause: [%w]", ipRange.Address, err)
+	}
+	ipDef := &libvirtxml.NetworkIP{
+		Address: prefix.Addr().String(),
+		Prefix:  uint(prefix.Bits()),
+	}
+	if prefix.Addr().Is6() {
+		ipDef.Family = "ipv6"
+	}
+	// DHCP is optional
+	if len(ipRange.DHCPStart) == 0 && len(ipRange.DHCPEnd) == 0 {
+		return ipDef, nil
+	}
+	start, err := parseAddress(ipRange.DHCPStart, prefix.Addr().Is6())
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseAddress(ipRange.DHCPEnd, prefix.Addr().Is6())
+	if err != nil {
+		return nil, err
+	}
+	if !prefix.Contains(start) || !prefix.Contains(end) {
+		return nil, fmt.Errorf("DHCP range [%s - %s] is not part of [%s]", start, end, prefix)
+	}
+	ipDef.DHCP = &libvirtxml.NetworkDHCP{
+		Ranges: []libvirtxml.NetworkDHCPRange{{
+			Start: start.String(),
+			End:   end.String(),
+		}},
+	}
+	return ipDef, nil
+}
+
+// CreateNetworkDef creates the libvirt definition of a managed network
+func CreateNetworkDef(opt *NetworkOptions) (*libvirtxml.Network, error) {
+	metadataXML, err := XMLMarshall(ManagedNetworkMetadata{Owner: opt.Owner})
+	if err != nil {
+		return nil, err
+	}
+	def := &libvirtxml.Network{
+		Name: opt.Name,
+		Metadata: &libvirtxml.NetworkMetadata{
+			XML: metadataXML,
+		},
+	}
+	mode := BoxNetworkMode(opt.Mode)
+	switch mode {
+	case NetworkModeNAT, NetworkModeRoute:
+		if !A.IsNonEmpty(opt.IPs) {
+			return nil, fmt.Errorf("network mode [%s] requires at least one IP range", mode)
+		}
+		def.Forward = &libvirtxml.NetworkForward{Mode: mode}
+	case NetworkModeIsolated:
+	case NetworkModeBridge:
+		if len(opt.Bridge) == 0 {
+			return nil, fmt.Errorf("network mode [%s] requires the name of an existing bridge", mode)
+		}
+		if A.IsNonEmpty(opt.IPs) || A.IsNonEmpty(opt.DNS) {
+			return nil, fmt.Errorf("network mode [%s] does not support IP ranges or DNS entries", mode)
+		}
+		def.Forward = &libvirtxml.NetworkForward{Mode: mode}
+	default:
+		return nil, fmt.Errorf("unsupported network mode [%s]", mode)
+	}
+	if len(opt.Bridge) > 0 {
+		def.Bridge = &libvirtxml.NetworkBridge{Name: opt.Bridge}
+	}
+	for _, ipRange := range opt.IPs {
+		ipDef, err := createNetworkIPDef(ipRange)
+		if err != nil {
+			return nil, err
+		}
+		def.IPs = append(def.IPs, *ipDef)
+	}
+	for _, entry := range opt.DNS {
+		ip, err := netip.ParseAddr(entry.IP)
+		if err != nil {
+			return nil, err
+		}
+		if !A.IsNonEmpty(entry.Hostnames) {
+			return nil, fmt.Errorf("DNS entry for [%s] does not define any hostnames", entry.IP)
+		}
+		if def.DNS == nil {
+			def.DNS = &libvirtxml.NetworkDNS{}
+		}
+		host := libvirtxml.NetworkDNSHost{IP: ip.String()}
+		for _, hostname := range entry.Hostnames {
+			host.Hostnames = append(host.Hostnames, libvirtxml.NetworkDNSHostHostname{Hostname: hostname})
+		}
+		def.DNS.Host = append(def.DNS.Host, host)
+	}
+	return def, nil
+}
+
+// getNetworkOwner returns the owner of a managed network or an empty string for unmanaged networks
+func getNetworkOwner(def *libvirtxml.Network) string {
+	if def.Metadata == nil {
+		return ""
+	}
+	var metadata ManagedNetworkMetadata
+	if err := xml.Unmarshal([]byte(def.Metadata.XML), &metadata); err != nil {
+		return ""
+	}
+	return metadata.Owner
+}
+
+func canonicalAddress(address string) string {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return address
+	}
+	return addr.String()
+}
+
+// networkFingerprint summarizes the aspects of a network that are managed by the network resource, so drift can be detected.
+// DHCP host entries are not part of the fingerprint, they are managed per instance.
+func networkFingerprint(def *libvirtxml.Network, withBridge bool) []string {
+	mode := NetworkModeIsolated
+	if def.Forward != nil {
+		mode = def.Forward.Mode
+	}
+	result := []string{fmt.Sprintf("mode=%s", mode)}
+	if withBridge && def.Bridge != nil {
+		result = append(result, fmt.Sprintf("bridge=%s", def.Bridge.Name))
+	}
+	for idx := range def.IPs {
+		ipDef := &def.IPs[idx]
+		prefix, err := getNetworkIPPrefix(ipDef)
+		if err != nil {
+			result = append(result, fmt.Sprintf("ip=%s", ipDef.Address))
+		} else {
+			result = append(result, fmt.Sprintf("ip=%s", prefix))
+		}
+		if ipDef.DHCP != nil {
+			for _, rng := range ipDef.DHCP.Ranges {
+				result = append(result, fmt.Sprintf("dhcp=%s-%s", canonicalAddress(rng.Start), canonicalAddress(rng.End)))
+			}
+		}
+	}
+	if def.DNS != nil {
+		var hosts []string
+		for _, host := range def.DNS.Host {
+			hostnames := A.MonadMap(host.Hostnames, func(hostname libvirtxml.NetworkDNSHostHostname) string {
+				return hostname.Hostname
+			})
+			hosts = append(hosts, fmt.Sprintf("dns=%s=%s", canonicalAddress(host.IP), strings.Join(hostnames, ",")))
+		}
+		sort.Strings(hosts)
+		result = append(result, hosts...)
+	}
+	return result
+}
+
+// isNetworkInSync checks if the existing network matches the desired definition
+func isNetworkInSync(desired, actual *libvirtxml.Network) bool {
+	withBridge := desired.Bridge != nil
+	return slices.Equal(networkFingerprint(desired, withBridge), networkFingerprint(actual, withBridge))
+}
+
+// preserveNetworkIdentity copies the generated identity and the DHCP host entries of the existing network into the
+// desired definition, so a redefinition does not affect attached instances or their static addresses
+func preserveNetworkIdentity(desired, actual *libvirtxml.Network) {
+	desired.UUID = actual.UUID
+	desired.MAC = actual.MAC
+	if desired.Bridge == nil {
+		desired.Bridge = actual.Bridge
+	}
+	for idx := range desired.IPs {
+		ipDef := &desired.IPs[idx]
+		if ipDef.DHCP == nil {
+			continue
+		}
+		for _, actualIPDef := range actual.IPs {
+			if actualIPDef.DHCP != nil && isSameAddress(actualIPDef.Address, ipDef.Address) {
+				ipDef.DHCP.Hosts = actualIPDef.DHCP.Hosts
+			}
+		}
+	}
+}
+
+// GetNetworkDomains returns the names of all domains with an interface on the network
+func GetNetworkDomains(client *LivirtClient) func(networkName string) ([]string, error) {
+	conn := client.LibVirt
+
+	return func(networkName string) ([]string, error) {
+		domains, _, err := conn.ConnectListAllDomains(NeedResults, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result []string
+		for _, domain := range domains {
+			domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+			if err != nil {
+				return nil, err
+			}
+			domainXML, err := parseDomainXML(domainStrg)
+			if err != nil {
+				return nil, err
+			}
+			if domainXML.Devices == nil {
+				continue
+			}
+			for _, iface := range domainXML.Devices.Interfaces {
+				if iface.Source != nil && iface.Source.Network != nil && iface.Source.Network.Network == networkName {
+					result = append(result, domain.Name)
+					break
+				}
+			}
+		}
+		return result, nil
+	}
+}
+
+// CreateNetworkSync (synchronously) creates a managed network or reconciles its drift
+func CreateNetworkSync(client *LivirtClient) func(opt *NetworkOptions) (*libvirtxml.Network, error) {
+	conn := client.LibVirt
+	networkXMLDesc := getNetworkXMLDesc(conn)
+	getNetworkDomains := GetNetworkDomains(client)
+
+	// persistentNetworkXMLDesc returns the definition that takes effect on the next start of the network
+	persistentNetworkXMLDesc := func(net *libvirt.Network) (*libvirtxml.Network, error) {
+		xmlDef, err := conn.NetworkGetXMLDesc(*net, uint32(libvirt.NetworkXMLInactive))
+		if err != nil {
+			return nil, err
+		}
+		return parseNetworkXML(xmlDef)
+	}
+
+	defineNetwork := func(def *libvirtxml.Network) (libvirt.Network, error) {
+		defXML, err := XMLMarshall(def)
+		if err != nil {
+			return libvirt.Network{}, err
+		}
+		log.Printf("Defining network [%s] ...", def.Name)
+		return conn.NetworkDefineXML(defXML)
+	}
+
+	return func(opt *NetworkOptions) (*libvirtxml.Network, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("CreateNetworkSync(%s)", opt.Name))()
+		// the desired state
+		desired, err := CreateNetworkDef(opt)
+		if err != nil {
+			return nil, err
+		}
+		net, err := conn.NetworkLookupByName(opt.Name)
+		if err != nil {
+			if !isError(err, libvirt.ErrNoNetwork) {
+				log.Printf("Unable to lookup network [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+			// new network
+			net, err = defineNetwork(desired)
+			if err != nil {
+				log.Printf("Unable to define network [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+		} else {
+			actual, err := networkXMLDesc(&net)
+			if err != nil {
+				log.Printf("Unable to get information for network [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+			// never take over a network we did not create
+			if owner := getNetworkOwner(actual); owner != opt.Owner {
+				return nil, fmt.Errorf("network [%s] exists but is not managed by this resource, owner is [%s]", opt.Name, owner)
+			}
+			if !isNetworkInSync(desired, actual) {
+				// a previous sync may already have redefined the network, pending a restart
+				persistent, err := persistentNetworkXMLDesc(&net)
+				if err != nil {
+					log.Printf("Unable to get the persistent definition of network [%s], cause: [%v]", opt.Name, err)
+					return nil, err
+				}
+				if !isNetworkInSync(desired, persistent) {
+					log.Printf("Network [%s] has drifted from its specification, redefining ...", opt.Name)
+					preserveNetworkIdentity(desired, actual)
+					net, err = defineNetwork(desired)
+					if err != nil {
+						log.Printf("Unable to redefine network [%s], cause: [%v]", opt.Name, err)
+						return nil, err
+					}
+				}
+				// the new definition only takes effect after a restart
+				active, err := conn.NetworkIsActive(net)
+				if err != nil {
+					return nil, err
+				}
+				if active != 0 {
+					domains, err := getNetworkDomains(opt.Name)
+					if err != nil {
+						return nil, err
+					}
+					if A.IsNonEmpty(domains) {
+						return nil, &NetworkInUseError{Network: opt.Name, Domains: domains}
+					}
+					log.Printf("Restarting network [%s] ...", opt.Name)
+					err = conn.NetworkDestroy(net)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		// make sure the network is running
+		active, err := conn.NetworkIsActive(net)
+		if err != nil {
+			return nil, err
+		}
+		if active == 0 {
+			log.Printf("Starting network [%s] ...", opt.Name)
+			err = conn.NetworkCreate(net)
+			if err != nil {
+				log.Printf("Unable to start network [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+		}
+		// autostart
+		autostart, err := conn.NetworkGetAutostart(net)
+		if err != nil {
+			return nil, err
+		}
+		if (autostart != 0) != opt.Autostart {
+			var flag int32
+			if opt.Autostart {
+				flag = 1
+			}
+			err = conn.NetworkSetAutostart(net, flag)
+			if err != nil {
+				log.Printf("Unable to set autostart of network [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+		}
+		// final state
+		return networkXMLDesc(&net)
+	}
+}
+
+// DeleteNetworkSync (synchronously) deletes a managed network, it refuses to do so while domains are attached
+func DeleteNetworkSync(client *LivirtClient) func(opt *NetworkOptions) error {
+	conn := client.LibVirt
+	networkXMLDesc := getNetworkXMLDesc(conn)
+	getNetworkDomains := GetNetworkDomains(client)
+
+	return func(opt *NetworkOptions) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("DeleteNetworkSync(%s)", opt.Name))()
+
+		net, err := conn.NetworkLookupByName(opt.Name)
+		if err != nil {
+			if isError(err, libvirt.ErrNoNetwork) {
+				log.Printf("Network [%s] does not exist, nothing to delete", opt.Name)
+				return nil
+			}
+			return err
+		}
+		actual, err := networkXMLDesc(&net)
+		if err != nil {
+			return err
+		}
+		if owner := getNetworkOwner(actual); owner != opt.Owner {
+			log.Printf("Network [%s] is not managed by this resource, leaving it untouched", opt.Name)
+			return nil
+		}
+		domains, err := getNetworkDomains(opt.Name)
+		if err != nil {
+			return err
+		}
+		if A.IsNonEmpty(domains) {
+			return &NetworkInUseError{Network: opt.Name, Domains: domains}
+		}
+		active, err := conn.NetworkIsActive(net)
+		if err != nil {
+			return err
+		}
+		if active != 0 {
+			log.Printf("Stopping network [%s] ...", opt.Name)
+			err = conn.NetworkDestroy(net)
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("Undefining network [%s] ...", opt.Name)
+		return conn.NetworkUndefine(net)
+	}
+}
+
+// NetworksFromRelated decodes the set of managed networks from the related data structure, only networks in ready state are returned
+func NetworksFromRelated(data map[string]any) ([]*NetworkCustomResource, error) {
+	var result []*NetworkCustomResource
+	if related, ok := data["related"].(map[string]any); ok {
+		// all networks
+		if networks, ok := related[KeyNetworkConfig].(map[string]any); ok {
+			// decode each network
+			for _, network := range networks {
+				// transcode to the expected format
+				net, err := common.Transcode[*NetworkCustomResource](network)
+				if err != nil {
+					return nil, err
+				}
+				// validate the status of the network
+				if common.Status(net.Status.Status) == common.Ready {
+					result = append(result, net)
+				} else {
+					// print the invalid network config
+					res, err := json.Marshal(net)
+					if err == nil {
+						log.Printf("Network not ready is [%s]", string(res))
+					}
+					log.Printf("Network [%s] is not in ready state, ignoring, cause: [%s]", net.Name, net.Status.Description)
+				}
+			}
+		}
+	}
+	// ok
+	return result, nil
+}
+
+// NetworkCustomResourceToNetworks converts from an array of NetworkCustomResource to an array of network names
+var NetworkCustomResourceToNetworks = A.Map(GetManagedNetworkName)
@@ -0,0 +1,131 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"libvirt.org/go/libvirtxml"
+)
+
+func createTestNetworkOptions() *NetworkOptions {
+	return &NetworkOptions{
+		Name:  "hpcr-net",
+		Owner: "uid",
+		IPs: []*NetworkIPRange{
+			{Address: "192.168.150.1/24", DHCPStart: "192.168.150.100", DHCPEnd: "192.168.150.200"},
+			{Address: "fd00:150::1/64"},
+		},
+		DNS: []*NetworkDNSEntry{
+			{IP: "192.168.150.10", Hostnames: []string{"registry.hpcr.local"}},
+		},
+	}
+}
+
+func TestCreateNetworkDef(t *testing.T) {
+	def, err := CreateNetworkDef(createTestNetworkOptions())
+	require.NoError(t, err)
+
+	assert.Equal(t, "hpcr-net", def.Name)
+	assert.Equal(t, NetworkModeNAT, def.Forward.Mode)
+	require.Len(t, def.IPs, 2)
+	assert.Equal(t, "192.168.150.1", def.IPs[0].Address)
+	assert.Equal(t, uint(24), def.IPs[0].Prefix)
+	assert.Equal(t, "192.168.150.100", def.IPs[0].DHCP.Ranges[0].Start)
+	assert.Equal(t, "ipv6", def.IPs[1].Family)
+	assert.Nil(t, def.IPs[1].DHCP)
+	assert.Equal(t, "registry.hpcr.local", def.DNS.Host[0].Hostnames[0].Hostname)
+	assert.Equal(t, "uid", getNetworkOwner(def))
+
+	// the definition survives a roundtrip through libvirt
+	defXML, err := XMLMarshall(def)
+	require.NoError(t, err)
+	parsed, err := parseNetworkXML(defXML)
+	require.NoError(t, err)
+	assert.Equal(t, "uid", getNetworkOwner(parsed))
+	assert.True(t, isNetworkInSync(def, parsed))
+}
+
+func TestCreateNetworkDefInvalid(t *testing.T) {
+	// bridge mode requires a bridge
+	_, err := CreateNetworkDef(&NetworkOptions{Name: "br", Mode: NetworkModeBridge})
+	assert.Error(t, err)
+	// bridge mode does not support IP ranges
+	_, err = CreateNetworkDef(&NetworkOptions{Name: "br", Mode: NetworkModeBridge, Bridge: "br0", IPs: []*NetworkIPRange{{Address: "10.0.0.1/24"}}})
+	assert.Error(t, err)
+	// NAT requires an IP range
+	_, err = CreateNetworkDef(&NetworkOptions{Name: "nat"})
+	assert.Error(t, err)
+	// DHCP range outside of the subnet
+	_, err = CreateNetworkDef(&NetworkOptions{Name: "nat", IPs: []*NetworkIPRange{{Address: "10.0.0.1/24", DHCPStart: "10.0.1.1", DHCPEnd: "10.0.1.9"}}})
+	assert.Error(t, err)
+	// unknown mode
+	_, err = CreateNetworkDef(&NetworkOptions{Name: "nat", Mode: "vepa"})
+	assert.Error(t, err)
+
+	// isolated networks do not forward
+	def, err := CreateNetworkDef(&NetworkOptions{Name: "iso", Mode: NetworkModeIsolated})
+	require.NoError(t, err)
+	assert.Nil(t, def.Forward)
+}
+
+func TestNetworkDrift(t *testing.T) {
+	desired, err := CreateNetworkDef(createTestNetworkOptions())
+	require.NoError(t, err)
+
+	// the network as reported by libvirt with generated identity, netmask and a static reservation
+	actual, err := parseNetworkXML(`<network>
+  <name>hpcr-net</name>
+  <uuid>97d16d9e-da57-492c-82a0-0388561bf065</uuid>
+  <forward mode="nat"><nat><port start="1024" end="65535"/></nat></forward>
+  <bridge name="virbr1" stp="on" delay="0"/>
+  <mac address="52:54:00:2b:4b:c4"/>
+  <dns><host ip="192.168.150.10"><hostname>registry.hpcr.local</hostname></host></dns>
+  <ip address="192.168.150.1" netmask="255.255.255.0">
+    <dhcp>
+      <range start="192.168.150.100" end="192.168.150.200"/>
+      <host mac="02:00:00:00:00:02" name="vsi" ip="192.168.150.20"/>
+    </dhcp>
+  </ip>
+  <ip family="ipv6" address="fd00:150::1" prefix="64"/>
+</network>`)
+	require.NoError(t, err)
+	assert.True(t, isNetworkInSync(desired, actual))
+
+	// a changed DHCP range is drift
+	desired.IPs[0].DHCP.Ranges[0].End = "192.168.150.150"
+	assert.False(t, isNetworkInSync(desired, actual))
+
+	// a redefinition keeps the identity and the reservations
+	preserveNetworkIdentity(desired, actual)
+	assert.Equal(t, actual.UUID, desired.UUID)
+	assert.Equal(t, "virbr1", desired.Bridge.Name)
+	require.Len(t, desired.IPs[0].DHCP.Hosts, 1)
+	assert.Equal(t, "192.168.150.20", desired.IPs[0].DHCP.Hosts[0].IP)
+}
+
+func TestGetNetworkOwnerUnmanaged(t *testing.T) {
+	assert.Empty(t, getNetworkOwner(&libvirtxml.Network{Name: "default"}))
+}
+
+func TestGetManagedNetworkName(t *testing.T) {
+	res := &NetworkCustomResource{ObjectMeta: metav1.ObjectMeta{Name: "hpcr-net"}}
+	assert.Equal(t, "hpcr-net", GetManagedNetworkName(res))
+	res.Spec.NetworkName = "other"
+	assert.Equal(t, "other", GetManagedNetworkName(res))
+}
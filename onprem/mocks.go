@@ -46,83 +46,147 @@ func GetSSHConfigPath() (string, error) {
 	return homedir.Expand("~/.ssh/config")
 }
 
-// LoadSSHConfig loads the SSH config file
-func LoadSSHConfig(configFile string) func(configName string) (*SSHConfig, error) {
+// maximum nesting of jump hosts that declare jump hosts themselves
+const maxProxyJumpDepth = 8
 
-	return func(configName string) (*SSHConfig, error) {
+// readSSHConfigFile reads a file referenced by the SSH config
+func readSSHConfigFile(name string) (string, error) {
+	resolved, err := homedir.Expand(name)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Clean(resolved))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
 
-		cfgFile, err := os.Open(filepath.Clean(configFile))
-		if err != nil {
-			return nil, err
-		}
-		defer safeClose(cfgFile)
+// loadSSHConfig resolves a host of the SSH config including its identities, certificates and jump hosts
+func loadSSHConfig(cfg *ssh_config.Config, configName string, depth int) (*SSHConfig, error) {
+	if depth > maxProxyJumpDepth {
+		return nil, fmt.Errorf("the jump hosts of [%s] are nested deeper than [%d] levels", configName, maxProxyJumpDepth)
+	}
 
-		cfg, err := ssh_config.Decode(cfgFile)
+	// prepare the config
+	sshConfig := &SSHConfig{}
+
+	// populate the config
+	port, err := cfg.Get(configName, "Port")
+	if (err == nil) && len(port) > 0 {
+		intPort, err := strconv.Atoi(port)
 		if err != nil {
 			return nil, err
 		}
+		sshConfig.Port = intPort
+	}
 
-		// prepare the config
-		sshConfig := &SSHConfig{}
-
-		// populate the config
-		port, err := cfg.Get(configName, "Port")
-		if (err == nil) && len(port) > 0 {
-			intPort, err := strconv.Atoi(port)
-			if err != nil {
-				return nil, err
-			}
-			sshConfig.Port = intPort
-		}
-
-		hostname, err := cfg.Get(configName, "Hostname")
-		if (err == nil) && len(hostname) > 0 {
-			sshConfig.Hostname = hostname
-		} else {
-			sshConfig.Hostname = configName
-		}
+	hostname, err := cfg.Get(configName, "Hostname")
+	if (err == nil) && len(hostname) > 0 {
+		sshConfig.Hostname = hostname
+	} else {
+		sshConfig.Hostname = configName
+	}
 
-		user, err := cfg.Get(configName, "User")
-		if (err == nil) && len(user) > 0 {
-			sshConfig.User = user
-		}
+	user, err := cfg.Get(configName, "User")
+	if (err == nil) && len(user) > 0 {
+		sshConfig.User = user
+	}
 
-		identityFile, err := cfg.Get(configName, "IdentityFile")
-		if (err == nil) && len(identityFile) > 0 {
+	// all identities are tried in order
+	var keys, certs []string
+	identityFiles, err := cfg.GetAll(configName, "IdentityFile")
+	if err == nil {
+		for _, identityFile := range identityFiles {
 			// try to read the file
-			resolved, err := homedir.Expand(identityFile)
+			auth, err := readSSHConfigFile(identityFile)
 			if err != nil {
 				return nil, err
 			}
-			auth, err := os.ReadFile(filepath.Clean(resolved))
+			keys = append(keys, auth)
+			// like OpenSSH pick up the certificate next to the key
+			cert, err := readSSHConfigFile(identityFile + "-cert.pub")
+			if err == nil {
+				certs = append(certs, strings.TrimSpace(cert))
+			}
+		}
+	}
+	certificateFiles, err := cfg.GetAll(configName, "CertificateFile")
+	if err == nil {
+		for _, certificateFile := range certificateFiles {
+			cert, err := readSSHConfigFile(certificateFile)
 			if err != nil {
 				return nil, err
 			}
-			// update the content
-			sshConfig.Key = string(auth)
+			certs = appendUnique(certs, strings.TrimSpace(cert))
+		}
+	}
+	sshConfig.Key = strings.Join(keys, "\n")
+	sshConfig.Certificate = strings.Join(certs, "\n")
+
+	knownHosts, err := cfg.Get(configName, "UserKnownHostsFile")
+	if err == nil {
+		// fallback to the regular known hosts file
+		if len(knownHosts) <= 0 {
+			knownHosts = "~/.ssh/known_hosts"
+		}
+		// try to read the file
+		auth, err := readSSHConfigFile(knownHosts)
+		if err != nil {
+			return nil, err
 		}
+		// split hosts by newline
+		hosts := strings.Split(auth, "\n")
+		sshConfig.KnownHosts = hosts
+	}
 
-		knownHosts, err := cfg.Get(configName, "UserKnownHostsFile")
-		if err == nil {
-			// fallback to the regular known hosts file
-			if len(knownHosts) <= 0 {
-				knownHosts = "~/.ssh/known_hosts"
-			}
-			// try to read the file
-			resolved, err := homedir.Expand(knownHosts)
+	strictHostKeyChecking, err := cfg.Get(configName, "StrictHostKeyChecking")
+	if err == nil {
+		sshConfig.HostKeyPolicy = getHostKeyPolicyFromStrictHostKeyChecking(strictHostKeyChecking)
+	}
+
+	// resolve the jump hosts, each one may be an alias in the config
+	proxyJump, err := cfg.Get(configName, "ProxyJump")
+	if err == nil {
+		for _, item := range parseProxyJump(proxyJump, &SSHConfig{}) {
+			hop, err := loadSSHConfig(cfg, item.Hostname, depth+1)
 			if err != nil {
 				return nil, err
 			}
-			auth, err := os.ReadFile(filepath.Clean(resolved))
-			if err != nil {
-				return nil, err
+			// explicit values of the jump option take precedence
+			if len(item.User) > 0 {
+				hop.User = item.User
+			}
+			if item.Port > 0 {
+				hop.Port = item.Port
 			}
-			// split hosts by newline
-			hosts := strings.Split(string(auth), "\n")
-			sshConfig.KnownHosts = hosts
+			// the jump hosts of a jump host are dialed before it
+			sshConfig.Jumps = append(sshConfig.Jumps, hop.Jumps...)
+			hop.Jumps = nil
+			sshConfig.Jumps = append(sshConfig.Jumps, hop)
+		}
+	}
+
+	return sshConfig, nil
+}
+
+// LoadSSHConfig loads the SSH config file
+func LoadSSHConfig(configFile string) func(configName string) (*SSHConfig, error) {
+
+	return func(configName string) (*SSHConfig, error) {
+
+		cfgFile, err := os.Open(filepath.Clean(configFile))
+		if err != nil {
+			return nil, err
+		}
+		defer safeClose(cfgFile)
+
+		cfg, err := ssh_config.Decode(cfgFile)
+		if err != nil {
+			return nil, err
 		}
 
-		return sshConfig, nil
+		return loadSSHConfig(cfg, configName, 0)
 	}
 }
 
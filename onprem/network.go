@@ -159,10 +159,26 @@ func networkRefCustomResourceToNetworks(res *NetworkRefCustomResource) string {
 // NetworkRefCustomResourceToNetworks converts from an array of NetworkRefCustomResource to an array of attached disks
 var NetworkRefCustomResourceToNetworks = A.Map(networkRefCustomResourceToNetworks)
 
+// NetworkRefCustomResourceToAddresses collects the static addresses of the network refs, keyed by the network name.
+// The addresses of the instance replace the ones of the network refs for the same network.
+func NetworkRefCustomResourceToAddresses(res []*NetworkRefCustomResource, addresses map[string]*NetworkAddress) map[string]*NetworkAddress {
+	result := make(map[string]*NetworkAddress)
+	for _, netRef := range res {
+		if len(netRef.Spec.IPv4) > 0 || len(netRef.Spec.IPv6) > 0 {
+			address := netRef.Spec.NetworkAddress
+			result[netRef.Spec.NetworkName] = &address
+		}
+	}
+	for network, address := range addresses {
+		result[network] = address
+	}
+	return result
+}
+
 func createNetworkXML(prefix string) func(networkName string) libvirtxml.DomainInterface {
 	return func(networkName string) libvirtxml.DomainInterface {
 		// produce a mac address
-		macAddr := CreateMacAddressFromHash(fmt.Sprintf("%s-%s", prefix, networkName))
+		macAddr := createInterfaceMacAddress(prefix, networkName)
 
 		log.Printf("Defining domain interface on network [%s], mac [%s]", networkName, macAddr)
 		return libvirtxml.DomainInterface{
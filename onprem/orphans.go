@@ -0,0 +1,482 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// Environment variable names
+	KeyOrphanSweep         = "ORPHAN_SWEEP"
+	KeyOrphanSweepInterval = "ORPHAN_SWEEP_INTERVAL"
+	KeyOrphanGracePeriod   = "ORPHAN_GRACE_PERIOD"
+	KeyOrphanDryRun        = "ORPHAN_DRY_RUN"
+
+	DefaultOrphanSweepInterval = time.Hour
+
+	// name of the volume that records since when the orphans of a pool are known
+	orphanRegistryVolumeName = "hpcr-orphans.json"
+	// maximum size of the orphan registry
+	maxOrphanRegistrySize = 64 * 1024
+)
+
+// OrphanedInstance describes the domain and the volumes left behind by a VSI resource that does not exist any more
+type OrphanedInstance struct {
+	// UID of the deleted resource, also the name of its domain unless the domain has been adopted
+	Owner string `json:"owner"`
+	// true if the domain still exists
+	Domain bool `json:"domain"`
+	// name of an adopted domain
+	DomainName string `json:"domainName,omitempty"`
+	// names of the volumes of the instance in the storage pool
+	Volumes []string `json:"volumes,omitempty"`
+	// time the orphan has been detected first
+	FirstSeen time.Time `json:"firstSeen"`
+	// true if the orphan is (or would be in dry-run mode) deleted
+	Delete bool `json:"delete"`
+	// human readable explanation
+	Reason string `json:"reason"`
+	// reason why the domain or one of the volumes must not be deleted
+	protected string
+}
+
+// OrphanReport summarizes a sweep of a storage pool
+type OrphanReport struct {
+	StoragePool string              `json:"storagePool"`
+	DryRun      bool                `json:"dryRun"`
+	Orphans     []*OrphanedInstance `json:"orphans"`
+}
+
+// OrphanSweepConfig controls the detection and cleanup of orphans
+type OrphanSweepConfig struct {
+	// false disables the periodic sweep
+	Enabled bool
+	// UIDs of the existing VSI resources
+	Live []string
+	// identifier of the cluster that sweeps, only its own domains are deleted. Empty if the live resources include
+	// the ones of all clusters using the host.
+	Cluster string
+	// orphans are deleted once they have been known for this period, zero only reports them
+	GracePeriod time.Duration
+	// minimum time between two periodic sweeps
+	Interval time.Duration
+	// only report, do not delete
+	DryRun bool
+}
+
+// orphanRegistry is persisted per storage pool and records when the orphans have been detected first
+type orphanRegistry struct {
+	// last time the sweep ran
+	LastSwept time.Time `json:"lastSwept,omitempty"`
+	// first detection keyed by owner
+	FirstSeen map[string]time.Time `json:"firstSeen"`
+}
+
+// instanceVolumePrefixes maps the prefixes of the volumes created for an instance to their suffixes
+var instanceVolumePrefixes = map[string]string{
+	"boot-":    ".qcow2",
+	"cidata-":  ".iso",
+	"console-": ".log",
+}
+
+// getInstanceVolumeOwner returns the UID of the resource an instance volume has been created for
+func getInstanceVolumeOwner(name string) (string, bool) {
+	for prefix, suffix := range instanceVolumePrefixes {
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		owner := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+		if _, err := uuid.Parse(owner); err == nil {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// findInstanceMetadata locates the metadata of the operator among the metadata elements of a domain
+func findInstanceMetadata(domainXML *libvirtxml.Domain) (*InstanceMetadata, bool) {
+	if domainXML.Metadata == nil {
+		return nil, false
+	}
+	decoder := xml.NewDecoder(strings.NewReader(domainXML.Metadata.XML))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, false
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != InstanceMetadataNamespace {
+			continue
+		}
+		var metadata InstanceMetadata
+		if decoder.DecodeElement(&metadata, &start) != nil {
+			return nil, false
+		}
+		return &metadata, true
+	}
+}
+
+// findInstanceOrphans groups the managed domains and the instance volumes whose owner is not alive by owner. The
+// domains map contains the owner of the domains that carry the metadata of the operator and an empty owner for the
+// others, volumes of an owner with a domain that is not managed by the operator are ignored.
+func findInstanceOrphans(domains map[string]string, volumes []string, live map[string]bool, protected map[string]string) []*OrphanedInstance {
+	byOwner := make(map[string]*OrphanedInstance)
+	getOrphan := func(owner string) *OrphanedInstance {
+		orphan, ok := byOwner[owner]
+		if !ok {
+			orphan = &OrphanedInstance{Owner: owner}
+			byOwner[owner] = orphan
+		}
+		return orphan
+	}
+	for name, owner := range domains {
+		if len(owner) > 0 && !live[owner] {
+			orphan := getOrphan(owner)
+			orphan.Domain = true
+			if name != owner {
+				orphan.DomainName = name
+			}
+		}
+	}
+	for _, name := range volumes {
+		owner, ok := getInstanceVolumeOwner(name)
+		if !ok || live[owner] {
+			continue
+		}
+		if domainOwner, exists := domains[owner]; exists && len(domainOwner) == 0 {
+			continue
+		}
+		orphan := getOrphan(owner)
+		orphan.Volumes = append(orphan.Volumes, name)
+		if reason, ok := protected[name]; ok {
+			orphan.protected = fmt.Sprintf("volume [%s] is %s", name, reason)
+		}
+	}
+	var result []*OrphanedInstance
+	for _, orphan := range byOwner {
+		sort.Strings(orphan.Volumes)
+		result = append(result, orphan)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Owner < result[j].Owner
+	})
+	return result
+}
+
+// planOrphanCleanup decides which orphans may be deleted and returns the first detection of the current orphans
+func planOrphanCleanup(orphans []*OrphanedInstance, firstSeen map[string]time.Time, now time.Time, gracePeriod time.Duration) map[string]time.Time {
+	result := make(map[string]time.Time)
+	for _, orphan := range orphans {
+		seen, ok := firstSeen[orphan.Owner]
+		if !ok {
+			seen = now
+		}
+		orphan.FirstSeen = seen
+		result[orphan.Owner] = seen
+		switch {
+		case orphan.protected != "":
+			orphan.Reason = orphan.protected
+		case gracePeriod <= 0:
+			orphan.Reason = fmt.Sprintf("orphaned since [%s], automatic cleanup is disabled", seen.Format(time.RFC3339))
+		case now.Sub(seen) < gracePeriod:
+			orphan.Reason = fmt.Sprintf("orphaned since [%s], within the grace period", seen.Format(time.RFC3339))
+		default:
+			orphan.Delete = true
+			orphan.Reason = fmt.Sprintf("orphaned since [%s]", seen.Format(time.RFC3339))
+		}
+	}
+	return result
+}
+
+// protectForeignDomains keeps the domains of orphans that have not been created by the sweeping cluster, other clusters
+// sharing the host have resources that the cluster does not know about
+func protectForeignDomains(orphans []*OrphanedInstance, clusters map[string]string, cluster string) {
+	if len(cluster) == 0 {
+		return
+	}
+	for _, orphan := range orphans {
+		if !orphan.Domain || orphan.protected != "" {
+			continue
+		}
+		domainName := orphan.Owner
+		if len(orphan.DomainName) > 0 {
+			domainName = orphan.DomainName
+		}
+		switch owner := clusters[domainName]; {
+		case len(owner) == 0:
+			orphan.protected = fmt.Sprintf("domain [%s] does not record its cluster", domainName)
+		case owner != cluster:
+			orphan.protected = fmt.Sprintf("domain [%s] belongs to cluster [%s]", domainName, owner)
+		}
+	}
+}
+
+// getManagedDomains lists all domains of the host with the owner recorded in the metadata of the operator, the owner of
+// a domain without metadata is empty and the owner of a domain that predates the recording is its name. The second
+// result contains the clusters recorded in the metadata.
+func getManagedDomains(conn *libvirt.Libvirt) func() (map[string]string, map[string]string, error) {
+	return func() (map[string]string, map[string]string, error) {
+		domains, _, err := conn.ConnectListAllDomains(NeedResults, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		result := make(map[string]string)
+		clusters := make(map[string]string)
+		for _, domain := range domains {
+			domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			domainXML, err := parseDomainXML(domainStrg)
+			if err != nil {
+				return nil, nil, err
+			}
+			metadata, ok := findInstanceMetadata(domainXML)
+			switch {
+			case !ok:
+				result[domain.Name] = ""
+			case len(metadata.Owner) > 0:
+				result[domain.Name] = metadata.Owner
+			default:
+				result[domain.Name] = domain.Name
+			}
+			if ok {
+				clusters[domain.Name] = metadata.Cluster
+			}
+		}
+		return result, clusters, nil
+	}
+}
+
+// getProtectedVolumes returns the volumes of a pool that must never be deleted by the sweep together with the reason,
+// i.e. retained volumes, attached volumes and backing files of other volumes
+func getProtectedVolumes(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, volumes []libvirt.StorageVol) (map[string]string, error) {
+	readRegistry := readJSONVolume(conn)
+	getDependents := getBackingFileDependents(conn)
+
+	return func(pool libvirt.StoragePool, volumes []libvirt.StorageVol) (map[string]string, error) {
+		result := make(map[string]string)
+		var retained retainedVolumes
+		_, err := readRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &retained)
+		if err != nil {
+			return nil, err
+		}
+		for name := range retained.Volumes {
+			result[name] = "retained"
+		}
+		var attachments attachmentRegistry
+		_, err = readRegistry(pool, attachmentRegistryVolumeName, maxAttachmentRegistrySize, &attachments)
+		if err != nil {
+			return nil, err
+		}
+		for name, attachment := range attachments.Volumes {
+			if len(attachment.Owners) > 0 {
+				result[name] = fmt.Sprintf("attached to VSIs %v", VolumeOwnerNames(attachment.Owners))
+			}
+		}
+		dependents, err := getDependents()
+		if err != nil {
+			return nil, err
+		}
+		for _, vol := range volumes {
+			path, err := conn.StorageVolGetPath(vol)
+			if err != nil {
+				continue
+			}
+			if deps := dependents[path]; len(deps) > 0 {
+				result[vol.Name] = fmt.Sprintf("the backing file of volumes %v", deps)
+			}
+		}
+		return result, nil
+	}
+}
+
+// SweepOrphans detects the domains and instance volumes of VSI resources that do not exist any more and deletes them
+// once they have been known as orphans for longer than the grace period
+func SweepOrphans(client *LivirtClient) func(storagePool string, cfg *OrphanSweepConfig) (*OrphanReport, error) {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	writeRegistry := writeJSONVolume(conn)
+	getDomains := getManagedDomains(conn)
+	getProtected := getProtectedVolumes(conn)
+	deleteInstance := DeleteInstanceSync(client)
+	releaseDataDisks := ReleaseDataDisks(client)
+	pinBaseImages := PinBaseImages(client)
+
+	return func(storagePool string, cfg *OrphanSweepConfig) (*OrphanReport, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("SweepOrphans(%s)", storagePool))()
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return nil, err
+		}
+		err = refreshPool(conn)(pool)
+		if err != nil {
+			return nil, err
+		}
+		var registry orphanRegistry
+		_, err = readRegistry(pool, orphanRegistryVolumeName, maxOrphanRegistrySize, &registry)
+		if err != nil {
+			return nil, err
+		}
+		domains, clusters, err := getDomains()
+		if err != nil {
+			return nil, err
+		}
+		volumes, _, err := conn.StoragePoolListAllVolumes(pool, NeedResults, 0)
+		if err != nil {
+			return nil, err
+		}
+		protected, err := getProtected(pool, volumes)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, vol := range volumes {
+			names = append(names, vol.Name)
+		}
+		orphans := findInstanceOrphans(domains, names, toSet(cfg.Live), protected)
+		protectForeignDomains(orphans, clusters, cfg.Cluster)
+		now := time.Now().UTC()
+		registry.FirstSeen = planOrphanCleanup(orphans, registry.FirstSeen, now, cfg.GracePeriod)
+		report := &OrphanReport{
+			StoragePool: storagePool,
+			DryRun:      cfg.DryRun,
+			Orphans:     orphans,
+		}
+		for _, orphan := range orphans {
+			log.Printf("Orphan [%s] on pool [%s]: domain=[%t], volumes=%v, delete=[%t], dryRun=[%t], reason: [%s]", orphan.Owner, storagePool, orphan.Domain, orphan.Volumes, orphan.Delete, cfg.DryRun, orphan.Reason)
+			if !orphan.Delete || cfg.DryRun {
+				continue
+			}
+			domainName := orphan.Owner
+			if len(orphan.DomainName) > 0 {
+				domainName = orphan.DomainName
+			}
+			if err := deleteInstance(storagePool, domainName); err != nil {
+				return report, err
+			}
+			// clean up the records of the instance, failures are logged only
+			if err := releaseDataDisks(domainName, nil); err != nil {
+				log.Printf("Unable to release the data disks of orphan [%s], cause: [%v]", orphan.Owner, err)
+			}
+			if err := pinBaseImages(storagePool, orphan.Owner, nil); err != nil {
+				log.Printf("Unable to release the pinned base images of orphan [%s], cause: [%v]", orphan.Owner, err)
+			}
+			delete(registry.FirstSeen, orphan.Owner)
+		}
+		registry.LastSwept = now
+		if err := writeRegistry(pool, orphanRegistryVolumeName, maxOrphanRegistrySize, &registry); err != nil {
+			return report, err
+		}
+		return report, refreshPool(conn)(pool)
+	}
+}
+
+// IsOrphanSweepDue tests if the sweep is enabled and if the last run on the pool is older than the interval
+func IsOrphanSweepDue(client *LivirtClient) func(storagePool string, cfg *OrphanSweepConfig) (bool, error) {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+
+	return func(storagePool string, cfg *OrphanSweepConfig) (bool, error) {
+		if !cfg.Enabled {
+			return false, nil
+		}
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return false, err
+		}
+		var registry orphanRegistry
+		_, err = readRegistry(pool, orphanRegistryVolumeName, maxOrphanRegistrySize, &registry)
+		if err != nil {
+			return false, err
+		}
+		return time.Since(registry.LastSwept) >= cfg.Interval, nil
+	}
+}
+
+// GetResourceUIDsFromList returns the UIDs of the items of a Kubernetes list, e.g. the output of kubectl get -o json
+func GetResourceUIDsFromList(data []byte) ([]string, error) {
+	var list struct {
+		Items []struct {
+			Metadata struct {
+				UID string `json:"uid"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, item := range list.Items {
+		if len(item.Metadata.UID) > 0 {
+			result = append(result, item.Metadata.UID)
+		}
+	}
+	return result, nil
+}
+
+// GetOrphanSweepConfigFromEnvMap deserializes the sweep config from a set of (env) parameters
+func GetOrphanSweepConfigFromEnvMap(envMap env.Environment) *OrphanSweepConfig {
+	result := &OrphanSweepConfig{Enabled: true, Interval: DefaultOrphanSweepInterval}
+	if enabled, ok := envMap[KeyOrphanSweep]; ok {
+		b, err := strconv.ParseBool(enabled)
+		if err == nil {
+			result.Enabled = b
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", enabled, KeyOrphanSweep)
+		}
+	}
+	if interval, ok := envMap[KeyOrphanSweepInterval]; ok {
+		d, err := time.ParseDuration(interval)
+		if err == nil && d > 0 {
+			result.Interval = d
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", interval, KeyOrphanSweepInterval)
+		}
+	}
+	if gracePeriod, ok := envMap[KeyOrphanGracePeriod]; ok {
+		d, err := time.ParseDuration(gracePeriod)
+		if err == nil && d > 0 {
+			result.GracePeriod = d
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", gracePeriod, KeyOrphanGracePeriod)
+		}
+	}
+	if dryRun, ok := envMap[KeyOrphanDryRun]; ok {
+		b, err := strconv.ParseBool(dryRun)
+		if err == nil {
+			result.DryRun = b
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", dryRun, KeyOrphanDryRun)
+		}
+	}
+	return result
+}
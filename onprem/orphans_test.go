@@ -0,0 +1,230 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	testOrphanLive    = "6d997109-6b44-40eb-8d88-8bf7fc90bfb5"
+	testOrphanGone    = "0f8a3c52-3b0e-4f57-9d4e-2b6d1a6f1c7e"
+	testOrphanForeign = "3b1f4a7e-5c2d-4e8f-9a0b-1c2d3e4f5a6b"
+	testOrphanVolumes = "9e8d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b"
+	testOrphanAdopted = "f1e2d3c4-b5a6-4978-8a9b-0c1d2e3f4a5b"
+)
+
+func TestGetInstanceVolumeOwner(t *testing.T) {
+	owner, ok := getInstanceVolumeOwner(GetBootVolumeName(testOrphanGone))
+	assert.True(t, ok)
+	assert.Equal(t, testOrphanGone, owner)
+
+	owner, ok = getInstanceVolumeOwner(GetCIDataVolumeName(testOrphanGone))
+	assert.True(t, ok)
+	assert.Equal(t, testOrphanGone, owner)
+
+	owner, ok = getInstanceVolumeOwner(GetLoggingVolumeName(testOrphanGone))
+	assert.True(t, ok)
+	assert.Equal(t, testOrphanGone, owner)
+
+	// not created for an instance
+	for _, name := range []string{"boot-manual.qcow2", "boot-" + testOrphanGone + ".raw", "hpcr-images.json", testOrphanGone} {
+		_, ok = getInstanceVolumeOwner(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestFindInstanceMetadata(t *testing.T) {
+	metadataXML, err := XMLMarshall(InstanceMetadata{Hash: "hash"})
+	require.NoError(t, err)
+
+	// the operator metadata next to the metadata of another application
+	metadata, ok := findInstanceMetadata(&libvirtxml.Domain{Metadata: &libvirtxml.DomainMetadata{
+		XML: `<libosinfo:libosinfo xmlns:libosinfo="http://libosinfo.org/xmlns/libvirt/domain/1.0"><libosinfo:os id="http://ubuntu.com/ubuntu/22.04"/></libosinfo:libosinfo>` + metadataXML,
+	}})
+	assert.True(t, ok)
+	assert.Equal(t, "hash", metadata.Hash)
+
+	// prefixed as returned by libvirt
+	metadata, ok = findInstanceMetadata(&libvirtxml.Domain{Metadata: &libvirtxml.DomainMetadata{
+		XML: `<hpcr:instance xmlns:hpcr="https://github.com/ibm-hyper-protect/k8s-operator-hpcr"><hpcr:hash>other</hpcr:hash></hpcr:instance>`,
+	}})
+	assert.True(t, ok)
+	assert.Equal(t, "other", metadata.Hash)
+
+	_, ok = findInstanceMetadata(&libvirtxml.Domain{})
+	assert.False(t, ok)
+	_, ok = findInstanceMetadata(&libvirtxml.Domain{Metadata: &libvirtxml.DomainMetadata{
+		XML: `<libosinfo:libosinfo xmlns:libosinfo="http://libosinfo.org/xmlns/libvirt/domain/1.0"/>`,
+	}})
+	assert.False(t, ok)
+}
+
+func TestFindInstanceOrphans(t *testing.T) {
+	domains := map[string]string{
+		testOrphanLive:    testOrphanLive,
+		testOrphanGone:    testOrphanGone,
+		testOrphanForeign: "",
+		"manual":          "",
+		// adopted domains are owned by their resource
+		"adopted-live": testOrphanLive,
+		"adopted-gone": testOrphanAdopted,
+	}
+	volumes := []string{
+		GetBootVolumeName(testOrphanLive),
+		GetLoggingVolumeName(testOrphanGone),
+		GetBootVolumeName(testOrphanGone),
+		GetBootVolumeName(testOrphanForeign),
+		GetCIDataVolumeName(testOrphanVolumes),
+		"hpcr-retained.json",
+	}
+	live := toSet([]string{testOrphanLive})
+
+	orphans := findInstanceOrphans(domains, volumes, live, map[string]string{
+		GetCIDataVolumeName(testOrphanVolumes): "retained",
+	})
+	require.Len(t, orphans, 3)
+
+	assert.Equal(t, testOrphanGone, orphans[0].Owner)
+	assert.True(t, orphans[0].Domain)
+	assert.Empty(t, orphans[0].DomainName)
+	assert.Equal(t, []string{GetBootVolumeName(testOrphanGone), GetLoggingVolumeName(testOrphanGone)}, orphans[0].Volumes)
+	assert.Empty(t, orphans[0].protected)
+
+	// volumes without a domain
+	assert.Equal(t, testOrphanVolumes, orphans[1].Owner)
+	assert.False(t, orphans[1].Domain)
+	assert.Equal(t, []string{GetCIDataVolumeName(testOrphanVolumes)}, orphans[1].Volumes)
+	assert.Contains(t, orphans[1].protected, "retained")
+
+	// an adopted domain is deleted by its name
+	assert.Equal(t, testOrphanAdopted, orphans[2].Owner)
+	assert.True(t, orphans[2].Domain)
+	assert.Equal(t, "adopted-gone", orphans[2].DomainName)
+	assert.Empty(t, orphans[2].Volumes)
+}
+
+func TestProtectForeignDomains(t *testing.T) {
+	create := func() []*OrphanedInstance {
+		return []*OrphanedInstance{
+			{Owner: "own", Domain: true},
+			{Owner: "other", Domain: true},
+			{Owner: "legacy", Domain: true},
+			{Owner: "adopted", Domain: true, DomainName: "manual"},
+			{Owner: "volumes", Volumes: []string{GetBootVolumeName("volumes")}},
+		}
+	}
+	clusters := map[string]string{
+		"own":    "cluster-a",
+		"other":  "cluster-b",
+		"legacy": "",
+		"manual": "cluster-a",
+	}
+
+	orphans := create()
+	protectForeignDomains(orphans, clusters, "cluster-a")
+	assert.Empty(t, orphans[0].protected)
+	assert.Contains(t, orphans[1].protected, "belongs to cluster [cluster-b]")
+	assert.Contains(t, orphans[2].protected, "does not record its cluster")
+	assert.Empty(t, orphans[3].protected)
+	assert.Empty(t, orphans[4].protected)
+
+	// a sweep that knows the resources of all clusters deletes any domain
+	orphans = create()
+	protectForeignDomains(orphans, clusters, "")
+	for _, orphan := range orphans {
+		assert.Empty(t, orphan.protected)
+	}
+}
+
+func TestPlanOrphanCleanup(t *testing.T) {
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-48 * time.Hour)
+
+	newOrphan := func(owner string) []*OrphanedInstance {
+		return []*OrphanedInstance{{Owner: owner, Domain: true}}
+	}
+	firstSeen := map[string]time.Time{testOrphanGone: old, "stale": old}
+
+	// known for longer than the grace period
+	orphans := newOrphan(testOrphanGone)
+	seen := planOrphanCleanup(orphans, firstSeen, now, 24*time.Hour)
+	assert.True(t, orphans[0].Delete)
+	assert.Equal(t, old, orphans[0].FirstSeen)
+	// only the current orphans are remembered
+	assert.Equal(t, map[string]time.Time{testOrphanGone: old}, seen)
+
+	// within the grace period
+	orphans = newOrphan(testOrphanGone)
+	planOrphanCleanup(orphans, firstSeen, now, 72*time.Hour)
+	assert.False(t, orphans[0].Delete)
+	assert.Contains(t, orphans[0].Reason, "grace period")
+
+	// a new orphan is never deleted right away
+	orphans = newOrphan(testOrphanVolumes)
+	seen = planOrphanCleanup(orphans, firstSeen, now, time.Nanosecond)
+	assert.False(t, orphans[0].Delete)
+	assert.Equal(t, now, seen[testOrphanVolumes])
+
+	// without a grace period orphans are only reported
+	orphans = newOrphan(testOrphanGone)
+	planOrphanCleanup(orphans, firstSeen, now, 0)
+	assert.False(t, orphans[0].Delete)
+	assert.Contains(t, orphans[0].Reason, "disabled")
+
+	// protected volumes are kept
+	orphans = newOrphan(testOrphanGone)
+	orphans[0].protected = "volume [x] is retained"
+	planOrphanCleanup(orphans, firstSeen, now, 24*time.Hour)
+	assert.False(t, orphans[0].Delete)
+	assert.Equal(t, "volume [x] is retained", orphans[0].Reason)
+}
+
+func TestGetResourceUIDsFromList(t *testing.T) {
+	uids, err := GetResourceUIDsFromList([]byte(`{"apiVersion":"v1","kind":"List","items":[{"metadata":{"name":"a","uid":"` + testOrphanLive + `"}},{"metadata":{"name":"b"}}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{testOrphanLive}, uids)
+
+	_, err = GetResourceUIDsFromList([]byte("not json"))
+	assert.Error(t, err)
+}
+
+func TestGetOrphanSweepConfigFromEnvMap(t *testing.T) {
+	cfg := GetOrphanSweepConfigFromEnvMap(env.Environment{})
+	assert.True(t, cfg.Enabled)
+	assert.Equal(t, DefaultOrphanSweepInterval, cfg.Interval)
+	assert.Zero(t, cfg.GracePeriod)
+	assert.False(t, cfg.DryRun)
+
+	cfg = GetOrphanSweepConfigFromEnvMap(env.Environment{
+		KeyOrphanSweep:         "false",
+		KeyOrphanSweepInterval: "30m",
+		KeyOrphanGracePeriod:   "168h",
+		KeyOrphanDryRun:        "true",
+	})
+	assert.False(t, cfg.Enabled)
+	assert.Equal(t, 30*time.Minute, cfg.Interval)
+	assert.Equal(t, 168*time.Hour, cfg.GracePeriod)
+	assert.True(t, cfg.DryRun)
+
+	cfg = GetOrphanSweepConfigFromEnvMap(env.Environment{KeyOrphanGracePeriod: "soon"})
+	assert.Zero(t, cfg.GracePeriod)
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+)
+
+const (
+	// the domain is running, the default
+	PowerStateRunning = "Running"
+	// the domain is shut down, its definition and disks are kept
+	PowerStateStopped = "Stopped"
+)
+
+// InstancePowerStatus reports the desired and the actual state of the domain of an instance
+type InstancePowerStatus struct {
+	PowerState string `json:"powerState"`
+	State      string `json:"state"`
+}
+
+// domainStateNames maps the libvirt domain states to the names reported in the status
+var domainStateNames = map[libvirt.DomainState]string{
+	libvirt.DomainNostate:     "NoState",
+	libvirt.DomainRunning:     "Running",
+	libvirt.DomainBlocked:     "Blocked",
+	libvirt.DomainPaused:      "Paused",
+	libvirt.DomainShutdown:    "ShuttingDown",
+	libvirt.DomainShutoff:     "Shutoff",
+	libvirt.DomainCrashed:     "Crashed",
+	libvirt.DomainPmsuspended: "Suspended",
+}
+
+// IsValidPowerState tests if the power state is supported
+func IsValidPowerState(powerState string) bool {
+	return powerState == PowerStateRunning || powerState == PowerStateStopped
+}
+
+// GetDomainStateName returns the name of a libvirt domain state
+func GetDomainStateName(state libvirt.DomainState) string {
+	if name, ok := domainStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", state)
+}
+
+// IsDomainStopped tests if a domain does not run and will not do so without being started
+func IsDomainStopped(state libvirt.DomainState) bool {
+	return state == libvirt.DomainShutoff || state == libvirt.DomainCrashed
+}
+
+func boolToInt32(value bool) int32 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// StopInstanceSync (synchronously) gracefully shuts down the domain of an instance, keeping its definition and disks. A
+// missing domain is defined without being started, an existing one is neither recreated nor updated while stopped.
+// Returns the actual state of the domain.
+func StopInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (libvirt.DomainState, error) {
+	conn := client.LibVirt
+	createInstance := CreateInstanceSync(client)
+	setMetadata := setInstanceMetadata(conn)
+	shutdown := shutDownDomain(client)
+
+	return func(opt *InstanceOptions) (libvirt.DomainState, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("StopInstanceSync(%s)", opt.Name))()
+
+		name := opt.Name
+		domain, err := conn.DomainLookupByName(name)
+		if err != nil {
+			// nothing to stop, define the domain so it can be started later
+			log.Printf("Domain [%s] does not exist, defining it without starting it ...", name)
+			_, err = createInstance(opt)
+			if err != nil {
+				return libvirt.DomainNostate, err
+			}
+			return libvirt.DomainShutoff, nil
+		}
+		// remember that the domain has been stopped on purpose, so it is started regardless of its restart policy
+		metadata, err := getInstanceMetadata(conn)(domain)
+		if err != nil {
+			return libvirt.DomainNostate, err
+		}
+		if metadata.PowerState != PowerStateStopped {
+			metadata.PowerState = PowerStateStopped
+			err = setMetadata(domain, metadata)
+			if err != nil {
+				return libvirt.DomainNostate, err
+			}
+			// do not start the domain when the host boots
+			err = conn.DomainSetAutostart(domain, 0)
+			if err != nil {
+				return libvirt.DomainNostate, err
+			}
+		}
+		// a paused domain cannot shut down, resume it so the guest can stop gracefully
+		state, _, err := conn.DomainGetState(domain, 0)
+		if err != nil {
+			return libvirt.DomainNostate, err
+		}
+		if libvirt.DomainState(state) == libvirt.DomainPaused {
+			log.Printf("Resuming paused domain [%s] to shut it down ...", name)
+			err = conn.DomainResume(domain)
+			if err != nil {
+				log.Printf("Unable to resume domain [%s], destroying it, cause: [%v]", name, err)
+				err = conn.DomainDestroy(domain)
+				if err != nil {
+					return libvirt.DomainNostate, err
+				}
+			}
+		}
+		err = shutdown(&domain)
+		if err != nil {
+			return libvirt.DomainNostate, err
+		}
+		state, _, err = conn.DomainGetState(domain, 0)
+		if err != nil {
+			return libvirt.DomainNostate, err
+		}
+		return libvirt.DomainState(state), nil
+	}
+}
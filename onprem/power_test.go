@@ -0,0 +1,61 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDomainStateName(t *testing.T) {
+	assert.Equal(t, "Running", GetDomainStateName(libvirt.DomainRunning))
+	assert.Equal(t, "ShuttingDown", GetDomainStateName(libvirt.DomainShutdown))
+	assert.Equal(t, "Shutoff", GetDomainStateName(libvirt.DomainShutoff))
+	assert.Equal(t, "Crashed", GetDomainStateName(libvirt.DomainCrashed))
+	assert.Equal(t, "Unknown(42)", GetDomainStateName(libvirt.DomainState(42)))
+}
+
+func TestIsDomainStopped(t *testing.T) {
+	assert.True(t, IsDomainStopped(libvirt.DomainShutoff))
+	assert.True(t, IsDomainStopped(libvirt.DomainCrashed))
+	assert.False(t, IsDomainStopped(libvirt.DomainShutdown))
+	assert.False(t, IsDomainStopped(libvirt.DomainPaused))
+	assert.False(t, IsDomainStopped(libvirt.DomainRunning))
+}
+
+func TestIsValidPowerState(t *testing.T) {
+	assert.Equal(t, PowerStateRunning, BoxPowerState(""))
+	assert.True(t, IsValidPowerState(PowerStateRunning))
+	assert.True(t, IsValidPowerState(PowerStateStopped))
+	assert.False(t, IsValidPowerState("Paused"))
+}
+
+func TestPowerStateMetadata(t *testing.T) {
+	metadataXML, err := XMLMarshall(InstanceMetadata{Hash: "hash", PowerState: PowerStateStopped})
+	assert.NoError(t, err)
+	assert.Contains(t, metadataXML, "<powerState>Stopped</powerState>")
+
+	var metadata InstanceMetadata
+	assert.NoError(t, xml.Unmarshal([]byte(metadataXML), &metadata))
+	assert.Equal(t, PowerStateStopped, metadata.PowerState)
+
+	// a running domain does not record a power state
+	metadataXML, err = XMLMarshall(InstanceMetadata{Hash: "hash"})
+	assert.NoError(t, err)
+	assert.NotContains(t, metadataXML, "powerState")
+}
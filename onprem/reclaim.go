@@ -0,0 +1,239 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+)
+
+const (
+	// the volume is deleted together with its data disk resource, the default
+	ReclaimPolicyDelete = "Delete"
+	// the volume is left on the host when its data disk resource is deleted
+	ReclaimPolicyRetain = "Retain"
+
+	// name of the volume that records the retained volumes of a pool
+	retainedVolumesVolumeName = "hpcr-retained.json"
+	// maximum size of the retained volumes registry
+	maxRetainedVolumesSize = 256 * 1024
+)
+
+// RetainedVolume records the data disk resource that left a volume behind
+type RetainedVolume struct {
+	// namespace of the deleted data disk resource
+	Namespace string `json:"namespace"`
+	// name of the deleted data disk resource
+	Name string `json:"name"`
+	// time the resource was deleted
+	RetainedAt time.Time `json:"retainedAt"`
+}
+
+// VolumeAdopter identifies the data disk resource that adopted a retained volume
+type VolumeAdopter struct {
+	// namespace of the data disk resource
+	Namespace string `json:"namespace"`
+	// name of the data disk resource
+	Name string `json:"name"`
+}
+
+// retainedVolumes records the retained volumes of a storage pool and the volumes adopted by data disks, both keyed by
+// volume name
+type retainedVolumes struct {
+	Volumes map[string]*RetainedVolume `json:"volumes"`
+	Adopted map[string]*VolumeAdopter  `json:"adopted,omitempty"`
+}
+
+// checkAdoptableVolume checks if a data disk may adopt a volume, i.e. the volume has been retained by a deleted data
+// disk or has already been adopted by the data disk
+func checkAdoptableVolume(registry *retainedVolumes, pool, name string, adopter *VolumeAdopter) error {
+	if current, ok := registry.Adopted[name]; ok {
+		if *current == *adopter {
+			return nil
+		}
+		return fmt.Errorf("volume [%s] on pool [%s] is already adopted by data disk [%s/%s]", name, pool, current.Namespace, current.Name)
+	}
+	if _, ok := registry.Volumes[name]; !ok {
+		return fmt.Errorf("volume [%s] on pool [%s] has not been retained by a data disk and cannot be adopted", name, pool)
+	}
+	return nil
+}
+
+// GetDataDiskVolumeName returns the name of the volume of a data disk, i.e. the adopted volume or the UID of the resource
+func GetDataDiskVolumeName(res *DataDiskCustomResource) string {
+	if len(res.Spec.VolumeName) > 0 {
+		return res.Spec.VolumeName
+	}
+	return string(res.UID)
+}
+
+// RetainDataDiskSync (synchronously) keeps the volume of a deleted data disk and records it in the registry of its pool
+func RetainDataDiskSync(client *LivirtClient) func(storagePool, name string, owner *RetainedVolume) error {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	writeRegistry := writeJSONVolume(conn)
+
+	return func(storagePool, name string, owner *RetainedVolume) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("RetainDataDiskSync(%s)", name))()
+
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.StorageVolLookupByName(pool, name); err != nil {
+			// nothing to retain
+			log.Printf("Volume [%s] does not exist on pool [%s], nothing to do", name, pool.Name)
+			return nil
+		}
+		defer lockRegistry(pool, retainedVolumesVolumeName)()
+		var registry retainedVolumes
+		_, err = readRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+		if err != nil {
+			return err
+		}
+		if registry.Volumes == nil {
+			registry.Volumes = make(map[string]*RetainedVolume)
+		}
+		registry.Volumes[name] = owner
+		delete(registry.Adopted, name)
+		log.Printf("Retaining volume [%s] of data disk [%s/%s] on pool [%s]", name, owner.Namespace, owner.Name, pool.Name)
+		return writeRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+	}
+}
+
+// CheckAdoptableVolume verifies that a data disk may adopt a volume. Only volumes retained by a deleted data disk can
+// be adopted, as long as they are not attached to a VSI, or volumes the data disk has adopted before.
+func CheckAdoptableVolume(client *LivirtClient) func(storagePool, name string, adopter *VolumeAdopter) error {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	getVolumeOwners := GetVolumeOwners(client)
+
+	return func(storagePool, name string, adopter *VolumeAdopter) error {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return err
+		}
+		var registry retainedVolumes
+		_, err = readRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+		if err != nil {
+			return err
+		}
+		err = checkAdoptableVolume(&registry, storagePool, name, adopter)
+		if err != nil {
+			return err
+		}
+		if _, ok := registry.Adopted[name]; ok {
+			return nil
+		}
+		// a retained volume may be in use via a data disk reference
+		owners, err := getVolumeOwners(storagePool, name)
+		if err != nil {
+			return err
+		}
+		if len(owners) > 0 {
+			return fmt.Errorf("volume [%s] on pool [%s] is attached to VSIs %v and cannot be adopted", name, storagePool, VolumeOwnerNames(owners))
+		}
+		return nil
+	}
+}
+
+// AdoptRetainedVolume moves a volume from the registry of retained volumes to the adopted volumes once a data disk
+// owns it again
+func AdoptRetainedVolume(client *LivirtClient) func(storagePool, name string, adopter *VolumeAdopter) error {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	writeRegistry := writeJSONVolume(conn)
+
+	return func(storagePool, name string, adopter *VolumeAdopter) error {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return err
+		}
+		defer lockRegistry(pool, retainedVolumesVolumeName)()
+		var registry retainedVolumes
+		_, err = readRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+		if err != nil {
+			return err
+		}
+		if current, ok := registry.Adopted[name]; ok {
+			if *current != *adopter {
+				return fmt.Errorf("volume [%s] on pool [%s] is already adopted by data disk [%s/%s]", name, storagePool, current.Namespace, current.Name)
+			}
+			return nil
+		}
+		if previous, ok := registry.Volumes[name]; ok {
+			log.Printf("Adopting volume [%s] retained by data disk [%s/%s] on pool [%s]", name, previous.Namespace, previous.Name, pool.Name)
+			delete(registry.Volumes, name)
+		} else {
+			// adopted before the adopters were recorded
+			log.Printf("Recording the adoption of volume [%s] on pool [%s]", name, pool.Name)
+		}
+		if registry.Adopted == nil {
+			registry.Adopted = make(map[string]*VolumeAdopter)
+		}
+		registry.Adopted[name] = adopter
+		return writeRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+	}
+}
+
+// IsAdoptedVolume tells if a data disk owns the volume it adopted, volumes adopted by other data disks or never
+// adopted must not be deleted or retained by the data disk
+func IsAdoptedVolume(client *LivirtClient) func(storagePool, name string, adopter *VolumeAdopter) (bool, error) {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+
+	return func(storagePool, name string, adopter *VolumeAdopter) (bool, error) {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return false, err
+		}
+		var registry retainedVolumes
+		_, err = readRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+		if err != nil {
+			return false, err
+		}
+		current, ok := registry.Adopted[name]
+		return ok && *current == *adopter, nil
+	}
+}
+
+// ReleaseAdoptedVolume removes the record of an adopted volume once the volume has been deleted
+func ReleaseAdoptedVolume(client *LivirtClient) func(storagePool, name string) error {
+	conn := client.LibVirt
+	readRegistry := readJSONVolume(conn)
+	writeRegistry := writeJSONVolume(conn)
+
+	return func(storagePool, name string) error {
+		pool, err := conn.StoragePoolLookupByName(storagePool)
+		if err != nil {
+			return err
+		}
+		defer lockRegistry(pool, retainedVolumesVolumeName)()
+		var registry retainedVolumes
+		found, err := readRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+		if err != nil || !found {
+			return err
+		}
+		if _, ok := registry.Adopted[name]; !ok {
+			return nil
+		}
+		delete(registry.Adopted, name)
+		return writeRegistry(pool, retainedVolumesVolumeName, maxRetainedVolumesSize, &registry)
+	}
+}
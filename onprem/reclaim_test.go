@@ -0,0 +1,60 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetDataDiskVolumeName(t *testing.T) {
+	disk := &DataDiskCustomResource{
+		ObjectMeta: metav1.ObjectMeta{Name: "disk", UID: "0f8a3c52-3b0e-4f57-9d4e-2b6d1a6f1c7e"},
+	}
+	assert.Equal(t, "0f8a3c52-3b0e-4f57-9d4e-2b6d1a6f1c7e", GetDataDiskVolumeName(disk))
+	assert.Equal(t, "0f8a3c52-3b0e-4f57-9d4e-2b6d1a6f1c7e", dataDiskCustomResourceToAttachedDataDisk(disk).Name)
+
+	// adopt a retained volume
+	disk.Spec.VolumeName = "retained"
+	assert.Equal(t, "retained", GetDataDiskVolumeName(disk))
+	assert.Equal(t, "retained", dataDiskCustomResourceToAttachedDataDisk(disk).Name)
+}
+
+func TestBoxReclaimPolicy(t *testing.T) {
+	assert.Equal(t, ReclaimPolicyDelete, BoxReclaimPolicy(""))
+	assert.Equal(t, ReclaimPolicyRetain, BoxReclaimPolicy(ReclaimPolicyRetain))
+}
+
+func TestCheckAdoptableVolume(t *testing.T) {
+	adopter := &VolumeAdopter{Namespace: "default", Name: "disk"}
+	registry := retainedVolumes{
+		Volumes: map[string]*RetainedVolume{
+			"retained": {Namespace: "default", Name: "old"},
+		},
+		Adopted: map[string]*VolumeAdopter{
+			"mine":   {Namespace: "default", Name: "disk"},
+			"theirs": {Namespace: "default", Name: "other"},
+		},
+	}
+
+	assert.NoError(t, checkAdoptableVolume(&registry, "images", "retained", adopter))
+	assert.NoError(t, checkAdoptableVolume(&registry, "images", "mine", adopter))
+	assert.ErrorContains(t, checkAdoptableVolume(&registry, "images", "theirs", adopter), "already adopted by data disk [default/other]")
+	// volumes of VSIs, bookkeeping volumes or foreign volumes have never been retained
+	assert.ErrorContains(t, checkAdoptableVolume(&registry, "images", "boot-0f8a3c52-3b0e-4f57-9d4e-2b6d1a6f1c7e.qcow2", adopter), "has not been retained")
+	assert.ErrorContains(t, checkAdoptableVolume(&registry, "images", retainedVolumesVolumeName, adopter), "has not been retained")
+}
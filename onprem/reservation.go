@@ -0,0 +1,421 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+// DhcpHostReservation is a static address of an interface of the instance
+type DhcpHostReservation struct {
+	// name of the libvirt network
+	Network string
+	// host entry in the DHCP section of the network
+	Host libvirtxml.NetworkDHCPHost
+}
+
+// dhcpHostUpdate is a single modification of the DHCP host entries of a network
+type dhcpHostUpdate struct {
+	Command     libvirt.NetworkUpdateCommand
+	ParentIndex int32
+	Host        libvirtxml.NetworkDHCPHost
+}
+
+func createInterfaceMacAddress(prefix, networkName string) string {
+	return CreateMacAddressFromHash(fmt.Sprintf("%s-%s", prefix, networkName))
+}
+
+// GetInterfaceMacAddress returns the MAC address of the interface of the instance on the given network
+func GetInterfaceMacAddress(opt *InstanceOptions, networkName string) string {
+	if len(opt.Networks) == 0 {
+		// the interface on the default network is based on the UUID
+		return CreateMacAddressFromMaybeUUID(opt.Name)
+	}
+	return createInterfaceMacAddress(opt.Name, networkName)
+}
+
+// sort the networks of the static addresses by name, so the hash is predictable
+func sortAddressNetworks(addresses map[string]*NetworkAddress) []string {
+	var sorted []string
+	for network := range addresses {
+		sorted = append(sorted, network)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// parseAddress parses an IPv4 or IPv6 address and makes sure it is of the expected family
+func parseAddress(address string, ipv6 bool) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return addr, err
+	}
+	if addr.Is6() != ipv6 || addr.Is4In6() {
+		return addr, fmt.Errorf("address [%s] is not a valid %s address", address, addressFamily(ipv6))
+	}
+	return addr, nil
+}
+
+func addressFamily(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// GetDhcpHostReservations returns the static addresses of the instance as DHCP host entries
+func GetDhcpHostReservations(opt *InstanceOptions) ([]*DhcpHostReservation, error) {
+	networks := GetNetworks(opt)
+	var result []*DhcpHostReservation
+	for _, network := range sortAddressNetworks(opt.Addresses) {
+		address := opt.Addresses[network]
+		if address == nil {
+			continue
+		}
+		if !slices.Contains(networks, network) {
+			return nil, fmt.Errorf("static address for network [%s], but the instance is not attached to it", network)
+		}
+		if len(address.IPv4) > 0 {
+			ip, err := parseAddress(address.IPv4, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, &DhcpHostReservation{
+				Network: network,
+				Host: libvirtxml.NetworkDHCPHost{
+					MAC:  GetInterfaceMacAddress(opt, network),
+					Name: opt.Name,
+					IP:   ip.String(),
+				},
+			})
+		}
+		if len(address.IPv6) > 0 {
+			ip, err := parseAddress(address.IPv6, true)
+			if err != nil {
+				return nil, err
+			}
+			// DHCPv6 identifies the host by name, there is no MAC in the host entry
+			result = append(result, &DhcpHostReservation{
+				Network: network,
+				Host: libvirtxml.NetworkDHCPHost{
+					Name: opt.Name,
+					IP:   ip.String(),
+				},
+			})
+		}
+	}
+	return result, nil
+}
+
+// getNetworkIPPrefix returns the address and subnet size of an IP definition of a network
+func getNetworkIPPrefix(ipDef *libvirtxml.NetworkIP) (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(ipDef.Address)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	bits := int(ipDef.Prefix)
+	if bits == 0 {
+		switch {
+		case len(ipDef.Netmask) > 0:
+			mask := net.ParseIP(ipDef.Netmask).To4()
+			if mask == nil {
+				return netip.Prefix{}, fmt.Errorf("invalid netmask [%s]", ipDef.Netmask)
+			}
+			bits, _ = net.IPMask(mask).Size()
+		case addr.Is6():
+			bits = 64
+		case addr.As4()[0] < 128:
+			bits = 8
+		case addr.As4()[0] < 192:
+			bits = 16
+		default:
+			bits = 24
+		}
+	}
+	return netip.PrefixFrom(addr, bits), nil
+}
+
+// findDhcpParentIndex returns the index of the IP definition of the network that serves the address via DHCP
+func findDhcpParentIndex(netDef *libvirtxml.Network, address string) (int, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return -1, err
+	}
+	for idx := range netDef.IPs {
+		ipDef := &netDef.IPs[idx]
+		prefix, err := getNetworkIPPrefix(ipDef)
+		if err != nil {
+			log.Printf("Unable to determine the subnet of [%s] on network [%s], cause: [%v]", ipDef.Address, netDef.Name, err)
+			continue
+		}
+		if !prefix.Contains(addr) {
+			continue
+		}
+		if ipDef.DHCP == nil {
+			return -1, fmt.Errorf("network [%s] does not serve DHCP for subnet [%s]", netDef.Name, prefix)
+		}
+		return idx, nil
+	}
+	return -1, fmt.Errorf("address [%s] is not part of any subnet of network [%s]", address, netDef.Name)
+}
+
+// describeDhcpHost returns a readable identifier of the owner of a host entry
+func describeDhcpHost(host *libvirtxml.NetworkDHCPHost) string {
+	switch {
+	case len(host.Name) > 0:
+		return host.Name
+	case len(host.MAC) > 0:
+		return host.MAC
+	default:
+		return host.ID
+	}
+}
+
+// describeDhcpLease returns a readable identifier of the holder of a lease
+func describeDhcpLease(lease *libvirt.NetworkDhcpLease) string {
+	switch {
+	case len(lease.Hostname) > 0 && len(lease.Hostname[0]) > 0:
+		return lease.Hostname[0]
+	case len(lease.Mac) > 0:
+		return lease.Mac[0]
+	default:
+		return lease.Ipaddr
+	}
+}
+
+// isDhcpLeaseOf tests if a lease is held by the host of the reservation, either by name or by MAC address
+func isDhcpLeaseOf(lease *libvirt.NetworkDhcpLease, hostname string, reservation *libvirtxml.NetworkDHCPHost) bool {
+	if len(lease.Hostname) > 0 && lease.Hostname[0] == hostname {
+		return true
+	}
+	return len(lease.Mac) > 0 && len(reservation.MAC) > 0 && strings.EqualFold(lease.Mac[0], reservation.MAC)
+}
+
+func isSameAddress(left, right string) bool {
+	l, err := netip.ParseAddr(left)
+	if err != nil {
+		return false
+	}
+	r, err := netip.ParseAddr(right)
+	if err != nil {
+		return false
+	}
+	return l == r
+}
+
+// planDhcpHostUpdates computes the modifications of the DHCP host entries of a network that realize the
+// reservations of the host. Entries of the host that are not reserved any more will be deleted, entries of other
+// hosts with a reserved address and active leases of other guests on a reserved address are reported as a conflict.
+func planDhcpHostUpdates(netDef *libvirtxml.Network, leases []libvirt.NetworkDhcpLease, hostname string, reservations []libvirtxml.NetworkDHCPHost) ([]*dhcpHostUpdate, error) {
+	// locate the parent of each reservation and check for conflicts
+	parents := make([]int, len(reservations))
+	for idx, reservation := range reservations {
+		parent, err := findDhcpParentIndex(netDef, reservation.IP)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range netDef.IPs[parent].DHCP.Hosts {
+			if host.Name != hostname && isSameAddress(host.IP, reservation.IP) {
+				return nil, fmt.Errorf("address [%s] on network [%s] is already reserved for [%s]", reservation.IP, netDef.Name, describeDhcpHost(&host))
+			}
+		}
+		for _, lease := range leases {
+			if isSameAddress(lease.Ipaddr, reservation.IP) && !isDhcpLeaseOf(&lease, hostname, &reservation) {
+				return nil, fmt.Errorf("address [%s] on network [%s] is leased to [%s]", reservation.IP, netDef.Name, describeDhcpLease(&lease))
+			}
+		}
+		parents[idx] = parent
+	}
+	// compare with the existing entries of the host
+	satisfied := make([]bool, len(reservations))
+	var deletes []*dhcpHostUpdate
+	for parent, ipDef := range netDef.IPs {
+		if ipDef.DHCP == nil {
+			continue
+		}
+		for _, host := range ipDef.DHCP.Hosts {
+			if host.Name != hostname {
+				continue
+			}
+			idx := slices.IndexFunc(reservations, func(reservation libvirtxml.NetworkDHCPHost) bool {
+				return isSameAddress(host.IP, reservation.IP) && strings.EqualFold(host.MAC, reservation.MAC)
+			})
+			if idx >= 0 && parents[idx] == parent {
+				satisfied[idx] = true
+				continue
+			}
+			host.Lease = nil
+			deletes = append(deletes, &dhcpHostUpdate{
+				Command:     libvirt.NetworkUpdateCommandDelete,
+				ParentIndex: int32(parent),
+				Host:        host,
+			})
+		}
+	}
+	// add the missing reservations
+	updates := deletes
+	for idx, reservation := range reservations {
+		if satisfied[idx] {
+			continue
+		}
+		updates = append(updates, &dhcpHostUpdate{
+			Command:     libvirt.NetworkUpdateCommandAddLast,
+			ParentIndex: int32(parents[idx]),
+			Host:        reservation,
+		})
+	}
+	return updates, nil
+}
+
+// ValidateNetworkAddress checks if the static addresses can be served by the network
+func ValidateNetworkAddress(netDef *libvirtxml.Network, address *NetworkAddress) error {
+	if len(address.IPv4) > 0 {
+		ip, err := parseAddress(address.IPv4, false)
+		if err != nil {
+			return err
+		}
+		if _, err := findDhcpParentIndex(netDef, ip.String()); err != nil {
+			return err
+		}
+	}
+	if len(address.IPv6) > 0 {
+		ip, err := parseAddress(address.IPv6, true)
+		if err != nil {
+			return err
+		}
+		if _, err := findDhcpParentIndex(netDef, ip.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNetworkUpdateFlags applies updates to the running and to the persistent configuration of the network
+func getNetworkUpdateFlags(conn *libvirt.Libvirt) func(net libvirt.Network) (libvirt.NetworkUpdateFlags, error) {
+	return func(net libvirt.Network) (libvirt.NetworkUpdateFlags, error) {
+		flags := libvirt.NetworkUpdateAffectCurrent
+		active, err := conn.NetworkIsActive(net)
+		if err != nil {
+			return flags, err
+		}
+		if active != 0 {
+			flags |= libvirt.NetworkUpdateAffectLive
+		}
+		persistent, err := conn.NetworkIsPersistent(net)
+		if err != nil {
+			return flags, err
+		}
+		if persistent != 0 {
+			flags |= libvirt.NetworkUpdateAffectConfig
+		}
+		return flags, nil
+	}
+}
+
+// SyncDhcpHostReservations updates the DHCP host entries of all networks, so they match the reservations of the host
+func SyncDhcpHostReservations(client *LivirtClient) func(hostname string, reservations []*DhcpHostReservation) error {
+	conn := client.LibVirt
+	networkXMLDesc := getNetworkXMLDesc(conn)
+	networkUpdateFlags := getNetworkUpdateFlags(conn)
+
+	type networkUpdates struct {
+		net     libvirt.Network
+		updates []*dhcpHostUpdate
+	}
+
+	return func(hostname string, reservations []*DhcpHostReservation) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("SyncDhcpHostReservations(%s)", hostname))()
+		// group the reservations by network
+		byNetwork := make(map[string][]libvirtxml.NetworkDHCPHost)
+		for _, reservation := range reservations {
+			byNetwork[reservation.Network] = append(byNetwork[reservation.Network], reservation.Host)
+		}
+		nets, _, err := conn.ConnectListAllNetworks(NeedResults, 0)
+		if err != nil {
+			log.Printf("Unable to list networks, cause: [%v]", err)
+			return err
+		}
+		// plan all updates first, so a conflict does not leave partial modifications behind
+		var plan []*networkUpdates
+		for _, net := range nets {
+			netDef, err := networkXMLDesc(&net)
+			if err != nil {
+				log.Printf("Unable to get information for network [%s], cause: [%v]", net.Name, err)
+				return err
+			}
+			var leases []libvirt.NetworkDhcpLease
+			// leases only matter for networks with reservations of the host
+			if len(byNetwork[net.Name]) > 0 {
+				leases, _, err = conn.NetworkGetDhcpLeases(net, nil, NeedResults, 0)
+				if err != nil {
+					log.Printf("Unable to get leases for the network [%s], cause: [%v]", net.Name, err)
+					return err
+				}
+			}
+			updates, err := planDhcpHostUpdates(netDef, leases, hostname, byNetwork[net.Name])
+			if err != nil {
+				return err
+			}
+			delete(byNetwork, net.Name)
+			if len(updates) > 0 {
+				plan = append(plan, &networkUpdates{net: net, updates: updates})
+			}
+		}
+		for network := range byNetwork {
+			return fmt.Errorf("network [%s] for the static address of [%s] does not exist", network, hostname)
+		}
+		// apply the updates
+		for _, netUpdates := range plan {
+			flags, err := networkUpdateFlags(netUpdates.net)
+			if err != nil {
+				log.Printf("Unable to get the state of network [%s], cause: [%v]", netUpdates.net.Name, err)
+				return err
+			}
+			for _, update := range netUpdates.updates {
+				hostXML, err := XMLMarshall(update.Host)
+				if err != nil {
+					return err
+				}
+				log.Printf("Updating DHCP host [%s] on network [%s], command [%d]", hostXML, netUpdates.net.Name, update.Command)
+				err = conn.NetworkUpdateCompat(netUpdates.net, update.Command, libvirt.NetworkSectionIPDhcpHost, update.ParentIndex, hostXML, flags)
+				if err != nil {
+					log.Printf("Unable to update DHCP host [%s] on network [%s], cause: [%v]", hostXML, netUpdates.net.Name, err)
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// DeleteDhcpHostReservations removes all DHCP host entries of the host
+func DeleteDhcpHostReservations(client *LivirtClient) func(hostname string) error {
+	syncDhcpHostReservations := SyncDhcpHostReservations(client)
+
+	return func(hostname string) error {
+		return syncDhcpHostReservations(hostname, nil)
+	}
+}
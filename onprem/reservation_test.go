@@ -0,0 +1,171 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"libvirt.org/go/libvirtxml"
+)
+
+const testNetworkXML = `<network>
+  <name>default</name>
+  <ip address="192.168.122.1" netmask="255.255.255.0">
+    <dhcp>
+      <range start="192.168.122.2" end="192.168.122.254"/>
+      <host mac="02:00:00:00:00:01" name="other" ip="192.168.122.10"/>
+      <host mac="02:00:00:00:00:02" name="vsi" ip="192.168.122.20"/>
+    </dhcp>
+  </ip>
+  <ip family="ipv6" address="fd00::1" prefix="64">
+    <dhcp>
+      <range start="fd00::100" end="fd00::1ff"/>
+    </dhcp>
+  </ip>
+</network>`
+
+func TestGetDhcpHostReservations(t *testing.T) {
+	opt := &InstanceOptions{
+		Name:     "vsi",
+		Networks: []string{"first", "second"},
+		Addresses: map[string]*NetworkAddress{
+			"second": {IPv4: "10.0.0.5", IPv6: "fd00::0005"},
+		},
+	}
+	reservations, err := GetDhcpHostReservations(opt)
+	require.NoError(t, err)
+	require.Len(t, reservations, 2)
+
+	assert.Equal(t, "second", reservations[0].Network)
+	assert.Equal(t, CreateMacAddressFromHash("vsi-second"), reservations[0].Host.MAC)
+	assert.Equal(t, "10.0.0.5", reservations[0].Host.IP)
+	// IPv6 entries are identified by name
+	assert.Empty(t, reservations[1].Host.MAC)
+	assert.Equal(t, "fd00::5", reservations[1].Host.IP)
+	assert.Equal(t, "vsi", reservations[1].Host.Name)
+
+	// the default network uses the MAC of the default interface
+	reservations, err = GetDhcpHostReservations(&InstanceOptions{
+		Name:      "vsi",
+		Addresses: map[string]*NetworkAddress{DefaultNetwork: {IPv4: "192.168.122.5"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, CreateMacAddressFromMaybeUUID("vsi"), reservations[0].Host.MAC)
+}
+
+func TestGetDhcpHostReservationsInvalid(t *testing.T) {
+	_, err := GetDhcpHostReservations(&InstanceOptions{
+		Name:      "vsi",
+		Addresses: map[string]*NetworkAddress{"other": {IPv4: "10.0.0.5"}},
+	})
+	assert.Error(t, err)
+
+	_, err = GetDhcpHostReservations(&InstanceOptions{
+		Name:      "vsi",
+		Addresses: map[string]*NetworkAddress{DefaultNetwork: {IPv4: "fd00::5"}},
+	})
+	assert.Error(t, err)
+}
+
+func TestPlanDhcpHostUpdates(t *testing.T) {
+	netDef, err := parseNetworkXML(testNetworkXML)
+	require.NoError(t, err)
+
+	// unchanged reservation
+	updates, err := planDhcpHostUpdates(netDef, nil, "vsi", []libvirtxml.NetworkDHCPHost{
+		{MAC: "02:00:00:00:00:02", Name: "vsi", IP: "192.168.122.20"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+
+	// changed reservation replaces the old entry
+	updates, err = planDhcpHostUpdates(netDef, nil, "vsi", []libvirtxml.NetworkDHCPHost{
+		{MAC: "02:00:00:00:00:02", Name: "vsi", IP: "192.168.122.21"},
+		{Name: "vsi", IP: "fd00::5"},
+	})
+	require.NoError(t, err)
+	require.Len(t, updates, 3)
+	assert.Equal(t, libvirt.NetworkUpdateCommandDelete, updates[0].Command)
+	assert.Equal(t, "192.168.122.20", updates[0].Host.IP)
+	assert.Equal(t, libvirt.NetworkUpdateCommandAddLast, updates[1].Command)
+	assert.Equal(t, int32(0), updates[1].ParentIndex)
+	assert.Equal(t, libvirt.NetworkUpdateCommandAddLast, updates[2].Command)
+	assert.Equal(t, int32(1), updates[2].ParentIndex)
+
+	// no reservations removes the entries of the host
+	updates, err = planDhcpHostUpdates(netDef, nil, "vsi", nil)
+	require.NoError(t, err)
+	require.Len(t, updates, 1)
+	assert.Equal(t, libvirt.NetworkUpdateCommandDelete, updates[0].Command)
+}
+
+func TestPlanDhcpHostUpdatesConflict(t *testing.T) {
+	netDef, err := parseNetworkXML(testNetworkXML)
+	require.NoError(t, err)
+
+	_, err = planDhcpHostUpdates(netDef, nil, "vsi", []libvirtxml.NetworkDHCPHost{
+		{MAC: "02:00:00:00:00:02", Name: "vsi", IP: "192.168.122.10"},
+	})
+	assert.ErrorContains(t, err, "already reserved for [other]")
+
+	_, err = planDhcpHostUpdates(netDef, nil, "vsi", []libvirtxml.NetworkDHCPHost{
+		{MAC: "02:00:00:00:00:02", Name: "vsi", IP: "10.0.0.1"},
+	})
+	assert.ErrorContains(t, err, "not part of any subnet")
+
+	// active leases of other guests conflict, leases of the host itself do not
+	leases := []libvirt.NetworkDhcpLease{
+		{Ipaddr: "192.168.122.30", Mac: libvirt.OptString{"02:00:00:00:00:09"}, Hostname: libvirt.OptString{"guest"}},
+		{Ipaddr: "192.168.122.31", Mac: libvirt.OptString{"02:00:00:00:00:02"}},
+	}
+	_, err = planDhcpHostUpdates(netDef, leases, "vsi", []libvirtxml.NetworkDHCPHost{
+		{MAC: "02:00:00:00:00:02", Name: "vsi", IP: "192.168.122.30"},
+	})
+	assert.ErrorContains(t, err, "is leased to [guest]")
+
+	_, err = planDhcpHostUpdates(netDef, leases, "vsi", []libvirtxml.NetworkDHCPHost{
+		{MAC: "02:00:00:00:00:02", Name: "vsi", IP: "192.168.122.31"},
+	})
+	assert.NoError(t, err)
+}
+
+func TestNetworkRefCustomResourceToAddresses(t *testing.T) {
+	refs := []*NetworkRefCustomResource{
+		{Spec: NetworkRefCustomResourceSpec{NetworkName: "first", NetworkAddress: NetworkAddress{IPv4: "10.0.0.1"}}},
+		{Spec: NetworkRefCustomResourceSpec{NetworkName: "second", NetworkAddress: NetworkAddress{IPv4: "10.0.1.1"}}},
+		{Spec: NetworkRefCustomResourceSpec{NetworkName: "third"}},
+	}
+	addresses := NetworkRefCustomResourceToAddresses(refs, map[string]*NetworkAddress{
+		"second": {IPv6: "fd00::5"},
+	})
+	assert.Equal(t, map[string]*NetworkAddress{
+		"first":  {IPv4: "10.0.0.1"},
+		"second": {IPv6: "fd00::5"},
+	}, addresses)
+}
+
+func TestInstanceHashWithAddresses(t *testing.T) {
+	opt := &InstanceOptions{Name: "vsi"}
+	hash := CreateInstanceHash(opt)
+	// no addresses keep the hash of existing instances
+	opt.Addresses = map[string]*NetworkAddress{}
+	assert.Equal(t, hash, CreateInstanceHash(opt))
+
+	opt.Addresses[DefaultNetwork] = &NetworkAddress{IPv4: "192.168.122.5"}
+	assert.NotEqual(t, hash, CreateInstanceHash(opt))
+}
@@ -0,0 +1,283 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// the existing definition is started again whenever the domain stops
+	RestartPolicyAlways = "Always"
+	// the existing definition is started again if the domain crashed or failed
+	RestartPolicyOnFailure = "OnFailure"
+	// the domain is recreated from scratch including a fresh boot disk, the default
+	RestartPolicyRecreate = "Recreate"
+	// the domain is left stopped
+	RestartPolicyNever = "Never"
+
+	// ConditionCrashLoopBackOff is the condition type reported while a restart is delayed
+	ConditionCrashLoopBackOff = "CrashLoopBackOff"
+	// ConditionInstanceStopped is the condition type reported for a stopped domain that is not restarted
+	ConditionInstanceStopped = "InstanceStopped"
+
+	// delay before the second restart of a crash loop, doubled for each further restart
+	restartBackoffBase = 10 * time.Second
+	// maximum delay between two restarts
+	restartBackoffMax = 5 * time.Minute
+	// a domain that ran for this long after its last restart is no longer considered to be crash looping
+	restartResetWindow = 10 * time.Minute
+)
+
+// InstanceRestarts records the restarts of an instance in its metadata
+type InstanceRestarts struct {
+	// total number of restarts
+	Count int `xml:"count,attr"`
+	// number of restarts of the current crash loop
+	Consecutive int `xml:"consecutive,attr"`
+	// time of the last restart
+	Last time.Time `xml:"last,attr"`
+}
+
+// InstanceRestartStatus reports the restarts of an instance in the status of its resource
+type InstanceRestartStatus struct {
+	Policy      string     `json:"policy"`
+	Count       int        `json:"count"`
+	LastRestart *time.Time `json:"lastRestart,omitempty"`
+	NextRestart *time.Time `json:"nextRestart,omitempty"`
+}
+
+// RestartBackOffError is returned if a stopped domain is restarted too often and its next restart is delayed
+type RestartBackOffError struct {
+	Name        string
+	Restarts    int
+	NextRestart time.Time
+}
+
+func (err *RestartBackOffError) Error() string {
+	return fmt.Sprintf("%s: domain [%s] stopped after [%d] restarts, next restart at [%s]", ConditionCrashLoopBackOff, err.Name, err.Restarts, err.NextRestart.Format(time.RFC3339))
+}
+
+// ConditionType returns the type of the condition that reports the error
+func (err *RestartBackOffError) ConditionType() string {
+	return ConditionCrashLoopBackOff
+}
+
+// InstanceStoppedError is returned if a stopped domain is not restarted because of its restart policy
+type InstanceStoppedError struct {
+	Name     string
+	Policy   string
+	Crashed  bool
+	Restarts int
+}
+
+func (err *InstanceStoppedError) Error() string {
+	if err.Crashed {
+		return fmt.Sprintf("%s: domain [%s] crashed and is not restarted, restart policy [%s]", ConditionInstanceStopped, err.Name, err.Policy)
+	}
+	return fmt.Sprintf("%s: domain [%s] has been shut down and is not restarted, restart policy [%s]", ConditionInstanceStopped, err.Name, err.Policy)
+}
+
+// ConditionType returns the type of the condition that reports the error
+func (err *InstanceStoppedError) ConditionType() string {
+	return ConditionInstanceStopped
+}
+
+// IsValidRestartPolicy tests if the restart policy is supported
+func IsValidRestartPolicy(policy string) bool {
+	switch policy {
+	case RestartPolicyAlways, RestartPolicyOnFailure, RestartPolicyRecreate, RestartPolicyNever:
+		return true
+	}
+	return false
+}
+
+// isDomainCrashed tests if a domain stopped because of a crash or failure rather than a shutdown
+func isDomainCrashed(state libvirt.DomainState, reason int32) bool {
+	if state == libvirt.DomainCrashed {
+		return true
+	}
+	switch libvirt.DomainShutoffReason(reason) {
+	case libvirt.DomainShutoffCrashed, libvirt.DomainShutoffFailed:
+		return state == libvirt.DomainShutoff
+	}
+	return false
+}
+
+// shouldRestart tests if the restart policy starts a stopped domain again
+func shouldRestart(policy string, crashed bool) bool {
+	switch policy {
+	case RestartPolicyAlways, RestartPolicyRecreate:
+		return true
+	case RestartPolicyOnFailure:
+		return crashed
+	}
+	return false
+}
+
+// getRestartBackoff returns the delay after the given number of restarts of a crash loop
+func getRestartBackoff(consecutive int) time.Duration {
+	if consecutive <= 0 {
+		return 0
+	}
+	backoff := restartBackoffBase
+	for i := 1; i < consecutive && backoff < restartBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, restartBackoffMax)
+}
+
+// getNextRestart returns the number of restarts of the current crash loop and the earliest time of the next restart
+func getNextRestart(restarts *InstanceRestarts, now time.Time) (int, time.Time) {
+	if restarts == nil || now.Sub(restarts.Last) >= restartResetWindow {
+		return 0, now
+	}
+	return restarts.Consecutive, restarts.Last.Add(getRestartBackoff(restarts.Consecutive))
+}
+
+// nextInstanceRestarts applies the restart policy and the crash loop backoff to a stopped domain and returns the
+// restarts to record for the restart
+func nextInstanceRestarts(name, policy string, crashed bool, restarts *InstanceRestarts, now time.Time) (*InstanceRestarts, error) {
+	count := 0
+	if restarts != nil {
+		count = restarts.Count
+	}
+	if !shouldRestart(policy, crashed) {
+		return nil, &InstanceStoppedError{Name: name, Policy: policy, Crashed: crashed, Restarts: count}
+	}
+	consecutive, next := getNextRestart(restarts, now)
+	if now.Before(next) {
+		return nil, &RestartBackOffError{Name: name, Restarts: count, NextRestart: next}
+	}
+	return &InstanceRestarts{Count: count + 1, Consecutive: consecutive + 1, Last: now}, nil
+}
+
+// GetInstanceRestartStatus returns the restarts recorded in the metadata of a domain
+func GetInstanceRestartStatus(opt *InstanceOptions, domainXML *libvirtxml.Domain) *InstanceRestartStatus {
+	status := &InstanceRestartStatus{Policy: opt.RestartPolicy}
+	if domainXML == nil {
+		return status
+	}
+	metadata, err := parseInstanceMetadata(domainXML)
+	if err != nil || metadata.Restarts == nil {
+		return status
+	}
+	status.Count = metadata.Restarts.Count
+	status.LastRestart = &metadata.Restarts.Last
+	return status
+}
+
+// RestartInstanceSync (synchronously) applies the restart policy to an existing domain with an up to date definition
+// that does not run. It returns the domain if the policy has been applied in place, otherwise the restarts to record
+// when the domain is recreated. A delayed restart or a domain that stays stopped are reported as errors. A domain
+// that has been stopped on purpose is started regardless of its restart policy.
+func RestartInstanceSync(client *LivirtClient) func(opt *InstanceOptions) (*libvirtxml.Domain, *InstanceRestarts, error) {
+	conn := client.LibVirt
+	setMetadata := setInstanceMetadata(conn)
+
+	return func(opt *InstanceOptions) (*libvirtxml.Domain, *InstanceRestarts, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("RestartInstanceSync(%s)", opt.Name))()
+
+		name := opt.Name
+		domain, err := conn.DomainLookupByName(name)
+		if err != nil {
+			// nothing to restart
+			return nil, nil, nil
+		}
+		state, reason, err := conn.DomainGetState(domain, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		domainXML, err := parseDomainXML(domainStrg)
+		if err != nil {
+			return nil, nil, err
+		}
+		// outdated definitions are always recreated
+		metadata, err := parseInstanceMetadata(domainXML)
+		if err != nil || !matchesInstanceHash(metadata, opt) {
+			return nil, nil, nil
+		}
+		policy := opt.RestartPolicy
+		powerStopped := metadata.PowerState == PowerStateStopped
+		domainState := libvirt.DomainState(state)
+		if !IsDomainStopped(domainState) {
+			if policy == RestartPolicyRecreate && !powerStopped {
+				return nil, nil, nil
+			}
+			// e.g. paused or shutting down, wait for the domain to settle
+			log.Printf("Domain [%s] is in state [%d], waiting for it to settle.", name, state)
+			return domainXML, nil, nil
+		}
+		restarts := metadata.Restarts
+		if powerStopped {
+			log.Printf("Starting domain [%s] that has been stopped on purpose ...", name)
+			metadata.PowerState = ""
+			// start the domain when the host boots
+			err = conn.DomainSetAutostart(domain, 1)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			crashed := isDomainCrashed(domainState, reason)
+			log.Printf("Domain [%s] stopped in state [%d] with reason [%d], crashed [%t], restart policy [%s].", name, state, reason, crashed, policy)
+			restarts, err = nextInstanceRestarts(name, policy, crashed, metadata.Restarts, time.Now())
+			if err != nil {
+				return nil, nil, err
+			}
+			if policy == RestartPolicyRecreate {
+				return nil, restarts, nil
+			}
+			log.Printf("Restarting domain [%s], restart [%d] ...", name, restarts.Count)
+		}
+		// record the restart and the power state in the persistent definition
+		metadata.Restarts = restarts
+		err = setMetadata(domain, metadata)
+		if err != nil {
+			return nil, nil, err
+		}
+		// a preserved crashed domain must be torn down before it can be started
+		if domainState == libvirt.DomainCrashed {
+			err = conn.DomainDestroy(domain)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err = conn.DomainCreate(domain)
+		if err != nil {
+			return nil, nil, err
+		}
+		// read back the domain info
+		domainStrg, err = conn.DomainGetXMLDesc(domain, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		domainXML, err = parseDomainXML(domainStrg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return domainXML, restarts, nil
+	}
+}
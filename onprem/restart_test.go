@@ -0,0 +1,134 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+	"libvirt.org/go/libvirtxml"
+)
+
+func TestIsDomainCrashed(t *testing.T) {
+	assert.True(t, isDomainCrashed(libvirt.DomainCrashed, 0))
+	assert.True(t, isDomainCrashed(libvirt.DomainShutoff, int32(libvirt.DomainShutoffCrashed)))
+	assert.True(t, isDomainCrashed(libvirt.DomainShutoff, int32(libvirt.DomainShutoffFailed)))
+	assert.False(t, isDomainCrashed(libvirt.DomainShutoff, int32(libvirt.DomainShutoffShutdown)))
+	assert.False(t, isDomainCrashed(libvirt.DomainShutoff, int32(libvirt.DomainShutoffDestroyed)))
+	// the reason of a running domain has a different meaning
+	assert.False(t, isDomainCrashed(libvirt.DomainRunning, int32(libvirt.DomainShutoffCrashed)))
+}
+
+func TestShouldRestart(t *testing.T) {
+	tests := []struct {
+		policy  string
+		crashed bool
+		restart bool
+	}{
+		{RestartPolicyAlways, false, true},
+		{RestartPolicyAlways, true, true},
+		{RestartPolicyOnFailure, false, false},
+		{RestartPolicyOnFailure, true, true},
+		{RestartPolicyRecreate, false, true},
+		{RestartPolicyRecreate, true, true},
+		{RestartPolicyNever, false, false},
+		{RestartPolicyNever, true, false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.restart, shouldRestart(tc.policy, tc.crashed), "%s crashed=%t", tc.policy, tc.crashed)
+	}
+}
+
+func TestGetRestartBackoff(t *testing.T) {
+	assert.Equal(t, time.Duration(0), getRestartBackoff(0))
+	assert.Equal(t, 10*time.Second, getRestartBackoff(1))
+	assert.Equal(t, 20*time.Second, getRestartBackoff(2))
+	assert.Equal(t, 40*time.Second, getRestartBackoff(3))
+	assert.Equal(t, restartBackoffMax, getRestartBackoff(6))
+	assert.Equal(t, restartBackoffMax, getRestartBackoff(100))
+}
+
+func TestNextInstanceRestarts(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	// the first restart happens immediately
+	restarts, err := nextInstanceRestarts("vsi", RestartPolicyAlways, false, nil, now)
+	assert.NoError(t, err)
+	assert.Equal(t, &InstanceRestarts{Count: 1, Consecutive: 1, Last: now}, restarts)
+	// the second one is delayed
+	_, err = nextInstanceRestarts("vsi", RestartPolicyAlways, true, restarts, now.Add(5*time.Second))
+	var backOffErr *RestartBackOffError
+	assert.ErrorAs(t, err, &backOffErr)
+	assert.Equal(t, 1, backOffErr.Restarts)
+	assert.Equal(t, now.Add(10*time.Second), backOffErr.NextRestart)
+	assert.Equal(t, ConditionCrashLoopBackOff, backOffErr.ConditionType())
+	// until the backoff expired
+	restarts, err = nextInstanceRestarts("vsi", RestartPolicyAlways, true, restarts, now.Add(10*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, restarts.Count)
+	assert.Equal(t, 2, restarts.Consecutive)
+	// a domain that ran long enough is no longer crash looping
+	later := restarts.Last.Add(restartResetWindow)
+	restarts, err = nextInstanceRestarts("vsi", RestartPolicyAlways, true, restarts, later)
+	assert.NoError(t, err)
+	assert.Equal(t, &InstanceRestarts{Count: 3, Consecutive: 1, Last: later}, restarts)
+}
+
+func TestNextInstanceRestartsStopped(t *testing.T) {
+	now := time.Now()
+	previous := &InstanceRestarts{Count: 2, Consecutive: 2, Last: now}
+
+	_, err := nextInstanceRestarts("vsi", RestartPolicyOnFailure, false, previous, now)
+	var stoppedErr *InstanceStoppedError
+	assert.ErrorAs(t, err, &stoppedErr)
+	assert.False(t, stoppedErr.Crashed)
+	assert.Equal(t, 2, stoppedErr.Restarts)
+
+	_, err = nextInstanceRestarts("vsi", RestartPolicyNever, true, nil, now)
+	assert.ErrorAs(t, err, &stoppedErr)
+	assert.True(t, stoppedErr.Crashed)
+	assert.Equal(t, ConditionInstanceStopped, stoppedErr.ConditionType())
+}
+
+func TestInstanceRestartsMetadata(t *testing.T) {
+	last := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	metadata := InstanceMetadata{
+		Hash:     "hash",
+		Restarts: &InstanceRestarts{Count: 3, Consecutive: 1, Last: last},
+	}
+	metadataXML, err := XMLMarshall(metadata)
+	assert.NoError(t, err)
+
+	domainXML := &libvirtxml.Domain{Metadata: &libvirtxml.DomainMetadata{XML: metadataXML}}
+	status := GetInstanceRestartStatus(&InstanceOptions{RestartPolicy: RestartPolicyAlways}, domainXML)
+	assert.Equal(t, RestartPolicyAlways, status.Policy)
+	assert.Equal(t, 3, status.Count)
+	assert.Equal(t, last, *status.LastRestart)
+	assert.Nil(t, status.NextRestart)
+
+	// metadata without restarts
+	var parsed InstanceMetadata
+	assert.NoError(t, xml.Unmarshal([]byte("<instance xmlns=\"https://github.com/ibm-hyper-protect/k8s-operator-hpcr\"><hash>hash</hash></instance>"), &parsed))
+	assert.Nil(t, parsed.Restarts)
+}
+
+func TestIsValidRestartPolicy(t *testing.T) {
+	assert.True(t, IsValidRestartPolicy(BoxRestartPolicy("")))
+	assert.Equal(t, RestartPolicyRecreate, BoxRestartPolicy(""))
+	assert.True(t, IsValidRestartPolicy(RestartPolicyOnFailure))
+	assert.False(t, IsValidRestartPolicy("Sometimes"))
+}
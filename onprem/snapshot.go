@@ -0,0 +1,264 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// running domains that use the data disk are paused while the snapshot is taken, i.e. for the duration of a
+	// full copy of the disk
+	SnapshotConsistencyPause = "pause"
+	// the snapshot is taken without pausing, it may be inconsistent if the disk is written to. This is the default
+	SnapshotConsistencyNone = "none"
+)
+
+var (
+	// full identifier of the data disk snapshot config entry
+	KeyDataDiskSnapshotConfig = fmt.Sprintf("%s.%s", KindDataDiskSnapshot, APIVersion)
+)
+
+type DataDiskSnapshotOptions struct {
+	// name of the snapshot
+	Name string
+	// the data disk to take the snapshot of
+	DataDisk *AttachedDataDisk
+	// name of the storage pool that receives the snapshot
+	StoragePool string
+	// consistency handling while the owning VSI is running
+	Consistency string
+}
+
+func GetSnapshotVolumeName(name string) string {
+	return fmt.Sprintf("snapshot-%s.qcow2", name)
+}
+
+// getRunningDomainsUsingPath returns the running domains that have a disk backed by the given file
+func getRunningDomainsUsingPath(conn *libvirt.Libvirt) func(path string) ([]libvirt.Domain, error) {
+	return func(path string) ([]libvirt.Domain, error) {
+		domains, _, err := conn.ConnectListAllDomains(NeedResults, libvirt.ConnectListDomainsActive)
+		if err != nil {
+			return nil, err
+		}
+		var result []libvirt.Domain
+		for _, domain := range domains {
+			domainStrg, err := conn.DomainGetXMLDesc(domain, 0)
+			if err != nil {
+				return nil, err
+			}
+			domainXML, err := parseDomainXML(domainStrg)
+			if err != nil {
+				return nil, err
+			}
+			if domainXML.Devices == nil {
+				continue
+			}
+			for _, disk := range domainXML.Devices.Disks {
+				if getDiskSourcePath(&disk) == path {
+					result = append(result, domain)
+					break
+				}
+			}
+		}
+		return result, nil
+	}
+}
+
+// pauseDomains suspends the running domains and returns a function that resumes them again
+func pauseDomains(conn *libvirt.Libvirt) func(domains []libvirt.Domain) (func(), error) {
+	return func(domains []libvirt.Domain) (func(), error) {
+		var paused []libvirt.Domain
+		resume := func() {
+			for _, domain := range paused {
+				log.Printf("Resuming domain [%s] ...", domain.Name)
+				if err := conn.DomainResume(domain); err != nil {
+					log.Printf("Unable to resume domain [%s], cause: [%v]", domain.Name, err)
+				}
+			}
+		}
+		for _, domain := range domains {
+			state, _, err := conn.DomainGetState(domain, 0)
+			if err != nil {
+				resume()
+				return nil, err
+			}
+			if libvirt.DomainState(state) != libvirt.DomainRunning {
+				continue
+			}
+			log.Printf("Pausing domain [%s] ...", domain.Name)
+			err = conn.DomainSuspend(domain)
+			if err != nil {
+				resume()
+				return nil, err
+			}
+			paused = append(paused, domain)
+		}
+		return resume, nil
+	}
+}
+
+// cloneVolume creates a full copy of a volume in the given layout, a partial copy is removed on failure
+func cloneVolume(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string, capacity uint64, source libvirt.StorageVol, layout *DataDiskLayout) (*libvirt.StorageVol, error) {
+	delVolume := deleteStorageVol(conn)
+	volumeDefXML := getDataDiskVolumeDefXML(conn)
+
+	return func(pool libvirt.StoragePool, name string, capacity uint64, source libvirt.StorageVol, layout *DataDiskLayout) (*libvirt.StorageVol, error) {
+		volumeXML, flags, err := volumeDefXML(pool, name, capacity, layout)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Cloning volume [%s] into [%s] on pool [%s] ...", source.Name, name, pool.Name)
+		vol, err := conn.StorageVolCreateXMLFrom(pool, volumeXML, source, flags)
+		if err != nil {
+			log.Printf("Unable to clone volume [%s] into [%s], cause: [%v]", source.Name, name, err)
+			if _, errDel := delVolume(pool, name); errDel != nil && !isError(errDel, libvirt.ErrNoStorageVol) {
+				log.Printf("Unable to remove partial volume [%s], cause: [%v]", name, errDel)
+			}
+			return nil, err
+		}
+		return &vol, nil
+	}
+}
+
+// copyVolume creates a full copy of a volume, the running VSIs that use the volume are paused during the copy
+// unless the consistency is none
+func copyVolume(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string, source *AttachedDataDisk, consistency string, layout *DataDiskLayout) (*libvirt.StorageVol, error) {
+	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+	getRunningDomains := getRunningDomainsUsingPath(conn)
+	pause := pauseDomains(conn)
+	clone := cloneVolume(conn)
+
+	return func(pool libvirt.StoragePool, name string, source *AttachedDataDisk, consistency string, layout *DataDiskLayout) (*libvirt.StorageVol, error) {
+		sourcePool, err := conn.StoragePoolLookupByName(source.StoragePool)
+		if err != nil {
+			return nil, err
+		}
+		sourceVol, err := conn.StorageVolLookupByName(sourcePool, source.Name)
+		if err != nil {
+			log.Printf("Unable to lookup volume [%s] on pool [%s], cause: [%v]", source.Name, sourcePool.Name, err)
+			return nil, err
+		}
+		sourceXML, err := storageVolXMLDesc(&sourceVol)
+		if err != nil {
+			return nil, err
+		}
+		// pause the VSIs that write to the volume for the duration of the copy
+		if consistency != SnapshotConsistencyNone {
+			domains, err := getRunningDomains(sourceXML.Target.Path)
+			if err != nil {
+				return nil, err
+			}
+			resume, err := pause(domains)
+			if err != nil {
+				return nil, err
+			}
+			defer resume()
+		}
+		return clone(pool, name, sourceXML.Capacity.Value, sourceVol, layout)
+	}
+}
+
+// CreateDataDiskSnapshotSync (synchronously) takes a point in time copy of a data disk. Snapshots are immutable, an
+// existing snapshot is returned as is.
+func CreateDataDiskSnapshotSync(client *LivirtClient) func(opt *DataDiskSnapshotOptions) (*libvirtxml.StorageVolume, error) {
+	conn := client.LibVirt
+	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+	copyVol := copyVolume(conn)
+
+	return func(opt *DataDiskSnapshotOptions) (*libvirtxml.StorageVolume, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("CreateDataDiskSnapshotSync(%s)", opt.Name))()
+
+		name := GetSnapshotVolumeName(opt.Name)
+		pool, err := conn.StoragePoolLookupByName(opt.StoragePool)
+		if err != nil {
+			return nil, err
+		}
+		// the snapshot has already been taken
+		existing, err := conn.StorageVolLookupByName(pool, name)
+		if err == nil {
+			return storageVolXMLDesc(&existing)
+		}
+		// snapshots are sparse qcow2 copies
+		vol, err := copyVol(pool, name, opt.DataDisk, opt.Consistency, &DataDiskLayout{Format: DataDiskFormatQCow2})
+		if err != nil {
+			return nil, err
+		}
+		return storageVolXMLDesc(vol)
+	}
+}
+
+// DeleteDataDiskSnapshotSync (synchronously) deletes a snapshot
+func DeleteDataDiskSnapshotSync(client *LivirtClient) func(storagePool, name string) error {
+	deleteSync := DeleteDataDiskSync(client)
+
+	return func(storagePool, name string) error {
+		return deleteSync(storagePool, GetSnapshotVolumeName(name))
+	}
+}
+
+// DataDiskSnapshotsFromRelated decodes the set of referenced snapshots from the related data structure
+func DataDiskSnapshotsFromRelated(data map[string]any) ([]*DataDiskSnapshotCustomResource, error) {
+	var result []*DataDiskSnapshotCustomResource
+	if related, ok := data["related"].(map[string]any); ok {
+		// all snapshots
+		if snapshots, ok := related[KeyDataDiskSnapshotConfig].(map[string]any); ok {
+			// decode each snapshot
+			for _, snapshot := range snapshots {
+				// transcode to the expected format
+				snap, err := common.Transcode[*DataDiskSnapshotCustomResource](snapshot)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, snap)
+			}
+		}
+	}
+	// ok
+	return result, nil
+}
+
+// GetDataDiskSnapshot locates the named snapshot and makes sure it is ready
+func GetDataDiskSnapshot(snapshots []*DataDiskSnapshotCustomResource, name string) (*DataDiskSnapshotCustomResource, error) {
+	for _, snapshot := range snapshots {
+		if snapshot.Name != name {
+			continue
+		}
+		if common.Status(snapshot.Status.Status) != common.Ready {
+			return nil, fmt.Errorf("snapshot [%s] is not ready, cause: [%s]", name, snapshot.Status.Description)
+		}
+		return snapshot, nil
+	}
+	return nil, fmt.Errorf("snapshot [%s] does not exist", name)
+}
+
+// GetDataDisk locates the named data disk and makes sure it is ready
+func GetDataDisk(dataDisks []*DataDiskCustomResource, name string) (*AttachedDataDisk, error) {
+	for _, dataDisk := range dataDisks {
+		if dataDisk.Name == name {
+			disk := dataDiskCustomResourceToAttachedDataDisk(dataDisk)
+			disk.StoragePool = BoxStoragePool(disk.StoragePool)
+			return disk, nil
+		}
+	}
+	return nil, fmt.Errorf("data disk [%s] does not exist or is not ready", name)
+}
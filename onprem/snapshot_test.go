@@ -0,0 +1,63 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetDataDiskSnapshot(t *testing.T) {
+	snapshots := []*DataDiskSnapshotCustomResource{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "ready"},
+			Status: DataDiskSnapshotStatus{
+				Status:   int(common.Ready),
+				Metadata: DataDiskSnapshotStatusMetadata{StoragePool: "images", VolumeName: GetSnapshotVolumeName("uid")},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "waiting"},
+			Status:     DataDiskSnapshotStatus{Status: int(common.Waiting)},
+		},
+	}
+
+	snapshot, err := GetDataDiskSnapshot(snapshots, "ready")
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot-uid.qcow2", snapshot.Status.Metadata.VolumeName)
+
+	_, err = GetDataDiskSnapshot(snapshots, "waiting")
+	assert.Error(t, err)
+	_, err = GetDataDiskSnapshot(snapshots, "missing")
+	assert.Error(t, err)
+}
+
+func TestGetDataDisk(t *testing.T) {
+	dataDisks := []*DataDiskCustomResource{
+		{ObjectMeta: metav1.ObjectMeta{Name: "disk", UID: "uid"}},
+	}
+
+	disk, err := GetDataDisk(dataDisks, "disk")
+	require.NoError(t, err)
+	assert.Equal(t, "uid", disk.Name)
+	assert.Equal(t, BoxStoragePool(""), disk.StoragePool)
+
+	_, err = GetDataDisk(dataDisks, "missing")
+	assert.Error(t, err)
+}
@@ -15,6 +15,9 @@
 package onprem
 
 import (
+	"bytes"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -22,12 +25,9 @@ import (
 	"strings"
 	"time"
 
-	"os"
-
 	"github.com/digitalocean/go-libvirt/socket"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 	v1 "k8s.io/api/core/v1"
 )
 
@@ -43,6 +43,12 @@ const (
 	KeyPort       = "PORT"
 	KeyKnownHosts = "KNOWN_HOSTS"
 	KeyUser       = "USER"
+	// OpenSSH user certificates, one per line in authorized_keys format
+	KeyCertificate = "CERTIFICATE"
+	// passphrase of encrypted private keys, should be kept in a secret
+	KeyPassphrase = "PASSPHRASE"
+	// comma separated jump hosts in the format of the OpenSSH ProxyJump option
+	KeyProxyJump = "PROXY_JUMP"
 )
 
 type SSHConfig struct {
@@ -50,7 +56,18 @@ type SSHConfig struct {
 	Port       int      `json:"port,omitempty" yaml:"port,omitempty"`
 	User       string   `json:"user,omitempty" yaml:"user,omitempty"`
 	KnownHosts []string `json:"knownHosts,omitempty" yaml:"knownHosts,omitempty"`
-	Key        string   `json:"key,omitempty" yaml:"key,omitempty"`
+	// one or more PEM encoded private keys, tried in order
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+	// OpenSSH user certificates for the private keys, one per line
+	Certificate string `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+	// passphrase of encrypted private keys
+	Passphrase string `json:"passphrase,omitempty" yaml:"passphrase,omitempty"`
+	// one of insecure, strict or tofu
+	HostKeyPolicy string `json:"hostKeyPolicy,omitempty" yaml:"hostKeyPolicy,omitempty"`
+	// jump hosts that are dialed in order before the host
+	Jumps []*SSHConfig `json:"jumps,omitempty" yaml:"jumps,omitempty"`
+	// path of the libvirt socket on the host, e.g. the one of virtqemud
+	Socket string `json:"socket,omitempty" yaml:"socket,omitempty"`
 }
 
 type sshDialer struct {
@@ -72,55 +89,103 @@ func getHost(config *SSHConfig) string {
 	return fmt.Sprintf("%s:%d", getHostname(config), getPort(config))
 }
 
-func getPrivateKey(config *SSHConfig) (ssh.Signer, error) {
-	return ssh.ParsePrivateKey([]byte(config.Key))
+func getSocket(config *SSHConfig) string {
+	if len(config.Socket) == 0 {
+		return defaultUnixSock
+	}
+	return config.Socket
 }
 
-func getUserName(config *SSHConfig) (string, error) {
-	usr := config.User
-	if len(usr) > 0 {
-		return usr, nil
+// splitPrivateKeys splits the PEM blocks of the configured private keys
+func splitPrivateKeys(key string) []string {
+	var result []string
+	rest := []byte(key)
+	for {
+		block, next := pem.Decode(rest)
+		if block == nil {
+			return result
+		}
+		result = append(result, string(pem.EncodeToMemory(block)))
+		rest = next
 	}
-	// just assume the default user
-	return defaultUsername, nil
 }
 
-func getHostKeyCallback(config *SSHConfig) (ssh.HostKeyCallback, error) {
-	// if no keys are configured, fallback to ignore everything
-	if len(config.KnownHosts) == 0 {
-		return ssh.InsecureIgnoreHostKey(), nil // #nosec G106 ignoring host key on purpose
-	}
-	// make sure the temp dir exists
-	tmpDir := os.TempDir()
-	err := os.MkdirAll(tmpDir, os.ModePerm)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create the temporary directory [%s], cause: [%w]", tmpDir, err)
-	}
-	// parse the hosts
-	file, err := os.CreateTemp(tmpDir, "knownHosts")
-	if err != nil {
-		return nil, fmt.Errorf("unable to create a temporary known host file in [%s], cause: [%w]", tmpDir, err)
+// parsePrivateKey parses a single private key, encrypted keys require the passphrase
+func parsePrivateKey(key, passphrase string) (ssh.Signer, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("the private key is encrypted, but no [%s] has been configured", KeyPassphrase)
+		}
+		return ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(passphrase))
 	}
-	defer func() {
-		file.Close() // #nosec: G104 - manually audited
-		err := os.Remove(file.Name())
+	return signer, err
+}
+
+// parseCertificates parses the OpenSSH user certificates
+func parseCertificates(certs string) ([]*ssh.Certificate, error) {
+	var result []*ssh.Certificate
+	rest := []byte(certs)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		pub, _, _, next, err := ssh.ParseAuthorizedKey(rest)
 		if err != nil {
-			log.Printf("Error during removal of [%s]: %v", file.Name(), err)
+			return nil, fmt.Errorf("unable to parse the [%s], cause: [%w]", KeyCertificate, err)
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return nil, fmt.Errorf("the [%s] contains a public key of type [%s] that is not a certificate", KeyCertificate, pub.Type())
 		}
-	}()
+		if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() > int64(cert.ValidBefore) {
+			log.Printf("The SSH certificate [%s] expired at [%v]", cert.KeyId, time.Unix(int64(cert.ValidBefore), 0))
+		}
+		result = append(result, cert)
+		rest = next
+	}
+	return result, nil
+}
 
-	for _, host := range config.KnownHosts {
-		_, err := fmt.Fprintln(file, host)
+// getSigners returns the signers for all private keys, a key with a matching certificate is offered
+// with the certificate first and as a plain key second
+func getSigners(config *SSHConfig) ([]ssh.Signer, error) {
+	keys := splitPrivateKeys(config.Key)
+	if len(keys) == 0 {
+		// report the error of the original parser
+		_, err := ssh.ParsePrivateKey([]byte(config.Key))
+		return nil, err
+	}
+	certs, err := parseCertificates(config.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	var result []ssh.Signer
+	for _, key := range keys {
+		signer, err := parsePrivateKey(key, config.Passphrase)
 		if err != nil {
 			return nil, err
 		}
+		pub := signer.PublicKey().Marshal()
+		for _, cert := range certs {
+			if bytes.Equal(cert.Key.Marshal(), pub) {
+				certSigner, err := ssh.NewCertSigner(cert, signer)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, certSigner)
+			}
+		}
+		result = append(result, signer)
 	}
-	err = file.Close()
-	if err != nil {
-		return nil, err
+	return result, nil
+}
+
+func getUserName(config *SSHConfig) (string, error) {
+	usr := config.User
+	if len(usr) > 0 {
+		return usr, nil
 	}
-	// construct the callback
-	return knownhosts.New(file.Name())
+	// just assume the default user
+	return defaultUsername, nil
 }
 
 func printBanner(msg string) error {
@@ -165,12 +230,8 @@ func (proxy *connProxy) SetWriteDeadline(t time.Time) error {
 	return proxy.delegate.SetWriteDeadline(t)
 }
 
-func (dialer *sshDialer) Dial() (net.Conn, error) {
-	// build the SSH config
-	config := dialer.config
-
-	origin := getHost(config)
-
+// getSSHClientConfig assembles the client config to connect to a single host
+func getSSHClientConfig(config *SSHConfig) (*ssh.ClientConfig, error) {
 	// detect the username
 	username, err := getUserName(config)
 	if err != nil {
@@ -181,26 +242,31 @@ func (dialer *sshDialer) Dial() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	// private key
-	signer, err := getPrivateKey(config)
+	// private keys and certificates
+	signers, err := getSigners(config)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg := ssh.ClientConfig{
+	return &ssh.ClientConfig{
 		User:            username,
 		HostKeyCallback: hostKeyCallback,
-		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
 		Timeout:         dialTimeout,
 		BannerCallback:  printBanner,
-	}
+	}, nil
+}
 
-	sshClient, err := ssh.Dial("tcp", origin, &cfg)
+func (dialer *sshDialer) Dial() (net.Conn, error) {
+	// build the SSH config
+	config := dialer.config
+
+	sshClient, err := dialSSH(config)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := sshClient.Dial("unix", defaultUnixSock)
+	conn, err := sshClient.Dial("unix", getSocket(config))
 	if err != nil {
 		log.Printf("Closing SSH client, cause [%v]", err)
 		errClient := sshClient.Close()
@@ -258,6 +324,10 @@ func GetSSHConfigFromEnvMap(envMap env.Environment) *SSHConfig {
 	result.Hostname = envMap[KeyHostname]
 	result.Key = getSSHPrivateKey(envMap)
 	result.User = envMap[KeyUser]
+	result.Socket = envMap[KeySocket]
+	result.Certificate = envMap[KeyCertificate]
+	result.Passphrase = envMap[KeyPassphrase]
+	result.HostKeyPolicy = envMap[KeyHostKeyPolicy]
 
 	port, ok := envMap[KeyPort]
 	if ok {
@@ -269,6 +339,9 @@ func GetSSHConfigFromEnvMap(envMap env.Environment) *SSHConfig {
 		result.KnownHosts = strings.Split(hosts, "\n")
 	}
 
+	// the jump hosts share the credentials of the host
+	result.Jumps = parseProxyJump(envMap[KeyProxyJump], result)
+
 	return result
 }
 
@@ -279,18 +352,38 @@ func GetEnvMapFromSSHConfig(config *SSHConfig) env.Environment {
 	if len(config.Hostname) > 0 {
 		result[KeyHostname] = config.Hostname
 	}
-	if len(config.Key) > 0 {
-		result[KeyPrivateKey] = config.Key
-	}
 	if config.Port > 0 {
 		result[KeyPort] = fmt.Sprintf("%d", config.Port)
 	}
-	if len(config.KnownHosts) > 0 {
-		result[KeyKnownHosts] = strings.Join(config.KnownHosts, "\n")
-	}
 	if len(config.User) > 0 {
 		result[KeyUser] = config.User
 	}
+	if len(config.Socket) > 0 {
+		result[KeySocket] = config.Socket
+	}
+	if len(config.Passphrase) > 0 {
+		result[KeyPassphrase] = config.Passphrase
+	}
+	if len(config.HostKeyPolicy) > 0 {
+		result[KeyHostKeyPolicy] = config.HostKeyPolicy
+	}
+	if len(config.Jumps) > 0 {
+		result[KeyProxyJump] = formatProxyJump(config.Jumps)
+	}
+	// the jump hosts share the credentials of the host, so merge them
+	key, certs, hosts := config.Key, config.Certificate, config.KnownHosts
+	if len(config.Jumps) > 0 {
+		key, certs, hosts = mergeJumpCredentials(config)
+	}
+	if len(key) > 0 {
+		result[KeyPrivateKey] = key
+	}
+	if len(certs) > 0 {
+		result[KeyCertificate] = certs
+	}
+	if len(hosts) > 0 {
+		result[KeyKnownHosts] = strings.Join(hosts, "\n")
+	}
 
 	return result
 }
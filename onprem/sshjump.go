@@ -0,0 +1,183 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshChain is an SSH client that is connected via zero or more jump hosts
+type sshChain struct {
+	*ssh.Client
+	// the clients of the jump hosts in dial order
+	jumps []*ssh.Client
+}
+
+// closeSSHClients closes clients in reverse order and returns the first error
+func closeSSHClients(clients []*ssh.Client) error {
+	var result error
+	for i := len(clients) - 1; i >= 0; i-- {
+		err := clients[i].Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Close closes the connection to the host and then the connections to the jump hosts
+func (chain *sshChain) Close() error {
+	return closeSSHClients(append(slices.Clone(chain.jumps), chain.Client))
+}
+
+// dialSSHViaJump connects to a host through an established connection to a jump host
+func dialSSHViaJump(jump *ssh.Client, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close() // #nosec: G104 - manually audited
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialSSH connects to the host of the config, via its jump hosts if any
+func dialSSH(config *SSHConfig) (*sshChain, error) {
+	var jumps []*ssh.Client
+	var client *ssh.Client
+
+	for _, hop := range append(slices.Clone(config.Jumps), config) {
+		addr := getHost(hop)
+		cfg, err := getSSHClientConfig(hop)
+		if err == nil {
+			if client == nil {
+				client, err = ssh.Dial("tcp", addr, cfg)
+			} else {
+				log.Printf("Connecting to [%s] via jump host [%s] ...", addr, client.RemoteAddr())
+				jumps = append(jumps, client)
+				client, err = dialSSHViaJump(client, addr, cfg)
+			}
+		}
+		if err != nil {
+			errClose := closeSSHClients(jumps)
+			if errClose != nil {
+				log.Printf("Unable to close the connections to the jump hosts, cause [%v].", errClose)
+			}
+			return nil, fmt.Errorf("unable to connect to [%s], cause: [%w]", addr, err)
+		}
+	}
+
+	return &sshChain{Client: client, jumps: jumps}, nil
+}
+
+// parseJumpHost parses a jump host of the form [user@]host[:port]
+func parseJumpHost(value string) *SSHConfig {
+	result := &SSHConfig{}
+	value = strings.TrimPrefix(value, "ssh://")
+	if idx := strings.LastIndex(value, "@"); idx >= 0 {
+		result.User = value[:idx]
+		value = value[idx+1:]
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err == nil {
+		result.Hostname = host
+		result.Port, _ = strconv.Atoi(port)
+	} else {
+		result.Hostname = strings.Trim(value, "[]")
+	}
+	return result
+}
+
+// parseProxyJump parses the comma separated jump hosts of the OpenSSH ProxyJump option, the jump
+// hosts inherit user, credentials and known hosts from the template unless specified explicitly
+func parseProxyJump(value string, template *SSHConfig) []*SSHConfig {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 || value == "none" {
+		return nil
+	}
+	var result []*SSHConfig
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		hop := parseJumpHost(item)
+		if len(hop.User) == 0 {
+			hop.User = template.User
+		}
+		hop.Key = template.Key
+		hop.Certificate = template.Certificate
+		hop.Passphrase = template.Passphrase
+		hop.KnownHosts = template.KnownHosts
+		hop.HostKeyPolicy = template.HostKeyPolicy
+		result = append(result, hop)
+	}
+	return result
+}
+
+// formatJumpHost formats a jump host as [user@]host[:port]
+func formatJumpHost(hop *SSHConfig) string {
+	host := hop.Hostname
+	if hop.Port > 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(hop.Port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if len(hop.User) > 0 {
+		return hop.User + "@" + host
+	}
+	return host
+}
+
+// formatProxyJump formats jump hosts in the format of the OpenSSH ProxyJump option
+func formatProxyJump(jumps []*SSHConfig) string {
+	hosts := make([]string, len(jumps))
+	for i, hop := range jumps {
+		hosts[i] = formatJumpHost(hop)
+	}
+	return strings.Join(hosts, ",")
+}
+
+// appendUnique appends the non empty values that are not contained, yet
+func appendUnique(result []string, values ...string) []string {
+	for _, value := range values {
+		if len(strings.TrimSpace(value)) > 0 && !slices.Contains(result, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// mergeJumpCredentials merges the private keys, certificates and known hosts of a host and its jump hosts,
+// since the env map shares them across all hops
+func mergeJumpCredentials(config *SSHConfig) (string, string, []string) {
+	var keys, certs, hosts []string
+	for _, hop := range append([]*SSHConfig{config}, config.Jumps...) {
+		keys = appendUnique(keys, splitPrivateKeys(hop.Key)...)
+		certs = appendUnique(certs, strings.Split(hop.Certificate, "\n")...)
+		hosts = appendUnique(hosts, hop.KnownHosts...)
+	}
+	return strings.Join(keys, ""), strings.Join(certs, "\n"), hosts
+}
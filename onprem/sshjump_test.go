@@ -0,0 +1,362 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// createTestKey creates a PEM encoded private key, encrypted if a passphrase is given
+func createTestKey(t *testing.T, passphrase string) (ssh.Signer, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	var block *pem.Block
+	if len(passphrase) > 0 {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "test", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "test")
+	}
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer, string(pem.EncodeToMemory(block))
+}
+
+// createTestUserCertificate signs the public key of the signer as a user certificate
+func createTestUserCertificate(t *testing.T, signer ssh.Signer) string {
+	ca, _ := createTestKey(t, "")
+	return createTestUserCertificateWithCA(t, signer, ca)
+}
+
+// createTestUserCertificateWithCA signs the public key of the signer by the CA
+func createTestUserCertificateWithCA(t *testing.T, signer, ca ssh.Signer) string {
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		KeyId:           "test",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"root"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+func TestParseProxyJump(t *testing.T) {
+	template := &SSHConfig{User: "root", Key: "key", Certificate: "cert", Passphrase: "secret", KnownHosts: []string{"host"}}
+
+	jumps := parseProxyJump("admin@bastion:2222, [fd00::1]:22,jump2", template)
+	require.Len(t, jumps, 3)
+
+	assert.Equal(t, "admin", jumps[0].User)
+	assert.Equal(t, "bastion", jumps[0].Hostname)
+	assert.Equal(t, 2222, jumps[0].Port)
+	assert.Equal(t, "fd00::1", jumps[1].Hostname)
+	assert.Equal(t, 22, jumps[1].Port)
+	assert.Equal(t, "root", jumps[2].User)
+	assert.Equal(t, "jump2", jumps[2].Hostname)
+	assert.Equal(t, 0, jumps[2].Port)
+	for _, hop := range jumps {
+		assert.Equal(t, "key", hop.Key)
+		assert.Equal(t, "cert", hop.Certificate)
+		assert.Equal(t, "secret", hop.Passphrase)
+		assert.Equal(t, []string{"host"}, hop.KnownHosts)
+	}
+
+	assert.Equal(t, "admin@bastion:2222,root@[fd00::1]:22,root@jump2", formatProxyJump(jumps))
+	assert.Nil(t, parseProxyJump("none", template))
+	assert.Nil(t, parseProxyJump("", template))
+}
+
+func TestSSHConfigWithJumpsFromEnvMap(t *testing.T) {
+	config := GetSSHConfigFromEnvMap(env.Environment{
+		KeyHostname:    "lpar",
+		KeyPrivateKey:  "key",
+		KeyCertificate: "cert",
+		KeyPassphrase:  "secret",
+		KeyProxyJump:   "bastion1,admin@bastion2:2222",
+	})
+
+	assert.Equal(t, "cert", config.Certificate)
+	assert.Equal(t, "secret", config.Passphrase)
+	require.Len(t, config.Jumps, 2)
+	assert.Equal(t, "bastion1", config.Jumps[0].Hostname)
+	assert.Equal(t, "key", config.Jumps[1].Key)
+
+	envMap := GetEnvMapFromSSHConfig(config)
+	assert.Equal(t, "bastion1,admin@bastion2:2222", envMap[KeyProxyJump])
+	assert.Equal(t, "secret", envMap[KeyPassphrase])
+}
+
+func TestMergeJumpCredentials(t *testing.T) {
+	_, key1 := createTestKey(t, "")
+	_, key2 := createTestKey(t, "")
+
+	config := &SSHConfig{
+		Hostname:   "lpar",
+		Key:        key1,
+		KnownHosts: []string{"lpar ssh-ed25519 AAAA"},
+		Jumps: []*SSHConfig{
+			{Hostname: "bastion", Key: key2, Certificate: "cert", KnownHosts: []string{"bastion ssh-ed25519 AAAA"}},
+			{Hostname: "bastion2", Key: key1, KnownHosts: []string{"lpar ssh-ed25519 AAAA"}},
+		},
+	}
+	envMap := GetEnvMapFromSSHConfig(config)
+
+	assert.Equal(t, []string{key1, key2}, splitPrivateKeys(envMap[KeyPrivateKey]))
+	assert.Equal(t, "cert", envMap[KeyCertificate])
+	assert.Equal(t, "lpar ssh-ed25519 AAAA\nbastion ssh-ed25519 AAAA", envMap[KeyKnownHosts])
+}
+
+func TestGetSignersWithPassphrase(t *testing.T) {
+	signer, key := createTestKey(t, "secret")
+
+	_, err := getSigners(&SSHConfig{Key: key})
+	assert.ErrorContains(t, err, KeyPassphrase)
+
+	signers, err := getSigners(&SSHConfig{Key: key, Passphrase: "secret"})
+	require.NoError(t, err)
+	require.Len(t, signers, 1)
+	assert.Equal(t, signer.PublicKey().Marshal(), signers[0].PublicKey().Marshal())
+}
+
+func TestGetSignersWithCertificate(t *testing.T) {
+	signer1, key1 := createTestKey(t, "")
+	_, key2 := createTestKey(t, "")
+	cert := createTestUserCertificate(t, signer1)
+
+	signers, err := getSigners(&SSHConfig{Key: key1 + key2, Certificate: cert})
+	require.NoError(t, err)
+	require.Len(t, signers, 3)
+
+	// the certificate is offered before the plain key
+	certKey, ok := signers[0].PublicKey().(*ssh.Certificate)
+	require.True(t, ok)
+	assert.Equal(t, signer1.PublicKey().Marshal(), certKey.Key.Marshal())
+	assert.Equal(t, signer1.PublicKey().Marshal(), signers[1].PublicKey().Marshal())
+
+	_, err = getSigners(&SSHConfig{Key: key1, Certificate: "invalid"})
+	assert.Error(t, err)
+}
+
+func TestLoadSSHConfigWithProxyJump(t *testing.T) {
+	dir := t.TempDir()
+	signer, key := createTestKey(t, "")
+	_, bastionKey := createTestKey(t, "")
+	cert := createTestUserCertificate(t, signer)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		return path
+	}
+	// key files do not necessarily end with a newline
+	keyFile := write("id_lpar", strings.TrimSpace(key))
+	write("id_lpar-cert.pub", cert)
+	bastionKeyFile := write("id_bastion", bastionKey)
+	knownHostsFile := write("known_hosts", "lpar ssh-ed25519 AAAA")
+
+	configFile := write("config", fmt.Sprintf(`
+Host lpar
+  Hostname lpar.example.com
+  User root
+  IdentityFile %s
+  IdentityFile %s
+  UserKnownHostsFile %s
+  ProxyJump admin@bastion
+
+Host bastion
+  Hostname bastion.example.com
+  Port 2222
+  User nobody
+  IdentityFile %s
+  UserKnownHostsFile %s
+  ProxyJump outer
+
+Host outer
+  UserKnownHostsFile %s
+`, keyFile, bastionKeyFile, knownHostsFile, bastionKeyFile, knownHostsFile, knownHostsFile))
+
+	config, err := LoadSSHConfig(configFile)("lpar")
+	require.NoError(t, err)
+
+	assert.Equal(t, "lpar.example.com", config.Hostname)
+	assert.Equal(t, []string{key, bastionKey}, splitPrivateKeys(config.Key))
+	assert.Equal(t, cert[:len(cert)-1], config.Certificate)
+
+	// the jump hosts of the bastion are dialed first
+	require.Len(t, config.Jumps, 2)
+	assert.Equal(t, "outer", config.Jumps[0].Hostname)
+	assert.Equal(t, "bastion.example.com", config.Jumps[1].Hostname)
+	assert.Equal(t, "admin", config.Jumps[1].User)
+	assert.Equal(t, 2222, config.Jumps[1].Port)
+	assert.Equal(t, bastionKey, config.Jumps[1].Key)
+}
+
+// startTestSSHServer starts an SSH server that forwards TCP connections and answers every command with its name
+func startTestSSHServer(t *testing.T, config *ssh.ServerConfig) string {
+	hostKey, _ := createTestKey(t, "")
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	handleChannel := func(newChannel ssh.NewChannel) {
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+				_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				return
+			}
+			conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+			if err != nil {
+				_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				return
+			}
+			channel, reqs, err := newChannel.Accept()
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			go func() {
+				_, _ = io.Copy(conn, channel)
+				conn.Close()
+			}()
+			_, _ = io.Copy(channel, conn)
+			channel.Close()
+		case "session":
+			channel, reqs, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			for req := range reqs {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				var cmd struct{ Command string }
+				_ = ssh.Unmarshal(req.Payload, &cmd)
+				_ = req.Reply(true, nil)
+				_, _ = channel.Write([]byte(cmd.Command))
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				channel.Close()
+			}
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					go handleChannel(newChannel)
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestDialSSHViaJumpHost(t *testing.T) {
+	bastionSigner, bastionKey := createTestKey(t, "")
+	lparSigner, lparKey := createTestKey(t, "secret")
+	ca, _ := createTestKey(t, "")
+	cert := createTestUserCertificateWithCA(t, lparSigner, ca)
+
+	// the bastion accepts its key only
+	bastionAddr := startTestSSHServer(t, &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), bastionSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key")
+		},
+	})
+	// the LPAR accepts certificates of the CA only
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), ca.PublicKey().Marshal())
+		},
+	}
+	lparAddr := startTestSSHServer(t, &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate})
+
+	parseAddr := func(addr string) (string, int) {
+		host, port, err := net.SplitHostPort(addr)
+		require.NoError(t, err)
+		portNumber, err := strconv.Atoi(port)
+		require.NoError(t, err)
+		return host, portNumber
+	}
+	bastionHost, bastionPort := parseAddr(bastionAddr)
+	lparHost, lparPort := parseAddr(lparAddr)
+
+	config := &SSHConfig{
+		Hostname:    lparHost,
+		Port:        lparPort,
+		Key:         bastionKey + lparKey,
+		Certificate: cert,
+		Passphrase:  "secret",
+		Jumps: []*SSHConfig{
+			{Hostname: bastionHost, Port: bastionPort, Key: bastionKey},
+		},
+	}
+
+	client, err := dialSSH(config)
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	out, err := session.Output("hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(out))
+}
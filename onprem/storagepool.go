@@ -0,0 +1,485 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	A "github.com/IBM/fp-go/array"
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"libvirt.org/go/libvirtxml"
+)
+
+const (
+	// pool backed by a directory on the host
+	StoragePoolTypeDir = "dir"
+	// pool backed by an LVM volume group
+	StoragePoolTypeLogical = "logical"
+	// pool backed by a network file system
+	StoragePoolTypeNetFS = "netfs"
+	// pool backed by the partitions of a disk, only supported for existing pools
+	StoragePoolTypeDisk = "disk"
+
+	// parent directory of dir and netfs pools without explicit path
+	DefaultStoragePoolDir = "/var/lib/libvirt/images"
+	// default format of netfs pools
+	DefaultNetFSFormat = "nfs"
+
+	// name of the volume that marks a pool as owned by a storage pool resource
+	storagePoolMarkerVolumeName = "hpcr-pool.json"
+	// size reserved for the marker
+	maxStoragePoolMarkerSize = uint64(4 * 1024)
+)
+
+type StoragePoolOptions struct {
+	// name of the libvirt storage pool
+	Name string
+	// identifier of the owning resource
+	Owner string
+	// type of the pool
+	Type string
+	// target path of the pool
+	Path string
+	// name of the volume group of a logical pool
+	VolumeGroup string
+	// physical devices of a logical pool
+	Devices []string
+	// hostname of the file server of a netfs pool
+	Host string
+	// exported directory of a netfs pool
+	Dir string
+	// format of a netfs pool
+	Format string
+	// start the pool when the host boots
+	Autostart bool
+	// refuse the deletion while managed volumes remain
+	ProtectVolumes bool
+}
+
+// storagePoolMarker is persisted in a pool created by a storage pool resource
+type storagePoolMarker struct {
+	// identifier of the owning resource
+	Owner string `json:"owner"`
+	// the operator built the underlying storage, only such storage is deleted with the pool
+	Built bool `json:"built,omitempty"`
+}
+
+// StoragePoolInfo reports the definition and usage of a storage pool
+type StoragePoolInfo struct {
+	// the pool definition
+	Pool *libvirtxml.StoragePool
+	// size of the pool in bytes
+	Capacity uint64
+	// allocated bytes
+	Allocation uint64
+	// available bytes
+	Available uint64
+}
+
+// StoragePoolInUseError reports volumes managed by the operator that remain in a pool
+type StoragePoolInUseError struct {
+	// name of the pool
+	StoragePool string
+	// names of the managed volumes
+	Volumes []string
+}
+
+func (e *StoragePoolInUseError) Error() string {
+	return fmt.Sprintf("storage pool [%s] still contains managed volumes %v", e.StoragePool, e.Volumes)
+}
+
+// GetManagedStoragePoolName returns the name of the libvirt storage pool of a storage pool resource
+func GetManagedStoragePoolName(res *StoragePoolCustomResource) string {
+	if len(res.Spec.PoolName) > 0 {
+		return res.Spec.PoolName
+	}
+	return res.Name
+}
+
+// CreateStoragePoolDef creates the libvirt definition of a managed storage pool
+func CreateStoragePoolDef(opt *StoragePoolOptions) (*libvirtxml.StoragePool, error) {
+	poolType := BoxStoragePoolType(opt.Type)
+	def := &libvirtxml.StoragePool{
+		Type:   poolType,
+		Name:   opt.Name,
+		Target: &libvirtxml.StoragePoolTarget{Path: opt.Path},
+	}
+	switch poolType {
+	case StoragePoolTypeDir:
+		if len(def.Target.Path) == 0 {
+			def.Target.Path = path.Join(DefaultStoragePoolDir, opt.Name)
+		}
+	case StoragePoolTypeLogical:
+		vg := opt.VolumeGroup
+		if len(vg) == 0 {
+			vg = opt.Name
+		}
+		def.Source = &libvirtxml.StoragePoolSource{Name: vg}
+		if A.IsNonEmpty(opt.Devices) {
+			def.Source.Format = &libvirtxml.StoragePoolSourceFormat{Type: "lvm2"}
+			for _, device := range opt.Devices {
+				def.Source.Device = append(def.Source.Device, libvirtxml.StoragePoolSourceDevice{Path: device})
+			}
+		}
+		if len(def.Target.Path) == 0 {
+			def.Target.Path = path.Join("/dev", vg)
+		}
+	case StoragePoolTypeNetFS:
+		if len(opt.Host) == 0 || len(opt.Dir) == 0 {
+			return nil, fmt.Errorf("storage pool type [%s] requires a host and an exported directory", poolType)
+		}
+		format := opt.Format
+		if len(format) == 0 {
+			format = DefaultNetFSFormat
+		}
+		def.Source = &libvirtxml.StoragePoolSource{
+			Host:   []libvirtxml.StoragePoolSourceHost{{Name: opt.Host}},
+			Dir:    &libvirtxml.StoragePoolSourceDir{Path: opt.Dir},
+			Format: &libvirtxml.StoragePoolSourceFormat{Type: format},
+		}
+		if len(def.Target.Path) == 0 {
+			def.Target.Path = path.Join(DefaultStoragePoolDir, opt.Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported storage pool type [%s]", poolType)
+	}
+	return def, nil
+}
+
+// checkStoragePoolDef verifies that an existing pool matches the desired definition, pools cannot be redefined
+// while they hold volumes, so a mismatch is reported instead
+func checkStoragePoolDef(desired, actual *libvirtxml.StoragePool) error {
+	if desired.Type != actual.Type {
+		return fmt.Errorf("storage pool [%s] is of type [%s] instead of [%s]", desired.Name, actual.Type, desired.Type)
+	}
+	if actual.Target == nil || path.Clean(actual.Target.Path) != path.Clean(desired.Target.Path) {
+		return fmt.Errorf("storage pool [%s] does not have the target path [%s]", desired.Name, desired.Target.Path)
+	}
+	if desired.Source != nil && (actual.Source == nil || actual.Source.Name != desired.Source.Name) {
+		return fmt.Errorf("storage pool [%s] does not have the source [%s]", desired.Name, desired.Source.Name)
+	}
+	return nil
+}
+
+// isManagedVolumeName checks if a volume has been created by the operator
+func isManagedVolumeName(name string, baseImages map[string]*BaseImage) bool {
+	switch {
+	case strings.HasPrefix(name, "boot-") && strings.HasSuffix(name, ".qcow2"):
+		return true
+	case strings.HasPrefix(name, "cidata-") && strings.HasSuffix(name, ".iso"):
+		return true
+	case strings.HasPrefix(name, "console-") && strings.HasSuffix(name, ".log"):
+		return true
+	case strings.HasPrefix(name, "snapshot-") && strings.HasSuffix(name, ".qcow2"):
+		return true
+	case strings.HasSuffix(name, ".seed"):
+		return true
+	}
+	// data disks are named after the UID of their resource
+	if _, err := uuid.Parse(name); err == nil {
+		return true
+	}
+	_, ok := baseImages[name]
+	return ok
+}
+
+func getStoragePoolXMLDesc(conn *libvirt.Libvirt) func(pool libvirt.StoragePool) (*libvirtxml.StoragePool, error) {
+	return func(pool libvirt.StoragePool) (*libvirtxml.StoragePool, error) {
+		poolStrg, err := conn.StoragePoolGetXMLDesc(pool, 0)
+		if err != nil {
+			return nil, err
+		}
+		var poolDef libvirtxml.StoragePool
+		err = xml.Unmarshal([]byte(poolStrg), &poolDef)
+		if err != nil {
+			return nil, err
+		}
+		return &poolDef, nil
+	}
+}
+
+// getPoolVolumes returns the volumes of a pool, split into the volumes managed by the operator and the remaining ones.
+// The bookkeeping volumes of the operator are not part of either list.
+func getPoolVolumes(conn *libvirt.Libvirt) func(pool libvirt.StoragePool) ([]string, []string, error) {
+	readIndex := readImageIndex(conn)
+
+	return func(pool libvirt.StoragePool) ([]string, []string, error) {
+		idx, err := readIndex(pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		volumes, _, err := conn.StoragePoolListAllVolumes(pool, NeedResults, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		var managed, other []string
+		for _, vol := range volumes {
+			switch {
+			case vol.Name == storagePoolMarkerVolumeName || vol.Name == imageIndexVolumeName || vol.Name == attachmentRegistryVolumeName || vol.Name == retainedVolumesVolumeName || vol.Name == orphanRegistryVolumeName:
+			case strings.HasSuffix(vol.Name, ".upload") || isManagedVolumeName(vol.Name, idx.Images):
+				managed = append(managed, vol.Name)
+			default:
+				other = append(other, vol.Name)
+			}
+		}
+		return managed, other, nil
+	}
+}
+
+// startStoragePool starts a pool, the pool is built first if it cannot be started as is. The result reports if the
+// pool had to be built.
+func startStoragePool(conn *libvirt.Libvirt) func(pool libvirt.StoragePool) (bool, error) {
+	return func(pool libvirt.StoragePool) (bool, error) {
+		active, err := conn.StoragePoolIsActive(pool)
+		if err != nil {
+			return false, err
+		}
+		if active != 0 {
+			return false, nil
+		}
+		log.Printf("Starting storage pool [%s] ...", pool.Name)
+		err = conn.StoragePoolCreate(pool, libvirt.StoragePoolCreateNormal)
+		if err == nil {
+			return false, nil
+		}
+		// never overwrite existing data while building
+		log.Printf("Unable to start storage pool [%s], building it, cause: [%v]", pool.Name, err)
+		err = conn.StoragePoolBuild(pool, libvirt.StoragePoolBuildNoOverwrite)
+		if err != nil {
+			return false, err
+		}
+		return true, conn.StoragePoolCreate(pool, libvirt.StoragePoolCreateNormal)
+	}
+}
+
+// CreateStoragePoolSync (synchronously) defines, builds and starts a managed storage pool and reports its usage
+func CreateStoragePoolSync(client *LivirtClient) func(opt *StoragePoolOptions) (*StoragePoolInfo, error) {
+	conn := client.LibVirt
+	storagePoolXMLDesc := getStoragePoolXMLDesc(conn)
+	startPool := startStoragePool(conn)
+	readMarker := readJSONVolume(conn)
+	writeMarker := writeJSONVolume(conn)
+	refresh := refreshPool(conn)
+
+	// defines a new pool, a pool that cannot be started is removed again
+	createPool := func(opt *StoragePoolOptions, def *libvirtxml.StoragePool) (libvirt.StoragePool, error) {
+		defXML, err := XMLMarshall(def)
+		if err != nil {
+			return libvirt.StoragePool{}, err
+		}
+		log.Printf("Defining storage pool [%s] ...", opt.Name)
+		pool, err := conn.StoragePoolDefineXML(defXML, 0)
+		if err != nil {
+			return pool, err
+		}
+		built, err := startPool(pool)
+		if err == nil {
+			err = writeMarker(pool, storagePoolMarkerVolumeName, maxStoragePoolMarkerSize, &storagePoolMarker{Owner: opt.Owner, Built: built})
+		}
+		if err != nil {
+			log.Printf("Unable to set up storage pool [%s], removing its definition, cause: [%v]", opt.Name, err)
+			if active, errActive := conn.StoragePoolIsActive(pool); errActive == nil && active != 0 {
+				_ = conn.StoragePoolDestroy(pool)
+			}
+			_ = conn.StoragePoolUndefine(pool)
+			return pool, err
+		}
+		return pool, nil
+	}
+
+	return func(opt *StoragePoolOptions) (*StoragePoolInfo, error) {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("CreateStoragePoolSync(%s)", opt.Name))()
+		// the desired state
+		desired, err := CreateStoragePoolDef(opt)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := conn.StoragePoolLookupByName(opt.Name)
+		if err != nil {
+			if !isError(err, libvirt.ErrNoStoragePool) {
+				log.Printf("Unable to lookup storage pool [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+			pool, err = createPool(opt, desired)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			actual, err := storagePoolXMLDesc(pool)
+			if err != nil {
+				return nil, err
+			}
+			err = checkStoragePoolDef(desired, actual)
+			if err != nil {
+				return nil, err
+			}
+			_, err = startPool(pool)
+			if err != nil {
+				log.Printf("Unable to start storage pool [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+			// never take over a pool we did not create
+			var marker storagePoolMarker
+			_, err = readMarker(pool, storagePoolMarkerVolumeName, maxStoragePoolMarkerSize, &marker)
+			if err != nil {
+				return nil, err
+			}
+			if marker.Owner != opt.Owner {
+				return nil, fmt.Errorf("storage pool [%s] exists but is not managed by this resource, owner is [%s]", opt.Name, marker.Owner)
+			}
+		}
+		// autostart
+		autostart, err := conn.StoragePoolGetAutostart(pool)
+		if err != nil {
+			return nil, err
+		}
+		if (autostart != 0) != opt.Autostart {
+			var flag int32
+			if opt.Autostart {
+				flag = 1
+			}
+			err = conn.StoragePoolSetAutostart(pool, flag)
+			if err != nil {
+				log.Printf("Unable to set autostart of storage pool [%s], cause: [%v]", opt.Name, err)
+				return nil, err
+			}
+		}
+		// report the usage
+		err = refresh(pool)
+		if err != nil {
+			return nil, err
+		}
+		_, capacity, allocation, available, err := conn.StoragePoolGetInfo(pool)
+		if err != nil {
+			return nil, err
+		}
+		poolXML, err := storagePoolXMLDesc(pool)
+		if err != nil {
+			return nil, err
+		}
+		return &StoragePoolInfo{
+			Pool:       poolXML,
+			Capacity:   capacity,
+			Allocation: allocation,
+			Available:  available,
+		}, nil
+	}
+}
+
+// DeleteStoragePoolSync (synchronously) removes a managed storage pool. The underlying storage is only deleted if the
+// operator built it and the pool does not hold any volumes, otherwise only the definition is removed and the storage is
+// kept.
+func DeleteStoragePoolSync(client *LivirtClient) func(opt *StoragePoolOptions) error {
+	conn := client.LibVirt
+	startPool := startStoragePool(conn)
+	readMarker := readJSONVolume(conn)
+	getVolumes := getPoolVolumes(conn)
+	delVolume := deleteStorageVol(conn)
+
+	return func(opt *StoragePoolOptions) error {
+		// log this config
+		defer CM.EntryExit(fmt.Sprintf("DeleteStoragePoolSync(%s)", opt.Name))()
+
+		pool, err := conn.StoragePoolLookupByName(opt.Name)
+		if err != nil {
+			if isError(err, libvirt.ErrNoStoragePool) {
+				log.Printf("Storage pool [%s] does not exist, nothing to delete", opt.Name)
+				return nil
+			}
+			return err
+		}
+		// the marker can only be read from a running pool
+		_, err = startPool(pool)
+		if err != nil {
+			return err
+		}
+		var marker storagePoolMarker
+		_, err = readMarker(pool, storagePoolMarkerVolumeName, maxStoragePoolMarkerSize, &marker)
+		if err != nil {
+			return err
+		}
+		if marker.Owner != opt.Owner {
+			log.Printf("Storage pool [%s] is not managed by this resource, leaving it untouched", opt.Name)
+			return nil
+		}
+		managed, other, err := getVolumes(pool)
+		if err != nil {
+			return err
+		}
+		if opt.ProtectVolumes && A.IsNonEmpty(managed) {
+			return &StoragePoolInUseError{StoragePool: opt.Name, Volumes: managed}
+		}
+		empty := !A.IsNonEmpty(managed) && !A.IsNonEmpty(other)
+		// pre-existing storage such as a volume group or a directory belongs to the administrator
+		deleteStorage := empty && marker.Built
+		if deleteStorage {
+			// remove the bookkeeping volumes, so the storage itself can be deleted
+			for _, name := range []string{imageIndexVolumeName, attachmentRegistryVolumeName, retainedVolumesVolumeName, orphanRegistryVolumeName, storagePoolMarkerVolumeName} {
+				if _, err := delVolume(pool, name); err != nil && !isError(err, libvirt.ErrNoStorageVol) {
+					return err
+				}
+			}
+		}
+		log.Printf("Stopping storage pool [%s] ...", opt.Name)
+		err = conn.StoragePoolDestroy(pool)
+		if err != nil {
+			return err
+		}
+		switch {
+		case deleteStorage:
+			log.Printf("Deleting the storage of pool [%s] ...", opt.Name)
+			err = conn.StoragePoolDelete(pool, libvirt.StoragePoolDeleteNormal)
+			if err != nil {
+				log.Printf("Unable to delete the storage of pool [%s], cause: [%v]", opt.Name, err)
+			}
+		case empty:
+			log.Printf("Storage of pool [%s] existed before the pool was created, keeping it", opt.Name)
+		default:
+			log.Printf("Storage pool [%s] still holds volumes, keeping its storage", opt.Name)
+		}
+		log.Printf("Undefining storage pool [%s] ...", opt.Name)
+		return conn.StoragePoolUndefine(pool)
+	}
+}
+
+// CheckStoragePool verifies that a storage pool exists and is running
+func CheckStoragePool(client *LivirtClient) func(name string) error {
+	conn := client.LibVirt
+
+	return func(name string) error {
+		pool, err := conn.StoragePoolLookupByName(name)
+		if err != nil {
+			if isError(err, libvirt.ErrNoStoragePool) {
+				return fmt.Errorf("storage pool [%s] does not exist", name)
+			}
+			return err
+		}
+		active, err := conn.StoragePoolIsActive(pool)
+		if err != nil {
+			return err
+		}
+		if active == 0 {
+			return fmt.Errorf("storage pool [%s] is not active", name)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateStoragePoolDef(t *testing.T) {
+	def, err := CreateStoragePoolDef(&StoragePoolOptions{Name: "images"})
+	require.NoError(t, err)
+	assert.Equal(t, StoragePoolTypeDir, def.Type)
+	assert.Equal(t, "/var/lib/libvirt/images/images", def.Target.Path)
+	assert.Nil(t, def.Source)
+
+	def, err = CreateStoragePoolDef(&StoragePoolOptions{Name: "lvm", Type: StoragePoolTypeLogical, Devices: []string{"/dev/sdb"}})
+	require.NoError(t, err)
+	assert.Equal(t, "lvm", def.Source.Name)
+	assert.Equal(t, "lvm2", def.Source.Format.Type)
+	assert.Equal(t, "/dev/sdb", def.Source.Device[0].Path)
+	assert.Equal(t, "/dev/lvm", def.Target.Path)
+
+	def, err = CreateStoragePoolDef(&StoragePoolOptions{Name: "nfs", Type: StoragePoolTypeNetFS, Host: "filer", Dir: "/export/hpcr"})
+	require.NoError(t, err)
+	assert.Equal(t, "filer", def.Source.Host[0].Name)
+	assert.Equal(t, "/export/hpcr", def.Source.Dir.Path)
+	assert.Equal(t, DefaultNetFSFormat, def.Source.Format.Type)
+
+	_, err = CreateStoragePoolDef(&StoragePoolOptions{Name: "nfs", Type: StoragePoolTypeNetFS})
+	assert.Error(t, err)
+	_, err = CreateStoragePoolDef(&StoragePoolOptions{Name: "iscsi", Type: "iscsi"})
+	assert.Error(t, err)
+}
+
+func TestCheckStoragePoolDef(t *testing.T) {
+	desired, err := CreateStoragePoolDef(&StoragePoolOptions{Name: "images", Path: "/data/images"})
+	require.NoError(t, err)
+
+	actual, err := CreateStoragePoolDef(&StoragePoolOptions{Name: "images", Path: "/data/images/"})
+	require.NoError(t, err)
+	assert.NoError(t, checkStoragePoolDef(desired, actual))
+
+	actual.Target.Path = "/data/other"
+	assert.Error(t, checkStoragePoolDef(desired, actual))
+
+	actual, err = CreateStoragePoolDef(&StoragePoolOptions{Name: "images", Type: StoragePoolTypeLogical})
+	require.NoError(t, err)
+	assert.Error(t, checkStoragePoolDef(desired, actual))
+}
+
+func TestIsManagedVolumeName(t *testing.T) {
+	baseImages := map[string]*BaseImage{"hpcr.qcow2": {Name: "hpcr.qcow2"}}
+
+	assert.True(t, isManagedVolumeName(GetBootVolumeName("vsi"), baseImages))
+	assert.True(t, isManagedVolumeName(GetCIDataVolumeName("vsi"), baseImages))
+	assert.True(t, isManagedVolumeName(GetLoggingVolumeName("vsi"), baseImages))
+	assert.True(t, isManagedVolumeName(GetSnapshotVolumeName("snap"), baseImages))
+	assert.True(t, isManagedVolumeName(GetSeedVolumeName("6d997109-6b44-40eb-8d88-8bf7fc90bfb5"), baseImages))
+	assert.True(t, isManagedVolumeName("6d997109-6b44-40eb-8d88-8bf7fc90bfb5", baseImages))
+	assert.True(t, isManagedVolumeName("hpcr.qcow2", baseImages))
+	assert.False(t, isManagedVolumeName("user.qcow2", baseImages))
+}
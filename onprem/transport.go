@@ -0,0 +1,196 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/digitalocean/go-libvirt/socket"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// tunnel to the libvirt socket of the host via SSH
+	TransportSSH = "ssh"
+	// connect to the libvirt TLS port of the host, authenticated by a client certificate
+	TransportTLS = "tls"
+	// connect to a local libvirt socket, for controllers running on the KVM host itself
+	TransportUnix = "unix"
+
+	// socket of the virtqemud daemon of modular libvirt deployments
+	VirtqemudSocket = "/var/run/libvirt/virtqemud-sock"
+
+	defaultTLSPort = 16514
+
+	// Environment variable names
+	KeyTransport     = "TRANSPORT"
+	KeySocket        = "SOCKET"
+	KeyURI           = "URI"
+	KeyTLSCACert     = "TLS_CA_CERT"
+	KeyTLSClientCert = "TLS_CLIENT_CERT"
+	KeyTLSClientKey  = "TLS_CLIENT_KEY"
+)
+
+// TLSConfig describes the connection to the libvirt TLS port of a host
+type TLSConfig struct {
+	Hostname string
+	Port     int
+	// PEM encoded CA certificate that signed the server certificate, falls back to the system roots
+	CACert string
+	// PEM encoded client certificate and key
+	ClientCert string
+	ClientKey  string
+}
+
+// TransportConfig selects how to connect to libvirt
+type TransportConfig struct {
+	// one of ssh, tls or unix
+	Transport string
+	// the libvirt URI, e.g. qemu:///system, empty to let the daemon choose
+	URI string
+	// the host used to identify the connection, e.g. for staged images
+	Hostname string
+	// the SSH config for the ssh transport
+	SSH *SSHConfig
+	// the TLS config for the tls transport
+	TLS *TLSConfig
+	// the path of the local socket for the unix transport
+	Socket string
+}
+
+type tlsDialer struct {
+	config *TLSConfig
+}
+
+func getTLSPort(config *TLSConfig) int {
+	if config.Port <= 0 {
+		return defaultTLSPort
+	}
+	return config.Port
+}
+
+func getTLSHost(config *TLSConfig) string {
+	return net.JoinHostPort(config.Hostname, strconv.Itoa(getTLSPort(config)))
+}
+
+// getTLSClientConfig creates the TLS client configuration from the PEM encoded certificates
+func getTLSClientConfig(config *TLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: config.Hostname,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(config.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, fmt.Errorf("unable to parse the CA certificate [%s]", KeyTLSCACert)
+		}
+		cfg.RootCAs = pool
+	}
+	if len(config.ClientCert) > 0 || len(config.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair([]byte(config.ClientCert), []byte(config.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the client certificate [%s] and key [%s], cause: [%w]", KeyTLSClientCert, KeyTLSClientKey, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (dialer *tlsDialer) Dial() (net.Conn, error) {
+	cfg, err := getTLSClientConfig(dialer.config)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", getTLSHost(dialer.config), cfg)
+}
+
+// CreateTLSDialer produces a dialer that connects to the libvirt TLS port of a host
+func CreateTLSDialer(config *TLSConfig) socket.Dialer {
+	return &tlsDialer{config: config}
+}
+
+// getEnvValue returns the first value found for the keys
+func getEnvValue(envMap env.Environment, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := envMap[key]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// GetTLSConfigFromEnvMap deserializes a TLS config from a set of (env) parameters, the certificates may also
+// use the key names of a secret of type kubernetes.io/tls
+func GetTLSConfigFromEnvMap(envMap env.Environment) *TLSConfig {
+	result := &TLSConfig{
+		Hostname:   envMap[KeyHostname],
+		CACert:     getEnvValue(envMap, KeyTLSCACert, v1.ServiceAccountRootCAKey),
+		ClientCert: getEnvValue(envMap, KeyTLSClientCert, v1.TLSCertKey),
+		ClientKey:  getEnvValue(envMap, KeyTLSClientKey, v1.TLSPrivateKeyKey),
+	}
+	port, ok := envMap[KeyPort]
+	if ok {
+		result.Port, _ = strconv.Atoi(port)
+	}
+	return result
+}
+
+// GetTransportConfigFromEnvMap deserializes the transport config from a set of (env) parameters
+func GetTransportConfigFromEnvMap(envMap env.Environment) (*TransportConfig, error) {
+	result := &TransportConfig{
+		Transport: envMap[KeyTransport],
+		URI:       envMap[KeyURI],
+		Hostname:  envMap[KeyHostname],
+	}
+	switch result.Transport {
+	case "", TransportSSH:
+		result.Transport = TransportSSH
+		result.SSH = GetSSHConfigFromEnvMap(envMap)
+	case TransportTLS:
+		result.TLS = GetTLSConfigFromEnvMap(envMap)
+		if len(result.TLS.Hostname) == 0 {
+			return nil, fmt.Errorf("the [%s] transport requires [%s]", TransportTLS, KeyHostname)
+		}
+	case TransportUnix:
+		result.Socket = envMap[KeySocket]
+		if len(result.Socket) == 0 {
+			result.Socket = defaultUnixSock
+		}
+		if len(result.Hostname) == 0 {
+			result.Hostname = "localhost"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported transport [%s] in [%s], expected one of [%s], [%s] or [%s]", result.Transport, KeyTransport, TransportSSH, TransportTLS, TransportUnix)
+	}
+	return result, nil
+}
+
+// createTransportDialer returns the dialer for the transport and the hash that identifies the connection
+func createTransportDialer(config *TransportConfig) (socket.Dialer, string) {
+	switch config.Transport {
+	case TransportTLS:
+		return CreateTLSDialer(config.TLS), getTLSHost(config.TLS)
+	case TransportUnix:
+		return dialers.NewLocal(dialers.WithSocket(config.Socket), dialers.WithLocalTimeout(dialTimeout)), "unix:" + config.Socket
+	default:
+		return CreateSSHDialer(config.SSH), getHost(config.SSH)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+)
+
+// createTestCertificate creates a PEM encoded certificate and key, signed by the parent or self signed
+func createTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return cert, key,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+func TestGetTransportConfigDefaultsToSSH(t *testing.T) {
+	cfg, err := GetTransportConfigFromEnvMap(env.Environment{
+		KeyHostname: "example.lpar.com",
+		KeySocket:   VirtqemudSocket,
+		KeyURI:      "qemu:///system",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, TransportSSH, cfg.Transport)
+	assert.Equal(t, "qemu:///system", cfg.URI)
+	assert.Equal(t, "example.lpar.com", cfg.Hostname)
+	assert.Equal(t, VirtqemudSocket, getSocket(cfg.SSH))
+	assert.Nil(t, cfg.TLS)
+}
+
+func TestGetTransportConfigUnix(t *testing.T) {
+	cfg, err := GetTransportConfigFromEnvMap(env.Environment{KeyTransport: TransportUnix})
+	require.NoError(t, err)
+
+	assert.Equal(t, defaultUnixSock, cfg.Socket)
+	assert.Equal(t, "localhost", cfg.Hostname)
+	assert.Nil(t, cfg.SSH)
+}
+
+func TestGetTransportConfigTLS(t *testing.T) {
+	cfg, err := GetTransportConfigFromEnvMap(env.Environment{
+		KeyTransport:               TransportTLS,
+		KeyHostname:                "example.lpar.com",
+		v1.TLSCertKey:              "cert",
+		v1.TLSPrivateKeyKey:        "key",
+		v1.ServiceAccountRootCAKey: "ca",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "cert", cfg.TLS.ClientCert)
+	assert.Equal(t, "key", cfg.TLS.ClientKey)
+	assert.Equal(t, "ca", cfg.TLS.CACert)
+	assert.Equal(t, "example.lpar.com:16514", getTLSHost(cfg.TLS))
+
+	_, err = GetTransportConfigFromEnvMap(env.Environment{KeyTransport: TransportTLS})
+	assert.Error(t, err)
+}
+
+func TestGetTransportConfigInvalid(t *testing.T) {
+	_, err := GetTransportConfigFromEnvMap(env.Environment{KeyTransport: "telnet"})
+	assert.Error(t, err)
+}
+
+func TestTLSDialer(t *testing.T) {
+	now := time.Now()
+	ca, caKey, caPEM, _ := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, serverPEM, serverKeyPEM := createTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	_, _, clientPEM, clientKeyPEM := createTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.X509KeyPair([]byte(serverPEM), []byte(serverKeyPEM))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	// the server requires a client certificate signed by the CA
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("ok"))
+	}()
+
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	portNumber, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	dialer := CreateTLSDialer(&TLSConfig{
+		Hostname:   "localhost",
+		Port:       portNumber,
+		CACert:     caPEM,
+		ClientCert: clientPEM,
+		ClientKey:  clientKeyPEM,
+	})
+	conn, err := dialer.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 2)
+	_, err = conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(buf))
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// Environment variable names
+	KeyUploadBandwidthLimit = "UPLOAD_BANDWIDTH_LIMIT"
+	KeyUploadChunkSize      = "UPLOAD_CHUNK_SIZE"
+
+	DefaultUploadChunkSize = uint64(256 * 1024 * 1024)
+
+	// size reserved for the upload progress marker
+	maxUploadProgressSize = uint64(4096)
+)
+
+// UploadConfig controls how images are transferred to a host
+type UploadConfig struct {
+	// maximum number of bytes per second, zero means unlimited
+	BandwidthLimit uint64 `json:"bandwidthLimit,omitempty" yaml:"bandwidthLimit,omitempty"`
+	// number of bytes transferred before the progress is recorded
+	ChunkSize uint64 `json:"chunkSize,omitempty" yaml:"chunkSize,omitempty"`
+}
+
+// uploadProgress is persisted next to a volume while its upload is incomplete
+type uploadProgress struct {
+	// total size of the image
+	Size uint64 `json:"size"`
+	// number of bytes successfully uploaded
+	Offset uint64 `json:"offset"`
+	// identity of the image the upload has been started with
+	Source string `json:"source,omitempty"`
+}
+
+type rateLimitedReader struct {
+	rdr   io.Reader
+	limit uint64
+	read  uint64
+	t0    time.Time
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// never read more than a tenth of the budget per second at once, so the rate stays smooth
+	if max := int(r.limit/10) + 1; len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.rdr.Read(p)
+	r.read += uint64(n)
+	// wait until the average rate drops below the limit
+	expected := time.Duration(float64(r.read) / float64(r.limit) * float64(time.Second))
+	if elapsed := time.Since(r.t0); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
+
+// createRateLimitedReader returns a reader that does not exceed the given number of bytes per second
+func createRateLimitedReader(rdr io.Reader, limit uint64) io.Reader {
+	if limit == 0 {
+		return rdr
+	}
+	return &rateLimitedReader{rdr: rdr, limit: limit, t0: time.Now()}
+}
+
+func getUploadChunkSize(config *UploadConfig) uint64 {
+	if config == nil || config.ChunkSize == 0 {
+		return DefaultUploadChunkSize
+	}
+	return config.ChunkSize
+}
+
+func getUploadBandwidthLimit(config *UploadConfig) uint64 {
+	if config == nil {
+		return 0
+	}
+	return config.BandwidthLimit
+}
+
+// GetUploadProgressVolumeName returns the name of the volume that tracks an incomplete upload
+func GetUploadProgressVolumeName(name string) string {
+	return fmt.Sprintf("%s.upload", name)
+}
+
+// readUploadProgress returns the progress of an incomplete upload or nil if the upload is complete
+func readUploadProgress(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string) *uploadProgress {
+	readVolume := readJSONVolume(conn)
+	return func(pool libvirt.StoragePool, name string) *uploadProgress {
+		var progress uploadProgress
+		exists, err := readVolume(pool, GetUploadProgressVolumeName(name), maxUploadProgressSize, &progress)
+		if !exists {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Unable to read the upload progress of [%s], cause: [%v]", name, err)
+			return &uploadProgress{}
+		}
+		return &progress
+	}
+}
+
+// writeUploadProgress records the progress of an incomplete upload
+func writeUploadProgress(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string, progress *uploadProgress) error {
+	writeVolume := writeJSONVolume(conn)
+	return func(pool libvirt.StoragePool, name string, progress *uploadProgress) error {
+		return writeVolume(pool, GetUploadProgressVolumeName(name), maxUploadProgressSize, progress)
+	}
+}
+
+// canResumeUpload tests if an incomplete upload continues with the same image, an image of unknown identity is
+// uploaded from scratch
+func canResumeUpload(progress *uploadProgress, identity string) bool {
+	return progress != nil && progress.Offset > 0 && len(identity) > 0 && progress.Source == identity
+}
+
+// deleteUploadProgress removes the marker of an incomplete upload
+func deleteUploadProgress(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string) {
+	delVol := deleteStorageVol(conn)
+	return func(pool libvirt.StoragePool, name string) {
+		markerName := GetUploadProgressVolumeName(name)
+		if _, err := conn.StorageVolLookupByName(pool, markerName); err != nil {
+			return
+		}
+		if _, err := delVol(pool, markerName); err != nil {
+			log.Printf("Unable to delete the upload marker [%s], cause: [%v]", markerName, err)
+		}
+	}
+}
+
+// uploadVolumeInChunks transfers the content from the offset of the progress in chunks and records the progress after
+// each chunk, so an interrupted upload can be resumed from the last recorded offset
+func uploadVolumeInChunks(client *LivirtClient) func(pool libvirt.StoragePool, volume libvirt.StorageVol, rdr io.Reader, progress uploadProgress) error {
+	conn := client.LibVirt
+	writeProgress := writeUploadProgress(conn)
+	deleteProgress := deleteUploadProgress(conn)
+
+	return func(pool libvirt.StoragePool, volume libvirt.StorageVol, rdr io.Reader, progress uploadProgress) error {
+		offset, size := progress.Offset, progress.Size
+		chunkSize := getUploadChunkSize(client.UploadConfig)
+		limited := createRateLimitedReader(createReaderWithLog(rdr, size-offset), getUploadBandwidthLimit(client.UploadConfig))
+		for offset < size {
+			length := min(chunkSize, size-offset)
+			err := conn.StorageVolUpload(volume, io.LimitReader(limited, int64(length)), offset, length, 0)
+			if err != nil {
+				return err
+			}
+			offset += length
+			// record the progress
+			progress.Offset = offset
+			err = writeProgress(pool, volume.Name, &progress)
+			if err != nil {
+				return err
+			}
+		}
+		// the upload is complete
+		deleteProgress(pool, volume.Name)
+		return nil
+	}
+}
+
+// GetUploadConfigFromEnvMap deserializes the upload config from a set of (env) parameters
+func GetUploadConfigFromEnvMap(envMap env.Environment) *UploadConfig {
+	result := &UploadConfig{}
+	if limit, ok := envMap[KeyUploadBandwidthLimit]; ok {
+		q, err := resource.ParseQuantity(limit)
+		if err == nil && q.Sign() > 0 {
+			result.BandwidthLimit = uint64(q.Value())
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", limit, KeyUploadBandwidthLimit)
+		}
+	}
+	if chunkSize, ok := envMap[KeyUploadChunkSize]; ok {
+		q, err := resource.ParseQuantity(chunkSize)
+		if err == nil && q.Sign() > 0 {
+			result.ChunkSize = uint64(q.Value())
+		} else {
+			log.Printf("Ignoring invalid value [%s] for [%s]", chunkSize, KeyUploadChunkSize)
+		}
+	}
+	return result
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUploadConfigFromEnvMap(t *testing.T) {
+	config := GetUploadConfigFromEnvMap(map[string]string{
+		KeyUploadBandwidthLimit: "10Mi",
+		KeyUploadChunkSize:      "1Gi",
+	})
+	assert.Equal(t, uint64(10*1024*1024), config.BandwidthLimit)
+	assert.Equal(t, uint64(1024*1024*1024), config.ChunkSize)
+
+	config = GetUploadConfigFromEnvMap(map[string]string{
+		KeyUploadBandwidthLimit: "fast",
+	})
+	assert.Equal(t, uint64(0), config.BandwidthLimit)
+	assert.Equal(t, DefaultUploadChunkSize, getUploadChunkSize(config))
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 2000)
+
+	t0 := time.Now()
+	read, err := io.ReadAll(createRateLimitedReader(bytes.NewReader(data), 4000))
+	require.NoError(t, err)
+	assert.Equal(t, data, read)
+	// 2000 bytes at 4000 bytes per second take at least half a second
+	assert.GreaterOrEqual(t, time.Since(t0), 450*time.Millisecond)
+
+	// no limit returns the original reader
+	rdr := bytes.NewReader(data)
+	assert.Same(t, rdr, createRateLimitedReader(rdr, 0))
+}
+
+func TestParseContentRange(t *testing.T) {
+	total, err := parseContentRange("bytes 100-199/200")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(200), total)
+
+	_, err = parseContentRange("bytes 100-199")
+	assert.Error(t, err)
+}
+
+func TestHTTPImageSourceResume(t *testing.T) {
+	content := "0123456789"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "hpcr.qcow2", time.Now(), strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	src, err := CreateImageSource(&ImageSourceConfig{})(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+
+	rdr, size, err := src.Open(4)
+	require.NoError(t, err)
+	defer rdr.Close()
+	// the size is the size of the full image, not of the remainder
+	assert.Equal(t, uint64(10), size)
+
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	assert.Equal(t, "456789", string(data))
+}
+
+func TestHTTPImageSourceResumeWithoutRange(t *testing.T) {
+	content := "0123456789"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ignore the range header
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	src, err := CreateImageSource(&ImageSourceConfig{})(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+
+	rdr, size, err := src.Open(4)
+	require.NoError(t, err)
+	defer rdr.Close()
+	assert.Equal(t, uint64(10), size)
+
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	assert.Equal(t, "456789", string(data))
+}
+
+func TestHTTPImageSourceResumeIfUnchanged(t *testing.T) {
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "hpcr.qcow2", time.Now(), strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	src, err := CreateImageSource(&ImageSourceConfig{})(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+
+	rdr, size, err := openImageSource(src, 4, `"v1"`)
+	require.NoError(t, err)
+	defer rdr.Close()
+	assert.Equal(t, uint64(10), size)
+
+	data, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	assert.Equal(t, "456789", string(data))
+
+	// the server answers with the full content of the new image
+	etag = `"v2"`
+	_, _, err = openImageSource(src, 4, `"v1"`)
+	assert.ErrorIs(t, err, ErrImageChanged)
+
+	// weak validators cannot be used for ranges
+	_, _, err = openImageSource(src, 4, `W/"v2"`)
+	assert.ErrorIs(t, err, ErrImageChanged)
+}
+
+func TestHTTPImageSourceResumeIfUnchangedWithoutRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ignore the range headers
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	src, err := CreateImageSource(&ImageSourceConfig{})(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+
+	// the content cannot be verified, so the upload restarts
+	_, _, err = openImageSource(src, 4, `"v1"`)
+	assert.ErrorIs(t, err, ErrImageChanged)
+}
+
+func TestCanResumeUpload(t *testing.T) {
+	progress := &uploadProgress{Size: 10, Offset: 4, Source: `"v1"`}
+	assert.True(t, canResumeUpload(progress, `"v1"`))
+	// a different image of the same size
+	assert.False(t, canResumeUpload(progress, `"v2"`))
+	// unknown identity, e.g. a marker of an earlier version
+	assert.False(t, canResumeUpload(&uploadProgress{Size: 10, Offset: 4}, ""))
+	// nothing uploaded, yet
+	assert.False(t, canResumeUpload(&uploadProgress{Size: 10, Source: `"v1"`}, `"v1"`))
+	assert.False(t, canResumeUpload(nil, `"v1"`))
+}
+
+func TestHTTPImageSourceIdentity(t *testing.T) {
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "hpcr.qcow2", time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	src, err := CreateImageSource(&ImageSourceConfig{})(server.URL + "/hpcr.qcow2")
+	require.NoError(t, err)
+	assert.Equal(t, `"v1"`, src.Identity())
+
+	// the same size, but different content
+	etag = `"v2"`
+	assert.Equal(t, `"v2"`, src.Identity())
+
+	// fall back to the modification time
+	etag = ""
+	assert.Equal(t, "Thu, 01 Jun 2023 00:00:00 GMT", src.Identity())
+}
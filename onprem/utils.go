@@ -143,3 +143,59 @@ func BoxDataDiskSize(size uint64) uint64 {
 	}
 	return size
 }
+
+func BoxNetworkMode(mode string) string {
+	if len(mode) <= 0 {
+		return NetworkModeNAT
+	}
+	return mode
+}
+
+func BoxStoragePoolType(poolType string) string {
+	if len(poolType) <= 0 {
+		return StoragePoolTypeDir
+	}
+	return poolType
+}
+
+func BoxSnapshotConsistency(consistency string) string {
+	if len(consistency) <= 0 {
+		return SnapshotConsistencyNone
+	}
+	return consistency
+}
+
+func BoxDataDiskMode(mode string) string {
+	if len(mode) <= 0 {
+		return DataDiskModeExclusive
+	}
+	return mode
+}
+
+func BoxReclaimPolicy(policy string) string {
+	if len(policy) <= 0 {
+		return ReclaimPolicyDelete
+	}
+	return policy
+}
+
+func BoxRestartPolicy(policy string) string {
+	if len(policy) <= 0 {
+		return RestartPolicyRecreate
+	}
+	return policy
+}
+
+func BoxPowerState(powerState string) string {
+	if len(powerState) <= 0 {
+		return PowerStateRunning
+	}
+	return powerState
+}
+
+func BoxDataDiskFormat(format string) string {
+	if len(format) <= 0 {
+		return DataDiskFormatQCow2
+	}
+	return format
+}
@@ -15,8 +15,11 @@
 package onprem
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
 
 	libvirt "github.com/digitalocean/go-libvirt"
 	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
@@ -153,3 +156,109 @@ func deleteVolumeByKey(client *LivirtClient) func(key string) error {
 		return err
 	}
 }
+
+// registryLocks serializes the read-modify-write cycles of the JSON registries, keyed by pool and volume name
+var registryLocks sync.Map
+
+// lockRegistry locks a JSON registry of a pool against concurrent updates, the result unlocks it
+func lockRegistry(pool libvirt.StoragePool, name string) func() {
+	key := fmt.Sprintf("%x/%s", pool.UUID, name)
+	value, _ := registryLocks.LoadOrStore(key, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// readJSONVolume decodes the JSON content of a small volume, the result indicates if the volume exists
+func readJSONVolume(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string, size uint64, v any) (bool, error) {
+	return func(pool libvirt.StoragePool, name string, size uint64, v any) (bool, error) {
+		vol, err := conn.StorageVolLookupByName(pool, name)
+		if err != nil {
+			return false, nil
+		}
+		var buffer bytes.Buffer
+		err = conn.StorageVolDownload(vol, &buffer, 0, size, 0)
+		if err != nil {
+			return true, err
+		}
+		// the volume is padded, so only decode the first value
+		return true, json.NewDecoder(&buffer).Decode(v)
+	}
+}
+
+// writeJSONVolume stores a value as JSON in a small raw volume of fixed size, the volume is created if required
+func writeJSONVolume(conn *libvirt.Libvirt) func(pool libvirt.StoragePool, name string, size uint64, v any) error {
+	return func(pool libvirt.StoragePool, name string, size uint64, v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if uint64(len(data)) > size {
+			return fmt.Errorf("content of volume [%s] exceeds [%d bytes]", name, size)
+		}
+		vol, err := conn.StorageVolLookupByName(pool, name)
+		if err != nil {
+			volumeDef := createDefaultVolume()
+			volumeDef.Name = name
+			volumeDef.Capacity.Value = size
+			volumeDef.Target.Format.Type = "raw"
+
+			volumeDefXML, err := XMLMarshall(volumeDef)
+			if err != nil {
+				return err
+			}
+			vol, err = conn.StorageVolCreateXML(pool, volumeDefXML, 0)
+			if err != nil {
+				return err
+			}
+		}
+		// pad the data so previous content is overwritten
+		padded := make([]byte, size)
+		copy(padded, data)
+		return conn.StorageVolUpload(vol, bytes.NewReader(padded), 0, size, 0)
+	}
+}
+
+// getBackingFileDependents returns the names of the volumes of all pools, indexed by the path of their backing file
+func getBackingFileDependents(conn *libvirt.Libvirt) func() (map[string][]string, error) {
+	storageVolXMLDesc := getStorageVolXMLDesc(conn)
+	return func() (map[string][]string, error) {
+		result := make(map[string][]string)
+		pools, _, err := conn.ConnectListAllStoragePools(NeedResults, libvirt.ConnectListStoragePoolsActive)
+		if err != nil {
+			return nil, err
+		}
+		for _, pool := range pools {
+			volumes, _, err := conn.StoragePoolListAllVolumes(pool, NeedResults, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, vol := range volumes {
+				volXML, err := storageVolXMLDesc(&vol)
+				if err != nil {
+					return nil, err
+				}
+				if volXML.BackingStore != nil && len(volXML.BackingStore.Path) > 0 {
+					result[volXML.BackingStore.Path] = append(result[volXML.BackingStore.Path], vol.Name)
+				}
+			}
+		}
+		return result, nil
+	}
+}
+
+// getVolumeDependents returns the names of the volumes that use the given volume as their backing file
+func getVolumeDependents(conn *libvirt.Libvirt) func(vol libvirt.StorageVol) ([]string, error) {
+	getDependents := getBackingFileDependents(conn)
+	return func(vol libvirt.StorageVol) ([]string, error) {
+		path, err := conn.StorageVolGetPath(vol)
+		if err != nil {
+			return nil, err
+		}
+		dependents, err := getDependents()
+		if err != nil {
+			return nil, err
+		}
+		return dependents[path], nil
+	}
+}
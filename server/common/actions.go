@@ -15,6 +15,8 @@
 package common
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
 	C "github.com/ibm-hyper-protect/terraform-provider-hpcr/contract"
 )
@@ -32,6 +34,35 @@ type ResourceStatus struct {
 	Description string
 	Error       error
 	Metadata    C.RawMap
+	Conditions  []*StatusCondition
+}
+
+// StatusCondition reports a well known problem of a resource in its status
+type StatusCondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ConditionError is implemented by errors that are reported as a condition of the resource
+type ConditionError interface {
+	error
+	ConditionType() string
+}
+
+// getErrorConditions returns the conditions reported by an error
+func getErrorConditions(err error) []*StatusCondition {
+	var condErr ConditionError
+	if !errors.As(err, &condErr) {
+		return nil
+	}
+	return []*StatusCondition{{
+		Type:    condErr.ConditionType(),
+		Status:  "True",
+		Reason:  condErr.ConditionType(),
+		Message: condErr.Error(),
+	}}
 }
 
 func CreateAction(status *ResourceStatus) (*ResourceStatus, error) {
@@ -59,15 +90,30 @@ func CreateErrorAction(err error) (*ResourceStatus, error) {
 		Status:      Error,
 		Description: err.Error(),
 		Error:       err,
+		Conditions:  getErrorConditions(err),
 	}, err
 }
 
+// CreateRetryAction reports a transient problem, the resource stays waiting and is synchronized again
+func CreateRetryAction(err error) (*ResourceStatus, error) {
+	return CreateAction(&ResourceStatus{
+		Status:      Waiting,
+		Description: err.Error(),
+		Error:       nil,
+		Conditions:  getErrorConditions(err),
+	})
+}
+
 func ResourceStatusToResponse(state *ResourceStatus) gin.H {
+	status := gin.H{
+		"status":      state.Status,
+		"description": state.Description,
+		"metadata":    state.Metadata,
+	}
+	if len(state.Conditions) > 0 {
+		status["conditions"] = state.Conditions
+	}
 	return gin.H{
-		"status": gin.H{
-			"status":      state.Status,
-			"description": state.Description,
-			"metadata":    state.Metadata,
-		},
+		"status": status,
 	}
 }
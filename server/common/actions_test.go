@@ -0,0 +1,64 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testConditionError struct{}
+
+func (err *testConditionError) Error() string {
+	return "something changed"
+}
+
+func (err *testConditionError) ConditionType() string {
+	return "SomethingChanged"
+}
+
+func TestErrorActionWithCondition(t *testing.T) {
+	state, err := CreateErrorAction(fmt.Errorf("unable to connect, cause: [%w]", &testConditionError{}))
+	assert.Error(t, err)
+
+	resp := ResourceStatusToResponse(state)
+	status := resp["status"].(gin.H)
+	assert.Equal(t, []*StatusCondition{{
+		Type:    "SomethingChanged",
+		Status:  "True",
+		Reason:  "SomethingChanged",
+		Message: "something changed",
+	}}, status["conditions"])
+}
+
+func TestErrorActionWithoutCondition(t *testing.T) {
+	state, _ := CreateErrorAction(fmt.Errorf("some error"))
+
+	resp := ResourceStatusToResponse(state)
+	assert.NotContains(t, resp["status"].(gin.H), "conditions")
+}
+
+func TestRetryActionWithCondition(t *testing.T) {
+	state, err := CreateRetryAction(&testConditionError{})
+	assert.NoError(t, err)
+	assert.Equal(t, Waiting, state.Status)
+
+	resp := ResourceStatusToResponse(state)
+	status := resp["status"].(gin.H)
+	assert.Len(t, status["conditions"], 1)
+}
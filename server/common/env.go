@@ -28,43 +28,50 @@ var (
 	keySecret    = fmt.Sprintf("%s.%s", "Secret", C.K8SAPIVersion)
 )
 
-// EnvFromConfigMapsOrSecrets merges all config maps into one
-func EnvFromConfigMapsOrSecrets(data map[string]any) env.Environment {
-	res := make(env.Environment)
+// configMapsFromRelated returns the data of all related config maps by name
+func configMapsFromRelated(data map[string]any) map[string]env.Environment {
+	res := make(map[string]env.Environment)
 	if related, ok := data["related"].(map[string]any); ok {
 		// all config maps
 		if configmaps, ok := related[keyConfigMap].(map[string]any); ok {
-			// iterate over all config maps and merge
+			// iterate over all config maps
 			for name, item := range configmaps {
-				log.Printf("Merging ConfigMap [%s] ...", name)
+				configMapEnv := make(env.Environment)
 				if configmap, ok := item.(map[string]any); ok {
 					// extract data
 					if configmapdata, ok := configmap["data"].(map[string]any); ok {
-						// merge
 						for key, value := range configmapdata {
 							if strgVal, ok := value.(string); ok {
-								res[key] = strgVal
+								configMapEnv[key] = strgVal
 							}
 						}
 					}
 				}
+				res[name] = configMapEnv
 			}
 		}
+	}
+	return res
+}
+
+// secretsFromRelated returns the decoded data of all related secrets by name
+func secretsFromRelated(data map[string]any) map[string]env.Environment {
+	res := make(map[string]env.Environment)
+	if related, ok := data["related"].(map[string]any); ok {
 		// all secrets maps
 		if secrets, ok := related[keySecret].(map[string]any); ok {
-			// iterate over all config maps and merge
+			// iterate over all secrets
 			for name, item := range secrets {
-				log.Printf("Merging Secret [%s] ...", name)
+				secretEnv := make(env.Environment)
 				if secret, ok := item.(map[string]any); ok {
 					// extract data
 					if secretdata, ok := secret["data"].(map[string]any); ok {
-						// merge
 						for key, value := range secretdata {
 							if strgVal, ok := value.(string); ok {
 								// secrets are baes64 encoded
 								decValue, err := base64.StdEncoding.DecodeString(strgVal)
 								if err == nil {
-									res[key] = string(decValue)
+									secretEnv[key] = string(decValue)
 								} else {
 									log.Printf("Unable to base64 decode the secret [%s], cause: [%v]", name, err)
 								}
@@ -72,8 +79,58 @@ func EnvFromConfigMapsOrSecrets(data map[string]any) env.Environment {
 						}
 					}
 				}
+				res[name] = secretEnv
 			}
 		}
 	}
 	return res
 }
+
+func mergeEnv(target, source env.Environment) {
+	for key, value := range source {
+		target[key] = value
+	}
+}
+
+// EnvFromConfigMapsOrSecrets merges all config maps into one
+func EnvFromConfigMapsOrSecrets(data map[string]any) env.Environment {
+	res := make(env.Environment)
+	for name, configMapEnv := range configMapsFromRelated(data) {
+		log.Printf("Merging ConfigMap [%s] ...", name)
+		mergeEnv(res, configMapEnv)
+	}
+	for name, secretEnv := range secretsFromRelated(data) {
+		log.Printf("Merging Secret [%s] ...", name)
+		mergeEnv(res, secretEnv)
+	}
+	return res
+}
+
+// EnvsFromConfigMapsOrSecrets produces one environment per target. Every config map that carries
+// the key identifies a target, all other config maps and all secrets are merged into every target.
+// The result is indexed by the value of the key.
+func EnvsFromConfigMapsOrSecrets(data map[string]any, key string) map[string]env.Environment {
+	shared := make(env.Environment)
+	targets := make(map[string]env.Environment)
+	for name, configMapEnv := range configMapsFromRelated(data) {
+		if target, ok := configMapEnv[key]; ok {
+			log.Printf("ConfigMap [%s] identifies target [%s] ...", name, target)
+			targets[target] = configMapEnv
+		} else {
+			log.Printf("Merging ConfigMap [%s] ...", name)
+			mergeEnv(shared, configMapEnv)
+		}
+	}
+	for name, secretEnv := range secretsFromRelated(data) {
+		log.Printf("Merging Secret [%s] ...", name)
+		mergeEnv(shared, secretEnv)
+	}
+	res := make(map[string]env.Environment)
+	for target, targetEnv := range targets {
+		merged := make(env.Environment)
+		mergeEnv(merged, shared)
+		mergeEnv(merged, targetEnv)
+		res[target] = merged
+	}
+	return res
+}
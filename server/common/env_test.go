@@ -61,3 +61,29 @@ func TestEnvFromConfigMaps2(t *testing.T) {
 	assert.Equal(t, "https://us-south-stage01.iaasdev.cloud.ibm.com", endpoint)
 	assert.Equal(t, "https://iam.test.cloud.ibm.com", iamEndpoint)
 }
+
+func TestEnvsFromConfigMapsOrSecrets(t *testing.T) {
+	data := map[string]any{
+		"related": map[string]any{
+			keyConfigMap: map[string]any{
+				"host1":  map[string]any{"data": map[string]any{"HOSTNAME": "lpar1", "PORT": "22"}},
+				"host2":  map[string]any{"data": map[string]any{"HOSTNAME": "lpar2"}},
+				"shared": map[string]any{"data": map[string]any{"PORT": "2222", "USER": "root"}},
+			},
+			keySecret: map[string]any{
+				// "key" base64 encoded
+				"ssh": map[string]any{"data": map[string]any{"KEY": "a2V5"}},
+			},
+		},
+	}
+
+	envs := EnvsFromConfigMapsOrSecrets(data, "HOSTNAME")
+	require.Len(t, envs, 2)
+
+	assert.Equal(t, "22", envs["lpar1"]["PORT"])
+	assert.Equal(t, "root", envs["lpar1"]["USER"])
+	assert.Equal(t, "key", envs["lpar1"]["KEY"])
+
+	assert.Equal(t, "2222", envs["lpar2"]["PORT"])
+	assert.Equal(t, "key", envs["lpar2"]["KEY"])
+}
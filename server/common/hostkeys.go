@@ -0,0 +1,60 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package common
+
+import (
+	"regexp"
+)
+
+// HostKeySecretName is the name of the secret that keeps the host keys pinned on first use
+const HostKeySecretName = "k8s-operator-hpcr-host-keys"
+
+// characters that are not allowed in the keys of a secret
+var reInvalidSecretKey = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// SecretHostKeyStore pins host keys in a secret, so they survive restarts of the controller. Each
+// key of the secret carries a known hosts line, so it can be copied into KNOWN_HOSTS as is.
+type SecretHostKeyStore struct {
+	client    *KubeClient
+	namespace string
+	name      string
+}
+
+// CreateSecretHostKeyStore creates a store that keeps the host keys in the given secret
+func CreateSecretHostKeyStore(client *KubeClient, namespace, name string) *SecretHostKeyStore {
+	return &SecretHostKeyStore{client: client, namespace: namespace, name: name}
+}
+
+// getHostKeySecretKey maps a host to a valid key of a secret
+func getHostKeySecretKey(host string) string {
+	return reInvalidSecretKey.ReplaceAllString(host, "_")
+}
+
+// LoadHostKey reads the pinned known hosts line of the host, the secret is read on every call, so deleting
+// a key re-pins the host on the next connection
+func (store *SecretHostKeyStore) LoadHostKey(host string) (string, error) {
+	data, err := GetSecretData(store.client)(store.namespace, store.name)
+	if err != nil {
+		return "", err
+	}
+	return data[getHostKeySecretKey(host)], nil
+}
+
+// StoreHostKey pins the known hosts line of the host
+func (store *SecretHostKeyStore) StoreHostKey(host, line string) error {
+	return UpdateSecretData(store.client)(store.namespace, store.name, map[string]string{
+		getHostKeySecretKey(host): line,
+	})
+}
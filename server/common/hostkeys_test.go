@@ -0,0 +1,107 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createFakeSecretServer emulates the secrets API of a single namespace
+func createFakeSecretServer(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	secrets := make(map[string]map[string][]byte)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		var body struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			StringData map[string]string `json:"stringData"`
+		}
+		if r.Body != nil {
+			data, _ := io.ReadAll(r.Body)
+			_ = json.Unmarshal(data, &body)
+		}
+		merge := func(name string) {
+			for key, value := range body.StringData {
+				secrets[name][key] = []byte(value)
+			}
+		}
+		name := filepath.Base(r.URL.Path)
+
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := secrets[name]
+			if !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"data": data})
+		case http.MethodPatch:
+			if _, ok := secrets[name]; !ok {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			merge(name)
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPost:
+			assert.Equal(t, "/api/v1/namespaces/hpcr/secrets", r.URL.Path)
+			secrets[body.Metadata.Name] = make(map[string][]byte)
+			merge(body.Metadata.Name)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+}
+
+func TestSecretHostKeyStore(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0600))
+
+	srv := createFakeSecretServer(t)
+	defer srv.Close()
+
+	store := CreateSecretHostKeyStore(createKubeClient(srv.URL, tokenFile, srv.Client()), "hpcr", HostKeySecretName)
+
+	line, err := store.LoadHostKey("[lpar]:2222")
+	require.NoError(t, err)
+	assert.Empty(t, line)
+
+	// the first key creates the secret, the second one updates it
+	require.NoError(t, store.StoreHostKey("[lpar]:2222", "[lpar]:2222 ssh-ed25519 AAAA"))
+	require.NoError(t, store.StoreHostKey("other", "other ssh-ed25519 BBBB"))
+
+	line, err = store.LoadHostKey("[lpar]:2222")
+	require.NoError(t, err)
+	assert.Equal(t, "[lpar]:2222 ssh-ed25519 AAAA", line)
+
+	line, err = store.LoadHostKey("other")
+	require.NoError(t, err)
+	assert.Equal(t, "other ssh-ed25519 BBBB", line)
+
+	assert.Equal(t, "_lpar__2222", getHostKeySecretKey("[lpar]:2222"))
+}
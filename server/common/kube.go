@@ -0,0 +1,338 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// environment variables injected into every pod
+	envKubernetesServiceHost = "KUBERNETES_SERVICE_HOST"
+	envKubernetesServicePort = "KUBERNETES_SERVICE_PORT"
+
+	// location of the credentials of the service account of the pod
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	kubeRequestTimeout = 10 * time.Second
+
+	// namespace used if the namespace of the pod cannot be determined
+	defaultNamespace = "default"
+
+	// namespace whose UID identifies a cluster, it exists in every cluster and cannot be deleted
+	clusterIDNamespace = "kube-system"
+)
+
+// KubeClient is a minimal client for the Kubernetes API server, authenticated via the service account of the pod
+type KubeClient struct {
+	baseURL    string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+// createKubeClient creates a client for the given API server
+func createKubeClient(baseURL, tokenFile string, httpClient *http.Client) *KubeClient {
+	return &KubeClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		tokenFile:  tokenFile,
+		httpClient: httpClient,
+	}
+}
+
+// CreateInClusterKubeClient creates a client for the API server of the cluster the controller runs in
+func CreateInClusterKubeClient() (*KubeClient, error) {
+	host, port := os.Getenv(envKubernetesServiceHost), os.Getenv(envKubernetesServicePort)
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("the controller does not run in a cluster, [%s] and [%s] are not set", envKubernetesServiceHost, envKubernetesServicePort)
+	}
+	caFile := filepath.Join(serviceAccountDir, "ca.crt")
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the CA of the cluster from [%s], cause: [%w]", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("unable to parse the CA of the cluster from [%s]", caFile)
+	}
+	httpClient := &http.Client{
+		Timeout: kubeRequestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:    pool,
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+	}
+	return createKubeClient("https://"+net.JoinHostPort(host, port), filepath.Join(serviceAccountDir, "token"), httpClient), nil
+}
+
+// GetInClusterKubeClient returns the shared client for the API server of the cluster the controller runs in
+var GetInClusterKubeClient = sync.OnceValues(CreateInClusterKubeClient)
+
+// inClusterID caches the identifier of the cluster the controller runs in once it has been determined
+var inClusterID struct {
+	sync.Mutex
+	id string
+}
+
+// GetInClusterID returns the identifier of the cluster the controller runs in, see GetClusterID
+func GetInClusterID() (string, error) {
+	inClusterID.Lock()
+	defer inClusterID.Unlock()
+	if len(inClusterID.id) > 0 {
+		return inClusterID.id, nil
+	}
+	client, err := GetInClusterKubeClient()
+	if err != nil {
+		return "", err
+	}
+	id, err := GetClusterID(client)()
+	if err != nil {
+		return "", err
+	}
+	inClusterID.id = id
+	return id, nil
+}
+
+// GetInClusterNamespace returns the namespace the controller runs in
+func GetInClusterNamespace() string {
+	data, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return defaultNamespace
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// getCollectionPath returns the path of the namespaced resources of a kind, apiVersion is either
+// a core version like v1 or of the form group/version. An empty namespace addresses all namespaces.
+func getCollectionPath(apiVersion, resource, namespace string) string {
+	if len(namespace) == 0 {
+		if strings.Contains(apiVersion, "/") {
+			return fmt.Sprintf("/apis/%s/%s", apiVersion, resource)
+		}
+		return fmt.Sprintf("/api/%s/%s", apiVersion, resource)
+	}
+	if strings.Contains(apiVersion, "/") {
+		return fmt.Sprintf("/apis/%s/namespaces/%s/%s", apiVersion, namespace, resource)
+	}
+	return fmt.Sprintf("/api/%s/namespaces/%s/%s", apiVersion, namespace, resource)
+}
+
+// getResourcePath returns the path of a namespaced resource
+func getResourcePath(apiVersion, resource, namespace, name string) string {
+	return getCollectionPath(apiVersion, resource, namespace) + "/" + name
+}
+
+// doKubeRequest sends a JSON request to the API server and returns the status code and the body of the response
+func doKubeRequest(client *KubeClient, method, path, contentType string, body any) (int, []byte, error) {
+	var rdr io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		rdr = bytes.NewReader(data)
+	}
+	// the token is rotated, so read it for every request
+	token, err := os.ReadFile(client.tokenFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to read the service account token from [%s], cause: [%w]", client.tokenFile, err)
+	}
+	req, err := http.NewRequest(method, client.baseURL+path, rdr)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to %s [%s], cause: [%w]", strings.ToLower(method), path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// createKubeStatusError creates the error for an unexpected response of the API server
+func createKubeStatusError(method, path string, status int, body []byte) error {
+	if len(body) > 4096 {
+		body = body[:4096]
+	}
+	return fmt.Errorf("unable to %s [%s], status: [%d %s], response: [%s]", strings.ToLower(method), path, status, http.StatusText(status), strings.TrimSpace(string(body)))
+}
+
+// AnnotateResource sets annotations of a namespaced custom resource via a merge patch. Since every update
+// of a parent resource triggers a sync, this can be used to reconcile a resource immediately.
+func AnnotateResource(client *KubeClient) func(apiVersion, resource, namespace, name string, annotations map[string]string) error {
+	return func(apiVersion, resource, namespace, name string, annotations map[string]string) error {
+		patch := map[string]any{
+			"metadata": map[string]any{
+				"annotations": annotations,
+			},
+		}
+		path := getResourcePath(apiVersion, resource, namespace, name)
+		status, body, err := doKubeRequest(client, http.MethodPatch, path, "application/merge-patch+json", patch)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return createKubeStatusError(http.MethodPatch, path, status, body)
+		}
+		return nil
+	}
+}
+
+// ListResourceUIDs returns the UIDs of all resources of a kind across all namespaces
+func ListResourceUIDs(client *KubeClient) func(apiVersion, resource string) ([]string, error) {
+	return func(apiVersion, resource string) ([]string, error) {
+		path := getCollectionPath(apiVersion, resource, "")
+		status, body, err := doKubeRequest(client, http.MethodGet, path, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, createKubeStatusError(http.MethodGet, path, status, body)
+		}
+		var list struct {
+			Items []struct {
+				Metadata struct {
+					UID string `json:"uid"`
+				} `json:"metadata"`
+			} `json:"items"`
+		}
+		err = json.Unmarshal(body, &list)
+		if err != nil {
+			return nil, err
+		}
+		result := make([]string, 0, len(list.Items))
+		for _, item := range list.Items {
+			result = append(result, item.Metadata.UID)
+		}
+		return result, nil
+	}
+}
+
+// GetClusterID returns an identifier of the cluster, i.e. the UID of the kube-system namespace
+func GetClusterID(client *KubeClient) func() (string, error) {
+	return func() (string, error) {
+		path := getResourcePath("v1", "namespaces", "", clusterIDNamespace)
+		status, body, err := doKubeRequest(client, http.MethodGet, path, "", nil)
+		if err != nil {
+			return "", err
+		}
+		if status != http.StatusOK {
+			return "", createKubeStatusError(http.MethodGet, path, status, body)
+		}
+		var namespace struct {
+			Metadata struct {
+				UID string `json:"uid"`
+			} `json:"metadata"`
+		}
+		err = json.Unmarshal(body, &namespace)
+		if err != nil {
+			return "", err
+		}
+		if len(namespace.Metadata.UID) == 0 {
+			return "", fmt.Errorf("the namespace [%s] does not have a UID", clusterIDNamespace)
+		}
+		return namespace.Metadata.UID, nil
+	}
+}
+
+// GetSecretData returns the decoded data of a secret in the namespace, nil if the secret does not exist
+func GetSecretData(client *KubeClient) func(namespace, name string) (map[string]string, error) {
+	return func(namespace, name string) (map[string]string, error) {
+		path := getResourcePath("v1", "secrets", namespace, name)
+		status, body, err := doKubeRequest(client, http.MethodGet, path, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusNotFound {
+			return nil, nil
+		}
+		if status != http.StatusOK {
+			return nil, createKubeStatusError(http.MethodGet, path, status, body)
+		}
+		var secret struct {
+			Data map[string][]byte `json:"data"`
+		}
+		err = json.Unmarshal(body, &secret)
+		if err != nil {
+			return nil, err
+		}
+		result := make(map[string]string)
+		for key, value := range secret.Data {
+			result[key] = string(value)
+		}
+		return result, nil
+	}
+}
+
+// UpdateSecretData merges data into a secret in the namespace, the secret is created if it does not exist
+func UpdateSecretData(client *KubeClient) func(namespace, name string, data map[string]string) error {
+	return func(namespace, name string, data map[string]string) error {
+		path := getResourcePath("v1", "secrets", namespace, name)
+		status, body, err := doKubeRequest(client, http.MethodPatch, path, "application/merge-patch+json", map[string]any{
+			"stringData": data,
+		})
+		if err != nil {
+			return err
+		}
+		if status == http.StatusOK {
+			return nil
+		}
+		if status != http.StatusNotFound {
+			return createKubeStatusError(http.MethodPatch, path, status, body)
+		}
+		// create the secret
+		path = getCollectionPath("v1", "secrets", namespace)
+		status, body, err = doKubeRequest(client, http.MethodPost, path, "application/json", map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]any{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"type":       "Opaque",
+			"stringData": data,
+		})
+		if err != nil {
+			return err
+		}
+		if status != http.StatusCreated {
+			return createKubeStatusError(http.MethodPost, path, status, body)
+		}
+		return nil
+	}
+}
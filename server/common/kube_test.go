@@ -0,0 +1,122 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package common
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotateResource(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	var patch map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/apis/hpse.ibm.com/v1/namespaces/default/onprem-hpcrs/sample", r.URL.Path)
+		assert.Equal(t, "application/merge-patch+json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		data, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(data, &patch))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := createKubeClient(srv.URL, tokenFile, srv.Client())
+	err := AnnotateResource(client)("hpse.ibm.com/v1", "onprem-hpcrs", "default", "sample", map[string]string{"key": "value"})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{"key": "value"},
+		},
+	}, patch)
+}
+
+func TestAnnotateResourceNotFound(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0600))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	client := createKubeClient(srv.URL, tokenFile, srv.Client())
+	err := AnnotateResource(client)("hpse.ibm.com/v1", "onprem-hpcrs", "default", "sample", map[string]string{"key": "value"})
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestListResourceUIDs(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0600))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/apis/hpse.ibm.com/v1/onprem-hpcrs", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(`{"kind":"List","items":[{"metadata":{"name":"a","uid":"uid-a"}},{"metadata":{"name":"b","uid":"uid-b"}}]}`))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	client := createKubeClient(srv.URL, tokenFile, srv.Client())
+	uids, err := ListResourceUIDs(client)("hpse.ibm.com/v1", "onprem-hpcrs")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"uid-a", "uid-b"}, uids)
+}
+
+func TestListResourceUIDsForbidden(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0600))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	client := createKubeClient(srv.URL, tokenFile, srv.Client())
+	_, err := ListResourceUIDs(client)("hpse.ibm.com/v1", "onprem-hpcrs")
+	assert.ErrorContains(t, err, "403")
+}
+
+func TestGetClusterID(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("secret"), 0600))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/api/v1/namespaces/kube-system", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(`{"kind":"Namespace","metadata":{"name":"kube-system","uid":"uid-cluster"}}`))
+		assert.NoError(t, err)
+	}))
+	defer srv.Close()
+
+	client := createKubeClient(srv.URL, tokenFile, srv.Client())
+	id, err := GetClusterID(client)()
+	require.NoError(t, err)
+	assert.Equal(t, "uid-cluster", id)
+}
@@ -65,3 +65,15 @@ func RefConfigMaps(labels *metav1.LabelSelector) RelatedResource {
 func RefSecrets(labels *metav1.LabelSelector) RelatedResource {
 	return RefResource(C.K8SAPIVersion, string(v1.ResourceSecrets), labels)
 }
+
+// CreateRelatedResourceRuleByName constructs a resource rule that selects resources by name
+func CreateRelatedResourceRuleByName(apiVersion, resource string, names ...string) *RelatedResourceRule {
+	return &RelatedResourceRule{
+		ResourceRule: ResourceRule{
+			APIVersion: apiVersion,
+			Resource:   resource,
+		},
+		LabelSelector: &metav1.LabelSelector{},
+		Names:         names,
+	}
+}
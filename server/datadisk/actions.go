@@ -24,11 +24,12 @@ import (
 )
 
 // createDataDiskReadyAction create the action
-func createDataDiskReadyAction(disk *libvirtxml.StorageVolume) (*common.ResourceStatus, error) {
+func createDataDiskReadyAction(disk *libvirtxml.StorageVolume, attachedTo []string) (*common.ResourceStatus, error) {
 
 	// metadata to attach
 	metadata := C.RawMap{
-		"Name": disk.Name,
+		"Name":       disk.Name,
+		"attachedTo": attachedTo,
 	}
 	// marshal the disk info into metadata
 	diskStrg, err := onprem.XMLMarshall(disk)
@@ -45,6 +46,16 @@ func createDataDiskReadyAction(disk *libvirtxml.StorageVolume) (*common.Resource
 	}, nil
 }
 
+// getAttachedTo returns the names of the VSIs the volume is attached to
+func getAttachedTo(client *onprem.LivirtClient, opt *onprem.DataDiskOptions) []string {
+	owners, err := onprem.GetVolumeOwners(client)(opt.StoragePool, opt.Name)
+	if err != nil {
+		log.Printf("Unable to read the attachments of volume [%s], cause: [%v]", opt.Name, err)
+		return nil
+	}
+	return onprem.VolumeOwnerNames(owners)
+}
+
 // CreateSyncAction synchronizes the state of the resource and determines what to do next
 func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.DataDiskOptions) (*common.ResourceStatus, error) {
 	// checks for the validity of the data disk
@@ -52,7 +63,7 @@ func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.DataDiskOptions)
 	diskXML, ok := isDataDiskValid(opt)
 	if ok {
 		// ready
-		return createDataDiskReadyAction(diskXML)
+		return createDataDiskReadyAction(diskXML, getAttachedTo(client, opt))
 	}
 	// create a disk (will resize if required)
 	diskSync := onprem.CreateDataDiskSync(client)
@@ -69,7 +80,7 @@ func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.DataDiskOptions)
 		return common.CreateErrorAction(err)
 	}
 	// ready
-	return createDataDiskReadyAction(diskXML)
+	return createDataDiskReadyAction(diskXML, getAttachedTo(client, opt))
 }
 
 func CreateFinalizeAction(client *onprem.LivirtClient, opt *onprem.DataDiskOptions) (*common.ResourceStatus, error) {
@@ -81,6 +92,22 @@ func CreateFinalizeAction(client *onprem.LivirtClient, opt *onprem.DataDiskOptio
 	if err != nil {
 		return common.CreateErrorAction(err)
 	}
+	// forget an adopted volume
+	err = onprem.ReleaseAdoptedVolume(client)(opt.StoragePool, opt.Name)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	// done
+	return common.CreateReadyAction()
+}
+
+// CreateRetainAction keeps the volume on the host when the resource is deleted
+func CreateRetainAction(client *onprem.LivirtClient, opt *onprem.DataDiskOptions, owner *onprem.RetainedVolume) (*common.ResourceStatus, error) {
+	retainSync := onprem.RetainDataDiskSync(client)
+	err := retainSync(opt.StoragePool, opt.Name, owner)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
 	// done
 	return common.CreateReadyAction()
 }
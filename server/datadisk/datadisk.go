@@ -19,11 +19,13 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/lock"
 )
 
 func CreatePingRoute(version, compileTime string) gin.HandlerFunc {
@@ -56,7 +58,59 @@ func syncDataDisk(req map[string]any) (*common.ResourceStatus, error) {
 		return common.CreateErrorAction(err)
 	}
 
-	return CreateSyncAction(client, opt)
+	src, err := onprem.GetDataDiskSource(&cfg.Parent.Spec)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+
+	// the storage pool may still be in the making
+	err = onprem.CheckStoragePool(client)(opt.StoragePool)
+	if err != nil {
+		log.Printf("Waiting for storage pool [%s], cause: [%v]", opt.StoragePool, err)
+		return common.CreateAction(&common.ResourceStatus{
+			Status:      common.Waiting,
+			Description: err.Error(),
+		})
+	}
+
+	// a new disk is populated from its source, existing disks do not depend on it
+	if src != nil && common.Status(cfg.Parent.Status.Status) != common.Ready {
+		opt.Source, err = dataDiskSourceFromRelated(req, src, env)
+		if err != nil {
+			log.Printf("Waiting for the source of data disk [%s], cause: [%v]", cfg.Parent.Name, err)
+			return common.CreateAction(&common.ResourceStatus{
+				Status:      common.Waiting,
+				Description: err.Error(),
+			})
+		}
+		// copies and uploads may take long, so do not run in parallel to other syncs
+		if !lock.Lock.TryLock() {
+			log.Println("Sync: waiting for lock ...")
+			return common.CreateStatusAction(common.Waiting)
+		}
+		defer lock.Lock.Unlock()
+	}
+
+	// only retained volumes may be adopted, disks adopted before keep their volume
+	adopter := &onprem.VolumeAdopter{Namespace: cfg.Parent.Namespace, Name: cfg.Parent.Name}
+	adopting := len(cfg.Parent.Spec.VolumeName) > 0
+	if adopting && common.Status(cfg.Parent.Status.Status) != common.Ready {
+		err = onprem.CheckAdoptableVolume(client)(opt.StoragePool, opt.Name, adopter)
+		if err != nil {
+			log.Printf("Refusing to adopt volume [%s] for data disk [%s], cause: [%v]", opt.Name, cfg.Parent.Name, err)
+			return common.CreateErrorAction(err)
+		}
+	}
+
+	state, err := CreateSyncAction(client, opt)
+	if err == nil && state.Status == common.Ready && adopting {
+		// the adopted volume is owned by this resource again
+		errAdopt := onprem.AdoptRetainedVolume(client)(opt.StoragePool, opt.Name, adopter)
+		if errAdopt != nil {
+			log.Printf("Unable to adopt volume [%s], cause: [%v]", opt.Name, errAdopt)
+		}
+	}
+	return state, err
 }
 
 func finalizeDataDisk(req map[string]any) (*common.ResourceStatus, error) {
@@ -79,6 +133,27 @@ func finalizeDataDisk(req map[string]any) (*common.ResourceStatus, error) {
 		return common.CreateErrorAction(err)
 	}
 
+	// a volume that has never been adopted belongs to someone else
+	if len(cfg.Parent.Spec.VolumeName) > 0 {
+		adopter := &onprem.VolumeAdopter{Namespace: cfg.Parent.Namespace, Name: cfg.Parent.Name}
+		owned, err := onprem.IsAdoptedVolume(client)(opt.StoragePool, opt.Name, adopter)
+		if err != nil {
+			return common.CreateErrorAction(err)
+		}
+		if !owned {
+			log.Printf("Volume [%s] has not been adopted by data disk [%s], leaving it untouched", opt.Name, cfg.Parent.Name)
+			return common.CreateReadyAction()
+		}
+	}
+
+	if opt.ReclaimPolicy == onprem.ReclaimPolicyRetain {
+		return CreateRetainAction(client, opt, &onprem.RetainedVolume{
+			Namespace:  cfg.Parent.Namespace,
+			Name:       cfg.Parent.Name,
+			RetainedAt: time.Now().UTC(),
+		})
+	}
+
 	return CreateFinalizeAction(client, opt)
 }
 
@@ -222,6 +297,10 @@ func CreateControllerCustomizeRoute() gin.HandlerFunc {
 				common.RefSecrets(cfg.Parent.Spec.TargetSelector),
 			}),
 		}
+		// the source of the content
+		if src, err := onprem.GetDataDiskSource(&cfg.Parent.Spec); err == nil && src != nil {
+			resp.RelatedResourceRules = append(resp.RelatedResourceRules, refDataDiskSource(src)...)
+		}
 		// dump it
 		data, err := json.Marshal(resp)
 		if err == nil {
@@ -15,6 +15,8 @@
 package datadisk
 
 import (
+	"fmt"
+
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
 )
@@ -24,9 +26,64 @@ import (
 func dataDiskOptionsFromConfigMap(data *DataDiskConfigResource, envMap env.Environment) (*onprem.DataDiskOptions, error) {
 	spec := data.Parent.Spec
 	opt := &onprem.DataDiskOptions{
-		Name:        string(data.Parent.UID),
-		StoragePool: onprem.BoxStoragePool(spec.StoragePool),
-		Size:        onprem.BoxDataDiskSize(spec.Size),
+		Name:          onprem.GetDataDiskVolumeName(&data.Parent),
+		StoragePool:   onprem.BoxStoragePool(spec.StoragePool),
+		Size:          onprem.BoxDataDiskSize(spec.Size),
+		ReclaimPolicy: onprem.BoxReclaimPolicy(spec.ReclaimPolicy),
+		Layout: onprem.DataDiskLayout{
+			Format:        onprem.BoxDataDiskFormat(spec.Format),
+			Preallocation: spec.Preallocation,
+		},
+	}
+	if opt.ReclaimPolicy != onprem.ReclaimPolicyDelete && opt.ReclaimPolicy != onprem.ReclaimPolicyRetain {
+		return nil, fmt.Errorf("unsupported reclaim policy [%s], must be one of [%s, %s]", opt.ReclaimPolicy, onprem.ReclaimPolicyDelete, onprem.ReclaimPolicyRetain)
+	}
+	if err := onprem.ValidateDataDiskLayout(&opt.Layout); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+// dataDiskSourceFromRelated resolves the content of a new data disk, referenced resources must be ready
+func dataDiskSourceFromRelated(req map[string]any, src *onprem.DataDiskSource, envMap env.Environment) (*onprem.DataDiskSourceOptions, error) {
+	opt := &onprem.DataDiskSourceOptions{
+		Format:      src.Format,
+		Consistency: onprem.BoxSnapshotConsistency(src.Consistency),
+	}
+	switch {
+	case len(src.DataDisk) > 0:
+		dataDisks, err := onprem.DataDisksFromRelated(req)
+		if err != nil {
+			return nil, err
+		}
+		opt.Volume, err = onprem.GetDataDisk(dataDisks, src.DataDisk)
+		if err != nil {
+			return nil, err
+		}
+	case len(src.DataDiskRef) > 0:
+		dataDiskRefs, err := onprem.DataDiskRefsFromRelated(req)
+		if err != nil {
+			return nil, err
+		}
+		opt.Volume, err = onprem.GetDataDiskRefVolume(dataDiskRefs, src.DataDiskRef)
+		if err != nil {
+			return nil, err
+		}
+	case len(src.Snapshot) > 0:
+		snapshots, err := onprem.DataDiskSnapshotsFromRelated(req)
+		if err != nil {
+			return nil, err
+		}
+		opt.Volume, err = onprem.GetDataDiskSnapshotVolume(snapshots, src.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		image, err := onprem.CreateImageSource(onprem.GetImageSourceConfigFromEnvMap(envMap))(src.URL)
+		if err != nil {
+			return nil, err
+		}
+		opt.Image = image
 	}
 	return opt, nil
 }
@@ -29,3 +29,33 @@ func RefDataDisks(labels *metav1.LabelSelector) common.RelatedResource {
 func RefDataDiskRefs(labels *metav1.LabelSelector) common.RelatedResource {
 	return common.RefResource(onprem.APIVersion, onprem.ResourceNameDataDiskRefs, labels)
 }
+
+// RefDataDisk references a data disk by name as related resource
+func RefDataDisk(name string) *common.RelatedResourceRule {
+	return common.CreateRelatedResourceRuleByName(onprem.APIVersion, onprem.ResourceNameDataDisks, name)
+}
+
+// RefDataDiskSnapshot references a data disk snapshot by name as related resource
+func RefDataDiskSnapshot(name string) *common.RelatedResourceRule {
+	return common.CreateRelatedResourceRuleByName(onprem.APIVersion, onprem.ResourceNameDataDiskSnapshots, name)
+}
+
+// RefDataDiskRef references a data disk reference by name as related resource
+func RefDataDiskRef(name string) *common.RelatedResourceRule {
+	return common.CreateRelatedResourceRuleByName(onprem.APIVersion, onprem.ResourceNameDataDiskRefs, name)
+}
+
+// refDataDiskSource references the resource that holds the content of a new data disk
+func refDataDiskSource(src *onprem.DataDiskSource) []*common.RelatedResourceRule {
+	var result []*common.RelatedResourceRule
+	if len(src.DataDisk) > 0 {
+		result = append(result, RefDataDisk(src.DataDisk))
+	}
+	if len(src.DataDiskRef) > 0 {
+		result = append(result, RefDataDiskRef(src.DataDiskRef))
+	}
+	if len(src.Snapshot) > 0 {
+		result = append(result, RefDataDiskSnapshot(src.Snapshot))
+	}
+	return result
+}
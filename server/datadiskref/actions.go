@@ -24,11 +24,12 @@ import (
 )
 
 // createDataDiskRefReadyAction create the action
-func createDataDiskRefReadyAction(disk *libvirtxml.StorageVolume) (*common.ResourceStatus, error) {
+func createDataDiskRefReadyAction(disk *libvirtxml.StorageVolume, attachedTo []string) (*common.ResourceStatus, error) {
 
 	// metadata to attach
 	metadata := C.RawMap{
-		"Name": disk.Name,
+		"Name":       disk.Name,
+		"attachedTo": attachedTo,
 	}
 	// marshal the disk info into metadata
 	diskStrg, err := onprem.XMLMarshall(disk)
@@ -45,6 +46,16 @@ func createDataDiskRefReadyAction(disk *libvirtxml.StorageVolume) (*common.Resou
 	}, nil
 }
 
+// getAttachedTo returns the names of the VSIs the volume is attached to
+func getAttachedTo(client *onprem.LivirtClient, opt *onprem.DataDiskRefOptions) []string {
+	owners, err := onprem.GetVolumeOwners(client)(opt.StoragePool, opt.Name)
+	if err != nil {
+		log.Printf("Unable to read the attachments of volume [%s], cause: [%v]", opt.Name, err)
+		return nil
+	}
+	return onprem.VolumeOwnerNames(owners)
+}
+
 // CreateSyncAction synchronizes the state of the resource and determines what to do next
 func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.DataDiskRefOptions) (*common.ResourceStatus, error) {
 	// checks for the validity of the data disk
@@ -54,5 +65,5 @@ func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.DataDiskRefOption
 		return common.CreateErrorAction(err)
 	}
 	// ready
-	return createDataDiskRefReadyAction(diskXML)
+	return createDataDiskRefReadyAction(diskXML, getAttachedTo(client, opt))
 }
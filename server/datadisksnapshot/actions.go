@@ -0,0 +1,81 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package datadisksnapshot
+
+import (
+	"log"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	C "github.com/ibm-hyper-protect/terraform-provider-hpcr/contract"
+	"libvirt.org/go/libvirtxml"
+)
+
+// createDataDiskSnapshotReadyAction reports the location of the snapshot so data disks can be restored from it
+func createDataDiskSnapshotReadyAction(opt *onprem.DataDiskSnapshotOptions, vol *libvirtxml.StorageVolume) (*common.ResourceStatus, error) {
+
+	// metadata to attach
+	metadata := C.RawMap{
+		"storagePool": opt.StoragePool,
+		"volumeName":  vol.Name,
+	}
+	// marshal the volume info into the description
+	volStrg, err := onprem.XMLMarshall(vol)
+	if err != nil {
+		log.Printf("Unable to marshal the snapshot XML, cause: [%v]", err)
+	}
+	return &common.ResourceStatus{
+		Status:      common.Ready,
+		Description: volStrg,
+		Error:       nil,
+		Metadata:    metadata,
+	}, nil
+}
+
+// createCurrentStatusAction keeps the current status of the snapshot
+func createCurrentStatusAction(cfg *DataDiskSnapshotConfigResource) (*common.ResourceStatus, error) {
+	status := cfg.Parent.Status
+	return common.CreateAction(&common.ResourceStatus{
+		Status:      common.Status(status.Status),
+		Description: status.Description,
+		Metadata: C.RawMap{
+			"storagePool": status.Metadata.StoragePool,
+			"volumeName":  status.Metadata.VolumeName,
+		},
+	})
+}
+
+// CreateSyncAction takes the snapshot unless it exists already
+func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.DataDiskSnapshotOptions) (*common.ResourceStatus, error) {
+	createSnapshotSync := onprem.CreateDataDiskSnapshotSync(client)
+	vol, err := createSnapshotSync(opt)
+	if err != nil {
+		log.Printf("Unable to create snapshot [%s], cause: [%v]", opt.Name, err)
+		return common.CreateErrorAction(err)
+	}
+	// successfully created the snapshot
+	return createDataDiskSnapshotReadyAction(opt, vol)
+}
+
+// CreateFinalizeAction deletes the snapshot volume
+func CreateFinalizeAction(client *onprem.LivirtClient, opt *onprem.DataDiskSnapshotOptions) (*common.ResourceStatus, error) {
+	deleteSync := onprem.DeleteDataDiskSnapshotSync(client)
+	err := deleteSync(opt.StoragePool, opt.Name)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	// done
+	return common.CreateReadyAction()
+}
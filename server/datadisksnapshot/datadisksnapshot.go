@@ -0,0 +1,269 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package datadisksnapshot
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/datadisk"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/lock"
+)
+
+func CreatePingRoute(version, compileTime string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"version": version,
+			"compile": compileTime,
+		})
+	}
+}
+
+// syncDataDiskSnapshot is invoked to synchronize the state of our resource
+func syncDataDiskSnapshot(req map[string]any) (*common.ResourceStatus, error) {
+	cfg, err := common.Transcode[*DataDiskSnapshotConfigResource](req)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	// snapshots are immutable, a snapshot that has been taken is not taken again
+	if common.Status(cfg.Parent.Status.Status) == common.Ready {
+		return createCurrentStatusAction(cfg)
+	}
+	// copies may take long and pause VSIs, so do not run in parallel to other syncs
+	if !lock.Lock.TryLock() {
+		log.Println("Sync: waiting for lock ...")
+		return createCurrentStatusAction(cfg)
+	}
+	defer lock.Lock.Unlock()
+
+	// the data disk must be ready before we can copy it
+	dataDisks, err := onprem.DataDisksFromRelated(req)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	dataDisk, err := onprem.GetDataDisk(dataDisks, cfg.Parent.Spec.DataDisk)
+	if err != nil {
+		log.Printf("Waiting for data disk [%s], cause: [%v]", cfg.Parent.Spec.DataDisk, err)
+		return common.CreateAction(&common.ResourceStatus{
+			Status:      common.Waiting,
+			Description: err.Error(),
+		})
+	}
+
+	// assemble all information about the environment by merging the config maps
+	env := common.EnvFromConfigMapsOrSecrets(req)
+
+	client, err := onprem.CreateLivirtClientFromEnvMap(env)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	defer client.Close()
+
+	opt, err := dataDiskSnapshotOptionsFromConfigMap(cfg, dataDisk, env)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+
+	return CreateSyncAction(client, opt)
+}
+
+func finalizeDataDiskSnapshot(req map[string]any) (*common.ResourceStatus, error) {
+
+	if !lock.Lock.TryLock() {
+		log.Println("Finalize: waiting for lock ...")
+		return common.CreateStatusAction(common.Waiting)
+	}
+	defer lock.Lock.Unlock()
+
+	env := common.EnvFromConfigMapsOrSecrets(req)
+
+	client, err := onprem.CreateLivirtClientFromEnvMap(env)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	defer client.Close()
+
+	cfg, err := common.Transcode[*DataDiskSnapshotConfigResource](req)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+
+	// the data disk may be gone already, the snapshot does not depend on it
+	opt, err := dataDiskSnapshotOptionsFromConfigMap(cfg, nil, env)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+
+	return CreateFinalizeAction(client, opt)
+}
+
+func CreateControllerSyncRoute() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		// log this config
+		defer CM.EntryExit("DataDiskSnapshotCreateControllerSyncRoute")()
+
+		log.Printf("synchronizing data disk snapshot ...")
+		jsonData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// decode the input
+		var req map[string]any
+		err = json.Unmarshal(jsonData, &req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// log the request
+		// log.Printf("JSON Input [%s]", string(jsonData))
+		// execute and handle
+		state, err := syncDataDiskSnapshot(req)
+		if err != nil {
+			log.Printf("Error [%v]", err)
+			// switch into error mode
+			c.JSON(http.StatusOK, common.ResourceStatusToResponse(state))
+			// bail out
+			return
+		}
+		// done
+		resp := common.ResourceStatusToResponse(state)
+		// set a retry if we are not ready, yet
+		if state.Status != common.Ready {
+			resp["resyncAfterSeconds"] = 10
+		}
+		// done
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func CreateControllerFinalizeRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// log this config
+		defer CM.EntryExit("DataDiskSnapshotCreateControllerFinalizeRoute")()
+
+		log.Printf("finalizing ...")
+
+		jsonData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		var req map[string]any
+		err = json.Unmarshal(jsonData, &req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// execute and handle
+		state, err := finalizeDataDiskSnapshot(req)
+		if err != nil {
+			log.Printf("Error [%v]", err)
+			// Handle error TODO really handle error
+			c.JSON(http.StatusOK, gin.H{
+				"finalized": true,
+			})
+			// bail out
+			return
+		}
+		// done finalizing
+		finalized := state.Status == common.Ready
+		resp := gin.H{
+			"finalized": finalized,
+		}
+		if !finalized {
+			resp["resyncAfterSeconds"] = 10
+		}
+		// final response
+		c.JSON(http.StatusOK, resp)
+		log.Printf("Finalized: [%t]", finalized)
+	}
+}
+
+// CreateControllerCustomizeRoute is invoked to
+func CreateControllerCustomizeRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// log this config
+		defer CM.EntryExit("DataDiskSnapshotCreateControllerCustomizeRoute")()
+		// parse body
+		jsonData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// decode the input
+		var req map[string]any
+		err = json.Unmarshal(jsonData, &req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// transcode to the expected format
+		cfg, err := common.Transcode[*DataDiskSnapshotConfigResource](req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// print namespace
+		log.Printf("Getting related resources for [%s] in namespace [%s] ...", cfg.Parent.Name, cfg.Parent.Namespace)
+		// produce a response
+		resp := common.CustomizeHookResponse{
+			RelatedResourceRules: common.CreateRelatedResourceRules([]common.RelatedResource{
+				// config
+				common.RefConfigMaps(cfg.Parent.Spec.TargetSelector),
+				common.RefSecrets(cfg.Parent.Spec.TargetSelector),
+			}),
+		}
+		// the data disk to copy
+		resp.RelatedResourceRules = append(resp.RelatedResourceRules, datadisk.RefDataDisk(cfg.Parent.Spec.DataDisk))
+		// dump it
+		data, err := json.Marshal(resp)
+		if err == nil {
+			log.Printf("customize response [%s]", string(data))
+		}
+
+		// done
+		c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package datadisksnapshot
+
+import (
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+)
+
+// dataDiskSnapshotOptionsFromConfigMap decodes the information required to take a snapshot
+// from the k8s resource and the resolved data disk
+func dataDiskSnapshotOptionsFromConfigMap(data *DataDiskSnapshotConfigResource, dataDisk *onprem.AttachedDataDisk, envMap env.Environment) (*onprem.DataDiskSnapshotOptions, error) {
+	spec := data.Parent.Spec
+	opt := &onprem.DataDiskSnapshotOptions{
+		Name:        string(data.Parent.UID),
+		DataDisk:    dataDisk,
+		StoragePool: getSnapshotStoragePool(data, dataDisk),
+		Consistency: onprem.BoxSnapshotConsistency(spec.Consistency),
+	}
+	return opt, nil
+}
+
+// getSnapshotStoragePool returns the pool that receives the snapshot, the snapshot is kept next to the data disk by default
+func getSnapshotStoragePool(data *DataDiskSnapshotConfigResource, dataDisk *onprem.AttachedDataDisk) string {
+	if data.Parent.Spec.StoragePool != "" {
+		return data.Parent.Spec.StoragePool
+	}
+	// the snapshot has been taken before
+	if data.Parent.Status.Metadata.StoragePool != "" {
+		return data.Parent.Status.Metadata.StoragePool
+	}
+	if dataDisk != nil {
+		return dataDisk.StoragePool
+	}
+	return onprem.BoxStoragePool("")
+}
@@ -0,0 +1,142 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+package image
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	C "github.com/ibm-hyper-protect/terraform-provider-hpcr/contract"
+)
+
+func createImageHostErrorStatus(err error) *onprem.ImageHostStatus {
+	return &onprem.ImageHostStatus{
+		Status:      int(common.Error),
+		Description: err.Error(),
+	}
+}
+
+// stageImageOnHost uploads the image to a single host
+func stageImageOnHost(cfg *ImageConfigResource, envMap env.Environment) *onprem.ImageHostStatus {
+	client, err := onprem.CreateLivirtClientFromEnvMap(envMap)
+	if err != nil {
+		return createImageHostErrorStatus(err)
+	}
+	defer client.Close()
+
+	opt, err := imageOptionsFromConfigMap(cfg, envMap)
+	if err != nil {
+		return createImageHostErrorStatus(err)
+	}
+
+	stageImage := onprem.StageImageSync(client)
+	vol, err := stageImage(opt)
+	if err != nil {
+		return createImageHostErrorStatus(err)
+	}
+	return &onprem.ImageHostStatus{
+		Status:      int(common.Ready),
+		Description: "Ready",
+		StoragePool: onprem.GetImageStoragePool(opt.StoragePool, opt.ImageSource),
+		VolumeName:  vol.Name,
+	}
+}
+
+// createCurrentStatusAction reports the status the resource already has
+func createCurrentStatusAction(cfg *ImageConfigResource) (*common.ResourceStatus, error) {
+	status := cfg.Parent.Status
+	return common.CreateAction(&common.ResourceStatus{
+		Status:      common.Status(status.Status),
+		Description: status.Description,
+		Metadata: C.RawMap{
+			"hosts": status.Metadata.Hosts,
+		},
+	})
+}
+
+func sortedHostnames(envs map[string]env.Environment) []string {
+	var hostnames []string
+	for hostname := range envs {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// CreateSyncAction stages the image on all hosts and reports the status per host
+func CreateSyncAction(cfg *ImageConfigResource, envs map[string]env.Environment) (*common.ResourceStatus, error) {
+	// log this config
+	defer CM.EntryExit(fmt.Sprintf("CreateSyncAction(%s)", cfg.Parent.Name))()
+	if len(envs) == 0 {
+		return common.CreateErrorAction(fmt.Errorf("the target selector of image [%s] does not select any config map with a [%s] key", cfg.Parent.Name, onprem.KeyHostname))
+	}
+	hosts := make(map[string]*onprem.ImageHostStatus)
+	var failures []string
+	for _, hostname := range sortedHostnames(envs) {
+		log.Printf("Staging image [%s] on host [%s] ...", cfg.Parent.Name, hostname)
+		hostStatus := stageImageOnHost(cfg, envs[hostname])
+		if common.Status(hostStatus.Status) != common.Ready {
+			log.Printf("Unable to stage image [%s] on host [%s], cause: [%s]", cfg.Parent.Name, hostname, hostStatus.Description)
+			failures = append(failures, fmt.Sprintf("%s: %s", hostname, hostStatus.Description))
+		}
+		hosts[hostname] = hostStatus
+	}
+	metadata := C.RawMap{
+		"hosts": hosts,
+	}
+	if len(failures) > 0 {
+		err := fmt.Errorf("unable to stage image on %d of %d hosts: %s", len(failures), len(hosts), strings.Join(failures, "; "))
+		return &common.ResourceStatus{
+			Status:      common.Error,
+			Description: err.Error(),
+			Error:       err,
+			Metadata:    metadata,
+		}, err
+	}
+	return common.CreateAction(&common.ResourceStatus{
+		Status:      common.Ready,
+		Description: "Ready",
+		Metadata:    metadata,
+	})
+}
+
+// CreateFinalizeAction releases the pins of the image on all hosts
+func CreateFinalizeAction(cfg *ImageConfigResource, envs map[string]env.Environment) (*common.ResourceStatus, error) {
+	// log this config
+	defer CM.EntryExit(fmt.Sprintf("CreateFinalizeAction(%s)", cfg.Parent.Name))()
+	for _, hostname := range sortedHostnames(envs) {
+		envMap := envs[hostname]
+		client, err := onprem.CreateLivirtClientFromEnvMap(envMap)
+		if err != nil {
+			log.Printf("Unable to connect to host [%s], cause: [%v]", hostname, err)
+			continue
+		}
+		opt, err := imageOptionsFromConfigMap(cfg, envMap)
+		if err == nil {
+			err = onprem.DeleteImageSync(client)(opt)
+		}
+		if err != nil {
+			log.Printf("Unable to release image [%s] on host [%s], cause: [%v]", cfg.Parent.Name, hostname, err)
+		}
+		client.Close()
+	}
+	// done
+	return common.CreateReadyAction()
+}
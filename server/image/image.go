@@ -0,0 +1,225 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package image
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/lock"
+)
+
+func CreatePingRoute(version, compileTime string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"version": version,
+			"compile": compileTime,
+		})
+	}
+}
+
+// syncImage is invoked to synchronize the state of our resource
+func syncImage(req map[string]any) (*common.ResourceStatus, error) {
+	cfg, err := common.Transcode[*ImageConfigResource](req)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+	// uploads may take long, so do not run in parallel to other syncs
+	if !lock.Lock.TryLock() {
+		log.Println("Sync: waiting for lock ...")
+		// keep the current status, VSIs rely on the per host information
+		return createCurrentStatusAction(cfg)
+	}
+	defer lock.Lock.Unlock()
+	// assemble the environment per host
+	envs := common.EnvsFromConfigMapsOrSecrets(req, onprem.KeyHostname)
+
+	return CreateSyncAction(cfg, envs)
+}
+
+func finalizeImage(req map[string]any) (*common.ResourceStatus, error) {
+
+	if !lock.Lock.TryLock() {
+		log.Println("Finalize: waiting for lock ...")
+		return common.CreateStatusAction(common.Waiting)
+	}
+	defer lock.Lock.Unlock()
+
+	envs := common.EnvsFromConfigMapsOrSecrets(req, onprem.KeyHostname)
+
+	cfg, err := common.Transcode[*ImageConfigResource](req)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+
+	return CreateFinalizeAction(cfg, envs)
+}
+
+func CreateControllerSyncRoute() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+		// log this config
+		defer CM.EntryExit("ImageCreateControllerSyncRoute")()
+
+		log.Printf("synchronizing image ...")
+		jsonData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// decode the input
+		var req map[string]any
+		err = json.Unmarshal(jsonData, &req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// log the request
+		// log.Printf("JSON Input [%s]", string(jsonData))
+		// execute and handle
+		state, err := syncImage(req)
+		if err != nil {
+			log.Printf("Error [%v]", err)
+			// switch into error mode
+			c.JSON(http.StatusOK, common.ResourceStatusToResponse(state))
+			// bail out
+			return
+		}
+		// done
+		resp := common.ResourceStatusToResponse(state)
+		// set a retry if we are not ready, yet
+		if state.Status != common.Ready {
+			resp["resyncAfterSeconds"] = 10
+		}
+		// done
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+func CreateControllerFinalizeRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		// log this config
+		defer CM.EntryExit("ImageCreateControllerFinalizeRoute")()
+
+		log.Printf("finalizing ...")
+
+		jsonData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		var req map[string]any
+		err = json.Unmarshal(jsonData, &req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// execute and handle
+		state, err := finalizeImage(req)
+		if err != nil {
+			log.Printf("Error [%v]", err)
+			// Handle error TODO really handle error
+			c.JSON(http.StatusOK, gin.H{
+				"finalized": true,
+			})
+			// bail out
+			return
+		}
+		// done finalizing
+		finalized := state.Status == common.Ready
+		resp := gin.H{
+			"finalized": finalized,
+		}
+		if !finalized {
+			resp["resyncAfterSeconds"] = 10
+		}
+		// final response
+		c.JSON(http.StatusOK, resp)
+		log.Printf("Finalized: [%t]", finalized)
+	}
+}
+
+// CreateControllerCustomizeRoute is invoked to
+func CreateControllerCustomizeRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// log this config
+		defer CM.EntryExit("ImageCreateControllerCustomizeRoute")()
+		// parse body
+		jsonData, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// decode the input
+		var req map[string]any
+		err = json.Unmarshal(jsonData, &req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// transcode to the expected format
+		cfg, err := common.Transcode[*ImageConfigResource](req)
+		if err != nil {
+			// Handle error
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		// print namespace
+		log.Printf("Getting related resources for [%s] in namespace [%s] ...", cfg.Parent.Name, cfg.Parent.Namespace)
+		// produce a response
+		resp := common.CustomizeHookResponse{
+			RelatedResourceRules: common.CreateRelatedResourceRules([]common.RelatedResource{
+				// config
+				common.RefConfigMaps(cfg.Parent.Spec.TargetSelector),
+				common.RefSecrets(cfg.Parent.Spec.TargetSelector),
+			}),
+		}
+		// dump it
+		data, err := json.Marshal(resp)
+		if err == nil {
+			log.Printf("customize response [%s]", string(data))
+		}
+
+		// done
+		c.JSON(http.StatusOK, resp)
+	}
+}
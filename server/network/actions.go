@@ -0,0 +1,93 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package network
+
+import (
+	"errors"
+	"log"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	C "github.com/ibm-hyper-protect/terraform-provider-hpcr/contract"
+	"libvirt.org/go/libvirtxml"
+)
+
+// createNetworkReadyAction create the action
+func createNetworkReadyAction(net *libvirtxml.Network) (*common.ResourceStatus, error) {
+
+	// metadata to attach
+	metadata := C.RawMap{
+		"Name": net.Name,
+	}
+	// marshal the network info into metadata
+	netStrg, err := onprem.XMLMarshall(net)
+	if err == nil {
+		metadata["networkXML"] = netStrg
+	} else {
+		log.Printf("Unable to marshal the network XML, cause: [%v]", err)
+	}
+	return &common.ResourceStatus{
+		Status:      common.Ready,
+		Description: netStrg,
+		Error:       nil,
+		Metadata:    metadata,
+	}, nil
+}
+
+// createNetworkInUseAction waits for the domains to detach from the network
+func createNetworkInUseAction(err *onprem.NetworkInUseError) (*common.ResourceStatus, error) {
+	return common.CreateAction(&common.ResourceStatus{
+		Status:      common.Waiting,
+		Description: err.Error(),
+		Metadata: C.RawMap{
+			"Name":    err.Network,
+			"domains": err.Domains,
+		},
+	})
+}
+
+// CreateSyncAction synchronizes the state of the resource and determines what to do next
+func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.NetworkOptions) (*common.ResourceStatus, error) {
+	createNetworkSync := onprem.CreateNetworkSync(client)
+	netXML, err := createNetworkSync(opt)
+	if err != nil {
+		// a changed definition waits for the attached domains
+		var inUse *onprem.NetworkInUseError
+		if errors.As(err, &inUse) {
+			log.Printf("Network [%s] has been redefined, restart is pending, cause: [%v]", opt.Name, err)
+			return createNetworkInUseAction(inUse)
+		}
+		log.Printf("Unable to create network [%s], cause: [%v]", opt.Name, err)
+		return common.CreateErrorAction(err)
+	}
+	// successfully created the network
+	return createNetworkReadyAction(netXML)
+}
+
+// CreateFinalizeAction deletes the network, but only after all domains have been detached
+func CreateFinalizeAction(client *onprem.LivirtClient, opt *onprem.NetworkOptions) (*common.ResourceStatus, error) {
+	deleteSync := onprem.DeleteNetworkSync(client)
+	err := deleteSync(opt)
+	if err != nil {
+		var inUse *onprem.NetworkInUseError
+		if errors.As(err, &inUse) {
+			log.Printf("Unable to delete network [%s], cause: [%v]", opt.Name, err)
+			return createNetworkInUseAction(inUse)
+		}
+		return common.CreateErrorAction(err)
+	}
+	// done
+	return common.CreateReadyAction()
+}
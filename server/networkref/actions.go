@@ -54,6 +54,14 @@ func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.NetworkRefOptions
 		log.Printf("Unable to lookup network ref [%s], cause: [%v]", opt.Name, err)
 		return common.CreateErrorAction(err)
 	}
+	// the static addresses must be served by the network
+	if opt.Address != nil {
+		err = onprem.ValidateNetworkAddress(netXML, opt.Address)
+		if err != nil {
+			log.Printf("Invalid static address for network ref [%s], cause: [%v]", opt.Name, err)
+			return common.CreateErrorAction(err)
+		}
+	}
 	// successfully located the network
 	return createNetworkRefReadyAction(netXML)
 }
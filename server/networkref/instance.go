@@ -22,7 +22,12 @@ import (
 // networkRefOptionsFromConfigMap decodes the information required to create a network ref
 // from the k8s resource
 func networkRefOptionsFromConfigMap(data *NetworkRefConfigResource, envMap env.Environment) (*onprem.NetworkRefOptions, error) {
-	return &onprem.NetworkRefOptions{
-		Name: onprem.BoxNetworkName(data.Parent.Spec.NetworkName),
-	}, nil
+	spec := data.Parent.Spec
+	opt := &onprem.NetworkRefOptions{
+		Name: onprem.BoxNetworkName(spec.NetworkName),
+	}
+	if len(spec.IPv4) > 0 || len(spec.IPv6) > 0 {
+		opt.Address = &spec.NetworkAddress
+	}
+	return opt, nil
 }
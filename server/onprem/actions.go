@@ -15,6 +15,7 @@
 package onprem
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -38,14 +39,25 @@ func getIPAddress(lease libvirt.NetworkDhcpLease) string {
 	return lease.Ipaddr
 }
 
+// getRunningPowerStatus reports the power state of a running VSI
+func getRunningPowerStatus(opt *onprem.InstanceOptions) *onprem.InstancePowerStatus {
+	return &onprem.InstancePowerStatus{
+		PowerState: opt.PowerState,
+		State:      onprem.GetDomainStateName(libvirt.DomainRunning),
+	}
+}
+
 func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.Domain, opt *onprem.InstanceOptions) (*common.ResourceStatus, error) {
 	msg := fmt.Sprintf("createInstanceRunningAction(%s)", opt.Name)
 
 	defer CM.PanicAfterTimeout(msg, 5*time.Second)()
 	defer CM.EntryExit(msg)()
 
-	// getLoggingVolume := onprem.GetLoggingVolume(client)
-	getLoggingVolume := onprem.GetLoggingVolumeViaCommand(client)
+	// the download via command tunnels through SSH, the other transports download via libvirt
+	getLoggingVolume := onprem.GetLoggingVolume(client)
+	if client.SSHConfig != nil {
+		getLoggingVolume = onprem.GetLoggingVolumeViaCommand(client)
+	}
 	getLeases := onprem.GetDCHPLeases(client)
 
 	// getIPAddresses determines the IP Addresses for the instance by checking for a all leases
@@ -74,11 +86,11 @@ func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.D
 	// fetch the logs
 	log.Printf("Domain [%s] is running, fetching logs ...", opt.Name)
 	// try to get the content of the logging volume
-	logName := onprem.GetLoggingVolumeName(opt.Name)
-	data, err := getLoggingVolume(opt.StoragePool, logName)
+	logPool, logName := onprem.GetInstanceLoggingVolume(opt, inst)
+	data, err := getLoggingVolume(logPool, logName)
 	if err != nil {
 		// log this
-		log.Printf("Unable to get the logging volume [%s] from pool [%s], cause: [%v]", logName, opt.StoragePool, err)
+		log.Printf("Unable to get the logging volume [%s] from pool [%s], cause: [%v]", logName, logPool, err)
 		// returns some error status
 		return &common.ResourceStatus{
 			Status:      common.Waiting,
@@ -95,6 +107,8 @@ func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.D
 	)
 	// partition the lines
 	success, failure := onprem.PartitionLogs(lines)
+	// classify the boot progress
+	report := onprem.ParseBootLog(lines)
 	if onprem.VSIFailedToStart(failure) {
 		// print some error details
 		logs := strings.Join(failure, "\n")
@@ -102,14 +116,22 @@ func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.D
 		// assemble some metadata
 		metadata := C.RawMap{
 			"logs": logs,
+			"boot": report,
 		}
 		if err == nil {
 			metadata["domainXML"] = instStrg
 		}
+		metadata["restarts"] = onprem.GetInstanceRestartStatus(opt, inst)
+		metadata["power"] = getRunningPowerStatus(opt)
+		// lead with the classified reason
+		desc := logs
+		if report.Failure != nil {
+			desc = fmt.Sprintf("%s\n%s", report.Failure, logs)
+		}
 		// VSI is ready but in an error state. It won't start at the next attempt
 		return common.CreateAction(&common.ResourceStatus{
 			Status:      common.Ready,
-			Description: logs,
+			Description: desc,
 			Error:       nil,
 			Metadata:    metadata,
 		})
@@ -122,6 +144,9 @@ func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.D
 		metadata := C.RawMap{
 			"logs":        logs,
 			"ipaddresses": getIPAddresses(),
+			"boot":        report,
+			"restarts":    onprem.GetInstanceRestartStatus(opt, inst),
+			"power":       getRunningPowerStatus(opt),
 		}
 		if err == nil {
 			metadata["domainXML"] = instStrg
@@ -142,6 +167,84 @@ func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.D
 		Status:      common.Waiting,
 		Description: desc,
 		Error:       nil,
+		Metadata: C.RawMap{
+			"boot":     report,
+			"restarts": onprem.GetInstanceRestartStatus(opt, inst),
+			"power":    getRunningPowerStatus(opt),
+		},
+	})
+}
+
+// createInstanceStoppedAction reports a VSI that has not been (re)started, either because its restart is delayed, its
+// restart policy keeps it stopped or its creation failed
+func createInstanceStoppedAction(opt *onprem.InstanceOptions, err error) (*common.ResourceStatus, error) {
+	// the restart is delayed, check back later
+	var backOffErr *onprem.RestartBackOffError
+	if errors.As(err, &backOffErr) {
+		log.Printf("Delaying the restart of the VSI [%s], cause: [%v]", opt.Name, err)
+		state, err := common.CreateRetryAction(err)
+		state.Metadata = C.RawMap{
+			"restarts": &onprem.InstanceRestartStatus{
+				Policy:      opt.RestartPolicy,
+				Count:       backOffErr.Restarts,
+				NextRestart: &backOffErr.NextRestart,
+			},
+		}
+		return state, err
+	}
+	// a VSI that has been shut down on purpose stays stopped
+	var stoppedErr *onprem.InstanceStoppedError
+	if errors.As(err, &stoppedErr) && !stoppedErr.Crashed {
+		log.Printf("VSI [%s] is stopped, restart policy [%s]", opt.Name, opt.RestartPolicy)
+		return common.CreateAction(&common.ResourceStatus{
+			Status:      common.Ready,
+			Description: err.Error(),
+			Error:       nil,
+			Metadata: C.RawMap{
+				"restarts": &onprem.InstanceRestartStatus{
+					Policy: opt.RestartPolicy,
+					Count:  stoppedErr.Restarts,
+				},
+			},
+		})
+	}
+	log.Printf("Unable to create the VSI [%s], cause: [%v]", opt.Name, err)
+	return common.CreateErrorAction(err)
+}
+
+// createStopSyncAction shuts down the VSI and reports ready once its domain is stopped
+func createStopSyncAction(client *onprem.LivirtClient, opt *onprem.InstanceOptions) (*common.ResourceStatus, error) {
+	// log this config
+	defer CM.EntryExit(fmt.Sprintf("createStopSyncAction(%s)", opt.Name))()
+
+	stopInstance := onprem.StopInstanceSync(client)
+	state, err := stopInstance(opt)
+	if err != nil {
+		log.Printf("Unable to stop the VSI [%s], cause: [%v]", opt.Name, err)
+		return common.CreateRetryAction(err)
+	}
+	power := &onprem.InstancePowerStatus{
+		PowerState: opt.PowerState,
+		State:      onprem.GetDomainStateName(state),
+	}
+	if !onprem.IsDomainStopped(state) {
+		// the shutdown is still in progress
+		return common.CreateAction(&common.ResourceStatus{
+			Status:      common.Waiting,
+			Description: fmt.Sprintf("Domain [%s] is shutting down, current state [%s]", opt.Name, power.State),
+			Error:       nil,
+			Metadata: C.RawMap{
+				"power": power,
+			},
+		})
+	}
+	return common.CreateAction(&common.ResourceStatus{
+		Status:      common.Ready,
+		Description: fmt.Sprintf("Domain [%s] is stopped", opt.Name),
+		Error:       nil,
+		Metadata: C.RawMap{
+			"power": power,
+		},
 	})
 }
 
@@ -149,10 +252,21 @@ func createInstanceRunningAction(client *onprem.LivirtClient, inst *libvirtxml.D
 func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.InstanceOptions) (*common.ResourceStatus, error) {
 	// log this config
 	defer CM.EntryExit(fmt.Sprintf("CreateSyncAction(%s)", opt.Name))()
+	// a stopped instance keeps its domain without checking it for updates
+	if opt.PowerState == onprem.PowerStateStopped {
+		return createStopSyncAction(client, opt)
+	}
 	// checks for the validity of the instance
 	isInstanceValid := onprem.IsInstanceValid(client)
 	inst, ok := isInstanceValid(opt)
 	if ok {
+		// attach and detach data disks without recreating the instance
+		syncDataDiskAttachments := onprem.SyncDataDiskAttachments(client)
+		inst, err := syncDataDiskAttachments(inst, opt.DataDisks)
+		if err != nil {
+			log.Printf("Unable to update the data disks of the VSI [%s], cause: [%v]", opt.Name, err)
+			return common.CreateErrorAction(err)
+		}
 		// validate the instance
 		return createInstanceRunningAction(client, inst, opt)
 	}
@@ -160,8 +274,7 @@ func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.InstanceOptions)
 	instSync := onprem.CreateInstanceSync(client)
 	result, err := instSync(opt)
 	if err != nil {
-		log.Printf("Unable to create the VSI [%s], cause: [%v]", opt.Name, err)
-		return common.CreateErrorAction(err)
+		return createInstanceStoppedAction(opt, err)
 	}
 	// log the result
 	resultStrg, err := onprem.XMLMarshall(result)
@@ -0,0 +1,208 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+)
+
+const (
+	// wait time before reconnecting to a host after the event stream broke
+	lifecycleReconnectInterval = 30 * time.Second
+)
+
+// lifecycleOwner identifies the resource that owns a domain
+type lifecycleOwner struct {
+	host      string
+	namespace string
+	name      string
+}
+
+// lifecycleWatcher subscribes to the lifecycle events of all domains of a host
+type lifecycleWatcher struct {
+	// the environment used to connect, the one of the most recent sync wins
+	env    env.Environment
+	cancel context.CancelFunc
+}
+
+var (
+	lifecycleMutex sync.Mutex
+	// owners of the domains keyed by the domain name, which is the UID of the resource
+	lifecycleOwners = make(map[string]*lifecycleOwner)
+	// one watcher per host keyed by the host
+	lifecycleWatchers = make(map[string]*lifecycleWatcher)
+
+	// the client used to touch the resources, lifecycle events are ignored if the controller does not run in a cluster
+	getKubeClient = sync.OnceValues(func() (*common.KubeClient, error) {
+		client, err := common.GetInClusterKubeClient()
+		if err != nil {
+			log.Printf("Lifecycle events are disabled, cause: [%v]", err)
+		}
+		return client, err
+	})
+)
+
+// watchDomain reconciles the resource as soon as its domain stops, crashes or gets undefined. The lifecycle events
+// are received via one connection per host that is opened on the first domain of the host.
+func watchDomain(host string, envMap env.Environment, domain string, parent *onprem.OnPremCustomResource) {
+	if !onprem.GetLifecycleEventsEnabledFromEnvMap(envMap) {
+		unwatchDomain(domain)
+		return
+	}
+	if _, err := getKubeClient(); err != nil {
+		return
+	}
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	lifecycleOwners[domain] = &lifecycleOwner{host: host, namespace: parent.Namespace, name: parent.Name}
+	if watcher, ok := lifecycleWatchers[host]; ok {
+		watcher.env = envMap
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watcher := &lifecycleWatcher{env: envMap, cancel: cancel}
+	lifecycleWatchers[host] = watcher
+
+	go runLifecycleWatcher(ctx, host, watcher)
+}
+
+// unwatchDomain forgets a domain and closes the connection to its host if this was the last domain of the host
+func unwatchDomain(domain string) {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	owner, ok := lifecycleOwners[domain]
+	if !ok {
+		return
+	}
+	delete(lifecycleOwners, domain)
+	for _, other := range lifecycleOwners {
+		if other.host == owner.host {
+			return
+		}
+	}
+	if watcher, ok := lifecycleWatchers[owner.host]; ok {
+		watcher.cancel()
+		delete(lifecycleWatchers, owner.host)
+	}
+}
+
+// getLifecycleOwner returns the owner of a domain identified by any of the keys
+func getLifecycleOwner(keys []string) *lifecycleOwner {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	for _, key := range keys {
+		if owner, ok := lifecycleOwners[key]; ok {
+			return owner
+		}
+	}
+	return nil
+}
+
+// getLifecycleWatcherEnv returns the environment to connect to the host of a watcher
+func getLifecycleWatcherEnv(watcher *lifecycleWatcher) env.Environment {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	return watcher.env
+}
+
+// runLifecycleWatcher receives the lifecycle events of a host and reconnects until the watcher is cancelled
+func runLifecycleWatcher(ctx context.Context, host string, watcher *lifecycleWatcher) {
+	for {
+		err := receiveLifecycleEvents(ctx, host, getLifecycleWatcherEnv(watcher))
+		if ctx.Err() != nil {
+			log.Printf("Stopped watching lifecycle events of host [%s]", host)
+			return
+		}
+		log.Printf("Reconnecting to host [%s] for lifecycle events in [%v], cause: [%v]", host, lifecycleReconnectInterval, err)
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped watching lifecycle events of host [%s]", host)
+			return
+		case <-time.After(lifecycleReconnectInterval):
+		}
+	}
+}
+
+// receiveLifecycleEvents subscribes to the lifecycle events of a host and handles them until the connection breaks
+func receiveLifecycleEvents(ctx context.Context, host string, envMap env.Environment) error {
+	client, err := onprem.CreateLivirtClientFromEnvMap(envMap)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	events, err := client.LibVirt.LifecycleEvents(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("unable to subscribe to the lifecycle events of host [%s], cause: [%w]", host, err)
+	}
+	defer func() {
+		cancel()
+		// unblock the subscription until it closes the channel
+		for range events {
+		}
+	}()
+	log.Printf("Watching lifecycle events of host [%s] ...", host)
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("the lifecycle event stream of host [%s] has been closed", host)
+			}
+			handleLifecycleEvent(&ev)
+		case <-client.LibVirt.Disconnected():
+			return fmt.Errorf("lost the connection to host [%s]", host)
+		}
+	}
+}
+
+// handleLifecycleEvent touches the resource that owns the domain of the event, so it gets reconciled immediately
+func handleLifecycleEvent(ev *libvirt.DomainEventLifecycleMsg) {
+	name, ok := onprem.GetLifecycleEventName(ev)
+	if !ok {
+		return
+	}
+	owner := getLifecycleOwner(onprem.GetLifecycleEventDomainKeys(ev))
+	if owner == nil {
+		return
+	}
+	kube, err := getKubeClient()
+	if err != nil {
+		return
+	}
+	log.Printf("Domain [%s] of VSI [%s/%s] has been [%s], triggering a reconcile ...", ev.Dom.Name, owner.namespace, owner.name, name)
+	value := fmt.Sprintf("%s %s", name, time.Now().UTC().Format(time.RFC3339))
+	err = common.AnnotateResource(kube)(onprem.APIVersion, onprem.ResourceNameVSIs, owner.namespace, owner.name, map[string]string{
+		onprem.AnnotationLifecycleEvent: value,
+	})
+	if err != nil {
+		log.Printf("Unable to trigger a reconcile of VSI [%s/%s], cause: [%v]", owner.namespace, owner.name, err)
+	}
+}
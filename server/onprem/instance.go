@@ -15,6 +15,8 @@
 package onprem
 
 import (
+	"fmt"
+
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
 )
@@ -24,10 +26,20 @@ import (
 func onpremInstanceOptionsFromConfigMap(data *OnPremConfigResource, envMap env.Environment) (*onprem.InstanceOptions, error) {
 	spec := data.Parent.Spec
 	opt := &onprem.InstanceOptions{
-		Name:        string(data.Parent.UID),
-		UserData:    spec.Contract,
-		ImageURL:    spec.ImageURL,
-		StoragePool: onprem.BoxStoragePool(spec.StoragePool),
+		Name:          onprem.GetInstanceDomainName(&data.Parent),
+		Owner:         string(data.Parent.UID),
+		UserData:      spec.Contract,
+		ImageURL:      spec.ImageURL,
+		StoragePool:   onprem.BoxStoragePool(spec.StoragePool),
+		BootDiskMode:  onprem.GetBootDiskModeFromEnvMap(envMap),
+		RestartPolicy: onprem.BoxRestartPolicy(spec.RestartPolicy),
+		PowerState:    onprem.BoxPowerState(spec.PowerState),
+	}
+	if !onprem.IsValidRestartPolicy(opt.RestartPolicy) {
+		return nil, fmt.Errorf("unsupported restart policy [%s], must be one of [%s, %s, %s, %s]", opt.RestartPolicy, onprem.RestartPolicyAlways, onprem.RestartPolicyOnFailure, onprem.RestartPolicyRecreate, onprem.RestartPolicyNever)
+	}
+	if !onprem.IsValidPowerState(opt.PowerState) {
+		return nil, fmt.Errorf("unsupported power state [%s], must be one of [%s, %s]", opt.PowerState, onprem.PowerStateRunning, onprem.PowerStateStopped)
 	}
 	return opt, nil
 }
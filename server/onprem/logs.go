@@ -0,0 +1,143 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package onprem
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+)
+
+const (
+	// interval between two reads of the console log while following it
+	logPollInterval = 2 * time.Second
+
+	// event carrying new content of the console log
+	LogEventLog = "log"
+	// event sent when the console log has been truncated and is streamed from the beginning again
+	LogEventRestart = "restart"
+	// event sent when the end of the log has been reached and the log is not followed
+	LogEventEOF = "eof"
+	// event sent when the log cannot be read
+	LogEventError = "error"
+)
+
+// logSource records how to reach the console log of a VSI
+type logSource struct {
+	env         env.Environment
+	storagePool string
+	name        string
+}
+
+// LogEvent is the payload of the server sent events of the log stream
+type LogEvent struct {
+	// offset of the text in the log
+	Offset uint64 `json:"offset"`
+	// the new content of the log
+	Text string `json:"text,omitempty"`
+	// offset to resume streaming from
+	Next uint64 `json:"next"`
+	// the error message of an error event
+	Error string `json:"error,omitempty"`
+}
+
+// logSources contains the console logs of the VSIs synchronized by this controller keyed by the UID of the resource
+var logSources sync.Map
+
+// registerLogSource remembers the location of the console log of a VSI
+func registerLogSource(uid string, envMap env.Environment, storagePool, name string) {
+	logSources.Store(uid, &logSource{env: envMap, storagePool: storagePool, name: name})
+}
+
+// unregisterLogSource forgets the console log of a deleted VSI
+func unregisterLogSource(uid string) {
+	logSources.Delete(uid)
+}
+
+// CreateLogsRoute streams the console log of a VSI as server sent events. The log is read from the optional
+// offset and followed until the client disconnects if follow is true.
+func CreateLogsRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uid := c.Param("uid")
+		// log this config
+		defer CM.EntryExit("OnPremLogsRoute(" + uid + ")")()
+
+		value, ok := logSources.Load(uid)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "VSI [" + uid + "] has not been synchronized by this controller, yet",
+			})
+			return
+		}
+		src := value.(*logSource)
+
+		follow, _ := strconv.ParseBool(c.DefaultQuery("follow", "false"))
+		offset, err := strconv.ParseUint(c.DefaultQuery("offset", "0"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		client, err := onprem.CreateLivirtClientFromEnvMap(src.env)
+		if err != nil {
+			log.Printf("Unable to create libvirt client, cause: [%v]", err)
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		defer client.Close()
+
+		readLog := onprem.ReadLoggingVolume(client)
+		done := c.Request.Context().Done()
+
+		c.Header("Cache-Control", "no-cache")
+		c.Stream(func(w io.Writer) bool {
+			chunk, err := readLog(src.storagePool, src.name, offset)
+			if err != nil {
+				log.Printf("Unable to read the console log of VSI [%s], cause: [%v]", uid, err)
+				c.SSEvent(LogEventError, &LogEvent{Offset: offset, Next: offset, Error: err.Error()})
+				return false
+			}
+			if chunk.Restarted {
+				c.SSEvent(LogEventRestart, &LogEvent{Offset: chunk.Offset, Next: chunk.Offset})
+			}
+			if len(chunk.Data) > 0 {
+				c.SSEvent(LogEventLog, &LogEvent{Offset: chunk.Offset, Text: string(chunk.Data), Next: chunk.Next})
+			}
+			offset = chunk.Next
+			if !follow {
+				c.SSEvent(LogEventEOF, &LogEvent{Offset: offset, Next: offset})
+				return false
+			}
+			select {
+			case <-done:
+				return false
+			case <-time.After(logPollInterval):
+				return true
+			}
+		})
+	}
+}
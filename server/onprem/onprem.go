@@ -23,10 +23,13 @@ import (
 	A "github.com/IBM/fp-go/array"
 	"github.com/gin-gonic/gin"
 	CM "github.com/ibm-hyper-protect/k8s-operator-hpcr/common"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/datadisk"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/image"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/lock"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/network"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/networkref"
 )
 
@@ -61,6 +64,12 @@ func syncOnPrem(req map[string]any) (*common.ResourceStatus, error) {
 		return common.CreateErrorAction(err)
 	}
 
+	// assemble information about the attached managed networks
+	networks, err := onprem.NetworksFromRelated(req)
+	if err != nil {
+		return common.CreateErrorAction(err)
+	}
+
 	client, err := onprem.CreateLivirtClientFromEnvMap(env)
 	if err != nil {
 		log.Printf("Unable to create libvirt client, cause: [%v]", err)
@@ -79,6 +88,47 @@ func syncOnPrem(req map[string]any) (*common.ResourceStatus, error) {
 		return common.CreateErrorAction(err)
 	}
 
+	// the domain records its cluster, so the orphan sweeps of other clusters sharing the host leave it alone
+	opt.Cluster, err = common.GetInClusterID()
+	if err != nil {
+		log.Printf("Unable to determine the cluster of VSI [%s], cause: [%v]", cfg.Parent.Name, err)
+	}
+
+	// the storage pool may still be in the making
+	err = onprem.CheckStoragePool(client)(opt.StoragePool)
+	if err != nil {
+		log.Printf("Waiting for storage pool [%s], cause: [%v]", opt.StoragePool, err)
+		return common.CreateAction(&common.ResourceStatus{
+			Status:      common.Waiting,
+			Description: err.Error(),
+		})
+	}
+
+	// resolve the location of the base image
+	if len(cfg.Parent.Spec.Image) > 0 {
+		images, err := onprem.ImagesFromRelated(req)
+		if err != nil {
+			return common.CreateErrorAction(err)
+		}
+		stagedImage, hostStatus, err := onprem.GetStagedImage(images, cfg.Parent.Spec.Image, client.Hostname)
+		if err != nil {
+			log.Printf("Waiting for image [%s], cause: [%v]", cfg.Parent.Spec.Image, err)
+			return common.CreateAction(&common.ResourceStatus{
+				Status:      common.Waiting,
+				Description: err.Error(),
+			})
+		}
+		// the URL is part of the instance hash
+		opt.ImageURL = stagedImage.Spec.ImageURL
+		opt.ImageSource = onprem.CreateStagedImageSource(hostStatus)
+	} else {
+		opt.ImageSource, err = onprem.CreateImageSource(onprem.GetImageSourceConfigFromEnvMap(env))(opt.ImageURL)
+		if err != nil {
+			log.Printf("Unable to create image source for [%s], cause: [%v]", opt.ImageURL, err)
+			return common.CreateErrorAction(err)
+		}
+	}
+
 	// dump the attached network references
 	if A.IsNonEmpty(networkRefs) {
 		// extract names
@@ -92,11 +142,120 @@ func syncOnPrem(req map[string]any) (*common.ResourceStatus, error) {
 	// attach data disks
 	opt.DataDisks = attachedDataDisks
 
+	// dump the attached managed networks
+	if A.IsNonEmpty(networks) {
+		// extract names
+		networkNames := onprem.NetworkCustomResourceToNetworks(networks)
+		// log the networks
+		log.Printf("Networks: %v", networkNames)
+	}
+
 	// attach networks
-	opt.Networks = onprem.NetworkRefCustomResourceToNetworks(networkRefs)
+	opt.Networks = A.Monoid[string]().Concat(
+		onprem.NetworkRefCustomResourceToNetworks(networkRefs),
+		onprem.NetworkCustomResourceToNetworks(networks),
+	)
+
+	// static addresses, the ones of the VSI take precedence over the ones of the network refs
+	opt.Addresses = onprem.NetworkRefCustomResourceToAddresses(networkRefs, cfg.Parent.Spec.Addresses)
+
+	// record the VSI as owner of its data disks, a disk attached to another VSI must not be attached a second time
+	owner := onprem.VolumeOwner{Domain: opt.Name, Name: cfg.Parent.Name}
+	err = onprem.ClaimDataDisks(client)(owner, opt.DataDisks)
+	if err != nil {
+		log.Printf("Refusing to attach the data disks of VSI [%s], cause: [%v]", cfg.Parent.Name, err)
+		// the pending claims of earlier attempts must not block the disks while the domain cannot be created
+		errRelease := onprem.ReleasePendingDataDisks(client)(opt.Name)
+		if errRelease != nil {
+			log.Printf("Unable to release the data disks of VSI [%s], cause: [%v]", cfg.Parent.Name, errRelease)
+		}
+		return common.CreateErrorAction(err)
+	}
+
+	// an existing domain named by the resource is adopted rather than recreated
+	if _, ok := cfg.Parent.Annotations[onprem.AnnotationDomainName]; ok {
+		err = onprem.AdoptInstanceSync(client)(opt)
+		if err != nil {
+			log.Printf("Unable to adopt the domain [%s] of VSI [%s], cause: [%v]", opt.Name, cfg.Parent.Name, err)
+			return common.CreateRetryAction(err)
+		}
+	}
+
+	// the console log can be streamed from now on
+	logPool, logName := onprem.LookupInstanceLoggingVolume(client)(opt)
+	registerLogSource(string(cfg.Parent.UID), env, logPool, logName)
+	// reconcile as soon as the domain stops, crashes or gets undefined
+	watchDomain(client.Hash, env, opt.Name, &cfg.Parent)
 
 	// make sure to construct the VSI
-	return CreateSyncAction(client, opt)
+	state, err := CreateSyncAction(client, opt)
+	if err != nil || state.Status == common.Error {
+		// a domain that could not be created must not block its data disks
+		errRelease := onprem.ReleasePendingDataDisks(client)(opt.Name)
+		if errRelease != nil {
+			log.Printf("Unable to release the data disks of VSI [%s], cause: [%v]", cfg.Parent.Name, errRelease)
+		}
+	} else {
+		// the disks that are no longer selected have been detached
+		errRelease := onprem.ReleaseDataDisks(client)(opt.Name, opt.DataDisks)
+		if errRelease != nil {
+			log.Printf("Unable to release the data disks of VSI [%s], cause: [%v]", cfg.Parent.Name, errRelease)
+		}
+	}
+	if err == nil && state.Status == common.Ready {
+		maintainBaseImages(client, opt.StoragePool, string(cfg.Parent.UID), cfg.Parent.Annotations, env)
+		sweepOrphans(client, opt.StoragePool, env)
+	}
+	return state, err
+}
+
+// maintainBaseImages updates the pins of the resource and runs the periodic garbage collection of base images,
+// failures are logged but do not affect the state of the resource
+func maintainBaseImages(client *onprem.LivirtClient, storagePool, owner string, annotations map[string]string, envMap env.Environment) {
+	err := onprem.PinBaseImages(client)(storagePool, owner, onprem.GetPinnedImagesFromAnnotations(annotations))
+	if err != nil {
+		log.Printf("Unable to pin base images on pool [%s], cause: [%v]", storagePool, err)
+	}
+	_, err = onprem.CollectBaseImagesIfDue(client)(storagePool, onprem.GetImageGCConfigFromEnvMap(envMap))
+	if err != nil {
+		log.Printf("Unable to collect base images on pool [%s], cause: [%v]", storagePool, err)
+	}
+}
+
+// sweepOrphans runs the periodic detection and cleanup of orphans on the storage pool. It compares against the VSI
+// resources of all namespaces, so it only runs inside of a cluster. Failures are logged but do not affect the state
+// of the resource
+func sweepOrphans(client *onprem.LivirtClient, storagePool string, envMap env.Environment) {
+	cfg := onprem.GetOrphanSweepConfigFromEnvMap(envMap)
+	due, err := onprem.IsOrphanSweepDue(client)(storagePool, cfg)
+	if err != nil {
+		log.Printf("Unable to check the orphan sweep of pool [%s], cause: [%v]", storagePool, err)
+		return
+	}
+	if !due {
+		return
+	}
+	kube, err := common.GetInClusterKubeClient()
+	if err != nil {
+		log.Printf("Skipping the orphan sweep of pool [%s], cause: [%v]", storagePool, err)
+		return
+	}
+	// only the domains of this cluster may be deleted, other clusters sharing the host have their own resources
+	cfg.Cluster, err = common.GetInClusterID()
+	if err != nil {
+		log.Printf("Unable to determine the cluster for the orphan sweep of pool [%s], cause: [%v]", storagePool, err)
+		return
+	}
+	// never sweep without a complete list of the existing resources
+	cfg.Live, err = common.ListResourceUIDs(kube)(onprem.APIVersion, onprem.ResourceNameVSIs)
+	if err != nil {
+		log.Printf("Unable to list the VSI resources for the orphan sweep of pool [%s], cause: [%v]", storagePool, err)
+		return
+	}
+	_, err = onprem.SweepOrphans(client)(storagePool, cfg)
+	if err != nil {
+		log.Printf("Unable to sweep the orphans of pool [%s], cause: [%v]", storagePool, err)
+	}
 }
 
 // finalizeOnPrem deletes a VSI
@@ -128,7 +287,25 @@ func finalizeOnPrem(req map[string]any) (*common.ResourceStatus, error) {
 		return common.CreateErrorAction(err)
 	}
 
-	return CreateFinalizeAction(client, opt)
+	// the domain is going away on purpose
+	unwatchDomain(opt.Name)
+
+	// release the pins of this resource
+	err = onprem.PinBaseImages(client)(opt.StoragePool, opt.Owner, nil)
+	if err != nil {
+		log.Printf("Unable to release pinned base images on pool [%s], cause: [%v]", opt.StoragePool, err)
+	}
+
+	state, err := CreateFinalizeAction(client, opt)
+	if err == nil && state.Status == common.Ready {
+		unregisterLogSource(string(cfg.Parent.UID))
+		// the domain is gone, so are its attachments
+		errRelease := onprem.ReleaseDataDisks(client)(opt.Name, nil)
+		if errRelease != nil {
+			log.Printf("Unable to release the data disks of VSI [%s], cause: [%v]", cfg.Parent.Name, errRelease)
+		}
+	}
+	return state, err
 }
 
 func CreateControllerSyncRoute() gin.HandlerFunc {
@@ -276,8 +453,13 @@ func CreateControllerCustomizeRoute() gin.HandlerFunc {
 				datadisk.RefDataDiskRefs(cfg.Parent.Spec.DiskSelector),
 				// networks
 				networkref.RefNetworkRefs(cfg.Parent.Spec.NetworkSelector),
+				network.RefNetworks(cfg.Parent.Spec.NetworkSelector),
 			}),
 		}
+		// pre-staged image
+		if len(cfg.Parent.Spec.Image) > 0 {
+			resp.RelatedResourceRules = append(resp.RelatedResourceRules, image.RefImage(cfg.Parent.Spec.Image))
+		}
 		// dump it
 		data, err := json.Marshal(resp)
 		if err == nil {
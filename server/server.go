@@ -21,8 +21,12 @@ import (
 
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/datadisk"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/datadiskref"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/datadisksnapshot"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/image"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/network"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/networkref"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/storagepool"
 	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/vpc"
 )
 
@@ -41,6 +45,7 @@ func CreateServer(version, compileTime string) func(port int) error {
 	r.POST("/onprem/sync", onprem.CreateControllerSyncRoute())
 	r.POST("/onprem/finalize", onprem.CreateControllerFinalizeRoute())
 	r.POST("/onprem/customize", onprem.CreateControllerCustomizeRoute())
+	r.GET("/onprem/logs/:uid", onprem.CreateLogsRoute())
 	// register the data disk routes
 	r.GET("/datadisk/ping", datadisk.CreatePingRoute(version, compileTime))
 	r.POST("/datadisk/sync", datadisk.CreateControllerSyncRoute())
@@ -54,6 +59,26 @@ func CreateServer(version, compileTime string) func(port int) error {
 	r.GET("/networkref/ping", networkref.CreatePingRoute(version, compileTime))
 	r.POST("/networkref/sync", networkref.CreateControllerSyncRoute())
 	r.POST("/networkref/customize", networkref.CreateControllerCustomizeRoute())
+	// register the network routes
+	r.GET("/network/ping", network.CreatePingRoute(version, compileTime))
+	r.POST("/network/sync", network.CreateControllerSyncRoute())
+	r.POST("/network/finalize", network.CreateControllerFinalizeRoute())
+	r.POST("/network/customize", network.CreateControllerCustomizeRoute())
+	// register the storage pool routes
+	r.GET("/storagepool/ping", storagepool.CreatePingRoute(version, compileTime))
+	r.POST("/storagepool/sync", storagepool.CreateControllerSyncRoute())
+	r.POST("/storagepool/finalize", storagepool.CreateControllerFinalizeRoute())
+	r.POST("/storagepool/customize", storagepool.CreateControllerCustomizeRoute())
+
+	r.GET("/datadisksnapshot/ping", datadisksnapshot.CreatePingRoute(version, compileTime))
+	r.POST("/datadisksnapshot/sync", datadisksnapshot.CreateControllerSyncRoute())
+	r.POST("/datadisksnapshot/finalize", datadisksnapshot.CreateControllerFinalizeRoute())
+	r.POST("/datadisksnapshot/customize", datadisksnapshot.CreateControllerCustomizeRoute())
+	// register the image routes
+	r.GET("/image/ping", image.CreatePingRoute(version, compileTime))
+	r.POST("/image/sync", image.CreateControllerSyncRoute())
+	r.POST("/image/finalize", image.CreateControllerFinalizeRoute())
+	r.POST("/image/customize", image.CreateControllerCustomizeRoute())
 
 	return func(port int) error {
 		return r.Run(fmt.Sprintf(":%d", port))
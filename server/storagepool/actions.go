@@ -0,0 +1,84 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package storagepool
+
+import (
+	"errors"
+	"log"
+
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/server/common"
+	C "github.com/ibm-hyper-protect/terraform-provider-hpcr/contract"
+)
+
+// createStoragePoolReadyAction create the action
+func createStoragePoolReadyAction(info *onprem.StoragePoolInfo) (*common.ResourceStatus, error) {
+
+	// metadata to attach
+	metadata := C.RawMap{
+		"Name":       info.Pool.Name,
+		"capacity":   info.Capacity,
+		"allocation": info.Allocation,
+		"available":  info.Available,
+	}
+	// marshal the pool info into metadata
+	poolStrg, err := onprem.XMLMarshall(info.Pool)
+	if err == nil {
+		metadata["poolXML"] = poolStrg
+	} else {
+		log.Printf("Unable to marshal the storage pool XML, cause: [%v]", err)
+	}
+	return &common.ResourceStatus{
+		Status:      common.Ready,
+		Description: poolStrg,
+		Error:       nil,
+		Metadata:    metadata,
+	}, nil
+}
+
+// CreateSyncAction synchronizes the state of the resource and determines what to do next
+func CreateSyncAction(client *onprem.LivirtClient, opt *onprem.StoragePoolOptions) (*common.ResourceStatus, error) {
+	createStoragePoolSync := onprem.CreateStoragePoolSync(client)
+	info, err := createStoragePoolSync(opt)
+	if err != nil {
+		log.Printf("Unable to create storage pool [%s], cause: [%v]", opt.Name, err)
+		return common.CreateErrorAction(err)
+	}
+	// successfully created the pool
+	return createStoragePoolReadyAction(info)
+}
+
+// CreateFinalizeAction deletes the storage pool, protected pools wait until the managed volumes are gone
+func CreateFinalizeAction(client *onprem.LivirtClient, opt *onprem.StoragePoolOptions) (*common.ResourceStatus, error) {
+	deleteSync := onprem.DeleteStoragePoolSync(client)
+	err := deleteSync(opt)
+	if err != nil {
+		var inUse *onprem.StoragePoolInUseError
+		if errors.As(err, &inUse) {
+			log.Printf("Unable to delete storage pool [%s], cause: [%v]", opt.Name, err)
+			return common.CreateAction(&common.ResourceStatus{
+				Status:      common.Waiting,
+				Description: inUse.Error(),
+				Metadata: C.RawMap{
+					"Name":    inUse.StoragePool,
+					"volumes": inUse.Volumes,
+				},
+			})
+		}
+		return common.CreateErrorAction(err)
+	}
+	// done
+	return common.CreateReadyAction()
+}
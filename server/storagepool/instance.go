@@ -0,0 +1,40 @@
+// Copyright 2023 IBM Corp.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.package datasource
+
+package storagepool
+
+import (
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/env"
+	"github.com/ibm-hyper-protect/k8s-operator-hpcr/onprem"
+)
+
+// storagePoolOptionsFromConfigMap decodes the information required to create a storage pool
+// from the k8s resource
+func storagePoolOptionsFromConfigMap(data *StoragePoolConfigResource, envMap env.Environment) (*onprem.StoragePoolOptions, error) {
+	spec := data.Parent.Spec
+	opt := &onprem.StoragePoolOptions{
+		Name:           onprem.GetManagedStoragePoolName(&data.Parent),
+		Owner:          string(data.Parent.UID),
+		Type:           onprem.BoxStoragePoolType(spec.Type),
+		Path:           spec.Path,
+		VolumeGroup:    spec.VolumeGroup,
+		Devices:        spec.Devices,
+		Host:           spec.Host,
+		Dir:            spec.Dir,
+		Format:         spec.Format,
+		Autostart:      spec.Autostart,
+		ProtectVolumes: spec.ProtectVolumes,
+	}
+	return opt, nil
+}
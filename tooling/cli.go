@@ -30,6 +30,9 @@ func CreateApp() *c.App {
 		Commands: []*c.Command{
 			cli.CreateSSHConfigCommand(),
 			cli.CreateOnPremCommand(),
+			cli.CreateImageGCCommand(),
+			cli.CreateOrphansCommand(),
+			cli.CreateAdoptCommand(),
 		},
 	}
 }